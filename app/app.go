@@ -4,10 +4,16 @@ package app
 import (
 	"context"
 	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
 
-	fs2 "github.com/podtserkovskiy/garnerd/storage/meta/fs"
-
+	"github.com/podtserkovskiy/garnerd/storage"
+	"github.com/podtserkovskiy/garnerd/storage/backend"
 	"github.com/podtserkovskiy/garnerd/storage/image/compact"
+	"github.com/podtserkovskiy/garnerd/storage/schema"
 	"github.com/podtserkovskiy/garnerd/storage/separated"
 
 	"github.com/docker/docker/client"
@@ -15,11 +21,72 @@ import (
 
 	"github.com/podtserkovskiy/garnerd/cache/lru"
 	"github.com/podtserkovskiy/garnerd/director"
+	"github.com/podtserkovskiy/garnerd/disk"
 	"github.com/podtserkovskiy/garnerd/docker"
+	"github.com/podtserkovskiy/garnerd/ingest"
 	"github.com/podtserkovskiy/garnerd/mover"
+	"github.com/podtserkovskiy/garnerd/registry"
 )
 
-func Start(maxCount int, dir string) error {
+type Config struct {
+	MaxCount int
+	Dir      string
+	// ImageBackend is "fs" for a tarball per image or "compact" for deduplicated compressed layers,
+	// "" keeps the backend of the cache dir.
+	ImageBackend string
+	// MetaBackend is "file" for meta.json, "journal" for the append-only meta.journal
+	// or "kv" for the indexed meta.db.
+	MetaBackend string
+	// ImageStorage and MetaStorage are URLs of backends, e.g. compact:///var/cache/garnerd or mem://,
+	// they replace ImageBackend and MetaBackend in the cache dir.
+	ImageStorage string
+	MetaStorage  string
+	// CompressionWorkers is a number of layers compressed at the same time.
+	CompressionWorkers int
+	// Codec compresses newly saved layers.
+	Codec compact.Codec
+	// RecompressIdle upgrades layers to RecompressLevel when the storage is idle, 0 disables it.
+	RecompressIdle  time.Duration
+	RecompressLevel int
+	// RebuildIndex rescans the cache dir and replaces the layer index before start.
+	RebuildIndex bool
+	// Watermarks evict images when the cache dir or the temp dir is running out of space.
+	Watermarks disk.Watermarks
+	// StorageURL is a default for ImageStorage and MetaStorage, e.g. s3://bucket/prefix,
+	// the cache dir keeps only schema versions then.
+	StorageURL string
+	// RegistryAddr serves cached images by the Registry v2 API, "" disables it.
+	RegistryAddr string
+	// ProxyUpstream is a registry which images missing in the cache are pulled through from, "" disables it.
+	// Images pulled through RegistryAddr are cached like images of containers.
+	ProxyUpstream string
+	// Peers are registries of other garnerd instances which are asked for missing images before ProxyUpstream,
+	// PeersFile lists more of them, one per line.
+	Peers     []string
+	PeersFile string
+	// SlowDir is a slow tier of the compact image backend, layers of images unused for DemoteAfter are moved there
+	// and moved back when the image is restored. "" keeps all layers in Dir.
+	SlowDir     string
+	DemoteAfter time.Duration
+	// DropDir is watched for `docker save` tarballs which are cached and moved aside, "" disables it.
+	// DropLoad loads them into the daemon too.
+	DropDir  string
+	DropLoad bool
+	// KeyFile or KeyEnv, a file or an environment variable, has a key which encrypts meta and layers of images
+	// in the compact image backend, the key is 32 bytes in hex, base64 or raw. Unset ones keep images in plain text.
+	KeyFile string
+	KeyEnv  string
+	// ReadOnly restores images from Dir without changing it, e.g. a prebuilt cache mounted read-only into many VMs:
+	// the dir is neither migrated nor cleaned up, images are never saved to it or evicted from it.
+	// OverlayDir is a writable cache dir which new images are cached in then, "" doesn't cache them.
+	ReadOnly   bool
+	OverlayDir string
+
+	// keys is the keyring of KeyFile or KeyEnv, it is set by loadKeys.
+	keys *compact.Keyring
+}
+
+func Start(cfg Config) error {
 	dockerClient, err := client.NewEnvClient()
 	if err != nil {
 		return fmt.Errorf("can't create docker client, %s", err)
@@ -34,24 +101,148 @@ func Start(maxCount int, dir string) error {
 		return fmt.Errorf("waiting for docker daemon, %s", err)
 	}
 
-	log.Infof("Cache dir: %s", dir)
-	storage := separated.NewStorage(fs2.NewMetaCRUD(fs2.NewMetaFile(dir)), compact.NewImgStorage(dir))
+	if err = cfg.Codec.Validate(); err != nil {
+		return fmt.Errorf("codec, %w", err)
+	}
+	if err = cfg.Watermarks.Validate(); err != nil {
+		return fmt.Errorf("watermarks, %w", err)
+	}
+	if cfg, err = cfg.loadKeys(); err != nil {
+		return err
+	}
+	if cfg.ReadOnly {
+		return startReadOnly(ctx, cfg, docker)
+	}
+	if cfg.OverlayDir != "" {
+		log.Warn("--overlay-dir is ignored, it is used only with --read-only")
+	}
+
+	log.Infof("Cache dir: %s", cfg.Dir)
+	imgURL, dirBackend, recorded, err := imageStorageURL(cfg)
+	if err != nil {
+		return err
+	}
+	log.Infof("Image storage: %s", imgURL)
+	imgStorage, err := backend.OpenImg(imgURL, cfg.backendParams())
+	if err != nil {
+		return err
+	}
+	compactStorage, isCompact := imgStorage.(*compact.ImgStorage)
+	if cfg.keys != nil && !isCompact {
+		return fmt.Errorf("only the compact image backend encrypts images, %s doesn't", imgURL)
+	}
+	if cfg.keys != nil {
+		log.Infof("Images are encrypted with key %s", cfg.keys.ID())
+	}
+	if isCompact {
+		// `garnerd rekey` refuses the dir while it is held
+		unlock, err := compactStorage.LockDir()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	metaURL := metaStorageURL(cfg)
+	log.Infof("Meta storage: %s", metaURL)
+	metaStorage, err := backend.OpenMeta(metaURL, cfg.backendParams())
+	if err != nil {
+		return err
+	}
+
+	storage := separated.NewStorage(metaStorage, imgStorage)
 	err = storage.Wait(ctx)
 	if err != nil {
 		return fmt.Errorf("waiting for storage, %s", err)
 	}
 
+	if dirBackend != "" && !recorded {
+		if err = writeImageBackend(cfg.Dir, dirBackend); err != nil {
+			return err
+		}
+	}
+
+	if err = schema.Migrate(cfg.Dir, separated.MetaSchemaComponent, separated.MetaMigrations(metaStorage)); err != nil {
+		return fmt.Errorf("migrating meta, %w", err)
+	}
+	if dirBackend != "" {
+		if err = migrateImgStorage(cfg.Dir, imgStorage, metaStorage); err != nil {
+			return err
+		}
+	}
+	if err = schema.Migrate(cfg.Dir, separated.ImageSchemaComponent, storage.Migrations()); err != nil {
+		return fmt.Errorf("migrating images, %w", err)
+	}
+
+	if cfg.RebuildIndex && !isCompact {
+		log.Warn("--rebuild-index is ignored, the layer index is a part of the compact image backend")
+	}
+	if cfg.RebuildIndex && isCompact {
+		log.Info("Rebuilding the layer index")
+		if err = compactStorage.RebuildIndex(); err != nil {
+			return fmt.Errorf("rebuilding the layer index, %w", err)
+		}
+	}
+
 	err = storage.CleanUp(ctx)
 	if err != nil {
 		return fmt.Errorf("cleaning up, %s", err)
 	}
 
-	cache, err := lru.NewCache(maxCount)
+	if cfg.RecompressIdle > 0 && !isCompact {
+		log.Warn("--recompress-idle is ignored, only the compact image backend compresses images")
+	}
+	if cfg.RecompressIdle > 0 && isCompact {
+		recompressCodec := cfg.Codec
+		recompressCodec.Level = cfg.RecompressLevel
+		if err = recompressCodec.Validate(); err != nil {
+			return fmt.Errorf("recompress codec, %w", err)
+		}
+		log.Infof("Layers are recompressed to %s after %s of idle", recompressCodec, cfg.RecompressIdle)
+		go compactStorage.RecompressIdle(ctx, recompressCodec, cfg.RecompressIdle)
+	}
+
+	if cfg.SlowDir != "" && !isCompact {
+		log.Warn("--slow-dir is ignored, only the compact image backend has tiers")
+	}
+	if cfg.SlowDir != "" && isCompact {
+		if cfg.DemoteAfter <= 0 {
+			return fmt.Errorf("demote after %s, it has to be positive", cfg.DemoteAfter)
+		}
+		log.Infof("Layers of images unused for %s are moved to %s", cfg.DemoteAfter, cfg.SlowDir)
+		go compactStorage.DemoteCold(ctx, cfg.DemoteAfter)
+	}
+
+	cache, err := lru.NewCache(cfg.MaxCount)
 	if err != nil {
 		return fmt.Errorf("creating cache, %s", err)
 	}
 
-	director := director.NewDirector(cache, storage, docker, mover.NewMover(storage, docker))
+	if cfg.RegistryAddr != "" {
+		handler, err := registryHandler(ctx, cfg, storage, imgStorage, cache)
+		if err != nil {
+			return err
+		}
+		if err = serveRegistry(cfg.RegistryAddr, handler); err != nil {
+			return err
+		}
+	}
+	if (cfg.ProxyUpstream != "" || len(cfg.Peers) > 0 || cfg.PeersFile != "") && cfg.RegistryAddr == "" {
+		log.Warn("--proxy-upstream, --peer and --peers-file are ignored, the proxy is served on --registry-addr")
+	}
+
+	if cfg.DropDir != "" {
+		watchDropDir(ctx, cfg, storage, docker, cache)
+	}
+
+	directorOpts := []director.Option{}
+	if cfg.Watermarks.Enabled() {
+		// layers are spooled to the temp dir while they are compressed
+		log.Infof("Images are evicted when %s or %s is used above %d%%", cfg.Dir, os.TempDir(), cfg.Watermarks.High)
+		directorOpts = append(directorOpts, director.WithWatermarks(cfg.Watermarks, cfg.Dir, os.TempDir()))
+	}
+
+	director := director.NewDirector(cache, storage, docker, mover.NewMover(storage, docker), directorOpts...)
 
 	err = director.Start(ctx)
 	if err != nil {
@@ -60,3 +251,75 @@ func Start(maxCount int, dir string) error {
 
 	return nil
 }
+
+// registryHandler serves images of the compact image storage, missing images are pulled through from ProxyUpstream.
+func registryHandler(ctx context.Context, cfg Config, store *separated.Storage, imgStorage separated.ImgStorage, cache *lru.Cache) (http.Handler, error) {
+	images, ok := imgStorage.(registry.Images)
+	if !ok {
+		return nil, fmt.Errorf("--registry-addr needs the compact image backend")
+	}
+
+	peers := cfg.Peers
+	if cfg.PeersFile != "" {
+		filePeers, err := registry.ReadPeers(cfg.PeersFile)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, filePeers...)
+	}
+
+	server := registry.NewServer(store, images, registry.WithOriginalManifests(filepath.Join(cfg.Dir, "proxy", "manifests")))
+	if cfg.ProxyUpstream == "" && len(peers) == 0 {
+		return server, nil
+	}
+
+	upstream := cfg.ProxyUpstream
+	if upstream == "" {
+		upstream = registry.DockerHub
+	}
+	proxy, err := registry.NewProxy(server, upstream, store, filepath.Join(cfg.Dir, "proxy"),
+		registry.WithPeers(peers...),
+		registry.WithOnCached(func(meta storage.Meta) {
+			cache.AddSilent(meta.ImageName, meta.ImageID)
+		}))
+	if err != nil {
+		return nil, fmt.Errorf("creating the registry proxy, %w", err)
+	}
+	go proxy.SweepSpool(ctx)
+	if len(peers) > 0 {
+		log.Infof("Images missing in the cache are asked from peers %v", peers)
+	}
+	log.Infof("Images missing in the cache are pulled through from %s", upstream)
+
+	return proxy, nil
+}
+
+// watchDropDir caches tarballs dropped into DropDir in the background.
+func watchDropDir(ctx context.Context, cfg Config, store ingest.Storage, daemon *docker.Daemon, cache *lru.Cache) {
+	opts := []ingest.Option{ingest.WithOnIngested(func(meta storage.Meta) {
+		cache.AddSilent(meta.ImageName, meta.ImageID)
+	})}
+	if cfg.DropLoad {
+		opts = append(opts, ingest.WithLoader(daemon))
+	}
+	log.Infof("Tarballs dropped into %s are cached", cfg.DropDir)
+
+	go ingest.NewWatcher(cfg.DropDir, store, opts...).Run(ctx)
+}
+
+// serveRegistry starts serving registry requests, it fails if the address can't be listened.
+func serveRegistry(addr string, handler http.Handler) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listening for registry requests, %w", err)
+	}
+	log.Infof("Registry v2 API: http://%s/v2/", listener.Addr())
+
+	go func() {
+		if err := http.Serve(listener, handler); err != nil {
+			log.Errorf("serving registry requests, %s", err)
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,252 @@
+// nolint: goerr113
+package app
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/pkg/ioutils"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/podtserkovskiy/garnerd/storage/backend"
+	"github.com/podtserkovskiy/garnerd/storage/image/compact"
+	fs1 "github.com/podtserkovskiy/garnerd/storage/image/fs"
+	"github.com/podtserkovskiy/garnerd/storage/schema"
+	"github.com/podtserkovskiy/garnerd/storage/separated"
+)
+
+const (
+	ImageBackendFS      = "fs"
+	ImageBackendCompact = "compact"
+
+	// imageBackendFile records which image backend owns images of the cache dir.
+	imageBackendFile = "image-backend"
+)
+
+// resolveImageBackend returns the image backend of the cache dir and whether it is recorded in the dir,
+// a new dir gets the requested one. Switching the backend of a dir with images needs Migrate.
+func resolveImageBackend(dir, requested string) (string, bool, error) {
+	current, err := readImageBackend(dir)
+	if err != nil {
+		return "", false, err
+	}
+
+	switch {
+	case current == "" && requested == "":
+		return ImageBackendCompact, false, nil
+	case current == "":
+		return requested, false, nil
+	case requested == "" || requested == current:
+		return current, true, nil
+	}
+
+	return "", false, fmt.Errorf(
+		"cache dir uses the '%s' image backend, run 'garnerd migrate --from %s --to %s %s' to switch it",
+		current, current, requested, dir,
+	)
+}
+
+// readImageBackend returns "" for a new dir, a dir without the record has been written by compact.
+func readImageBackend(dir string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, imageBackendFile))
+	if os.IsNotExist(err) {
+		if _, err = os.Stat(filepath.Join(dir, "meta")); err == nil {
+			return ImageBackendCompact, nil
+		}
+
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("reading the image backend, %w", err)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+func writeImageBackend(dir, backend string) error {
+	if err := ioutils.AtomicWriteFile(filepath.Join(dir, imageBackendFile), []byte(backend+"\n"), 0600); err != nil {
+		return fmt.Errorf("writing the image backend, %w", err)
+	}
+
+	return nil
+}
+
+func (cfg Config) backendParams() backend.Params {
+	return backend.Params{CompressionWorkers: cfg.CompressionWorkers, Codec: cfg.Codec, SlowTier: cfg.SlowDir, Keyring: cfg.keys}
+}
+
+// imageStorageURL returns the URL of the image storage and, if images are kept in the cache dir,
+// its image backend and whether the backend is recorded in the dir.
+func imageStorageURL(cfg Config) (string, string, bool, error) {
+	for _, storageURL := range []string{cfg.ImageStorage, cfg.StorageURL} {
+		if storageURL != "" {
+			return storageURL, "", false, nil
+		}
+	}
+
+	dirBackend, recorded, err := resolveImageBackend(cfg.Dir, cfg.ImageBackend)
+	if err != nil {
+		return "", "", false, err
+	}
+
+	return dirImageURL(dirBackend, cfg.Dir), dirBackend, recorded, nil
+}
+
+func dirImageURL(dirBackend, dir string) string {
+	scheme := dirBackend
+	if dirBackend == ImageBackendFS {
+		scheme = backend.SchemeFile
+	}
+
+	return backend.URL(scheme, absDir(dir))
+}
+
+// metaStorageURL returns the URL of the meta storage, meta backends of the cache dir are named by their schemes.
+func metaStorageURL(cfg Config) string {
+	for _, storageURL := range []string{cfg.MetaStorage, cfg.StorageURL} {
+		if storageURL != "" {
+			return storageURL
+		}
+	}
+
+	scheme := cfg.MetaBackend
+	if scheme == "" {
+		scheme = backend.SchemeFile
+	}
+
+	return backend.URL(scheme, absDir(cfg.Dir))
+}
+
+func absDir(dir string) string {
+	if abs, err := filepath.Abs(dir); err == nil {
+		return abs
+	}
+
+	return dir
+}
+
+// migrateImgStorage upgrades the layout of the image backend, metas must be migrated before.
+func migrateImgStorage(dir string, imgStorage separated.ImgStorage, metaStorage separated.MetaCRUD) error {
+	component, migrations := imgMigrations(imgStorage, metaStorage)
+	if component == "" {
+		return nil
+	}
+
+	if err := schema.Migrate(dir, component, migrations); err != nil {
+		return fmt.Errorf("migrating image storage, %w", err)
+	}
+
+	return nil
+}
+
+// imgMigrations returns the schema component of the image storage and its migrations, "" if it has none.
+func imgMigrations(imgStorage separated.ImgStorage, metaStorage separated.MetaCRUD) (string, []schema.Migration) {
+	imageNames := func() ([]string, error) {
+		metas, err := metaStorage.GetAll()
+		if err != nil {
+			return nil, err
+		}
+
+		names := make([]string, 0, len(metas))
+		for _, meta := range metas {
+			names = append(names, meta.ImageName)
+		}
+
+		return names, nil
+	}
+
+	switch s := imgStorage.(type) {
+	case *compact.ImgStorage:
+		return compact.SchemaComponent, s.Migrations(imageNames)
+	case *fs1.ImgStorage:
+		return fs1.SchemaComponent, s.Migrations(imageNames)
+	}
+
+	return "", nil
+}
+
+// Migrate copies images of the cache dir from one image backend to another.
+// Every copy is verified before the dir is switched to the new backend, images of the old one are removed after that.
+// Garnerd must not run on the dir during the migration.
+func Migrate(cfg Config, from, to string) error {
+	if from == to {
+		return fmt.Errorf("image backend is '%s' already", to)
+	}
+
+	current, err := readImageBackend(cfg.Dir)
+	if err != nil {
+		return err
+	}
+	if current == "" {
+		current = ImageBackendCompact
+	}
+	if current != from {
+		return fmt.Errorf("cache dir uses the '%s' image backend, not '%s'", current, from)
+	}
+
+	if err = cfg.Codec.Validate(); err != nil {
+		return fmt.Errorf("codec, %w", err)
+	}
+	if cfg, err = cfg.loadKeys(); err != nil {
+		return err
+	}
+
+	src, err := backend.OpenImg(dirImageURL(from, cfg.Dir), cfg.backendParams())
+	if err != nil {
+		return err
+	}
+	dst, err := backend.OpenImg(dirImageURL(to, cfg.Dir), cfg.backendParams())
+	if err != nil {
+		return err
+	}
+	metaStorage, err := backend.OpenMeta(metaStorageURL(cfg), cfg.backendParams())
+	if err != nil {
+		return err
+	}
+
+	if err = schema.Migrate(cfg.Dir, separated.MetaSchemaComponent, separated.MetaMigrations(metaStorage)); err != nil {
+		return fmt.Errorf("migrating meta, %w", err)
+	}
+	for _, imgStorage := range []separated.ImgStorage{src, dst} {
+		if err = migrateImgStorage(cfg.Dir, imgStorage, metaStorage); err != nil {
+			return err
+		}
+	}
+
+	storage := separated.NewStorage(metaStorage, src)
+	if err = schema.Migrate(cfg.Dir, separated.ImageSchemaComponent, storage.Migrations()); err != nil {
+		return fmt.Errorf("migrating images, %w", err)
+	}
+	if err = storage.CleanUp(context.Background()); err != nil {
+		return fmt.Errorf("cleaning up, %w", err)
+	}
+	if err = storage.CopyImagesTo(dst); err != nil {
+		return err
+	}
+
+	if err = writeImageBackend(cfg.Dir, to); err != nil {
+		return err
+	}
+	log.Infof("Cache dir has been switched to the '%s' image backend", to)
+
+	metas, err := metaStorage.GetAll()
+	if err != nil {
+		return err
+	}
+	removed := map[string]bool{}
+	for _, meta := range metas {
+		if removed[meta.ImageID] {
+			continue
+		}
+		removed[meta.ImageID] = true
+		if err = src.Remove(meta.ImageID); err != nil {
+			log.Warnf("removing '%s' from the '%s' image backend, %s", meta.ImageID, from, err)
+		}
+	}
+
+	return nil
+}
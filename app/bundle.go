@@ -0,0 +1,127 @@
+// nolint: goerr113
+package app
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/podtserkovskiy/garnerd/storage/backend"
+	"github.com/podtserkovskiy/garnerd/storage/schema"
+	"github.com/podtserkovskiy/garnerd/storage/separated"
+)
+
+// openStorage opens storages of the cache dir without a docker daemon, they are migrated and cleaned up like on Start.
+// Garnerd must not run on the dir meanwhile.
+func openStorage(cfg Config) (*separated.Storage, error) {
+	if err := cfg.Codec.Validate(); err != nil {
+		return nil, fmt.Errorf("codec, %w", err)
+	}
+	cfg, err := cfg.loadKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	imgURL, dirBackend, recorded, err := imageStorageURL(cfg)
+	if err != nil {
+		return nil, err
+	}
+	imgStorage, err := backend.OpenImg(imgURL, cfg.backendParams())
+	if err != nil {
+		return nil, err
+	}
+	metaStorage, err := backend.OpenMeta(metaStorageURL(cfg), cfg.backendParams())
+	if err != nil {
+		return nil, err
+	}
+
+	storage := separated.NewStorage(metaStorage, imgStorage)
+	if err = storage.Wait(context.Background()); err != nil {
+		return nil, fmt.Errorf("waiting for storage, %w", err)
+	}
+
+	if dirBackend != "" && !recorded {
+		if err = writeImageBackend(cfg.Dir, dirBackend); err != nil {
+			return nil, err
+		}
+	}
+	if err = schema.Migrate(cfg.Dir, separated.MetaSchemaComponent, separated.MetaMigrations(metaStorage)); err != nil {
+		return nil, fmt.Errorf("migrating meta, %w", err)
+	}
+	if dirBackend != "" {
+		if err = migrateImgStorage(cfg.Dir, imgStorage, metaStorage); err != nil {
+			return nil, err
+		}
+	}
+	if err = schema.Migrate(cfg.Dir, separated.ImageSchemaComponent, storage.Migrations()); err != nil {
+		return nil, fmt.Errorf("migrating images, %w", err)
+	}
+	if err = storage.CleanUp(context.Background()); err != nil {
+		return nil, fmt.Errorf("cleaning up, %w", err)
+	}
+
+	return storage, nil
+}
+
+// Export writes the images of the cache dir to the bundle file, all images are exported if imageNames is empty.
+// The file is replaced only when the bundle is complete.
+func Export(cfg Config, bundlePath string, imageNames []string) error {
+	storage, err := openStorage(cfg)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(bundlePath), filepath.Base(bundlePath)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	err = storage.Export(tmpFile, imageNames)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("exporting, %w", err)
+	}
+
+	if err = os.Rename(tmpFile.Name(), bundlePath); err != nil {
+		return err
+	}
+	log.Infof("Bundle has been written to %s", bundlePath)
+
+	return nil
+}
+
+// Import merges images of the bundle file into the cache dir, tags of other images are resolved by the rule.
+func Import(cfg Config, bundlePath string, rule separated.ConflictRule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+
+	storage, err := openStorage(cfg)
+	if err != nil {
+		return err
+	}
+
+	bundle, err := os.Open(bundlePath)
+	if err != nil {
+		return err
+	}
+	defer bundle.Close()
+
+	report, err := storage.Import(bundle, rule)
+	if err != nil {
+		return fmt.Errorf("importing %s, %w", bundlePath, err)
+	}
+	log.Infof(
+		"Imported %d images and %d tags, %d images were cached already, %d tags were kept by the '%s' rule",
+		report.Images, report.Tags, report.StoredImages, report.Conflicts, rule,
+	)
+
+	return nil
+}
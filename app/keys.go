@@ -0,0 +1,91 @@
+// nolint: goerr113
+package app
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/podtserkovskiy/garnerd/storage/backend"
+	"github.com/podtserkovskiy/garnerd/storage/image/compact"
+)
+
+// loadKeys returns the config with the keyring of KeyFile or KeyEnv.
+func (cfg Config) loadKeys() (Config, error) {
+	keys, err := loadKeyring(cfg.KeyFile, cfg.KeyEnv)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.keys = keys
+
+	return cfg, nil
+}
+
+// loadKeyring reads the key from the file or the environment variable, it returns nil if both are unset.
+func loadKeyring(file, env string) (*compact.Keyring, error) {
+	var data []byte
+	switch {
+	case file != "" && env != "":
+		return nil, fmt.Errorf("the key is set by both the file '%s' and the variable %s", file, env)
+	case file != "":
+		var err error
+		if data, err = ioutil.ReadFile(file); err != nil {
+			return nil, fmt.Errorf("reading the key, %w", err)
+		}
+	case env != "":
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			return nil, fmt.Errorf("the key variable %s is not set", env)
+		}
+		data = []byte(value)
+	default:
+		return nil, nil
+	}
+
+	key, err := compact.ParseKey(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return compact.NewKeyring(key)
+}
+
+// Rekey encrypts images of the compact image storage with the key of cfg, files encrypted with the old key
+// or in plain text are rewritten. Without a key of cfg images are decrypted. It fails if garnerd runs on the dir,
+// an interrupted rekey is finished by running it again.
+func Rekey(cfg Config, oldKeyFile, oldKeyEnv string) error {
+	cfg, err := cfg.loadKeys()
+	if err != nil {
+		return err
+	}
+	old, err := loadKeyring(oldKeyFile, oldKeyEnv)
+	if err != nil {
+		return fmt.Errorf("old key, %w", err)
+	}
+
+	imgURL, _, _, err := imageStorageURL(cfg)
+	if err != nil {
+		return err
+	}
+	imgStorage, err := backend.OpenImg(imgURL, cfg.backendParams())
+	if err != nil {
+		return err
+	}
+	compactStorage, ok := imgStorage.(*compact.ImgStorage)
+	if !ok {
+		return fmt.Errorf("only the compact image backend encrypts images, %s doesn't", imgURL)
+	}
+
+	if _, err = compactStorage.Rekey(old); err != nil {
+		return err
+	}
+	if cfg.keys != nil {
+		log.Infof("Images are encrypted with key %s", cfg.keys.ID())
+	} else {
+		log.Info("Images are decrypted")
+	}
+
+	return nil
+}
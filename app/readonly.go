@@ -0,0 +1,134 @@
+// nolint: goerr113
+package app
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/podtserkovskiy/garnerd/cache/lru"
+	"github.com/podtserkovskiy/garnerd/director"
+	"github.com/podtserkovskiy/garnerd/docker"
+	"github.com/podtserkovskiy/garnerd/mover"
+	"github.com/podtserkovskiy/garnerd/registry"
+	"github.com/podtserkovskiy/garnerd/storage"
+	"github.com/podtserkovskiy/garnerd/storage/backend"
+	"github.com/podtserkovskiy/garnerd/storage/overlay"
+	"github.com/podtserkovskiy/garnerd/storage/schema"
+	"github.com/podtserkovskiy/garnerd/storage/separated"
+)
+
+// startReadOnly restores images from the read-only cache dir, new images are cached in OverlayDir if it is set.
+// The cache dir is neither migrated nor cleaned up, images are never saved to it or evicted from it.
+func startReadOnly(ctx context.Context, cfg Config, daemon *docker.Daemon) error {
+	if cfg.RebuildIndex || cfg.RecompressIdle > 0 {
+		log.Warn("--rebuild-index and --recompress-idle are ignored, the cache dir is read-only")
+	}
+	if cfg.ProxyUpstream != "" || len(cfg.Peers) > 0 || cfg.PeersFile != "" {
+		log.Warn("--proxy-upstream, --peer and --peers-file are ignored, the cache dir is read-only")
+	}
+
+	base, baseImages, err := openReadOnly(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	var local storage.Storage
+	if cfg.OverlayDir != "" {
+		overlayCfg := cfg
+		overlayCfg.Dir, overlayCfg.SlowDir = cfg.OverlayDir, ""
+		overlayCfg.ImageStorage, overlayCfg.MetaStorage, overlayCfg.StorageURL = "", "", ""
+		localStorage, err := openStorage(overlayCfg)
+		if err != nil {
+			return fmt.Errorf("opening the overlay dir, %w", err)
+		}
+		local = localStorage
+		log.Infof("New images are cached in %s", cfg.OverlayDir)
+	} else {
+		log.Info("New images are not cached, the cache dir is read-only")
+	}
+	store := overlay.NewStorage(base, local)
+
+	cache, err := lru.NewCache(cfg.MaxCount)
+	if err != nil {
+		return fmt.Errorf("creating cache, %s", err)
+	}
+
+	if cfg.RegistryAddr != "" {
+		images, ok := baseImages.(registry.Images)
+		if !ok {
+			return fmt.Errorf("--registry-addr needs the compact image backend")
+		}
+		// images of the overlay dir aren't served
+		if err = serveRegistry(cfg.RegistryAddr, registry.NewServer(base, images)); err != nil {
+			return err
+		}
+	}
+
+	directorOpts := []director.Option{}
+	switch {
+	case cfg.DropDir != "" && local == nil:
+		log.Warn("--drop-dir is ignored, tarballs can be cached only in --overlay-dir")
+	case cfg.DropDir != "":
+		watchDropDir(ctx, cfg, store, daemon, cache)
+	}
+	switch {
+	case cfg.Watermarks.Enabled() && local == nil:
+		log.Warn("--high-watermark is ignored, images are evicted only from --overlay-dir")
+	case cfg.Watermarks.Enabled():
+		log.Infof("Images are evicted when %s is used above %d%%", cfg.OverlayDir, cfg.Watermarks.High)
+		directorOpts = append(directorOpts, director.WithWatermarks(cfg.Watermarks, cfg.OverlayDir))
+	}
+
+	director := director.NewDirector(cache, store, daemon, mover.NewMover(store, daemon), directorOpts...)
+	if err = director.Start(ctx); err != nil {
+		return fmt.Errorf("start, %s", err)
+	}
+
+	return nil
+}
+
+// openReadOnly opens storages of the cache dir without writing to it, the dir has to be migrated by this garnerd.
+func openReadOnly(ctx context.Context, cfg Config) (*separated.Storage, separated.ImgStorage, error) {
+	params := cfg.backendParams()
+	params.ReadOnly = true
+
+	log.Infof("Cache dir: %s, read-only", cfg.Dir)
+	imgURL, dirBackend, _, err := imageStorageURL(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Infof("Image storage: %s", imgURL)
+	imgStorage, err := backend.OpenImg(imgURL, params)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	metaURL := metaStorageURL(cfg)
+	log.Infof("Meta storage: %s", metaURL)
+	metaStorage, err := backend.OpenMeta(metaURL, params)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	store := separated.NewStorage(metaStorage, imgStorage)
+	if err = store.Wait(ctx); err != nil {
+		return nil, nil, fmt.Errorf("waiting for storage, %s", err)
+	}
+
+	checks := map[string][]schema.Migration{
+		separated.MetaSchemaComponent:  separated.MetaMigrations(metaStorage),
+		separated.ImageSchemaComponent: store.Migrations(),
+	}
+	if component, migrations := imgMigrations(imgStorage, metaStorage); dirBackend != "" && component != "" {
+		checks[component] = migrations
+	}
+	for component, migrations := range checks {
+		if err = schema.Check(cfg.Dir, component, migrations); err != nil {
+			return nil, nil, fmt.Errorf("read-only cache dir, %w, start garnerd on it without --read-only once", err)
+		}
+	}
+
+	return store, imgStorage, nil
+}
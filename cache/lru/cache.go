@@ -4,6 +4,8 @@ import (
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/hashicorp/golang-lru/simplelru"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/podtserkovskiy/garnerd/docker"
 )
 
 type CacheItem struct {
@@ -11,6 +13,7 @@ type CacheItem struct {
 	ImageName string
 }
 
+// Cache evicts the least recently used images, image names are normalized like references from the daemon.
 type Cache struct {
 	lru            simplelru.LRUCache
 	onAdd, onEvict func(imageName string, imageID string)
@@ -31,18 +34,34 @@ func NewCache(cacheSize int) (*Cache, error) {
 	return cache, nil
 }
 
+// AddSilent marks the image as used without onAdd, tags of one image share an entry.
 func (c *Cache) AddSilent(imageName, imageID string) {
-	c.lru.Add(imageName, CacheItem{ImageName: imageName, ImageID: imageID})
+	imageName = docker.NormalizeNameOrKeep(imageName)
+	c.lru.Add(imageID, CacheItem{ImageName: imageName, ImageID: imageID})
 }
 
+// Add marks the image as used, onAdd is called for a new ImageID. Tags of one image share an entry.
 func (c *Cache) Add(imageName, imageID string) {
-	isNew := !c.lru.Contains(imageName)
-	c.lru.Add(imageName, CacheItem{ImageName: imageName, ImageID: imageID})
+	imageName = docker.NormalizeNameOrKeep(imageName)
+	isNew := !c.lru.Contains(imageID)
+	c.lru.Add(imageID, CacheItem{ImageName: imageName, ImageID: imageID})
 	if isNew {
 		c.onAdd(imageName, imageID)
 	}
 }
 
+// EvictOldest evicts the least recently used image, it returns false if the cache is empty.
+func (c *Cache) EvictOldest() bool {
+	_, _, ok := c.lru.RemoveOldest()
+
+	return ok
+}
+
+// Len returns a number of cached images.
+func (c *Cache) Len() int {
+	return c.lru.Len()
+}
+
 func (c *Cache) OnAdd(f func(imageName string, imageID string)) {
 	c.onAdd = f
 }
@@ -1,25 +1,158 @@
 package cmd
 
 import (
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
 	"github.com/podtserkovskiy/garnerd/app"
+	"github.com/podtserkovskiy/garnerd/ingest"
+	"github.com/podtserkovskiy/garnerd/registry"
+	"github.com/podtserkovskiy/garnerd/storage/backend"
+	"github.com/podtserkovskiy/garnerd/storage/image/compact"
+	"github.com/podtserkovskiy/garnerd/storage/separated"
 )
 
 func Execute() {
-	maxCount := 0
+	cfg := app.Config{}
 	rootCmd := &cobra.Command{
 		Use:   "garnerd",
 		Short: "Garnerd is a useful cache for docker",
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return app.Start(maxCount, args[0])
+			cfg.Dir = args[0]
+
+			return app.Start(cfg)
 		},
 	}
-	rootCmd.Flags().IntVar(&maxCount, "max-count", 10, "maximum images in the cache")
+	rootCmd.Flags().IntVar(&cfg.MaxCount, "max-count", 10, "maximum images in the cache")
+	rootCmd.Flags().StringVar(&cfg.ImageBackend, "image-backend", "", "image storage: fs or compact, defaults to the one of the cache dir")
+	rootCmd.PersistentFlags().StringVar(&cfg.MetaBackend, "meta-backend", "file", "metadata storage: file, journal or kv")
+	rootCmd.Flags().StringVar(&cfg.ImageStorage, "image-storage", "", "image storage url, one of "+schemes(backend.ImgSchemes())+", replaces --image-backend")
+	rootCmd.PersistentFlags().StringVar(&cfg.MetaStorage, "meta-storage", "", "metadata storage url, one of "+schemes(backend.MetaSchemes())+", replaces --meta-backend")
+	rootCmd.PersistentFlags().IntVar(&cfg.CompressionWorkers, "compression-workers", runtime.NumCPU(), "layers compressed in parallel")
+	rootCmd.PersistentFlags().StringVar(&cfg.Codec.Name, "codec", compact.DefaultCodec.Name, "layers compression: none, gzip or zstd")
+	rootCmd.PersistentFlags().IntVar(&cfg.Codec.Level, "codec-level", compact.DefaultCodec.Level, "compression level, gzip 1-9, zstd "+levels(compact.ZstdLevels))
+	rootCmd.PersistentFlags().BoolVar(&cfg.Codec.LongWindow, "codec-long", false, "zstd long-distance matching window")
+	rootCmd.Flags().DurationVar(&cfg.RecompressIdle, "recompress-idle", 0, "recompress layers to --recompress-level after this idle time, 0 disables")
+	rootCmd.Flags().IntVar(&cfg.RecompressLevel, "recompress-level", compact.ZstdLevels[len(compact.ZstdLevels)-1], "compression level used by idle recompression")
+	rootCmd.PersistentFlags().StringVar(&cfg.KeyFile, "key-file", "", "file with a 32-byte key in hex or base64, image files of the compact backend are encrypted with it, meta storages and names of image dirs are not")
+	rootCmd.PersistentFlags().StringVar(&cfg.KeyEnv, "key-env", "", "environment variable with the key, replaces --key-file")
+	rootCmd.PersistentFlags().StringVar(&cfg.SlowDir, "slow-dir", "", "slow tier of the compact image backend, e.g. on an HDD, layers of cold images are moved there")
+	rootCmd.Flags().DurationVar(&cfg.DemoteAfter, "demote-after", 24*time.Hour, "move layers of images unused for this time to --slow-dir")
+	rootCmd.Flags().BoolVar(&cfg.RebuildIndex, "rebuild-index", false, "rebuild the layer index from the cache dir before start")
+	rootCmd.Flags().IntVar(&cfg.Watermarks.High, "high-watermark", 0, "evict images when the cache dir or the temp dir is used above this percent, 0 disables")
+	rootCmd.Flags().IntVar(&cfg.Watermarks.Low, "low-watermark", 0, "percent of use which eviction by --high-watermark stops at")
+	rootCmd.Flags().StringVar(&cfg.StorageURL, "storage-url", "", "default of --image-storage and --meta-storage, e.g. s3://bucket/prefix?endpoint=http://minio:9000")
+
+	rootCmd.Flags().StringVar(&cfg.RegistryAddr, "registry-addr", "", "serve cached images by the Registry v2 API on the address, e.g. :5000, needs the compact image backend")
+	rootCmd.Flags().StringVar(&cfg.ProxyUpstream, "proxy-upstream", "", "pull images missing in the cache through --registry-addr from the registry and cache them, e.g. "+registry.DockerHub)
+	rootCmd.Flags().StringSliceVar(&cfg.Peers, "peer", nil, "registry url of another garnerd instance, e.g. http://10.0.0.2:5000, missing images are asked from peers before --proxy-upstream")
+	rootCmd.Flags().StringVar(&cfg.PeersFile, "peers-file", "", "file of --peer urls, one per line")
+	rootCmd.Flags().StringVar(&cfg.DropDir, "drop-dir", "", "cache docker save tarballs dropped into the dir, they are moved to its "+
+		ingest.ProcessedDir+" or "+ingest.FailedDir+" subdir")
+	rootCmd.Flags().BoolVar(&cfg.DropLoad, "drop-load", false, "load tarballs of --drop-dir into docker too")
+	rootCmd.Flags().BoolVar(&cfg.ReadOnly, "read-only", false, "only restore images from the cache dir, e.g. a shared read-only mount, it is never written")
+	rootCmd.Flags().StringVar(&cfg.OverlayDir, "overlay-dir", "", "writable cache dir which new images are cached in with --read-only")
+
+	rootCmd.AddCommand(migrateCmd(&cfg))
+	rootCmd.AddCommand(exportCmd(&cfg))
+	rootCmd.AddCommand(importCmd(&cfg))
+	rootCmd.AddCommand(rekeyCmd(&cfg))
 
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatal(err)
 	}
 }
+
+func schemes(names []string) string {
+	for i, name := range names {
+		names[i] = name + "://"
+	}
+
+	return strings.Join(names, ", ")
+}
+
+func levels(list []int) string {
+	names := make([]string, len(list))
+	for i, level := range list {
+		names[i] = strconv.Itoa(level)
+	}
+
+	return strings.Join(names, ", ")
+}
+
+func migrateCmd(cfg *app.Config) *cobra.Command {
+	var from, to string
+	migrateCmd := &cobra.Command{
+		Use:   "migrate --from fs --to compact DIR",
+		Short: "Move cached images to another image backend, garnerd must be stopped",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg.Dir = args[0]
+
+			return app.Migrate(*cfg, from, to)
+		},
+	}
+	migrateCmd.Flags().StringVar(&from, "from", app.ImageBackendFS, "current image backend: fs or compact")
+	migrateCmd.Flags().StringVar(&to, "to", app.ImageBackendCompact, "new image backend: fs or compact")
+
+	return migrateCmd
+}
+
+func exportCmd(cfg *app.Config) *cobra.Command {
+	var images []string
+	exportCmd := &cobra.Command{
+		Use:   "export --image alpine:3 DIR BUNDLE",
+		Short: "Write cached images to a bundle file, garnerd must be stopped",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg.Dir = args[0]
+
+			return app.Export(*cfg, args[1], images)
+		},
+	}
+	exportCmd.Flags().StringSliceVar(&images, "image", nil, "image to export, all cached images are exported by default")
+
+	return exportCmd
+}
+
+func importCmd(cfg *app.Config) *cobra.Command {
+	var rule string
+	importCmd := &cobra.Command{
+		Use:   "import --conflict keep DIR BUNDLE",
+		Short: "Merge images of a bundle file into the cache, garnerd must be stopped",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg.Dir = args[0]
+
+			return app.Import(*cfg, args[1], separated.ConflictRule(rule))
+		},
+	}
+	importCmd.Flags().StringVar(&rule, "conflict", string(separated.KeepLocal),
+		"tag cached for another image: keep, replace or newer to keep the image created later")
+
+	return importCmd
+}
+
+func rekeyCmd(cfg *app.Config) *cobra.Command {
+	var oldKeyFile, oldKeyEnv string
+	rekeyCmd := &cobra.Command{
+		Use:   "rekey --old-key-file old.key --key-file new.key DIR",
+		Short: "Encrypt cached images with the key of --key-file, without a key they are decrypted, garnerd must be stopped",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg.Dir = args[0]
+
+			return app.Rekey(*cfg, oldKeyFile, oldKeyEnv)
+		},
+	}
+	rekeyCmd.Flags().StringVar(&oldKeyFile, "old-key-file", "", "file with the key images are encrypted with now, unset for a cache in plain text")
+	rekeyCmd.Flags().StringVar(&oldKeyEnv, "old-key-env", "", "environment variable with the old key, replaces --old-key-file")
+
+	return rekeyCmd
+}
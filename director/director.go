@@ -2,11 +2,13 @@ package director
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sort"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/podtserkovskiy/garnerd/disk"
 	"github.com/podtserkovskiy/garnerd/docker"
 	"github.com/podtserkovskiy/garnerd/storage"
 )
@@ -16,11 +18,14 @@ type Cache interface {
 	Add(imageName, imageID string)
 	OnAdd(func(imageName, imageID string))
 	OnEvict(func(imageName, imageID string))
+	EvictOldest() bool
+	Len() int
 }
 
 type Mover interface {
 	FromDockerToStorage(ctx context.Context, imageName string) error
-	FromStorageToDocker(ctx context.Context, imageName string) error
+	// FromStorageToDocker restores the image by Meta.Key()
+	FromStorageToDocker(ctx context.Context, key string) error
 }
 
 type Director struct {
@@ -28,10 +33,28 @@ type Director struct {
 	mover   Mover
 	storage storage.Storage
 	docker  docker.Docker
+
+	watermarks  disk.Watermarks
+	watchedDirs []string
+	usageOf     func(dir string) (disk.Usage, error)
+}
+
+type Option func(*Director)
+
+// WithWatermarks evicts images before a save when any of dirs is used above the high watermark.
+func WithWatermarks(watermarks disk.Watermarks, dirs ...string) Option {
+	return func(d *Director) {
+		d.watermarks, d.watchedDirs = watermarks, dirs
+	}
 }
 
-func NewDirector(cache Cache, storage storage.Storage, docker docker.Docker, mover Mover) *Director {
-	return &Director{cache: cache, storage: storage, docker: docker, mover: mover}
+func NewDirector(cache Cache, storage storage.Storage, docker docker.Docker, mover Mover, opts ...Option) *Director {
+	d := &Director{cache: cache, storage: storage, docker: docker, mover: mover, usageOf: disk.UsageOf}
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	return d
 }
 
 func (d *Director) Start(ctx context.Context) error {
@@ -46,7 +69,14 @@ func (d *Director) Start(ctx context.Context) error {
 	return nil
 }
 
+// init restores images of the daemon platform, images of other platforms stay in the cache for other daemons.
 func (d *Director) init(ctx context.Context) error {
+	platform, err := d.docker.Platform(ctx)
+	if err != nil {
+		return fmt.Errorf("getting the daemon platform, %w", err)
+	}
+	log.Infof("Daemon platform: %s", platform)
+
 	metas, err := d.storage.GetAllMeta()
 	if err != nil {
 		return fmt.Errorf("getting persisted metadata, %w", err)
@@ -56,11 +86,16 @@ func (d *Director) init(ctx context.Context) error {
 		return metas[i].UpdatedAt.UnixNano() < metas[j].UpdatedAt.UnixNano()
 	})
 
+	restored := map[string]bool{}
 	for _, meta := range metas {
-		if err := d.mover.FromStorageToDocker(ctx, meta.ImageName); err != nil {
-			log.Errorf("loading '%s' from storage, %s", meta.ImageName, err)
-
-			continue
+		// a dump restores every tag of the image, an image pinned only by digest is restored by its ImageID
+		if !restored[meta.ImageID] && runsOn(meta, platform) {
+			if err := d.mover.FromStorageToDocker(ctx, meta.Key()); err != nil {
+				log.Errorf("loading '%s' from storage, %s", meta.ImageName, err)
+
+				continue
+			}
+			restored[meta.ImageID] = true
 		}
 
 		d.cache.AddSilent(meta.ImageName, meta.ImageID)
@@ -69,9 +104,30 @@ func (d *Director) init(ctx context.Context) error {
 	return nil
 }
 
+// runsOn reports whether the image is for the platform, images cached without a platform are restored anyway.
+func runsOn(meta storage.Meta, platform docker.Platform) bool {
+	if meta.OS == "" || meta.Architecture == "" {
+		return true
+	}
+
+	return meta.OS == platform.OS && meta.Architecture == platform.Architecture
+}
+
 func (d *Director) saveImg(ctx context.Context) func(imageName, imageID string) {
 	return func(imageName, imageID string) {
-		if err := d.mover.FromDockerToStorage(ctx, imageName); err != nil {
+		d.makeRoom(0)
+		err := d.mover.FromDockerToStorage(ctx, imageName)
+		if disk.IsNoSpace(err) {
+			log.Warnf("Caching '%s', %s, evicting images to retry", imageName, err)
+			d.makeRoom(1)
+			err = d.mover.FromDockerToStorage(ctx, imageName)
+		}
+		if errors.Is(err, storage.ErrReadOnly) {
+			log.Debugf("'%s' is not cached, %s", imageName, err)
+
+			return
+		}
+		if err != nil {
 			log.Warnf("Caching '%s', %s", imageName, err)
 
 			return
@@ -80,20 +136,99 @@ func (d *Director) saveImg(ctx context.Context) func(imageName, imageID string)
 	}
 }
 
+// makeRoom evicts at least minEvictions least recently used images and then goes on while a watched dir
+// is used above the high watermark, down to the low one. The image being saved is the most recently used,
+// so it is never evicted.
+func (d *Director) makeRoom(minEvictions int) {
+	if minEvictions == 0 && !d.watermarks.Enabled() {
+		return
+	}
+
+	limit := d.watermarks.High
+	for evicted := 0; d.cache.Len() > 1; evicted++ {
+		if evicted >= minEvictions {
+			if !d.watermarks.Enabled() {
+				return
+			}
+			used, err := d.usedPercent()
+			if err != nil {
+				log.Warnf("Checking free space, %s", err)
+
+				return
+			}
+			if used < float64(limit) {
+				return
+			}
+		}
+		if evicted == 0 {
+			log.Info("Evicting least recently used images to free space")
+		}
+		limit = d.watermarks.Low
+
+		if !d.cache.EvictOldest() {
+			return
+		}
+	}
+}
+
+// usedPercent returns the usage of the fullest watched dir.
+func (d *Director) usedPercent() (float64, error) {
+	maxUsed := 0.0
+	for _, dir := range d.watchedDirs {
+		usage, err := d.usageOf(dir)
+		if err != nil {
+			return 0, fmt.Errorf("'%s', %w", dir, err)
+		}
+		if used := usage.UsedPercent(); used > maxUsed {
+			maxUsed = used
+		}
+	}
+
+	return maxUsed, nil
+}
+
+// removeImg removes every tag of the evicted image.
 func (d *Director) removeImg() func(imageName, imageID string) {
-	return func(imageName, imageID string) {
-		if err := d.storage.Remove(imageName); err != nil {
-			log.Warnf("Removing '%s', %s", imageName, err)
+	return func(_, imageID string) {
+		metas, err := d.storage.GetAllMeta()
+		if err != nil {
+			log.Warnf("Removing '%s', %s", imageID, err)
 
 			return
 		}
-		log.Infof("Image '%s' has been evicted", imageName)
+
+		for _, meta := range metas {
+			if meta.ImageID != imageID {
+				continue
+			}
+			err := d.storage.Remove(meta.Key())
+			if errors.Is(err, storage.ErrReadOnly) {
+				// images of a shared read-only cache stay in it
+				continue
+			}
+			if err != nil {
+				log.Warnf("Removing '%s', %s", meta.ImageName, err)
+
+				continue
+			}
+			log.Infof("Image '%s' has been evicted", meta.ImageName)
+		}
 	}
 }
 
 func (d *Director) listenContainerCreated(ctx context.Context) {
 	log.Info("Listening for new containers")
 	for container := range d.docker.ListenContainerCreation(ctx) {
+		key := storage.Key(container.ImageName, container.Platform.OS, container.Platform.Architecture)
 		d.cache.Add(container.ImageName, container.ImageID)
+		err := d.storage.MarkUsed(key)
+		if errors.Is(err, storage.ErrNotFound) {
+			// the cache saves only new images, a new tag of a cached image is saved here
+			d.saveImg(ctx)(container.ImageName, container.ImageID)
+			err = d.storage.MarkUsed(key)
+		}
+		if err != nil {
+			log.Warnf("Counting a hit of '%s', %s", container.ImageName, err)
+		}
 	}
 }
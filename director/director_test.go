@@ -4,12 +4,17 @@ package director
 import (
 	"context"
 	"errors"
+	"fmt"
+	"os"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 
+	"github.com/podtserkovskiy/garnerd/disk"
+	"github.com/podtserkovskiy/garnerd/docker"
 	"github.com/podtserkovskiy/garnerd/mocks"
 	"github.com/podtserkovskiy/garnerd/storage"
 )
@@ -35,16 +40,27 @@ func metaByUpdatedDesc() []storage.Meta {
 	}
 }
 
+var linuxAmd64 = docker.Platform{OS: "linux", Architecture: "amd64"}
+
 func TestDirector_init(t *testing.T) {
+	t.Run("returns an error when docker.Platform returns an error", func(t *testing.T) {
+		director, _, _, dm, _ := NewTestData()
+		dm.On("Platform", mock.Anything).Return(docker.Platform{}, errors.New("docker err"))
+		err := director.init(context.Background())
+		require.EqualError(t, err, "getting the daemon platform, docker err")
+	})
+
 	t.Run("returns an error when storage.GetAllMeta returns an error", func(t *testing.T) {
-		director, _, sm, _, _ := NewTestData()
+		director, _, sm, dm, _ := NewTestData()
+		dm.On("Platform", mock.Anything).Return(linuxAmd64, nil)
 		sm.On("GetAllMeta").Return(nil, errors.New("storage err"))
 		err := director.init(context.Background())
 		require.EqualError(t, err, "getting persisted metadata, storage err")
 	})
 
 	t.Run("not updates cache when mover.FromStorageToDocker returns an error", func(t *testing.T) {
-		director, _, sm, _, mm := NewTestData()
+		director, _, sm, dm, mm := NewTestData()
+		dm.On("Platform", mock.Anything).Return(linuxAmd64, nil)
 		sm.On("GetAllMeta").Return(metaByUpdatedDesc(), nil)
 		mm.On("FromStorageToDocker", mock.Anything, mock.Anything).Return(errors.New("mover err"))
 		err := director.init(context.Background())
@@ -52,7 +68,8 @@ func TestDirector_init(t *testing.T) {
 	})
 
 	t.Run("updates cache on successful moves", func(t *testing.T) {
-		director, cm, sm, _, mm := NewTestData()
+		director, cm, sm, dm, mm := NewTestData()
+		dm.On("Platform", mock.Anything).Return(linuxAmd64, nil)
 		sm.On("GetAllMeta").Return(metaByUpdatedDesc(), nil)
 		mm.On("FromStorageToDocker", mock.Anything, mock.Anything).Return(nil)
 		cm.On("AddSilent", "a-name", "a-id").Return().Once()
@@ -60,4 +77,174 @@ func TestDirector_init(t *testing.T) {
 		err := director.init(context.Background())
 		require.NoError(t, err)
 	})
+
+	t.Run("images of other platforms are not restored", func(t *testing.T) {
+		director, cm, sm, dm, mm := NewTestData()
+		dm.On("Platform", mock.Anything).Return(linuxAmd64, nil)
+		sm.On("GetAllMeta").Return([]storage.Meta{
+			{ImageName: "app:1", ImageID: "arm-id", OS: "linux", Architecture: "arm64"},
+			{ImageName: "app:1", ImageID: "amd-id", OS: "linux", Architecture: "amd64"},
+		}, nil)
+		mm.On("FromStorageToDocker", mock.Anything, "app:1 linux/amd64").Return(nil).Once()
+		cm.On("AddSilent", "app:1", "arm-id").Return().Once()
+		cm.On("AddSilent", "app:1", "amd-id").Return().Once()
+
+		require.NoError(t, director.init(context.Background()))
+		mm.AssertExpectations(t)
+		cm.AssertExpectations(t)
+	})
+
+	t.Run("digest-pinned images are restored", func(t *testing.T) {
+		director, cm, sm, dm, mm := NewTestData()
+		dm.On("Platform", mock.Anything).Return(linuxAmd64, nil)
+		pinned := "app@sha256:0000000000000000000000000000000000000000000000000000000000000001"
+		pinnedOnly := "tool@sha256:0000000000000000000000000000000000000000000000000000000000000002"
+		sm.On("GetAllMeta").Return([]storage.Meta{
+			{ImageName: pinned, ImageID: "app-id", UpdatedAt: time.Unix(1, 0)},
+			{ImageName: pinnedOnly, ImageID: "tool-id", UpdatedAt: time.Unix(2, 0)},
+			{ImageName: "app:1", ImageID: "app-id", UpdatedAt: time.Unix(3, 0)},
+		}, nil)
+		// the dump of the pinned image restores app:1 too
+		mm.On("FromStorageToDocker", mock.Anything, pinned).Return(nil).Once()
+		mm.On("FromStorageToDocker", mock.Anything, pinnedOnly).Return(nil).Once()
+		cm.On("AddSilent", pinned, "app-id").Return().Once()
+		cm.On("AddSilent", pinnedOnly, "tool-id").Return().Once()
+		cm.On("AddSilent", "app:1", "app-id").Return().Once()
+
+		require.NoError(t, director.init(context.Background()))
+		mm.AssertExpectations(t)
+		cm.AssertExpectations(t)
+	})
+}
+
+func TestDirector_initSharedImage(t *testing.T) {
+	director, cm, sm, dm, mm := NewTestData()
+	dm.On("Platform", mock.Anything).Return(linuxAmd64, nil)
+	sm.On("GetAllMeta").Return([]storage.Meta{
+		{ImageName: "app:1", ImageID: "app-id", UpdatedAt: time.Unix(1, 0)},
+		{ImageName: "app:latest", ImageID: "app-id", UpdatedAt: time.Unix(2, 0)},
+	}, nil)
+	mm.On("FromStorageToDocker", mock.Anything, "app:1").Return(nil).Once()
+	cm.On("AddSilent", "app:1", "app-id").Return().Once()
+	cm.On("AddSilent", "app:latest", "app-id").Return().Once()
+
+	require.NoError(t, director.init(context.Background()))
+	mm.AssertExpectations(t)
+	cm.AssertExpectations(t)
+}
+
+func TestDirector_removeImg(t *testing.T) {
+	director, _, sm, _, _ := NewTestData()
+	sm.On("GetAllMeta").Return([]storage.Meta{
+		{ImageName: "app:1", ImageID: "app-id"},
+		{ImageName: "app:latest", ImageID: "app-id"},
+		{ImageName: "other:1", ImageID: "other-id"},
+	}, nil)
+	sm.On("Remove", "app:1").Return(nil).Once()
+	sm.On("Remove", "app:latest").Return(nil).Once()
+
+	director.removeImg()("app:1", "app-id")
+	sm.AssertExpectations(t)
+}
+
+func TestDirector_listenContainerCreated(t *testing.T) {
+	director, cm, sm, dm, _ := NewTestData()
+	events := make(chan docker.ContainerCreated, 1)
+	events <- docker.ContainerCreated{ImageName: "a-name", ImageID: "a-id", Platform: linuxAmd64}
+	close(events)
+	dm.On("ListenContainerCreation", mock.Anything).Return((<-chan docker.ContainerCreated)(events))
+	cm.On("Add", "a-name", "a-id").Return().Once()
+	sm.On("MarkUsed", "a-name linux/amd64").Return(errors.New("storage err")).Once()
+
+	director.listenContainerCreated(context.Background())
+	cm.AssertExpectations(t)
+	sm.AssertExpectations(t)
+}
+
+func TestDirector_listenContainerCreatedNewTag(t *testing.T) {
+	director, cm, sm, dm, mm := NewTestData()
+	events := make(chan docker.ContainerCreated, 1)
+	events <- docker.ContainerCreated{ImageName: "app:latest", ImageID: "app-id"}
+	close(events)
+	dm.On("ListenContainerCreation", mock.Anything).Return((<-chan docker.ContainerCreated)(events))
+	// the image is cached under another tag, so the cache doesn't call onAdd
+	cm.On("Add", "app:latest", "app-id").Return().Once()
+	sm.On("MarkUsed", "app:latest").Return(storage.ErrNotFound).Once()
+	mm.On("FromDockerToStorage", mock.Anything, "app:latest").Return(nil).Once()
+	sm.On("MarkUsed", "app:latest").Return(nil).Once()
+
+	director.listenContainerCreated(context.Background())
+	mm.AssertExpectations(t)
+	sm.AssertExpectations(t)
+}
+
+// usageSeq returns the usages one by one, the last one is repeated.
+func usageSeq(usedPercents ...uint64) func(string) (disk.Usage, error) {
+	return func(string) (disk.Usage, error) {
+		used := usedPercents[0]
+		if len(usedPercents) > 1 {
+			usedPercents = usedPercents[1:]
+		}
+
+		return disk.Usage{Total: 100, Free: 100 - used}, nil
+	}
+}
+
+func TestDirector_makeRoom(t *testing.T) {
+	watermarks := disk.Watermarks{High: 90, Low: 80}
+
+	t.Run("evicts down to the low watermark", func(t *testing.T) {
+		director, cm, _, _, _ := NewTestData()
+		WithWatermarks(watermarks, "cache-dir")(director)
+		director.usageOf = usageSeq(95, 85, 79)
+		cm.On("Len").Return(5)
+		cm.On("EvictOldest").Return(true).Twice()
+
+		director.makeRoom(0)
+		cm.AssertExpectations(t)
+	})
+
+	t.Run("nothing is evicted below the high watermark", func(t *testing.T) {
+		director, cm, _, _, _ := NewTestData()
+		WithWatermarks(watermarks, "cache-dir", "temp-dir")(director)
+		director.usageOf = usageSeq(85)
+		cm.On("Len").Return(5)
+
+		director.makeRoom(0)
+		cm.AssertNotCalled(t, "EvictOldest")
+	})
+
+	t.Run("the fullest dir counts", func(t *testing.T) {
+		director, cm, _, _, _ := NewTestData()
+		WithWatermarks(watermarks, "cache-dir", "temp-dir")(director)
+		director.usageOf = usageSeq(10, 95, 10, 50)
+		cm.On("Len").Return(5)
+		cm.On("EvictOldest").Return(true).Once()
+
+		director.makeRoom(0)
+		cm.AssertExpectations(t)
+	})
+
+	t.Run("the image being saved is kept", func(t *testing.T) {
+		director, cm, _, _, _ := NewTestData()
+		WithWatermarks(watermarks, "cache-dir")(director)
+		director.usageOf = usageSeq(99)
+		cm.On("Len").Return(1)
+
+		director.makeRoom(0)
+		cm.AssertNotCalled(t, "EvictOldest")
+	})
+}
+
+func TestDirector_saveImgRetriesOnNoSpace(t *testing.T) {
+	director, cm, _, _, mm := NewTestData()
+	noSpace := fmt.Errorf("saving, %w", &os.PathError{Op: "write", Path: "layer.tar", Err: syscall.ENOSPC})
+	mm.On("FromDockerToStorage", mock.Anything, "app:1").Return(noSpace).Once()
+	mm.On("FromDockerToStorage", mock.Anything, "app:1").Return(nil).Once()
+	cm.On("Len").Return(3)
+	cm.On("EvictOldest").Return(true).Once()
+
+	director.saveImg(context.Background())("app:1", "app-id")
+	mm.AssertExpectations(t)
+	cm.AssertExpectations(t)
 }
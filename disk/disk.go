@@ -0,0 +1,58 @@
+// Package disk watches free space of the dirs garnerd writes to.
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// Usage of the filesystem which holds a dir.
+type Usage struct {
+	Total uint64
+	// Free is available to unprivileged users.
+	Free uint64
+}
+
+// UsedPercent is a share of the filesystem which can't be used anymore.
+func (u Usage) UsedPercent() float64 {
+	if u.Total == 0 {
+		return 0
+	}
+
+	return 100 * float64(u.Total-u.Free) / float64(u.Total)
+}
+
+// Watermarks are percents of the filesystem in use. Once a dir is used above High,
+// images are evicted until it is used below Low. Zero watermarks disable eviction by space.
+type Watermarks struct {
+	High int
+	Low  int
+}
+
+func (w Watermarks) Enabled() bool {
+	return w.High > 0
+}
+
+func (w Watermarks) Validate() error {
+	if !w.Enabled() && w.Low == 0 {
+		return nil
+	}
+	if w.High < 1 || w.High > 100 {
+		return fmt.Errorf("high watermark is %d%%, 1-100%% is expected", w.High) // nolint: goerr113
+	}
+	if w.Low < 0 || w.Low >= w.High {
+		return fmt.Errorf("low watermark is %d%%, 0-%d%% is expected", w.Low, w.High-1) // nolint: goerr113
+	}
+
+	return nil
+}
+
+func (w Watermarks) String() string {
+	return fmt.Sprintf("%d%%-%d%%", w.Low, w.High)
+}
+
+// IsNoSpace reports whether the error is caused by a full filesystem.
+func IsNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
@@ -0,0 +1,45 @@
+package disk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatermarks_Validate(t *testing.T) {
+	require.NoError(t, Watermarks{}.Validate())
+	require.NoError(t, Watermarks{High: 90, Low: 80}.Validate())
+	require.NoError(t, Watermarks{High: 100, Low: 0}.Validate())
+	require.EqualError(t, Watermarks{High: 101, Low: 80}.Validate(), "high watermark is 101%, 1-100% is expected")
+	require.EqualError(t, Watermarks{High: 0, Low: 80}.Validate(), "high watermark is 0%, 1-100% is expected")
+	require.EqualError(t, Watermarks{High: 80, Low: 80}.Validate(), "low watermark is 80%, 0-79% is expected")
+}
+
+func TestUsage_UsedPercent(t *testing.T) {
+	require.Equal(t, 75.0, Usage{Total: 400, Free: 100}.UsedPercent())
+	require.Equal(t, 0.0, Usage{}.UsedPercent())
+}
+
+func TestUsageOf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	usage, err := UsageOf(dir)
+	require.NoError(t, err)
+	require.NotZero(t, usage.Total)
+	require.True(t, usage.Free <= usage.Total)
+
+	_, err = UsageOf(dir + "/missing")
+	require.Error(t, err)
+}
+
+func TestIsNoSpace(t *testing.T) {
+	err := &os.PathError{Op: "write", Path: "layer.tar", Err: syscall.ENOSPC}
+	require.True(t, IsNoSpace(fmt.Errorf("saving, %w", err)))
+	require.False(t, IsNoSpace(fmt.Errorf("saving, %w", os.ErrNotExist)))
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package disk
+
+import (
+	"syscall"
+)
+
+// UsageOf returns usage of the filesystem which holds the dir.
+func UsageOf(dir string) (Usage, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return Usage{}, err
+	}
+
+	// Bsize has different types on different platforms
+	blockSize := uint64(stat.Bsize)
+
+	return Usage{Total: stat.Blocks * blockSize, Free: stat.Bavail * blockSize}, nil
+}
@@ -0,0 +1,10 @@
+package disk
+
+import (
+	"errors"
+)
+
+// UsageOf is not supported on windows, watermarks can't be used there.
+func UsageOf(dir string) (Usage, error) {
+	return Usage{}, errors.New("disk usage is not supported on windows") // nolint: goerr113
+}
@@ -21,12 +21,27 @@ type Docker interface {
 	LoadDump(ctx context.Context, image io.Reader) error
 	ListenContainerCreation(ctx context.Context) <-chan ContainerCreated
 	ContainsSameVersion(ctx context.Context, yourImageID, imageName string) (bool, error)
-	ImageID(ctx context.Context, imageName string) (string, bool, error)
+	Inspect(ctx context.Context, imageName string) (ImageInfo, bool, error)
+	Platform(ctx context.Context) (Platform, error)
+}
+
+// ImageInfo is what the daemon knows about an image.
+type ImageInfo struct {
+	ID           string
+	RepoDigests  []string
+	LayerDigests []string
+	OS           string
+	Architecture string
+	Created      time.Time
+	// Size is an uncompressed size of the image.
+	Size int64
 }
 
 type ContainerCreated struct {
 	ImageID   string
 	ImageName string
+	// Platform of the image
+	Platform Platform
 }
 
 type Daemon struct {
@@ -55,7 +70,12 @@ func (w *Daemon) ListenContainerCreation(ctx context.Context) <-chan ContainerCr
 	resChan := make(chan ContainerCreated)
 	go func() {
 		for msg := range msgs {
-			imageName := msg.Actor.ID
+			imageName, err := NormalizeName(msg.Actor.ID)
+			if err != nil {
+				log.Warnf("image '%s' has an invalid reference, %s", msg.Actor.ID, err)
+
+				continue
+			}
 			log.Infof("Image '%s' has been used", imageName)
 			inspect, _, err := w.client.ImageInspectWithRaw(ctx, imageName)
 			if err != nil {
@@ -67,6 +87,7 @@ func (w *Daemon) ListenContainerCreation(ctx context.Context) <-chan ContainerCr
 			resChan <- ContainerCreated{
 				ImageID:   inspect.ID,
 				ImageName: imageName,
+				Platform:  Platform{OS: inspect.Os, Architecture: inspect.Architecture},
 			}
 		}
 		close(resChan)
@@ -108,17 +129,30 @@ func (w *Daemon) LoadDump(ctx context.Context, image io.Reader) error {
 	return nil
 }
 
-// ImageID returns ImageID, isFound and err.
-func (w *Daemon) ImageID(ctx context.Context, imageName string) (string, bool, error) {
+// Inspect returns ImageInfo, isFound and err.
+func (w *Daemon) Inspect(ctx context.Context, imageName string) (ImageInfo, bool, error) {
 	inspect, _, err := w.client.ImageInspectWithRaw(ctx, imageName)
 	if client.IsErrNotFound(err) {
-		return "", false, nil
+		return ImageInfo{}, false, nil
+	}
+	if err != nil {
+		return ImageInfo{}, false, fmt.Errorf("getting info from docker, %w", err)
 	}
+
+	created, err := time.Parse(time.RFC3339Nano, inspect.Created)
 	if err != nil {
-		return "", false, fmt.Errorf("getting info from docker, %w", err)
+		log.Warnf("image '%s' has invalid created time '%s'", imageName, inspect.Created)
 	}
 
-	return inspect.ID, true, nil
+	return ImageInfo{
+		ID:           inspect.ID,
+		RepoDigests:  inspect.RepoDigests,
+		LayerDigests: inspect.RootFS.Layers,
+		OS:           inspect.Os,
+		Architecture: inspect.Architecture,
+		Created:      created,
+		Size:         inspect.Size,
+	}, true, nil
 }
 
 func (w *Daemon) ContainsSameVersion(ctx context.Context, imageName, yourImageID string) (bool, error) {
@@ -0,0 +1,44 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Platform is where an image runs, in terms of the image config, e.g. linux/arm64.
+type Platform struct {
+	OS           string
+	Architecture string
+}
+
+func (p Platform) String() string {
+	return p.OS + "/" + p.Architecture
+}
+
+// Platform returns the platform of the daemon.
+func (w *Daemon) Platform(ctx context.Context) (Platform, error) {
+	info, err := w.client.Info(ctx)
+	if err != nil {
+		return Platform{}, fmt.Errorf("getting info from docker, %w", err)
+	}
+
+	return Platform{OS: info.OSType, Architecture: NormalizeArchitecture(info.Architecture)}, nil
+}
+
+// NormalizeArchitecture turns the machine name which the daemon reports, e.g. x86_64,
+// into the architecture of image configs, e.g. amd64.
+func NormalizeArchitecture(machine string) string {
+	switch machine = strings.ToLower(machine); {
+	case machine == "x86_64" || machine == "x86-64":
+		return "amd64"
+	case machine == "aarch64" || machine == "armv8l":
+		return "arm64"
+	case machine == "i386" || machine == "i686":
+		return "386"
+	case strings.HasPrefix(machine, "armv"):
+		return "arm"
+	default:
+		return machine
+	}
+}
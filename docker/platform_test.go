@@ -0,0 +1,22 @@
+package docker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeArchitecture(t *testing.T) {
+	cases := map[string]string{
+		"x86_64":  "amd64",
+		"aarch64": "arm64",
+		"armv7l":  "arm",
+		"i686":    "386",
+		"s390x":   "s390x",
+		"amd64":   "amd64",
+	}
+
+	for machine, expected := range cases {
+		require.Equal(t, expected, NormalizeArchitecture(machine), machine)
+	}
+}
@@ -0,0 +1,45 @@
+package docker
+
+import (
+	"github.com/docker/distribution/reference"
+)
+
+// NormalizeName turns an image reference into the cache key: the familiar form with an explicit tag,
+// e.g. docker.io/library/ubuntu -> ubuntu:latest. A digest wins over a tag like in the daemon,
+// so ubuntu:20.04@sha256:... -> ubuntu@sha256:...
+func NormalizeName(name string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return "", err
+	}
+
+	if canonical, ok := named.(reference.Canonical); ok {
+		named, err = reference.WithDigest(reference.TrimNamed(named), canonical.Digest())
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return reference.FamiliarString(reference.TagNameOnly(named)), nil
+}
+
+// NormalizeNameOrKeep is NormalizeName which keeps names that aren't valid references as they are.
+func NormalizeNameOrKeep(name string) string {
+	normalized, err := NormalizeName(name)
+	if err != nil {
+		return name
+	}
+
+	return normalized
+}
+
+// IsDigest reports whether the reference pins an image by its digest.
+func IsDigest(name string) bool {
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return false
+	}
+	_, ok := named.(reference.Canonical)
+
+	return ok
+}
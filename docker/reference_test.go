@@ -0,0 +1,41 @@
+package docker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const digest = "sha256:0000000000000000000000000000000000000000000000000000000000000001"
+
+func TestNormalizeName(t *testing.T) {
+	cases := []struct {
+		name, expected string
+	}{
+		{"ubuntu", "ubuntu:latest"},
+		{"ubuntu:latest", "ubuntu:latest"},
+		{"docker.io/library/ubuntu:latest", "ubuntu:latest"},
+		{"docker.io/foo/bar:1", "foo/bar:1"},
+		{"quay.io/foo/bar", "quay.io/foo/bar:latest"},
+		{"localhost:5000/bar:1", "localhost:5000/bar:1"},
+		{"ubuntu@" + digest, "ubuntu@" + digest},
+		{"docker.io/library/ubuntu:20.04@" + digest, "ubuntu@" + digest},
+	}
+
+	for _, tc := range cases {
+		normalized, err := NormalizeName(tc.name)
+		require.NoError(t, err, tc.name)
+		require.Equal(t, tc.expected, normalized, tc.name)
+	}
+
+	_, err := NormalizeName("Ubuntu")
+	require.Error(t, err)
+	require.Equal(t, "Ubuntu", NormalizeNameOrKeep("Ubuntu"))
+	require.Equal(t, "ubuntu:latest", NormalizeNameOrKeep("docker.io/library/ubuntu"))
+}
+
+func TestIsDigest(t *testing.T) {
+	require.True(t, IsDigest("ubuntu@"+digest))
+	require.False(t, IsDigest("ubuntu:latest"))
+	require.False(t, IsDigest("Ubuntu"))
+}
@@ -0,0 +1,259 @@
+package ingest
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/podtserkovskiy/garnerd/docker"
+	"github.com/podtserkovskiy/garnerd/storage"
+	"github.com/podtserkovskiy/garnerd/storage/image/compact"
+)
+
+const maxConfigSize = 4 << 20
+
+// manifestEntry is an image of manifest.json in the `docker save` format.
+type manifestEntry struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+type imageConfig struct {
+	OS           string    `json:"os"`
+	Architecture string    `json:"architecture"`
+	Created      time.Time `json:"created"`
+	RootFS       struct {
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// tarballImage is an image of a tarball, metas are its tags.
+type tarballImage struct {
+	entry manifestEntry
+	metas []storage.Meta
+}
+
+// tarball is a file in the `docker save` format, it may be compressed by gzip or zstd.
+type tarball string
+
+func (t tarball) open() (io.ReadCloser, error) {
+	file, err := os.Open(string(t))
+	if err != nil {
+		return nil, err
+	}
+
+	dec, err := compact.NewDecompressor(file)
+	if err != nil {
+		_ = file.Close()
+
+		return nil, err
+	}
+
+	return readCloser{Reader: dec, closers: []io.Closer{dec, file}}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r readCloser) Close() error {
+	var err error
+	for _, closer := range r.closers {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// walk calls f for every entry of the tarball until f returns false.
+func (t tarball) walk(f func(header *tar.Header, content io.Reader) (bool, error)) error {
+	src, err := t.open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tarReader := tar.NewReader(src)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		next, err := f(header, tarReader)
+		if err != nil || !next {
+			return err
+		}
+	}
+}
+
+// images reads manifest.json and configs of the tarball and builds a meta for every tag.
+func (t tarball) images() ([]tarballImage, error) {
+	var entries []manifestEntry
+	err := t.walk(func(header *tar.Header, content io.Reader) (bool, error) {
+		if path.Clean(header.Name) != "manifest.json" {
+			return true, nil
+		}
+
+		return false, json.NewDecoder(content).Decode(&entries)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest.json, %w", err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("manifest.json has no images") // nolint: goerr113
+	}
+
+	configs, sizes := map[string][]byte{}, map[string]int64{}
+	for _, entry := range entries {
+		configs[path.Clean(entry.Config)] = nil
+		for _, layer := range entry.Layers {
+			if path.Base(layer) != "layer.tar" || path.Dir(layer) == "." {
+				return nil, fmt.Errorf("layer '%s' is not in the `docker save` format", layer) // nolint: goerr113
+			}
+		}
+	}
+	err = t.walk(func(header *tar.Header, content io.Reader) (bool, error) {
+		name := path.Clean(header.Name)
+		sizes[name] = header.Size
+		if _, ok := configs[name]; ok {
+			data, err := ioutil.ReadAll(io.LimitReader(content, maxConfigSize+1))
+			if err == nil && len(data) > maxConfigSize {
+				err = fmt.Errorf("config '%s' is bigger than %d bytes", name, maxConfigSize) // nolint: goerr113
+			}
+			configs[name] = data
+
+			return true, err
+		}
+
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	images := make([]tarballImage, 0, len(entries))
+	for _, entry := range entries {
+		image, err := newTarballImage(entry, configs[path.Clean(entry.Config)], sizes)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, image)
+	}
+
+	return images, nil
+}
+
+func newTarballImage(entry manifestEntry, configData []byte, sizes map[string]int64) (tarballImage, error) {
+	if configData == nil {
+		return tarballImage{}, fmt.Errorf("config '%s' is missing", entry.Config) // nolint: goerr113
+	}
+	if len(entry.RepoTags) == 0 {
+		return tarballImage{}, fmt.Errorf("image '%s' has no tags", entry.Config) // nolint: goerr113
+	}
+
+	var config imageConfig
+	if err := json.Unmarshal(configData, &config); err != nil {
+		return tarballImage{}, fmt.Errorf("decoding config '%s', %w", entry.Config, err)
+	}
+
+	sum := sha256.Sum256(configData)
+	meta := storage.Meta{
+		ImageID:      "sha256:" + hex.EncodeToString(sum[:]),
+		LayerDigests: config.RootFS.DiffIDs,
+		OS:           config.OS,
+		Architecture: config.Architecture,
+		Created:      config.Created,
+	}
+	for _, layer := range entry.Layers {
+		meta.Size += sizes[path.Clean(layer)]
+	}
+
+	image := tarballImage{entry: entry}
+	for _, tag := range entry.RepoTags {
+		imageName, err := docker.NormalizeName(tag)
+		if err != nil {
+			return tarballImage{}, fmt.Errorf("tag '%s', %w", tag, err)
+		}
+		meta.ImageName = imageName
+		image.metas = append(image.metas, meta)
+	}
+
+	return image, nil
+}
+
+// writeImage writes a tarball of only the image, the other images of the tarball are left out.
+func (t tarball) writeImage(dst io.Writer, entry manifestEntry) error {
+	layerDirs := map[string]bool{}
+	for _, layer := range entry.Layers {
+		layerDirs[path.Dir(path.Clean(layer))] = false
+	}
+
+	tarWriter := tar.NewWriter(dst)
+	err := t.walk(func(header *tar.Header, content io.Reader) (bool, error) {
+		name := path.Clean(header.Name)
+		dir, isLayerDir := layerDirs[name]
+		switch {
+		case isLayerDir && header.FileInfo().IsDir():
+			if dir {
+				return true, nil
+			}
+			layerDirs[name] = true
+		case isLayerFile(layerDirs, name):
+			// the image store takes files after a dir entry for files of a layer
+			if !layerDirs[path.Dir(name)] {
+				layerDirs[path.Dir(name)] = true
+				dirHeader := &tar.Header{Name: path.Dir(name) + "/", Mode: 0755, Typeflag: tar.TypeDir}
+				if err := tarWriter.WriteHeader(dirHeader); err != nil {
+					return false, err
+				}
+			}
+		case name == path.Clean(entry.Config):
+		default:
+			return true, nil
+		}
+
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return false, err
+		}
+		_, err := io.Copy(tarWriter, content) // nolint: gosec
+
+		return true, err
+	})
+	if err != nil {
+		return err
+	}
+
+	manifest, err := json.Marshal([]manifestEntry{entry})
+	if err != nil {
+		return err
+	}
+	if err = tarWriter.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0644, Size: int64(len(manifest))}); err != nil {
+		return err
+	}
+	if _, err = tarWriter.Write(manifest); err != nil {
+		return err
+	}
+
+	return tarWriter.Close()
+}
+
+func isLayerFile(layerDirs map[string]bool, name string) bool {
+	_, ok := layerDirs[path.Dir(name)]
+
+	return ok
+}
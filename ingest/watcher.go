@@ -0,0 +1,257 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+)
+
+const (
+	// ProcessedDir and FailedDir are subdirs of the drop dir which tarballs are moved to,
+	// a failed tarball has its error next to it in a file with ErrorSuffix.
+	ProcessedDir = "processed"
+	FailedDir    = "failed"
+	ErrorSuffix  = ".error"
+
+	defaultInterval = 5 * time.Second
+)
+
+// Storage caches ingested images.
+type Storage interface {
+	Save(meta storage.Meta, imageDump io.Reader) error
+	SaveTag(meta storage.Meta) error
+}
+
+// Loader loads ingested tarballs into the daemon.
+type Loader interface {
+	LoadDump(ctx context.Context, image io.Reader) error
+}
+
+// Watcher caches images of `docker save` tarballs dropped into a dir.
+// The dir is polled and a tarball is ingested once its size and modification time stop changing,
+// so a tarball which is still being copied is not touched. Hidden files are ignored.
+type Watcher struct {
+	dir        string
+	storage    Storage
+	loader     Loader
+	interval   time.Duration
+	onIngested func(meta storage.Meta)
+
+	// seen are files of the previous poll
+	seen map[string]fileState
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+type Option func(*Watcher)
+
+// WithLoader loads ingested tarballs into the daemon too.
+func WithLoader(loader Loader) Option {
+	return func(w *Watcher) {
+		w.loader = loader
+	}
+}
+
+// WithInterval sets how often the dir is polled.
+func WithInterval(interval time.Duration) Option {
+	return func(w *Watcher) {
+		w.interval = interval
+	}
+}
+
+// WithOnIngested calls f for every tag of an ingested image.
+func WithOnIngested(f func(meta storage.Meta)) Option {
+	return func(w *Watcher) {
+		w.onIngested = f
+	}
+}
+
+func NewWatcher(dir string, store Storage, opts ...Option) *Watcher {
+	w := &Watcher{
+		dir:        dir,
+		storage:    store,
+		interval:   defaultInterval,
+		onIngested: func(storage.Meta) {},
+		seen:       map[string]fileState{},
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+
+	return w
+}
+
+// Run polls the dir until ctx is done.
+func (w *Watcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.poll(ctx); err != nil {
+			log.Warnf("Polling '%s', %s", w.dir, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll ingests tarballs which haven't changed since the previous poll.
+func (w *Watcher) poll(ctx context.Context) error {
+	files, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]fileState{}
+	for _, file := range files {
+		if !file.Mode().IsRegular() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+
+		state := fileState{size: file.Size(), modTime: file.ModTime()}
+		if prev, ok := w.seen[file.Name()]; !ok || prev != state {
+			seen[file.Name()] = state
+
+			continue
+		}
+
+		w.ingestFile(ctx, file.Name())
+	}
+	w.seen = seen
+
+	return nil
+}
+
+// ingestFile caches images of the tarball and moves it aside.
+func (w *Watcher) ingestFile(ctx context.Context, name string) {
+	log.Infof("Ingesting '%s'", name)
+	err := w.ingest(ctx, tarball(filepath.Join(w.dir, name)))
+	if err != nil {
+		log.Warnf("Ingesting '%s', %s", name, err)
+		if moveErr := w.moveAside(name, FailedDir, err); moveErr != nil {
+			log.Errorf("Moving '%s' to %s, %s", name, FailedDir, moveErr)
+		}
+
+		return
+	}
+
+	if err = w.moveAside(name, ProcessedDir, nil); err != nil {
+		log.Errorf("Moving '%s' to %s, %s", name, ProcessedDir, err)
+	}
+}
+
+func (w *Watcher) ingest(ctx context.Context, src tarball) error {
+	images, err := src.images()
+	if err != nil {
+		return err
+	}
+
+	for _, image := range images {
+		if err = w.saveImage(src, image); err != nil {
+			return fmt.Errorf("caching '%s', %w", image.metas[0].ImageName, err)
+		}
+	}
+
+	if w.loader == nil {
+		return nil
+	}
+
+	dump, err := src.open()
+	if err != nil {
+		return err
+	}
+	defer dump.Close()
+
+	if err = w.loader.LoadDump(ctx, dump); err != nil {
+		return fmt.Errorf("loading into the daemon, %w", err)
+	}
+
+	return nil
+}
+
+// saveImage saves the image with its first tag and adds the others, a stored image gets only the tags.
+func (w *Watcher) saveImage(src tarball, image tarballImage) error {
+	for _, meta := range image.metas {
+		err := w.storage.SaveTag(meta)
+		if errors.Is(err, storage.ErrNotFound) {
+			pipeReader, pipeWriter := io.Pipe()
+			go func() {
+				_ = pipeWriter.CloseWithError(src.writeImage(pipeWriter, image.entry))
+			}()
+			err = w.storage.Save(meta, pipeReader)
+			_ = pipeReader.CloseWithError(err)
+		}
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Image '%s' has been ingested", meta.ImageName)
+		w.onIngested(meta)
+	}
+
+	return nil
+}
+
+// moveAside moves the file to the subdir, the error is written next to it.
+func (w *Watcher) moveAside(name, subdir string, ingestErr error) error {
+	dir := filepath.Join(w.dir, subdir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	asideName := freeName(dir, name, time.Now())
+	if ingestErr != nil {
+		if err := ioutil.WriteFile(filepath.Join(dir, asideName+ErrorSuffix), []byte(ingestErr.Error()+"\n"), 0600); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(filepath.Join(w.dir, name), filepath.Join(dir, asideName))
+}
+
+// freeName returns the name unless an earlier tarball or its error took it,
+// otherwise the name gets a timestamp suffix before its extensions, like images-20201001T120000.tar.gz.
+func freeName(dir, name string, now time.Time) string {
+	base, ext := name, ""
+	if n := strings.Index(name, "."); n > 0 {
+		base, ext = name[:n], name[n:]
+	}
+
+	candidate := name
+	for n := 0; isTaken(filepath.Join(dir, candidate)); n++ {
+		suffix := now.Format("20060102T150405")
+		if n > 0 {
+			suffix += fmt.Sprintf("-%d", n)
+		}
+		candidate = base + "-" + suffix + ext
+	}
+
+	return candidate
+}
+
+func isTaken(path string) bool {
+	for _, taken := range []string{path, path + ErrorSuffix} {
+		if _, err := os.Lstat(taken); !os.IsNotExist(err) {
+			return true
+		}
+	}
+
+	return false
+}
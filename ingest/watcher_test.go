@@ -0,0 +1,269 @@
+package ingest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+	"github.com/podtserkovskiy/garnerd/storage/image/compact"
+	"github.com/podtserkovskiy/garnerd/storage/meta/mem"
+	"github.com/podtserkovskiy/garnerd/storage/separated"
+)
+
+func setUpTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	return dir
+}
+
+type testImage struct {
+	tags   []string
+	layers []string
+}
+
+// makeTarball writes images in the `docker save` format, layers with the same content are shared.
+func makeTarball(t *testing.T, images ...testImage) ([]byte, []string) {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	writeFile := func(name string, data []byte) {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}))
+		_, err := tw.Write(data)
+		require.NoError(t, err)
+	}
+
+	entries, imageIDs, written := []manifestEntry{}, []string{}, map[string]bool{}
+	for _, image := range images {
+		entry := manifestEntry{RepoTags: image.tags}
+		diffIDs := []string{}
+		for _, layer := range image.layers {
+			sum := sha256.Sum256([]byte(layer))
+			dir := hex.EncodeToString(sum[:])
+			diffIDs = append(diffIDs, "sha256:"+dir)
+			entry.Layers = append(entry.Layers, dir+"/layer.tar")
+			if written[dir] {
+				continue
+			}
+			written[dir] = true
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: dir + "/", Mode: 0755, Typeflag: tar.TypeDir}))
+			writeFile(dir+"/VERSION", []byte("1.0"))
+			writeFile(dir+"/layer.tar", []byte(layer))
+		}
+
+		config, err := json.Marshal(map[string]interface{}{
+			"os": "linux", "architecture": "arm64", "created": "2020-09-01T10:00:00Z",
+			"rootfs": map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+		})
+		require.NoError(t, err)
+		sum := sha256.Sum256(config)
+		entry.Config = hex.EncodeToString(sum[:]) + ".json"
+		writeFile(entry.Config, config)
+		entries = append(entries, entry)
+		imageIDs = append(imageIDs, "sha256:"+hex.EncodeToString(sum[:]))
+	}
+
+	manifest, err := json.Marshal(entries)
+	require.NoError(t, err)
+	writeFile("manifest.json", manifest)
+	writeFile("repositories", []byte("{}"))
+	require.NoError(t, tw.Close())
+
+	return buf.Bytes(), imageIDs
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	_, err := gw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	return buf.Bytes()
+}
+
+// readFiles returns contents of regular files of the dump.
+func readFiles(t *testing.T, dump io.Reader) map[string]string {
+	files := map[string]string{}
+	tr := tar.NewReader(dump)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		require.NoError(t, err)
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		content, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		files[header.Name] = string(content)
+	}
+}
+
+type loaderStub struct {
+	loaded [][]byte
+}
+
+func (l *loaderStub) LoadDump(_ context.Context, image io.Reader) error {
+	data, err := ioutil.ReadAll(image)
+	l.loaded = append(l.loaded, data)
+
+	return err
+}
+
+func TestWatcher(t *testing.T) {
+	ctx := context.Background()
+	newWatcher := func(t *testing.T, opts ...Option) (*Watcher, *separated.Storage, string) {
+		dir := setUpTempDir(t)
+		store := separated.NewStorage(mem.NewMetaCRUD(), compact.NewImgStorage(filepath.Join(dir, "images")))
+		dropDir := filepath.Join(dir, "drop")
+		require.NoError(t, os.Mkdir(dropDir, os.ModePerm))
+
+		return NewWatcher(dropDir, store, opts...), store, dropDir
+	}
+
+	t.Run("images of a tarball are cached", func(t *testing.T) {
+		ingested := []string{}
+		loader := &loaderStub{}
+		watcher, store, dropDir := newWatcher(t, WithLoader(loader), WithOnIngested(func(meta storage.Meta) {
+			ingested = append(ingested, meta.ImageName)
+		}))
+		data, imageIDs := makeTarball(t,
+			testImage{tags: []string{"alpine:3", "docker.io/library/alpine:latest"}, layers: []string{"base"}},
+			testImage{tags: []string{"app:1"}, layers: []string{"base", "app"}},
+		)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dropDir, "images.tar.gz"), gzipped(t, data), 0600))
+
+		require.NoError(t, watcher.poll(ctx))
+		require.Empty(t, ingested, "a new file may be still being copied")
+		require.NoError(t, watcher.poll(ctx))
+		require.Equal(t, []string{"alpine:3", "alpine:latest", "app:1"}, ingested)
+
+		meta, err := store.GetMeta(storage.Key("app:1", "linux", "arm64"))
+		require.NoError(t, err)
+		require.Equal(t, imageIDs[1], meta.ImageID)
+		require.Equal(t, int64(len("base")+len("app")), meta.Size)
+		require.Len(t, meta.LayerDigests, 2)
+		require.Equal(t, 2020, meta.Created.Year())
+
+		dump, err := store.Load(storage.Key("alpine:latest", "linux", "arm64"))
+		require.NoError(t, err)
+		files := readFiles(t, dump)
+		require.NoError(t, dump.Close())
+		require.Contains(t, files, imageIDs[0][len("sha256:"):]+".json")
+		require.NotContains(t, files, imageIDs[1][len("sha256:"):]+".json", "other images are left out")
+
+		require.Equal(t, [][]byte{data}, loader.loaded)
+		require.FileExists(t, filepath.Join(dropDir, ProcessedDir, "images.tar.gz"))
+		require.NoFileExists(t, filepath.Join(dropDir, "images.tar.gz"))
+	})
+
+	t.Run("failure is recorded next to the tarball", func(t *testing.T) {
+		watcher, _, dropDir := newWatcher(t)
+		data, _ := makeTarball(t, testImage{layers: []string{"base"}})
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dropDir, "untagged.tar"), data, 0600))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dropDir, ".partial.tar"), data, 0600))
+
+		require.NoError(t, watcher.poll(ctx))
+		require.NoError(t, watcher.poll(ctx))
+
+		require.FileExists(t, filepath.Join(dropDir, FailedDir, "untagged.tar"))
+		message, err := ioutil.ReadFile(filepath.Join(dropDir, FailedDir, "untagged.tar"+ErrorSuffix))
+		require.NoError(t, err)
+		require.Contains(t, string(message), "has no tags")
+		require.FileExists(t, filepath.Join(dropDir, ".partial.tar"), "hidden files are ignored")
+	})
+
+	t.Run("earlier tarballs of the same name are kept", func(t *testing.T) {
+		watcher, _, dropDir := newWatcher(t)
+		data, _ := makeTarball(t, testImage{layers: []string{"base"}})
+		for n := 0; n < 2; n++ {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(dropDir, "untagged.tar"), data, 0600))
+			require.NoError(t, watcher.poll(ctx))
+			require.NoError(t, watcher.poll(ctx))
+		}
+
+		failed, err := ioutil.ReadDir(filepath.Join(dropDir, FailedDir))
+		require.NoError(t, err)
+		require.Len(t, failed, 4, "both tarballs have their errors")
+	})
+
+	t.Run("growing file waits", func(t *testing.T) {
+		watcher, _, dropDir := newWatcher(t)
+		data, _ := makeTarball(t, testImage{tags: []string{"alpine:3"}, layers: []string{"base"}})
+		path := filepath.Join(dropDir, "alpine.tar")
+		require.NoError(t, ioutil.WriteFile(path, data[:len(data)/2], 0600))
+		require.NoError(t, watcher.poll(ctx))
+
+		require.NoError(t, ioutil.WriteFile(path, data, 0600))
+		require.NoError(t, watcher.poll(ctx))
+		require.FileExists(t, path)
+
+		require.NoError(t, watcher.poll(ctx))
+		require.FileExists(t, filepath.Join(dropDir, ProcessedDir, "alpine.tar"))
+		require.NoDirExists(t, filepath.Join(dropDir, FailedDir))
+	})
+
+	t.Run("an oversized config is refused", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		for name, data := range map[string][]byte{
+			"manifest.json": []byte(`[{"Config":"config.json","RepoTags":["a:1"],"Layers":[]}]`),
+			"config.json":   bytes.Repeat([]byte(" "), maxConfigSize+1),
+		} {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}))
+			_, err := tw.Write(data)
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+		path := filepath.Join(setUpTempDir(t), "big.tar")
+		require.NoError(t, ioutil.WriteFile(path, buf.Bytes(), 0600))
+
+		_, err := tarball(path).images()
+		require.EqualError(t, err, fmt.Sprintf("config 'config.json' is bigger than %d bytes", maxConfigSize))
+	})
+
+	t.Run("only the image's files are written", func(t *testing.T) {
+		data, _ := makeTarball(t, testImage{tags: []string{"a:1"}, layers: []string{"x"}}, testImage{tags: []string{"b:1"}, layers: []string{"y"}})
+		path := filepath.Join(setUpTempDir(t), "images.tar")
+		require.NoError(t, ioutil.WriteFile(path, data, 0600))
+
+		images, err := tarball(path).images()
+		require.NoError(t, err)
+		require.Len(t, images, 2)
+		buf := &bytes.Buffer{}
+		require.NoError(t, tarball(path).writeImage(buf, images[1].entry))
+
+		files := readFiles(t, buf)
+		require.Len(t, files, 4, fmt.Sprint(files))
+		require.Contains(t, files, images[1].entry.Layers[0])
+		require.Contains(t, files, images[1].entry.Config)
+	})
+}
+
+func TestFreeName(t *testing.T) {
+	dir := setUpTempDir(t)
+	now := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	require.Equal(t, "images.tar.gz", freeName(dir, "images.tar.gz", now))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "images.tar.gz"+ErrorSuffix), nil, 0600))
+	require.Equal(t, "images-20201001T120000.tar.gz", freeName(dir, "images.tar.gz", now))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "images-20201001T120000.tar.gz"), nil, 0600))
+	require.Equal(t, "images-20201001T120000-1.tar.gz", freeName(dir, "images.tar.gz", now))
+}
@@ -19,6 +19,34 @@ func (_m *Cache) AddSilent(imageName string, imageID string) {
 	_m.Called(imageName, imageID)
 }
 
+// EvictOldest provides a mock function with given fields:
+func (_m *Cache) EvictOldest() bool {
+	ret := _m.Called()
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func() bool); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	return r0
+}
+
+// Len provides a mock function with given fields:
+func (_m *Cache) Len() int {
+	ret := _m.Called()
+
+	var r0 int
+	if rf, ok := ret.Get(0).(func() int); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(int)
+	}
+
+	return r0
+}
+
 // OnAdd provides a mock function with given fields: _a0
 func (_m *Cache) OnAdd(_a0 func(string, string)) {
 	_m.Called(_a0)
@@ -37,15 +37,15 @@ func (_m *Docker) ContainsSameVersion(ctx context.Context, yourImageID string, i
 	return r0, r1
 }
 
-// ImageID provides a mock function with given fields: ctx, imageName
-func (_m *Docker) ImageID(ctx context.Context, imageName string) (string, bool, error) {
+// Inspect provides a mock function with given fields: ctx, imageName
+func (_m *Docker) Inspect(ctx context.Context, imageName string) (docker.ImageInfo, bool, error) {
 	ret := _m.Called(ctx, imageName)
 
-	var r0 string
-	if rf, ok := ret.Get(0).(func(context.Context, string) string); ok {
+	var r0 docker.ImageInfo
+	if rf, ok := ret.Get(0).(func(context.Context, string) docker.ImageInfo); ok {
 		r0 = rf(ctx, imageName)
 	} else {
-		r0 = ret.Get(0).(string)
+		r0 = ret.Get(0).(docker.ImageInfo)
 	}
 
 	var r1 bool
@@ -95,6 +95,27 @@ func (_m *Docker) LoadDump(ctx context.Context, image io.Reader) error {
 	return r0
 }
 
+// Platform provides a mock function with given fields: ctx
+func (_m *Docker) Platform(ctx context.Context) (docker.Platform, error) {
+	ret := _m.Called(ctx)
+
+	var r0 docker.Platform
+	if rf, ok := ret.Get(0).(func(context.Context) docker.Platform); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Get(0).(docker.Platform)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // SaveDump provides a mock function with given fields: ctx, name
 func (_m *Docker) SaveDump(ctx context.Context, name string) (io.ReadCloser, error) {
 	ret := _m.Called(ctx, name)
@@ -37,20 +37,20 @@ func (_m *Storage) GetAllMeta() ([]storage.Meta, error) {
 	return r0, r1
 }
 
-// GetMeta provides a mock function with given fields: imageName
-func (_m *Storage) GetMeta(imageName string) (storage.Meta, error) {
-	ret := _m.Called(imageName)
+// GetMeta provides a mock function with given fields: key
+func (_m *Storage) GetMeta(key string) (storage.Meta, error) {
+	ret := _m.Called(key)
 
 	var r0 storage.Meta
 	if rf, ok := ret.Get(0).(func(string) storage.Meta); ok {
-		r0 = rf(imageName)
+		r0 = rf(key)
 	} else {
 		r0 = ret.Get(0).(storage.Meta)
 	}
 
 	var r1 error
 	if rf, ok := ret.Get(1).(func(string) error); ok {
-		r1 = rf(imageName)
+		r1 = rf(key)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -58,13 +58,13 @@ func (_m *Storage) GetMeta(imageName string) (storage.Meta, error) {
 	return r0, r1
 }
 
-// Load provides a mock function with given fields: imageName
-func (_m *Storage) Load(imageName string) (io.ReadCloser, error) {
-	ret := _m.Called(imageName)
+// Load provides a mock function with given fields: key
+func (_m *Storage) Load(key string) (io.ReadCloser, error) {
+	ret := _m.Called(key)
 
 	var r0 io.ReadCloser
 	if rf, ok := ret.Get(0).(func(string) io.ReadCloser); ok {
-		r0 = rf(imageName)
+		r0 = rf(key)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(io.ReadCloser)
@@ -73,7 +73,7 @@ func (_m *Storage) Load(imageName string) (io.ReadCloser, error) {
 
 	var r1 error
 	if rf, ok := ret.Get(1).(func(string) error); ok {
-		r1 = rf(imageName)
+		r1 = rf(key)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -81,13 +81,13 @@ func (_m *Storage) Load(imageName string) (io.ReadCloser, error) {
 	return r0, r1
 }
 
-// Remove provides a mock function with given fields: imageName
-func (_m *Storage) Remove(imageName string) error {
-	ret := _m.Called(imageName)
+// MarkRestored provides a mock function with given fields: key
+func (_m *Storage) MarkRestored(key string) error {
+	ret := _m.Called(key)
 
 	var r0 error
 	if rf, ok := ret.Get(0).(func(string) error); ok {
-		r0 = rf(imageName)
+		r0 = rf(key)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -95,13 +95,55 @@ func (_m *Storage) Remove(imageName string) error {
 	return r0
 }
 
-// Save provides a mock function with given fields: imageName, imageID, imageDump
-func (_m *Storage) Save(imageName string, imageID string, imageDump io.Reader) error {
-	ret := _m.Called(imageName, imageID, imageDump)
+// MarkUsed provides a mock function with given fields: key
+func (_m *Storage) MarkUsed(key string) error {
+	ret := _m.Called(key)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string, string, io.Reader) error); ok {
-		r0 = rf(imageName, imageID, imageDump)
+	if rf, ok := ret.Get(0).(func(string) error); ok {
+		r0 = rf(key)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// Remove provides a mock function with given fields: key
+func (_m *Storage) Remove(key string) error {
+	ret := _m.Called(key)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string) error); ok {
+		r0 = rf(key)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// Save provides a mock function with given fields: meta, imageDump
+func (_m *Storage) Save(meta storage.Meta, imageDump io.Reader) error {
+	ret := _m.Called(meta, imageDump)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(storage.Meta, io.Reader) error); ok {
+		r0 = rf(meta, imageDump)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// SaveTag provides a mock function with given fields: meta
+func (_m *Storage) SaveTag(meta storage.Meta) error {
+	ret := _m.Called(meta)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(storage.Meta) error); ok {
+		r0 = rf(meta)
 	} else {
 		r0 = ret.Error(0)
 	}
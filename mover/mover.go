@@ -2,6 +2,7 @@ package mover
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	log "github.com/sirupsen/logrus"
@@ -20,22 +21,42 @@ func NewMover(storage storage.Storage, docker docker.Docker) *Mover {
 }
 
 func (m *Mover) FromDockerToStorage(ctx context.Context, imageName string) error {
-	imageID, found, err := m.docker.ImageID(ctx, imageName)
+	info, found, err := m.docker.Inspect(ctx, imageName)
 	if err != nil {
-		return fmt.Errorf("getting imageId, %w", err)
+		return fmt.Errorf("inspecting, %w", err)
 	}
 
 	if !found {
 		return fmt.Errorf("image has not been found in docker") // nolint: goerr113
 	}
 
+	meta := storage.Meta{
+		ImageName:    imageName,
+		ImageID:      info.ID,
+		Size:         info.Size,
+		LayerDigests: info.LayerDigests,
+		RepoDigests:  info.RepoDigests,
+		OS:           info.OS,
+		Architecture: info.Architecture,
+		Created:      info.Created,
+	}
+
+	// another tag of a stored image doesn't need a dump
+	err = m.storage.SaveTag(meta)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("saving tag, %w", err)
+	}
+
 	dump, err := m.docker.SaveDump(ctx, imageName)
 	if err != nil {
 		return fmt.Errorf("dumping, %w", err)
 	}
 	defer dump.Close()
 
-	err = m.storage.Save(imageName, imageID, dump)
+	err = m.storage.Save(meta, dump)
 	if err != nil {
 		return fmt.Errorf("saving, %w", err)
 	}
@@ -43,13 +64,21 @@ func (m *Mover) FromDockerToStorage(ctx context.Context, imageName string) error
 	return nil
 }
 
-func (m *Mover) FromStorageToDocker(ctx context.Context, imageName string) error {
-	meta, err := m.storage.GetMeta(imageName)
+// FromStorageToDocker restores the image by Meta.Key().
+// docker load can't recreate a digest reference and the daemon refuses to tag with one, so an image pinned by digest
+// is loaded by its ImageID with its other tags. A pull of the digest then finds its config and layers in the daemon,
+// it fetches only the manifest, which the registry of garnerd serves too, and records the digest reference.
+func (m *Mover) FromStorageToDocker(ctx context.Context, key string) error {
+	meta, err := m.storage.GetMeta(key)
 	if err != nil {
-		return fmt.Errorf("getting meta '%s' from storage, %w", imageName, err)
+		return fmt.Errorf("getting meta '%s' from storage, %w", key, err)
 	}
 
-	isSame, err := m.docker.ContainsSameVersion(ctx, meta.ImageName, meta.ImageID)
+	ref := meta.ImageName
+	if docker.IsDigest(ref) {
+		ref = meta.ImageID
+	}
+	isSame, err := m.docker.ContainsSameVersion(ctx, ref, meta.ImageID)
 	if err != nil {
 		return fmt.Errorf("checking '%s' in the daemon, %w", meta.ImageName, err)
 	}
@@ -60,7 +89,7 @@ func (m *Mover) FromStorageToDocker(ctx context.Context, imageName string) error
 		return nil
 	}
 
-	dump, err := m.storage.Load(meta.ImageName)
+	dump, err := m.storage.Load(key)
 	if err != nil {
 		return fmt.Errorf("loading '%s' from storage, %w", meta.ImageName, err)
 	}
@@ -71,6 +100,10 @@ func (m *Mover) FromStorageToDocker(ctx context.Context, imageName string) error
 		return fmt.Errorf("loading '%s' into daemon, %w", meta.ImageName, err)
 	}
 
+	if err = m.storage.MarkRestored(key); err != nil {
+		log.Warnf("recording restore of '%s', %s", meta.ImageName, err)
+	}
+
 	log.Infof("image '%s' has been successfully loaded", meta.ImageName)
 
 	return nil
@@ -7,10 +7,12 @@ import (
 	"errors"
 	"io/ioutil"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 
+	"github.com/podtserkovskiy/garnerd/docker"
 	"github.com/podtserkovskiy/garnerd/mocks"
 	"github.com/podtserkovskiy/garnerd/storage"
 )
@@ -21,26 +23,52 @@ func NewTestData() (*Mover, *mocks.Storage, *mocks.Docker, context.Context) {
 	return NewMover(storage, docker), storage, docker, context.Background()
 }
 
+func imageInfo() docker.ImageInfo {
+	return docker.ImageInfo{
+		ID:           "id-a1",
+		RepoDigests:  []string{"img-a@sha256:aaaa"},
+		LayerDigests: []string{"sha256:1111"},
+		OS:           "linux",
+		Architecture: "amd64",
+		Created:      time.Unix(23, 0),
+		Size:         42,
+	}
+}
+
+func expectedMeta() storage.Meta {
+	return storage.Meta{
+		ImageName:    "img-a",
+		ImageID:      "id-a1",
+		Size:         42,
+		LayerDigests: []string{"sha256:1111"},
+		RepoDigests:  []string{"img-a@sha256:aaaa"},
+		OS:           "linux",
+		Architecture: "amd64",
+		Created:      time.Unix(23, 0),
+	}
+}
+
 func TestMover_FromDockerToStorage(t *testing.T) {
 	t.Run("returns an error when docker.ImageID returns an error", func(t *testing.T) {
 		mover, _, dm, ctx := NewTestData()
-		dm.On("ImageID", ctx, "img-a").Return("", false, errors.New("docker error"))
+		dm.On("Inspect", ctx, "img-a").Return(docker.ImageInfo{}, false, errors.New("docker error"))
 
 		err := mover.FromDockerToStorage(ctx, "img-a")
-		require.EqualError(t, err, "getting imageId, docker error")
+		require.EqualError(t, err, "inspecting, docker error")
 	})
 
 	t.Run("returns an error when docker image has not been found in docker", func(t *testing.T) {
 		mover, _, dm, ctx := NewTestData()
-		dm.On("ImageID", ctx, "img-a").Return("", false, nil)
+		dm.On("Inspect", ctx, "img-a").Return(docker.ImageInfo{}, false, nil)
 
 		err := mover.FromDockerToStorage(ctx, "img-a")
 		require.EqualError(t, err, "image has not been found in docker")
 	})
 
 	t.Run("returns an error when docker.SaveDump returns an error", func(t *testing.T) {
-		mover, _, dm, ctx := NewTestData()
-		dm.On("ImageID", ctx, "img-a").Return("id-a1", true, nil)
+		mover, sm, dm, ctx := NewTestData()
+		dm.On("Inspect", ctx, "img-a").Return(imageInfo(), true, nil)
+		sm.On("SaveTag", expectedMeta()).Return(storage.ErrNotFound)
 		dm.On("SaveDump", ctx, "img-a").Return(nil, errors.New("docker error"))
 
 		err := mover.FromDockerToStorage(ctx, "img-a")
@@ -49,10 +77,11 @@ func TestMover_FromDockerToStorage(t *testing.T) {
 
 	t.Run("returns an error when storage.Save returns an error", func(t *testing.T) {
 		mover, sm, dm, ctx := NewTestData()
-		dm.On("ImageID", ctx, "img-a").Return("id-a1", true, nil)
+		dm.On("Inspect", ctx, "img-a").Return(imageInfo(), true, nil)
+		sm.On("SaveTag", expectedMeta()).Return(storage.ErrNotFound)
 		file := ioutil.NopCloser(bytes.NewBufferString("aaa"))
 		dm.On("SaveDump", ctx, "img-a").Return(file, nil)
-		sm.On("Save", "img-a", "id-a1", mock.Anything).Return(errors.New("storage error"))
+		sm.On("Save", expectedMeta(), mock.Anything).Return(errors.New("storage error"))
 
 		err := mover.FromDockerToStorage(ctx, "img-a")
 		require.EqualError(t, err, "saving, storage error")
@@ -60,13 +89,33 @@ func TestMover_FromDockerToStorage(t *testing.T) {
 
 	t.Run("success", func(t *testing.T) {
 		mover, sm, dm, ctx := NewTestData()
-		dm.On("ImageID", ctx, "img-a").Return("id-a1", true, nil)
+		dm.On("Inspect", ctx, "img-a").Return(imageInfo(), true, nil)
+		sm.On("SaveTag", expectedMeta()).Return(storage.ErrNotFound)
 		file := ioutil.NopCloser(bytes.NewBufferString("aaa"))
 		dm.On("SaveDump", ctx, "img-a").Return(file, nil)
-		sm.On("Save", "img-a", "id-a1", mock.Anything).Return(nil)
+		sm.On("Save", expectedMeta(), mock.Anything).Return(nil)
+
+		err := mover.FromDockerToStorage(ctx, "img-a")
+		require.NoError(t, err)
+	})
+
+	t.Run("another tag of a stored image is saved without a dump", func(t *testing.T) {
+		mover, sm, dm, ctx := NewTestData()
+		dm.On("Inspect", ctx, "img-a").Return(imageInfo(), true, nil)
+		sm.On("SaveTag", expectedMeta()).Return(nil)
 
 		err := mover.FromDockerToStorage(ctx, "img-a")
 		require.NoError(t, err)
+		dm.AssertNotCalled(t, "SaveDump", ctx, "img-a")
+	})
+
+	t.Run("returns an error when storage.SaveTag returns an error", func(t *testing.T) {
+		mover, sm, dm, ctx := NewTestData()
+		dm.On("Inspect", ctx, "img-a").Return(imageInfo(), true, nil)
+		sm.On("SaveTag", expectedMeta()).Return(errors.New("storage error"))
+
+		err := mover.FromDockerToStorage(ctx, "img-a")
+		require.EqualError(t, err, "saving tag, storage error")
 	})
 }
 
@@ -97,6 +146,20 @@ func TestMover_FromStorageToDocker(t *testing.T) {
 		require.NoError(t, err, "checking 'img-a' in the daemon, docker error")
 	})
 
+	t.Run("digest-pinned image is restored by its ImageID", func(t *testing.T) {
+		mover, sm, dm, ctx := NewTestData()
+		name := "img-a@sha256:0000000000000000000000000000000000000000000000000000000000000001"
+		sm.On("GetMeta", name).Return(storage.Meta{ImageName: name, ImageID: "sha256:a1"}, nil)
+		dm.On("ContainsSameVersion", ctx, "sha256:a1", "sha256:a1").Return(false, nil)
+		sm.On("Load", name).Return(ioutil.NopCloser(bytes.NewBufferString("aaa")), nil)
+		dm.On("LoadDump", ctx, mock.Anything).Return(nil)
+		sm.On("MarkRestored", name).Return(nil)
+
+		require.NoError(t, mover.FromStorageToDocker(ctx, name))
+		dm.AssertExpectations(t)
+		sm.AssertExpectations(t)
+	})
+
 	t.Run("returns an error when storage.Load returns an error", func(t *testing.T) {
 		mover, sm, dm, ctx := NewTestData()
 		sm.On("GetMeta", "img-a").Return(storage.Meta{ImageName: "img-a", ImageID: "img-a1"}, nil)
@@ -126,8 +189,10 @@ func TestMover_FromStorageToDocker(t *testing.T) {
 		file := ioutil.NopCloser(bytes.NewBufferString("aaa"))
 		sm.On("Load", "img-a").Return(file, nil)
 		dm.On("LoadDump", ctx, mock.Anything).Return(nil)
+		sm.On("MarkRestored", "img-a").Return(nil).Once()
 
 		err := mover.FromStorageToDocker(ctx, "img-a")
 		require.NoError(t, err)
+		sm.AssertExpectations(t)
 	})
 }
@@ -0,0 +1,123 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/podtserkovskiy/garnerd/storage/image/compact"
+)
+
+const (
+	mediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeIndex    = "application/vnd.oci.image.index.v1+json"
+	mediaTypeConfig   = "application/vnd.oci.image.config.v1+json"
+	// layers are served as they are in `docker save`, so their digests are the diff ids of the config
+	mediaTypeLayer = "application/vnd.oci.image.layer.v1.tar"
+)
+
+type platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+type descriptor struct {
+	MediaType string    `json:"mediaType"`
+	Digest    string    `json:"digest"`
+	Size      int64     `json:"size"`
+	Platform  *platform `json:"platform,omitempty"`
+}
+
+type manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        descriptor   `json:"config"`
+	Layers        []descriptor `json:"layers"`
+}
+
+type index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Manifests     []descriptor `json:"manifests"`
+}
+
+type imageConfig struct {
+	platform
+	RootFS struct {
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// servedImage is an image of the compact store described by the distribution API.
+type servedImage struct {
+	platform     platform
+	manifest     []byte
+	digest       string
+	config       []byte
+	configDigest string
+	// layers are layer ids by their digests
+	layers map[string]string
+}
+
+func newServedImage(image compact.Image) (servedImage, error) {
+	var config imageConfig
+	if err := json.Unmarshal(image.Config, &config); err != nil {
+		return servedImage{}, fmt.Errorf("decoding the image config, %w", err)
+	}
+	if len(config.RootFS.DiffIDs) != len(image.Layers) {
+		return servedImage{}, fmt.Errorf( // nolint: goerr113
+			"the image config has %d diff ids, but the image has %d layers", len(config.RootFS.DiffIDs), len(image.Layers),
+		)
+	}
+
+	served := servedImage{
+		platform:     config.platform,
+		config:       image.Config,
+		configDigest: digestOf(image.Config),
+		layers:       map[string]string{},
+	}
+	imageManifest := manifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeManifest,
+		Config:        descriptor{MediaType: mediaTypeConfig, Digest: served.configDigest, Size: int64(len(image.Config))},
+		Layers:        []descriptor{},
+	}
+	for n, layer := range image.Layers {
+		diffID := config.RootFS.DiffIDs[n]
+		served.layers[diffID] = layer.ID
+		imageManifest.Layers = append(imageManifest.Layers, descriptor{MediaType: mediaTypeLayer, Digest: diffID, Size: layer.Size})
+	}
+
+	var err error
+	if served.manifest, err = json.Marshal(imageManifest); err != nil {
+		return servedImage{}, err
+	}
+	served.digest = digestOf(served.manifest)
+
+	return served, nil
+}
+
+// newIndex lists manifests of a tag cached for several platforms.
+func newIndex(images []servedImage) ([]byte, error) {
+	imageIndex := index{SchemaVersion: 2, MediaType: mediaTypeIndex}
+	for _, image := range images {
+		imagePlatform := image.platform
+		imageIndex.Manifests = append(imageIndex.Manifests, descriptor{
+			MediaType: mediaTypeManifest,
+			Digest:    image.digest,
+			Size:      int64(len(image.manifest)),
+			Platform:  &imagePlatform,
+		})
+	}
+	sort.Slice(imageIndex.Manifests, func(i, j int) bool {
+		return imageIndex.Manifests[i].Digest < imageIndex.Manifests[j].Digest
+	})
+
+	return json.Marshal(imageIndex)
+}
+
+func digestOf(data []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
@@ -0,0 +1,98 @@
+package registry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/ioutils"
+)
+
+// originalManifests keeps manifests and indexes of the upstream as they have been pulled through the proxy,
+// so pulls by their digests get the same bytes. Generated manifests of the same images have other digests.
+type originalManifests struct {
+	dir string
+}
+
+type originalManifest struct {
+	MediaType string
+	Data      []byte
+}
+
+func (o *originalManifests) path(digest string) string {
+	return filepath.Join(o.dir, filepath.Base(strings.Replace(digest, ":", "-", 1)))
+}
+
+func (o *originalManifests) save(mediaType string, data []byte) error {
+	encoded, err := json.Marshal(originalManifest{MediaType: mediaType, Data: data})
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(o.dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	return ioutils.AtomicWriteFile(o.path(digestOf(data)), encoded, 0600)
+}
+
+func (o *originalManifests) get(digest string) (content, bool) {
+	encoded, err := ioutil.ReadFile(o.path(digest))
+	if err != nil {
+		return content{}, false
+	}
+
+	var original originalManifest
+	if err = json.Unmarshal(encoded, &original); err != nil || digestOf(original.Data) != digest {
+		return content{}, false
+	}
+
+	return content{mediaType: original.MediaType, digest: digest, data: original.Data}, true
+}
+
+// servable returns the manifest of a cached image or an index which lists one, cached maps ImageIDs.
+func (o *originalManifests) servable(digest string, cached map[string]bool) (content, bool) {
+	found, ok := o.get(digest)
+	if !ok {
+		return content{}, false
+	}
+
+	var listed upstreamManifest
+	if err := json.Unmarshal(found.data, &listed); err != nil {
+		return content{}, false
+	}
+	if cached[listed.Config.Digest] {
+		return found, true
+	}
+	for _, child := range listed.Manifests {
+		if _, ok := o.servable(child.Digest, cached); ok {
+			return found, true
+		}
+	}
+
+	return content{}, false
+}
+
+// sweep removes manifests saved before the time which are not servable anymore, e.g. of evicted images.
+func (o *originalManifests) sweep(before time.Time, cached map[string]bool) error {
+	files, err := ioutil.ReadDir(o.dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if !file.ModTime().Before(before) {
+			continue
+		}
+		if _, ok := o.servable(strings.Replace(file.Name(), "-", ":", 1), cached); !ok {
+			_ = os.Remove(filepath.Join(o.dir, file.Name()))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package registry
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PeerHeader marks requests of other garnerd instances, they are served from the cache only,
+// so peers never pull images for each other and never ask each other in a loop.
+const PeerHeader = "Garnerd-Peer"
+
+// ReadPeers reads registry urls of peers from the file, one per line, blank lines and #-comments are skipped.
+func ReadPeers(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading peers, %w", err)
+	}
+	defer file.Close()
+
+	peers := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if n := strings.Index(line, "#"); n >= 0 {
+			line = strings.TrimSpace(line[:n])
+		}
+		if line != "" {
+			peers = append(peers, line)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading peers, %w", err)
+	}
+
+	return peers, nil
+}
+
+// peers are registries of other garnerd instances, they are asked in turn before the upstream.
+type peers []*upstream
+
+func newPeers(rawURLs []string, client *http.Client) (peers, error) {
+	list := peers{}
+	for _, rawURL := range rawURLs {
+		peer, err := newUpstream(rawURL, client)
+		if err != nil {
+			return nil, fmt.Errorf("peer '%s', %w", rawURL, err)
+		}
+		list = append(list, peer)
+	}
+
+	return list, nil
+}
+
+// manifest returns the manifest of the first peer which has it,
+// a manifest which doesn't match the requested digest is skipped.
+func (ps peers) manifest(ctx context.Context, name, ref string, header http.Header) (content, bool) {
+	for _, peer := range ps {
+		found, err := peer.manifest(ctx, name, ref, withPeerHeader(header))
+		if err != nil {
+			logPeerError(peer, err)
+
+			continue
+		}
+
+		return found, true
+	}
+
+	return content{}, false
+}
+
+// blob calls spool with the blob of every peer which has it until spool succeeds.
+func (ps peers) blob(ctx context.Context, name, digest string, spool func(blob io.Reader) error) bool {
+	for _, peer := range ps {
+		resp, err := peer.do(ctx, http.MethodGet, name, "blobs/"+digest, withPeerHeader(nil))
+		if err != nil {
+			logPeerError(peer, err)
+
+			continue
+		}
+		err = spool(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			log.Warnf("Fetching '%s' from peer %s, %s", digest, peer.base, err)
+
+			continue
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// manifest gets the manifest and checks it against a requested digest.
+func (u *upstream) manifest(ctx context.Context, name, ref string, header http.Header) (content, error) {
+	resp, err := u.do(ctx, http.MethodGet, name, "manifests/"+ref, header)
+	if err != nil {
+		return content{}, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+	if err != nil {
+		return content{}, err
+	}
+	digest := digestOf(data)
+	if strings.HasPrefix(ref, "sha256:") && ref != digest {
+		return content{}, fmt.Errorf("manifest '%s' of %s has digest '%s'", ref, u.base, digest) // nolint: goerr113
+	}
+
+	return content{mediaType: resp.Header.Get("Content-Type"), digest: digest, data: data}, nil
+}
+
+func withPeerHeader(header http.Header) http.Header {
+	withPeer := http.Header{PeerHeader: {"1"}}
+	for key, values := range header {
+		withPeer[key] = values
+	}
+
+	return withPeer
+}
+
+// logPeerError logs failures of peers, misses are expected and are logged at the debug level.
+func logPeerError(peer *upstream, err error) {
+	if isUpstreamNotFound(err) {
+		log.Debugf("peer %s, %s", peer.base, err)
+
+		return
+	}
+	log.Warnf("Asking peer %s, %s", peer.base, err)
+}
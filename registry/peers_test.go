@@ -0,0 +1,21 @@
+package registry
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadPeers(t *testing.T) {
+	path := filepath.Join(setUpTempDir(t), "peers")
+	require.NoError(t, ioutil.WriteFile(path, []byte("# office\nhttp://10.0.0.2:5000\n\n  http://10.0.0.3:5000 # laptop\n"), 0644))
+
+	peers, err := ReadPeers(path)
+	require.NoError(t, err)
+	require.Equal(t, []string{"http://10.0.0.2:5000", "http://10.0.0.3:5000"}, peers)
+
+	_, err = ReadPeers(filepath.Join(filepath.Dir(path), "missing"))
+	require.Error(t, err)
+}
@@ -0,0 +1,716 @@
+package registry
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/podtserkovskiy/garnerd/docker"
+	"github.com/podtserkovskiy/garnerd/storage"
+	"github.com/podtserkovskiy/garnerd/storage/image/compact"
+)
+
+const (
+	mediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	maxManifestSize = 4 << 20
+
+	// cacheTimeout bounds fetching the blobs of an image being cached and saving it.
+	cacheTimeout = 30 * time.Minute
+	// spoolMaxAge is the age of spooled blobs which are swept unless a cache uses them,
+	// it outlives cacheTimeout, so unpacked layers aren't swept from under a cache.
+	spoolMaxAge = 2 * cacheTimeout
+)
+
+// nolint: gochecknoglobals
+var manifestMediaTypes = []string{mediaTypeDockerManifest, mediaTypeDockerList, mediaTypeManifest, mediaTypeIndex}
+
+// Storage caches images pulled through the proxy.
+type Storage interface {
+	Save(meta storage.Meta, imageDump io.Reader) error
+	SaveTag(meta storage.Meta) error
+}
+
+// Proxy is a pull-through mirror of an upstream registry, Docker Hub by default.
+// Cached images are served by the Server, missing ones are asked from peers, which are other garnerd instances,
+// and then streamed from the upstream. Pulled images are cached on the way:
+// blobs are spooled while they are streamed to the client and an image is saved once all its blobs are there.
+// Images of the proxy are named like Docker Hub images, because daemons mirror only Docker Hub.
+type Proxy struct {
+	local    *Server
+	upstream *upstream
+	peerURLs []string
+	peers    peers
+	storage  Storage
+	spoolDir string
+	onCached func(meta storage.Meta)
+
+	// blobs lock spooled blobs by digests
+	blobs *compact.KeyedMutex
+
+	mu sync.Mutex
+	// tags are image names by digests of manifests listed in indexes of the tags
+	tags map[string]string
+	// caching are manifest digests of images being cached
+	caching map[string]bool
+	// spoolUsers count caches using spooled blobs by digests, the last one removes the blob
+	spoolUsers map[string]int
+	wg         sync.WaitGroup
+}
+
+type ProxyOption func(*Proxy)
+
+// WithHTTPClient sets a client for upstream requests.
+func WithHTTPClient(client *http.Client) ProxyOption {
+	return func(p *Proxy) {
+		p.upstream.client = client
+	}
+}
+
+// WithPeers asks registries of other garnerd instances for missing images before the upstream.
+func WithPeers(rawURLs ...string) ProxyOption {
+	return func(p *Proxy) {
+		p.peerURLs = append(p.peerURLs, rawURLs...)
+	}
+}
+
+// WithOnCached calls f after an image pulled through the proxy has been cached.
+func WithOnCached(f func(meta storage.Meta)) ProxyOption {
+	return func(p *Proxy) {
+		p.onCached = f
+	}
+}
+
+// NewProxy serves images of local and pulls missing ones through from upstreamURL, blobs are spooled in spoolDir.
+func NewProxy(local *Server, upstreamURL string, store Storage, spoolDir string, opts ...ProxyOption) (*Proxy, error) {
+	upstream, err := newUpstream(upstreamURL, http.DefaultClient)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Proxy{
+		local:    local,
+		upstream: upstream,
+		storage:  store,
+		spoolDir: spoolDir,
+		onCached: func(storage.Meta) {},
+		blobs:    compact.NewKeyedMutex(),
+		tags:     map[string]string{},
+		caching:  map[string]bool{},
+
+		spoolUsers: map[string]int{},
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.peers, err = newPeers(p.peerURLs, p.upstream.client); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Wait waits for images which are being cached.
+func (p *Proxy) Wait() {
+	p.wg.Wait()
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	manifestAt, blobAt := strings.LastIndex(path, "/manifests/"), strings.LastIndex(path, "/blobs/")
+	switch {
+	case r.Method != http.MethodGet && r.Method != http.MethodHead, path == r.URL.Path, r.Header.Get(PeerHeader) != "":
+		p.local.ServeHTTP(w, r)
+	case manifestAt > 0:
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		p.serveManifest(w, r, path[:manifestAt], path[manifestAt+len("/manifests/"):])
+	case blobAt > 0:
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		p.serveBlob(w, r, path[:blobAt], path[blobAt+len("/blobs/"):])
+	default:
+		p.local.ServeHTTP(w, r)
+	}
+}
+
+func (p *Proxy) serveManifest(w http.ResponseWriter, r *http.Request, name, ref string) {
+	found, err := p.local.manifest(name, ref)
+	if err == nil {
+		serveContent(w, r, found.mediaType, found.digest, found.data)
+
+		return
+	}
+	if !isNotFound(err) {
+		writeLookupError(w, err)
+
+		return
+	}
+
+	header := http.Header{"Accept": r.Header["Accept"]}
+	if len(header["Accept"]) == 0 {
+		header["Accept"] = manifestMediaTypes
+	}
+	pulled, ok := p.peers.manifest(r.Context(), name, ref, header)
+	if !ok {
+		if pulled, err = p.upstream.manifest(r.Context(), name, ref, header); err != nil {
+			writeUpstreamError(w, codeManifestUnknown, err)
+
+			return
+		}
+	}
+
+	serveContent(w, r, pulled.mediaType, pulled.digest, pulled.data)
+	if r.Method == http.MethodGet {
+		p.learn(name, ref, pulled)
+	}
+}
+
+// upstreamManifest is an image manifest or an index of Docker or OCI.
+type upstreamManifest struct {
+	Config    descriptor   `json:"config"`
+	Layers    []descriptor `json:"layers"`
+	Manifests []descriptor `json:"manifests"`
+}
+
+// learn remembers tags of manifests listed by an index and starts caching an image manifest,
+// the upstream bytes of both are kept for pulls by their digests.
+func (p *Proxy) learn(name, ref string, found content) {
+	digest := found.digest
+	var pulled upstreamManifest
+	if err := json.Unmarshal(found.data, &pulled); err != nil {
+		log.Warnf("decoding the upstream manifest of '%s', %s", name, err)
+
+		return
+	}
+
+	imageName, err := docker.NormalizeName(name + "@" + digest)
+	if !strings.HasPrefix(ref, "sha256:") {
+		imageName, err = docker.NormalizeName(name + ":" + ref)
+	}
+	if err != nil {
+		log.Warnf("caching '%s', %s", name, err)
+
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if tag, ok := p.tags[digest]; ok {
+		imageName = tag
+	}
+	if len(pulled.Manifests) > 0 {
+		for _, listed := range pulled.Manifests {
+			p.tags[listed.Digest] = imageName
+		}
+		p.local.saveOriginal(found.mediaType, found.data)
+
+		return
+	}
+	if pulled.Config.Digest == "" || p.caching[digest] {
+		return
+	}
+
+	p.caching[digest] = true
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		if err := p.cache(name, imageName, digest, pulled); err != nil {
+			log.Warnf("Caching '%s' pulled through the proxy, %s", imageName, err)
+		} else {
+			p.local.saveOriginal(found.mediaType, found.data)
+		}
+
+		p.mu.Lock()
+		delete(p.caching, digest)
+		p.mu.Unlock()
+	}()
+}
+
+func (p *Proxy) serveBlob(w http.ResponseWriter, r *http.Request, name, digest string) {
+	found, err := p.local.blob(name, digest)
+	if err == nil {
+		defer found.Close()
+		serveBlob(w, r, digest, found)
+
+		return
+	}
+	if !isNotFound(err) {
+		writeLookupError(w, err)
+
+		return
+	}
+
+	// peers are on the same network, their blobs are checked before they are sent,
+	// a blob which is being spooled for another request is streamed without waiting for it
+	if path, ok := p.fetchPeerBlob(r.Context(), name, digest, false); ok {
+		p.serveSpooled(w, r, digest, path)
+
+		return
+	}
+
+	// a range needs the whole blob, otherwise the blob is streamed to the client while it is spooled
+	if r.Method == http.MethodGet && r.Header.Get("Range") == "" {
+		p.streamBlob(w, r, name, digest)
+
+		return
+	}
+
+	path, err := p.fetchBlob(r.Context(), name, digest)
+	if err != nil {
+		writeUpstreamError(w, codeBlobUnknown, err)
+
+		return
+	}
+	p.serveSpooled(w, r, digest, path)
+}
+
+func (p *Proxy) serveSpooled(w http.ResponseWriter, r *http.Request, digest, path string) {
+	spooled, err := os.Open(path)
+	if err != nil {
+		writeInternalError(w, err)
+
+		return
+	}
+	defer spooled.Close()
+	serveBlob(w, r, digest, spooled)
+}
+
+func (p *Proxy) spoolPath(digest string) string {
+	return filepath.Join(p.spoolDir, "blobs", filepath.Base(strings.Replace(digest, ":", "-", 1)))
+}
+
+// streamBlob sends the blob from the spool or from the upstream, the upstream blob is spooled on the way.
+// The spooling request goes at the pace of its client, so others don't wait for it and stream the blob without spooling.
+func (p *Proxy) streamBlob(w http.ResponseWriter, r *http.Request, name, digest string) {
+	unlock, spooling := p.blobs.TryLock(digest)
+	if spooling {
+		defer unlock()
+	}
+
+	// blobs appear in the spool complete, so they are served without the lock
+	if spooled, err := os.Open(p.spoolPath(digest)); err == nil {
+		defer spooled.Close()
+		serveBlob(w, r, digest, spooled)
+
+		return
+	}
+
+	resp, err := p.upstream.do(r.Context(), http.MethodGet, name, "blobs/"+digest, nil)
+	if err != nil {
+		writeUpstreamError(w, codeBlobUnknown, err)
+
+		return
+	}
+	defer resp.Body.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", digest)
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", fmt.Sprint(resp.ContentLength))
+	}
+	if spooling {
+		err = p.spool(digest, io.TeeReader(resp.Body, w))
+	} else {
+		_, err = io.Copy(w, resp.Body)
+	}
+	if err != nil {
+		// the status has been sent already, the client sees a broken body
+		log.Warnf("streaming '%s' of '%s', %s", digest, name, err)
+	}
+}
+
+// fetchPeerBlob spools the blob of a peer unless it is spooled already and returns its path.
+// Unless wait is set, it gives up if the blob is being spooled by another request.
+func (p *Proxy) fetchPeerBlob(ctx context.Context, name, digest string, wait bool) (string, bool) {
+	if len(p.peers) == 0 {
+		return "", false
+	}
+	if wait {
+		defer p.blobs.Lock(digest)()
+	} else {
+		unlock, ok := p.blobs.TryLock(digest)
+		if !ok {
+			return "", false
+		}
+		defer unlock()
+	}
+
+	path := p.spoolPath(digest)
+	if _, err := os.Stat(path); err == nil {
+		return path, true
+	}
+
+	return path, p.peers.blob(ctx, name, digest, func(blob io.Reader) error {
+		return p.spool(digest, blob)
+	})
+}
+
+// fetchBlob spools the blob of a peer or of the upstream unless it is spooled already and returns its path.
+func (p *Proxy) fetchBlob(ctx context.Context, name, digest string) (string, error) {
+	if path, ok := p.fetchPeerBlob(ctx, name, digest, true); ok {
+		return path, nil
+	}
+
+	defer p.blobs.Lock(digest)()
+
+	path := p.spoolPath(digest)
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	resp, err := p.upstream.do(ctx, http.MethodGet, name, "blobs/"+digest, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	return path, p.spool(digest, resp.Body)
+}
+
+// spool writes the blob to the spool, a blob with another digest is dropped.
+func (p *Proxy) spool(digest string, blob io.Reader) error {
+	path := p.spoolPath(digest)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(tmp, hash), blob); err != nil {
+		return err
+	}
+	if got := "sha256:" + hex.EncodeToString(hash.Sum(nil)); got != digest {
+		return fmt.Errorf("blob '%s' has digest '%s'", digest, got) // nolint: goerr113
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// holdSpooled marks spooled blobs as used by a cache, so concurrent caches sharing them don't remove them.
+func (p *Proxy) holdSpooled(digests ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, digest := range digests {
+		p.spoolUsers[digest]++
+	}
+}
+
+// releaseSpooled removes spooled blobs which are not used by other caches anymore.
+// A blob is removed under its lock, so it is never removed while it is being spooled.
+func (p *Proxy) releaseSpooled(digests ...string) {
+	for _, digest := range digests {
+		unlock := p.blobs.Lock(digest)
+		p.mu.Lock()
+		p.spoolUsers[digest]--
+		if p.spoolUsers[digest] <= 0 {
+			delete(p.spoolUsers, digest)
+			_ = os.Remove(p.spoolPath(digest))
+		}
+		p.mu.Unlock()
+		unlock()
+	}
+}
+
+// SweepSpool removes spooled blobs which no cache uses and which are older than spoolMaxAge,
+// e.g. blobs of HEAD and range requests and of manifests which are never cached.
+func (p *Proxy) SweepSpool(ctx context.Context) {
+	ticker := time.NewTicker(spoolMaxAge)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := p.sweepSpool(time.Now().Add(-spoolMaxAge)); err != nil {
+			log.Warn("sweeping the proxy spool, ", err)
+		}
+		if err := p.local.sweepOriginals(time.Now().Add(-spoolMaxAge)); err != nil {
+			log.Warn("sweeping upstream manifests, ", err)
+		}
+	}
+}
+
+func (p *Proxy) sweepSpool(before time.Time) error {
+	files, err := ioutil.ReadDir(filepath.Join(p.spoolDir, "blobs"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if !file.ModTime().Before(before) {
+			continue
+		}
+		path := filepath.Join(p.spoolDir, "blobs", file.Name())
+		// temp files of spooling and unpacking are removed by their writers, stale ones are left by crashes
+		if strings.HasPrefix(file.Name(), ".") {
+			_ = os.Remove(path)
+
+			continue
+		}
+
+		digest := strings.Replace(file.Name(), "-", ":", 1)
+		// a locked blob is being spooled or removed
+		unlock, ok := p.blobs.TryLock(digest)
+		if !ok {
+			continue
+		}
+		p.mu.Lock()
+		if p.spoolUsers[digest] == 0 {
+			_ = os.Remove(path)
+		}
+		p.mu.Unlock()
+		unlock()
+	}
+
+	return nil
+}
+
+// cache saves the image of the upstream manifest, its layers are decompressed and checked against diff ids.
+func (p *Proxy) cache(name, imageName, manifestDigest string, pulled upstreamManifest) error {
+	ctx, cancel := context.WithTimeout(context.Background(), cacheTimeout)
+	defer cancel()
+	blobs := []string{pulled.Config.Digest}
+	for _, layer := range pulled.Layers {
+		blobs = append(blobs, layer.Digest)
+	}
+	p.holdSpooled(blobs...)
+	defer func() {
+		p.releaseSpooled(blobs...)
+	}()
+
+	configPath, err := p.fetchBlob(ctx, name, pulled.Config.Digest)
+	if err != nil {
+		return fmt.Errorf("fetching the config, %w", err)
+	}
+	configData, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	var config struct {
+		imageConfig
+		Created time.Time `json:"created"`
+	}
+	if err = json.Unmarshal(configData, &config); err != nil {
+		return fmt.Errorf("decoding the config, %w", err)
+	}
+	if len(config.RootFS.DiffIDs) != len(pulled.Layers) {
+		return fmt.Errorf("the config has %d diff ids, but the manifest has %d layers", len(config.RootFS.DiffIDs), len(pulled.Layers)) // nolint: goerr113
+	}
+	// layers of peers are spooled by diff ids
+	p.holdSpooled(config.RootFS.DiffIDs...)
+	blobs = append(blobs, config.RootFS.DiffIDs...)
+
+	meta := storage.Meta{
+		ImageName:    imageName,
+		ImageID:      pulled.Config.Digest,
+		LayerDigests: config.RootFS.DiffIDs,
+		OS:           config.OS,
+		Architecture: config.Architecture,
+		Created:      config.Created,
+	}
+	if repoDigest, err := docker.NormalizeName(name + "@" + manifestDigest); err == nil {
+		meta.RepoDigests = []string{repoDigest}
+	}
+
+	err = p.storage.SaveTag(meta)
+	if err == nil {
+		p.onCached(meta)
+
+		return nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+
+	layers := make([]string, len(pulled.Layers))
+	defer func() {
+		for _, layer := range layers {
+			if layer != "" {
+				_ = os.Remove(layer)
+			}
+		}
+	}()
+	for n, layer := range pulled.Layers {
+		compressed, err := p.fetchLayer(ctx, name, layer.Digest, meta.LayerDigests[n])
+		if err != nil {
+			return fmt.Errorf("fetching layer '%s', %w", layer.Digest, err)
+		}
+		size, err := p.unpackLayer(compressed, meta.LayerDigests[n], &layers[n])
+		if err != nil {
+			return fmt.Errorf("unpacking layer '%s', %w", layer.Digest, err)
+		}
+		meta.Size += size
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		_ = pipeWriter.CloseWithError(writeImageDump(pipeWriter, meta, configData, layers))
+	}()
+	if err = p.storage.Save(meta, pipeReader); err != nil {
+		_ = pipeReader.CloseWithError(err)
+
+		return err
+	}
+	log.Infof("Image '%s' pulled through the proxy has been cached", imageName)
+	p.onCached(meta)
+
+	return nil
+}
+
+// fetchLayer spools the layer, peers are asked for the layer by its diff id first,
+// because they serve uncompressed layers and the upstream layer may not have been pulled by the client.
+func (p *Proxy) fetchLayer(ctx context.Context, name, digest, diffID string) (string, error) {
+	path := p.spoolPath(digest)
+	if _, err := os.Stat(path); err == nil || diffID == digest {
+		return p.fetchBlob(ctx, name, digest)
+	}
+	if path, ok := p.fetchPeerBlob(ctx, name, diffID, true); ok {
+		return path, nil
+	}
+
+	return p.fetchBlob(ctx, name, digest)
+}
+
+// unpackLayer decompresses the layer into the spool, checks it against the diff id and returns its size.
+func (p *Proxy) unpackLayer(compressedPath, diffID string, path *string) (int64, error) {
+	compressed, err := os.Open(compressedPath)
+	if err != nil {
+		return 0, err
+	}
+	defer compressed.Close()
+	dec, err := compact.NewDecompressor(compressed)
+	if err != nil {
+		return 0, err
+	}
+	defer dec.Close()
+
+	layer, err := ioutil.TempFile(filepath.Dir(compressedPath), ".layer-")
+	if err != nil {
+		return 0, err
+	}
+	defer layer.Close()
+	*path = layer.Name()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(layer, hash), dec)
+	if err != nil {
+		return 0, err
+	}
+	if got := "sha256:" + hex.EncodeToString(hash.Sum(nil)); got != diffID {
+		return 0, fmt.Errorf("layer has diff id '%s' instead of '%s'", got, diffID) // nolint: goerr113
+	}
+
+	return size, layer.Close()
+}
+
+// writeImageDump writes the image in the `docker save` format, layer dirs are named by diff ids.
+func writeImageDump(dst io.Writer, meta storage.Meta, config []byte, layers []string) error {
+	tarWriter := tar.NewWriter(dst)
+	layerFiles := []string{}
+	for n, layerPath := range layers {
+		dir := strings.TrimPrefix(meta.LayerDigests[n], "sha256:")
+		if err := writeLayer(tarWriter, dir, layerPath); err != nil {
+			return err
+		}
+		layerFiles = append(layerFiles, dir+"/layer.tar")
+	}
+
+	saveManifest := []map[string]interface{}{{
+		"Config":   strings.TrimPrefix(meta.ImageID, "sha256:") + ".json",
+		"RepoTags": []string{},
+		"Layers":   layerFiles,
+	}}
+	if !docker.IsDigest(meta.ImageName) {
+		saveManifest[0]["RepoTags"] = []string{meta.ImageName}
+	}
+	manifestData, err := json.Marshal(saveManifest)
+	if err != nil {
+		return err
+	}
+	if err = writeTarFile(tarWriter, "manifest.json", manifestData); err != nil {
+		return err
+	}
+	if err = writeTarFile(tarWriter, strings.TrimPrefix(meta.ImageID, "sha256:")+".json", config); err != nil {
+		return err
+	}
+
+	return tarWriter.Close()
+}
+
+func writeLayer(tarWriter *tar.Writer, dir, layerPath string) error {
+	layer, err := os.Open(layerPath)
+	if err != nil {
+		return err
+	}
+	defer layer.Close()
+	info, err := layer.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err = tarWriter.WriteHeader(&tar.Header{Name: dir + "/", Mode: 0755, Typeflag: tar.TypeDir}); err != nil {
+		return err
+	}
+	if err = writeTarFile(tarWriter, dir+"/VERSION", []byte("1.0")); err != nil {
+		return err
+	}
+	if err = writeTarFile(tarWriter, dir+"/json", []byte(`{"id":"`+dir+`"}`)); err != nil {
+		return err
+	}
+	if err = tarWriter.WriteHeader(&tar.Header{Name: dir + "/layer.tar", Mode: 0644, Size: info.Size()}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tarWriter, layer)
+
+	return err
+}
+
+func writeTarFile(tarWriter *tar.Writer, name string, data []byte) error {
+	if err := tarWriter.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}); err != nil {
+		return err
+	}
+	_, err := tarWriter.Write(data)
+
+	return err
+}
+
+func writeUpstreamError(w http.ResponseWriter, notFoundCode string, err error) {
+	if isUpstreamNotFound(err) {
+		writeError(w, http.StatusNotFound, notFoundCode, err.Error())
+
+		return
+	}
+	log.Warnf("proxy, %s", err)
+	writeError(w, http.StatusBadGateway, codeUnsupported, err.Error())
+}
@@ -0,0 +1,390 @@
+package registry
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+	"github.com/podtserkovskiy/garnerd/storage/image/compact"
+	"github.com/podtserkovskiy/garnerd/storage/meta/mem"
+	"github.com/podtserkovskiy/garnerd/storage/separated"
+)
+
+// upstreamStub is a registry which demands a bearer token like Docker Hub.
+type upstreamStub struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	manifests map[string][]byte
+	blobs     map[string][]byte
+	tokens    int
+	requests  int
+}
+
+func newUpstreamStub(t *testing.T) *upstreamStub {
+	u := &upstreamStub{manifests: map[string][]byte{}, blobs: map[string][]byte{}}
+	u.Server = httptest.NewServer(http.HandlerFunc(u.serve))
+	t.Cleanup(u.Close)
+
+	return u
+}
+
+func (u *upstreamStub) serve(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.requests++
+	if r.URL.Path == "/token" {
+		if r.URL.Query().Get("scope") != "repository:library/alpine:pull" {
+			w.WriteHeader(http.StatusForbidden)
+
+			return
+		}
+		u.tokens++
+		_, _ = w.Write([]byte(`{"token":"secret"}`))
+
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+u.URL+`/token",service="stub"`)
+		w.WriteHeader(http.StatusUnauthorized)
+
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v2/library/alpine/")
+	if data, ok := u.manifests[strings.TrimPrefix(path, "manifests/")]; ok {
+		var pulled struct {
+			MediaType string `json:"mediaType"`
+		}
+		_ = json.Unmarshal(data, &pulled)
+		w.Header().Set("Content-Type", pulled.MediaType)
+		_, _ = w.Write(data)
+
+		return
+	}
+	if data, ok := u.blobs[strings.TrimPrefix(path, "blobs/")]; ok {
+		_, _ = w.Write(data)
+
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// push adds an image of gzipped layers and returns its manifest digest.
+func (u *upstreamStub) push(t *testing.T, arch string, layers ...[]byte) (string, []byte) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	diffIDs, descriptors := []string{}, []descriptor{}
+	for _, layer := range layers {
+		buf := &bytes.Buffer{}
+		gz := gzip.NewWriter(buf)
+		_, err := gz.Write(layer)
+		require.NoError(t, err)
+		require.NoError(t, gz.Close())
+
+		digest := digestOf(buf.Bytes())
+		u.blobs[digest] = buf.Bytes()
+		diffIDs = append(diffIDs, digestOf(layer))
+		descriptors = append(descriptors, descriptor{
+			MediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip", Digest: digest, Size: int64(buf.Len()),
+		})
+	}
+
+	config, err := json.Marshal(map[string]interface{}{
+		"os":           "linux",
+		"architecture": arch,
+		"created":      "2020-10-01T00:00:00Z",
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+	})
+	require.NoError(t, err)
+	u.blobs[digestOf(config)] = config
+
+	data, err := json.Marshal(manifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeDockerManifest,
+		Config:        descriptor{MediaType: "application/vnd.docker.container.image.v1+json", Digest: digestOf(config), Size: int64(len(config))},
+		Layers:        descriptors,
+	})
+	require.NoError(t, err)
+	u.manifests[digestOf(data)] = data
+
+	return digestOf(data), config
+}
+
+func (u *upstreamStub) tag(t *testing.T, tag string, manifests ...string) []byte {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	list := index{SchemaVersion: 2, MediaType: mediaTypeDockerList}
+	for _, digest := range manifests {
+		list.Manifests = append(list.Manifests, descriptor{MediaType: mediaTypeDockerManifest, Digest: digest, Size: int64(len(u.manifests[digest]))})
+	}
+	data, err := json.Marshal(list)
+	require.NoError(t, err)
+	u.manifests[tag] = data
+	u.manifests[digestOf(data)] = data
+
+	return data
+}
+
+func TestProxy(t *testing.T) {
+	dir := setUpTempDir(t)
+	upstream := newUpstreamStub(t)
+	base, app := []byte("base layer"), bytes.Repeat([]byte("app layer "), 1000)
+	amd64, amd64Config := upstream.push(t, "amd64", base, app)
+	arm64, _ := upstream.push(t, "arm64", base)
+	list := upstream.tag(t, "3", amd64, arm64)
+
+	images := compact.NewImgStorage(filepath.Join(dir, "images"))
+	store := separated.NewStorage(mem.NewMetaCRUD(), images)
+	cached := make(chan storage.Meta, 1)
+	server := NewServer(store, images, WithOriginalManifests(filepath.Join(dir, "manifests")))
+	proxy, err := NewProxy(server, upstream.URL, store, filepath.Join(dir, "spool"), WithOnCached(func(meta storage.Meta) {
+		cached <- meta
+	}))
+	require.NoError(t, err)
+
+	t.Run("pull through", func(t *testing.T) {
+		resp := get(t, proxy, http.MethodGet, "/v2/library/alpine/manifests/3", nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		require.Equal(t, mediaTypeDockerList, resp.Header().Get("Content-Type"))
+		require.Equal(t, digestOf(list), resp.Header().Get("Docker-Content-Digest"))
+		require.Equal(t, list, resp.Body.Bytes())
+
+		resp = get(t, proxy, http.MethodGet, "/v2/library/alpine/manifests/"+amd64, nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		require.Equal(t, amd64, resp.Header().Get("Docker-Content-Digest"))
+
+		var pulled manifest
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &pulled))
+		for _, blob := range append(pulled.Layers, pulled.Config) {
+			resp = get(t, proxy, http.MethodGet, "/v2/library/alpine/blobs/"+blob.Digest, nil)
+			require.Equal(t, http.StatusOK, resp.Code)
+			require.Equal(t, upstream.blobs[blob.Digest], resp.Body.Bytes())
+		}
+
+		resp = get(t, proxy, http.MethodGet, "/v2/library/alpine/blobs/"+pulled.Layers[1].Digest, http.Header{"Range": {"bytes=10-19"}})
+		require.Equal(t, http.StatusPartialContent, resp.Code)
+		require.Equal(t, upstream.blobs[pulled.Layers[1].Digest][10:20], resp.Body.Bytes())
+		require.Equal(t, 1, upstream.tokens)
+	})
+
+	t.Run("cached", func(t *testing.T) {
+		proxy.Wait()
+		meta := <-cached
+		require.Equal(t, "alpine:3", meta.ImageName)
+		require.Equal(t, digestOf(amd64Config), meta.ImageID)
+		require.Equal(t, "amd64", meta.Architecture)
+		require.Equal(t, []string{digestOf(base), digestOf(app)}, meta.LayerDigests)
+		require.Equal(t, []string{"alpine@" + amd64}, meta.RepoDigests)
+		require.Equal(t, int64(len(base)+len(app)), meta.Size)
+
+		metas, err := store.GetAllMeta()
+		require.NoError(t, err)
+		require.Len(t, metas, 1)
+		require.Equal(t, meta.ImageID, metas[0].ImageID)
+
+		image, err := images.Image(meta.ImageID)
+		require.NoError(t, err)
+		require.Equal(t, amd64Config, image.Config)
+
+		spooled, err := ioutil.ReadDir(filepath.Join(dir, "spool", "blobs"))
+		require.NoError(t, err)
+		require.Empty(t, spooled)
+	})
+
+	t.Run("digest mismatch", func(t *testing.T) {
+		upstream.mu.Lock()
+		upstream.manifests[arm64] = []byte(`{"mediaType":"` + mediaTypeDockerManifest + `","schemaVersion":2}`)
+		upstream.mu.Unlock()
+
+		resp := get(t, proxy, http.MethodGet, "/v2/library/alpine/manifests/"+arm64, nil)
+		require.Equal(t, http.StatusBadGateway, resp.Code)
+	})
+
+	t.Run("unknown upstream", func(t *testing.T) {
+		resp := get(t, proxy, http.MethodGet, "/v2/library/alpine/manifests/2", nil)
+		require.Equal(t, http.StatusNotFound, resp.Code)
+		require.Contains(t, resp.Body.String(), "MANIFEST_UNKNOWN")
+	})
+
+	t.Run("served without upstream", func(t *testing.T) {
+		upstream.Close()
+
+		resp := get(t, proxy, http.MethodGet, "/v2/library/alpine/manifests/3", nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		require.Equal(t, mediaTypeManifest, resp.Header().Get("Content-Type"))
+
+		resp = get(t, proxy, http.MethodGet, "/v2/library/alpine/blobs/"+digestOf(app), nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		require.Equal(t, app, resp.Body.Bytes())
+
+		resp = get(t, proxy, http.MethodGet, "/v2/library/alpine/manifests/latest", nil)
+		require.Equal(t, http.StatusBadGateway, resp.Code)
+	})
+
+	t.Run("upstream manifests are served by their digests", func(t *testing.T) {
+		for _, digest := range []string{amd64, digestOf(list)} {
+			resp := get(t, server, http.MethodGet, "/v2/library/alpine/manifests/"+digest, nil)
+			require.Equal(t, http.StatusOK, resp.Code)
+			require.Equal(t, digest, resp.Header().Get("Docker-Content-Digest"))
+			require.Equal(t, digest, digestOf(resp.Body.Bytes()))
+		}
+		resp := get(t, server, http.MethodGet, "/v2/library/alpine/manifests/"+digestOf(list), nil)
+		require.Equal(t, mediaTypeDockerList, resp.Header().Get("Content-Type"))
+
+		// arm64 has never been cached
+		require.Equal(t, http.StatusNotFound, get(t, server, http.MethodGet, "/v2/library/alpine/manifests/"+arm64, nil).Code)
+	})
+
+	t.Run("upstream manifests of evicted images are swept", func(t *testing.T) {
+		require.NoError(t, server.sweepOriginals(time.Now().Add(time.Hour)))
+		require.FileExists(t, server.originals.path(amd64))
+
+		metas, err := store.GetAllMeta()
+		require.NoError(t, err)
+		for _, meta := range metas {
+			require.NoError(t, store.Remove(meta.Key()))
+		}
+		require.NoError(t, server.sweepOriginals(time.Now().Add(time.Hour)))
+		require.NoFileExists(t, server.originals.path(amd64))
+		require.NoFileExists(t, server.originals.path(digestOf(list)))
+	})
+}
+
+func TestPeers(t *testing.T) {
+	dir := setUpTempDir(t)
+
+	// the peer has alpine:3 cached, its upstream must never be asked for peers
+	peerImages := compact.NewImgStorage(filepath.Join(dir, "peer"))
+	base, app := []byte("base layer"), bytes.Repeat([]byte("app layer "), 1000)
+	cachedImage := saveImage(t, peerImages, "amd64", base, app)
+	peerStore := separated.NewStorage(mem.NewMetaCRUD(), peerImages)
+	require.NoError(t, peerStore.SaveTag(storage.Meta{ImageName: "alpine:3", ImageID: cachedImage.id, OS: "linux", Architecture: "amd64"}))
+	peerUpstream := newUpstreamStub(t)
+	peerProxy, err := NewProxy(NewServer(peerStore, peerImages), peerUpstream.URL, peerStore, filepath.Join(dir, "peer-spool"))
+	require.NoError(t, err)
+	peer := httptest.NewServer(peerProxy)
+	defer peer.Close()
+
+	// a broken peer sends other blobs
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/blobs/") {
+			_, _ = w.Write([]byte("garbage"))
+
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer broken.Close()
+
+	images := compact.NewImgStorage(filepath.Join(dir, "images"))
+	store := separated.NewStorage(mem.NewMetaCRUD(), images)
+	upstream := newUpstreamStub(t)
+	proxy, err := NewProxy(NewServer(store, images), upstream.URL, store, filepath.Join(dir, "spool"), WithPeers(broken.URL, peer.URL))
+	require.NoError(t, err)
+
+	t.Run("pulled from peer", func(t *testing.T) {
+		resp := get(t, proxy, http.MethodGet, "/v2/library/alpine/manifests/3", nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		require.Equal(t, mediaTypeManifest, resp.Header().Get("Content-Type"))
+
+		var pulled manifest
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &pulled))
+		require.Equal(t, cachedImage.id, pulled.Config.Digest)
+
+		resp = get(t, proxy, http.MethodGet, "/v2/library/alpine/blobs/"+cachedImage.id, nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		require.Equal(t, cachedImage.config, resp.Body.Bytes())
+		resp = get(t, proxy, http.MethodGet, "/v2/library/alpine/blobs/"+digestOf(app), nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		require.Equal(t, app, resp.Body.Bytes())
+
+		proxy.Wait()
+		image, err := images.Image(cachedImage.id)
+		require.NoError(t, err)
+		require.Equal(t, cachedImage.config, image.Config)
+
+		metas, err := store.GetAllMeta()
+		require.NoError(t, err)
+		require.Len(t, metas, 1)
+		require.Equal(t, "alpine:3", metas[0].ImageName)
+		require.Equal(t, []string{digestOf(base), digestOf(app)}, metas[0].LayerDigests)
+
+		require.Zero(t, upstream.requests)
+	})
+
+	t.Run("peers miss", func(t *testing.T) {
+		resp := get(t, proxy, http.MethodGet, "/v2/library/alpine/manifests/edge", nil)
+		require.Equal(t, http.StatusNotFound, resp.Code)
+
+		require.Zero(t, peerUpstream.requests)
+		require.NotZero(t, upstream.requests)
+	})
+}
+
+func TestProxy_Spool(t *testing.T) {
+	dir := setUpTempDir(t)
+	upstream := newUpstreamStub(t)
+	_, config := upstream.push(t, "amd64", []byte("base layer"))
+	digest := digestOf(config)
+
+	images := compact.NewImgStorage(filepath.Join(dir, "images"))
+	store := separated.NewStorage(mem.NewMetaCRUD(), images)
+	proxy, err := NewProxy(NewServer(store, images), upstream.URL, store, filepath.Join(dir, "spool"))
+	require.NoError(t, err)
+
+	t.Run("a blob being spooled is streamed without waiting", func(t *testing.T) {
+		unlock := proxy.blobs.Lock(digest)
+		resp := get(t, proxy, http.MethodGet, "/v2/library/alpine/blobs/"+digest, nil)
+		unlock()
+		require.Equal(t, http.StatusOK, resp.Code)
+		require.Equal(t, config, resp.Body.Bytes())
+		require.NoFileExists(t, proxy.spoolPath(digest))
+	})
+
+	t.Run("a blob shared by caches is removed by the last one", func(t *testing.T) {
+		resp := get(t, proxy, http.MethodGet, "/v2/library/alpine/blobs/"+digest, nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		require.FileExists(t, proxy.spoolPath(digest))
+
+		proxy.holdSpooled(digest)
+		proxy.holdSpooled(digest)
+		proxy.releaseSpooled(digest)
+		require.FileExists(t, proxy.spoolPath(digest))
+		proxy.releaseSpooled(digest)
+		require.NoFileExists(t, proxy.spoolPath(digest))
+	})
+
+	t.Run("old blobs nobody uses are swept", func(t *testing.T) {
+		resp := get(t, proxy, http.MethodHead, "/v2/library/alpine/blobs/"+digest, nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		require.FileExists(t, proxy.spoolPath(digest))
+
+		require.NoError(t, proxy.sweepSpool(time.Now().Add(-time.Hour)))
+		require.FileExists(t, proxy.spoolPath(digest))
+
+		proxy.holdSpooled(digest)
+		require.NoError(t, proxy.sweepSpool(time.Now().Add(time.Hour)))
+		require.FileExists(t, proxy.spoolPath(digest))
+
+		proxy.releaseSpooled(digest)
+		resp = get(t, proxy, http.MethodHead, "/v2/library/alpine/blobs/"+digest, nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		require.NoError(t, proxy.sweepSpool(time.Now().Add(time.Hour)))
+		require.NoFileExists(t, proxy.spoolPath(digest))
+	})
+}
@@ -0,0 +1,449 @@
+// Package registry serves cached images by the read side of the Docker Registry v2 / OCI distribution API,
+// so other daemons can use garnerd as a registry mirror.
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/podtserkovskiy/garnerd/docker"
+	"github.com/podtserkovskiy/garnerd/storage"
+	"github.com/podtserkovskiy/garnerd/storage/image/compact"
+)
+
+const (
+	codeNameUnknown     = "NAME_UNKNOWN"
+	codeManifestUnknown = "MANIFEST_UNKNOWN"
+	codeBlobUnknown     = "BLOB_UNKNOWN"
+	codeNameInvalid     = "NAME_INVALID"
+	codeUnsupported     = "UNSUPPORTED"
+)
+
+// Metas lists cached tags.
+type Metas interface {
+	GetAllMeta() ([]storage.Meta, error)
+}
+
+// Images reads images stored by their ImageIDs.
+type Images interface {
+	Image(imageName string) (compact.Image, error)
+	OpenLayer(layerID string) (*compact.LayerReader, error)
+	// Changes is bumped when an image is saved or removed.
+	Changes() uint64
+}
+
+type Server struct {
+	metas  Metas
+	images Images
+
+	// served describes images by their ImageIDs, it is dropped when images change
+	servedMu      sync.Mutex
+	served        map[string]servedImage
+	servedChanges uint64
+
+	// originals are manifests of the proxy's upstream, they are nil unless WithOriginalManifests is set
+	originals *originalManifests
+}
+
+type ServerOption func(*Server)
+
+// WithOriginalManifests serves upstream manifests of images pulled through the proxy from the dir by their digests.
+// Their layers are compressed blobs of the upstream, which the proxy streams, the server has only uncompressed ones.
+func WithOriginalManifests(dir string) ServerOption {
+	return func(s *Server) {
+		s.originals = &originalManifests{dir: dir}
+	}
+}
+
+func NewServer(metas Metas, images Images, opts ...ServerOption) *Server {
+	s := &Server{metas: metas, images: images, served: map[string]servedImage{}}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, codeUnsupported, "the registry is read-only")
+
+		return
+	}
+
+	if r.URL.Path == "/v2" || r.URL.Path == "/v2/" {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte("{}"))
+
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	switch {
+	case path == r.URL.Path:
+		http.NotFound(w, r)
+	case strings.Contains(path, "/manifests/"):
+		n := strings.LastIndex(path, "/manifests/")
+		s.serveManifest(w, r, path[:n], path[n+len("/manifests/"):])
+	case strings.Contains(path, "/blobs/"):
+		n := strings.LastIndex(path, "/blobs/")
+		s.serveBlob(w, r, path[:n], path[n+len("/blobs/"):])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveManifest(w http.ResponseWriter, r *http.Request, name, ref string) {
+	found, err := s.manifest(name, ref)
+	if err != nil {
+		writeLookupError(w, err)
+
+		return
+	}
+	serveContent(w, r, found.mediaType, found.digest, found.data)
+}
+
+func (s *Server) serveBlob(w http.ResponseWriter, r *http.Request, name, digest string) {
+	found, err := s.blob(name, digest)
+	if err != nil {
+		writeLookupError(w, err)
+
+		return
+	}
+	defer found.Close()
+
+	serveBlob(w, r, digest, found)
+}
+
+// content is a manifest or an index with its media type.
+type content struct {
+	mediaType string
+	digest    string
+	data      []byte
+}
+
+// manifest returns the manifest by a digest or a tag, tags cached for several platforms are served by an index.
+func (s *Server) manifest(name, ref string) (content, error) {
+	metas, err := s.repoMetas(name)
+	if err != nil {
+		return content{}, err
+	}
+
+	if strings.HasPrefix(ref, "sha256:") {
+		return s.manifestByDigest(metas, ref)
+	}
+
+	tagged, err := docker.NormalizeName(name + ":" + ref)
+	if err != nil {
+		return content{}, &lookupError{http.StatusNotFound, codeManifestUnknown, err.Error()}
+	}
+	tagMetas := []storage.Meta{}
+	for _, meta := range metas {
+		if meta.ImageName == tagged {
+			tagMetas = append(tagMetas, meta)
+		}
+	}
+
+	images, err := s.servedImages(tagMetas)
+	if err != nil {
+		return content{}, err
+	}
+	switch len(images) {
+	case 0:
+		return content{}, &lookupError{http.StatusNotFound, codeManifestUnknown, "'" + tagged + "' is not cached"}
+	case 1:
+		return content{mediaType: mediaTypeManifest, digest: images[0].digest, data: images[0].manifest}, nil
+	}
+
+	imageIndex, err := newIndex(images)
+	if err != nil {
+		return content{}, err
+	}
+
+	return content{mediaType: mediaTypeIndex, digest: digestOf(imageIndex), data: imageIndex}, nil
+}
+
+// manifestByDigest finds the manifest or the index of a tag among images of the repository,
+// the original upstream manifest is served if the digest is of one.
+func (s *Server) manifestByDigest(metas []storage.Meta, digest string) (content, error) {
+	images, err := s.servedImages(metas)
+	if err != nil {
+		return content{}, err
+	}
+
+	byID := map[string]servedImage{}
+	for _, image := range images {
+		if image.digest == digest {
+			return content{mediaType: mediaTypeManifest, digest: image.digest, data: image.manifest}, nil
+		}
+		byID[image.configDigest] = image
+	}
+
+	tags := map[string][]servedImage{}
+	for _, meta := range metas {
+		if image, ok := byID[meta.ImageID]; ok {
+			tags[meta.ImageName] = append(tags[meta.ImageName], image)
+		}
+	}
+	for _, tagImages := range tags {
+		if len(tagImages) < 2 {
+			continue
+		}
+		imageIndex, err := newIndex(tagImages)
+		if err != nil {
+			return content{}, err
+		}
+		if digestOf(imageIndex) == digest {
+			return content{mediaType: mediaTypeIndex, digest: digest, data: imageIndex}, nil
+		}
+	}
+
+	if s.originals != nil {
+		cached := map[string]bool{}
+		for imageID := range byID {
+			cached[imageID] = true
+		}
+		if original, ok := s.originals.servable(digest, cached); ok {
+			return original, nil
+		}
+	}
+
+	return content{}, &lookupError{http.StatusNotFound, codeManifestUnknown, "'" + digest + "' is not cached"}
+}
+
+type blobReader interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// blob opens a config or a layer of the repository.
+func (s *Server) blob(name, digest string) (blobReader, error) {
+	metas, err := s.repoMetas(name)
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := s.servedImages(metas)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, image := range images {
+		if image.configDigest == digest {
+			return nopCloser{bytes.NewReader(image.config)}, nil
+		}
+
+		layerID, ok := image.layers[digest]
+		if !ok {
+			continue
+		}
+		layer, err := s.images.OpenLayer(layerID)
+		if errors.Is(err, storage.ErrNotFound) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return layer, nil
+	}
+
+	return nil, &lookupError{http.StatusNotFound, codeBlobUnknown, "'" + digest + "' is not cached"}
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// repoMetas returns metas of the repository.
+func (s *Server) repoMetas(name string) ([]storage.Meta, error) {
+	repo, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return nil, &lookupError{http.StatusBadRequest, codeNameInvalid, err.Error()}
+	}
+
+	metas, err := s.metas.GetAllMeta()
+	if err != nil {
+		return nil, err
+	}
+
+	repoMetas := []storage.Meta{}
+	for _, meta := range metas {
+		named, err := reference.ParseNormalizedNamed(meta.ImageName)
+		if err == nil && named.Name() == repo.Name() {
+			repoMetas = append(repoMetas, meta)
+		}
+	}
+	if len(repoMetas) == 0 {
+		return nil, &lookupError{http.StatusNotFound, codeNameUnknown, "'" + reference.FamiliarName(repo) + "' is not cached"}
+	}
+
+	return repoMetas, nil
+}
+
+// servedImages describes every image of the metas once, images removed concurrently are skipped.
+// Descriptions are cached until any image is saved or removed, so manifests aren't read and decrypted per request.
+func (s *Server) servedImages(metas []storage.Meta) ([]servedImage, error) {
+	// changes are taken before images are read, so a description of a changed image is never kept
+	changes := s.images.Changes()
+	seen := map[string]bool{}
+	images := []servedImage{}
+	for _, meta := range metas {
+		if seen[meta.ImageID] {
+			continue
+		}
+		seen[meta.ImageID] = true
+
+		if served, ok := s.cachedImage(meta.ImageID, changes); ok {
+			images = append(images, served)
+
+			continue
+		}
+
+		image, err := s.images.Image(meta.ImageID)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		served, err := newServedImage(image)
+		if err != nil {
+			log.Warnf("serving '%s', %s", meta.ImageName, err)
+
+			continue
+		}
+		s.cacheImage(meta.ImageID, served, changes)
+		images = append(images, served)
+	}
+
+	return images, nil
+}
+
+// saveOriginal keeps the upstream manifest of an image pulled through the proxy.
+func (s *Server) saveOriginal(mediaType string, data []byte) {
+	if s.originals == nil {
+		return
+	}
+	if err := s.originals.save(mediaType, data); err != nil {
+		log.Warnf("saving the upstream manifest '%s', %s", digestOf(data), err)
+	}
+}
+
+// sweepOriginals removes upstream manifests saved before the time whose images are not cached anymore.
+func (s *Server) sweepOriginals(before time.Time) error {
+	if s.originals == nil {
+		return nil
+	}
+
+	metas, err := s.metas.GetAllMeta()
+	if err != nil {
+		return err
+	}
+	cached := map[string]bool{}
+	for _, meta := range metas {
+		cached[meta.ImageID] = true
+	}
+
+	return s.originals.sweep(before, cached)
+}
+
+func (s *Server) cachedImage(imageID string, changes uint64) (servedImage, bool) {
+	s.servedMu.Lock()
+	defer s.servedMu.Unlock()
+
+	if changes > s.servedChanges {
+		s.served, s.servedChanges = map[string]servedImage{}, changes
+	}
+	if changes != s.servedChanges {
+		return servedImage{}, false
+	}
+	served, ok := s.served[imageID]
+
+	return served, ok
+}
+
+func (s *Server) cacheImage(imageID string, served servedImage, changes uint64) {
+	s.servedMu.Lock()
+	defer s.servedMu.Unlock()
+
+	if s.servedChanges == changes {
+		s.served[imageID] = served
+	}
+}
+
+func serveContent(w http.ResponseWriter, r *http.Request, mediaType, digest string, data []byte) {
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Etag", `"`+digest+`"`)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// serveBlob answers GET, HEAD and range requests.
+// A layer is decompressed again for every range which starts before the previous one.
+func serveBlob(w http.ResponseWriter, r *http.Request, digest string, blob io.ReadSeeker) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Etag", `"`+digest+`"`)
+	http.ServeContent(w, r, "", time.Time{}, blob)
+}
+
+// lookupError is a response of the distribution API.
+type lookupError struct {
+	statusCode int
+	code       string
+	message    string
+}
+
+func (e *lookupError) Error() string {
+	return e.message
+}
+
+func isNotFound(err error) bool {
+	var lookupErr *lookupError
+
+	return errors.As(err, &lookupErr) && lookupErr.statusCode == http.StatusNotFound
+}
+
+func writeLookupError(w http.ResponseWriter, err error) {
+	var lookupErr *lookupError
+	if errors.As(err, &lookupErr) {
+		writeError(w, lookupErr.statusCode, lookupErr.code, lookupErr.message)
+
+		return
+	}
+	writeInternalError(w, err)
+}
+
+type responseError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeError(w http.ResponseWriter, statusCode int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(struct {
+		Errors []responseError `json:"errors"`
+	}{Errors: []responseError{{Code: code, Message: message}}})
+}
+
+func writeInternalError(w http.ResponseWriter, err error) {
+	log.Warnf("registry, %s", err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,240 @@
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+	"github.com/podtserkovskiy/garnerd/storage/image/compact"
+)
+
+func setUpTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("can't create tempdir", err)
+	}
+	t.Cleanup(cleanUpTempDir(t, dir))
+
+	return dir
+}
+
+func cleanUpTempDir(t *testing.T, dir string) func() {
+	return func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatal("can't remove tempdir", err)
+		}
+	}
+}
+
+type metasStub []storage.Meta
+
+func (m metasStub) GetAllMeta() ([]storage.Meta, error) {
+	return m, nil
+}
+
+type testImage struct {
+	id     string
+	config []byte
+	layers [][]byte
+}
+
+// saveImage saves a `docker save` dump of the layers for the platform and returns the image.
+func saveImage(t *testing.T, images *compact.ImgStorage, arch string, layers ...[]byte) testImage {
+	diffIDs := []string{}
+	for _, layer := range layers {
+		diffIDs = append(diffIDs, digestOf(layer))
+	}
+	config, err := json.Marshal(map[string]interface{}{
+		"os":           "linux",
+		"architecture": arch,
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+	})
+	require.NoError(t, err)
+	id := digestOf(config)
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	writeFile := func(name string, content []byte) {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}))
+		_, err := tw.Write(content)
+		require.NoError(t, err)
+	}
+	layerFiles := []string{}
+	for _, layer := range layers {
+		dir := fmt.Sprintf("%x", sha256.Sum256(append([]byte(arch), layer...)))
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: dir + "/", Mode: 0755, Typeflag: tar.TypeDir}))
+		writeFile(dir+"/layer.tar", layer)
+		layerFiles = append(layerFiles, dir+"/layer.tar")
+	}
+	manifest, err := json.Marshal([]map[string]interface{}{{"Config": id[7:] + ".json", "Layers": layerFiles}})
+	require.NoError(t, err)
+	writeFile("manifest.json", manifest)
+	writeFile(id[7:]+".json", config)
+	require.NoError(t, tw.Close())
+
+	require.NoError(t, images.Save(id, buf))
+
+	return testImage{id: id, config: config, layers: layers}
+}
+
+func get(t *testing.T, server http.Handler, method, path string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp := httptest.NewRecorder()
+	server.ServeHTTP(resp, req)
+
+	return resp
+}
+
+func TestServer(t *testing.T) {
+	images := compact.NewImgStorage(setUpTempDir(t))
+	base, app := []byte("base layer"), bytes.Repeat([]byte("app layer "), 1000)
+	amd64 := saveImage(t, images, "amd64", base, app)
+	arm64 := saveImage(t, images, "arm64", base)
+	other := saveImage(t, images, "amd64", []byte("other"))
+
+	server := NewServer(metasStub{
+		{ImageName: "alpine:3", ImageID: amd64.id, OS: "linux", Architecture: "amd64"},
+		{ImageName: "alpine:3", ImageID: arm64.id, OS: "linux", Architecture: "arm64"},
+		{ImageName: "alpine:latest", ImageID: amd64.id, OS: "linux", Architecture: "amd64"},
+		{ImageName: "quay.io/team/other:1", ImageID: other.id},
+	}, images)
+
+	t.Run("api version", func(t *testing.T) {
+		resp := get(t, server, http.MethodGet, "/v2/", nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		require.Equal(t, "registry/2.0", resp.Header().Get("Docker-Distribution-API-Version"))
+	})
+
+	var latest manifest
+	t.Run("manifest by tag", func(t *testing.T) {
+		resp := get(t, server, http.MethodGet, "/v2/library/alpine/manifests/latest", nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		require.Equal(t, mediaTypeManifest, resp.Header().Get("Content-Type"))
+		require.Equal(t, digestOf(resp.Body.Bytes()), resp.Header().Get("Docker-Content-Digest"))
+
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &latest))
+		require.Equal(t, descriptor{MediaType: mediaTypeConfig, Digest: amd64.id, Size: int64(len(amd64.config))}, latest.Config)
+		require.Equal(t, []descriptor{
+			{MediaType: mediaTypeLayer, Digest: digestOf(base), Size: int64(len(base))},
+			{MediaType: mediaTypeLayer, Digest: digestOf(app), Size: int64(len(app))},
+		}, latest.Layers)
+
+		head := get(t, server, http.MethodHead, "/v2/alpine/manifests/latest", nil)
+		require.Equal(t, http.StatusOK, head.Code)
+		require.Equal(t, resp.Header().Get("Docker-Content-Digest"), head.Header().Get("Docker-Content-Digest"))
+		require.Equal(t, fmt.Sprint(resp.Body.Len()), head.Header().Get("Content-Length"))
+		require.Empty(t, head.Body.Bytes())
+	})
+
+	t.Run("index of platforms", func(t *testing.T) {
+		resp := get(t, server, http.MethodGet, "/v2/library/alpine/manifests/3", nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		require.Equal(t, mediaTypeIndex, resp.Header().Get("Content-Type"))
+
+		var imageIndex index
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &imageIndex))
+		require.Len(t, imageIndex.Manifests, 2)
+		platforms := []string{}
+		for _, manifest := range imageIndex.Manifests {
+			platforms = append(platforms, manifest.Platform.OS+"/"+manifest.Platform.Architecture)
+
+			byDigest := get(t, server, http.MethodGet, "/v2/library/alpine/manifests/"+manifest.Digest, nil)
+			require.Equal(t, http.StatusOK, byDigest.Code)
+			require.Equal(t, manifest.Digest, digestOf(byDigest.Body.Bytes()))
+		}
+		require.ElementsMatch(t, []string{"linux/amd64", "linux/arm64"}, platforms)
+
+		byDigest := get(t, server, http.MethodGet, "/v2/library/alpine/manifests/"+digestOf(resp.Body.Bytes()), nil)
+		require.Equal(t, http.StatusOK, byDigest.Code)
+		require.Equal(t, resp.Body.Bytes(), byDigest.Body.Bytes())
+	})
+
+	t.Run("blobs", func(t *testing.T) {
+		resp := get(t, server, http.MethodGet, "/v2/library/alpine/blobs/"+amd64.id, nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		require.Equal(t, amd64.config, resp.Body.Bytes())
+
+		resp = get(t, server, http.MethodGet, "/v2/library/alpine/blobs/"+digestOf(app), nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		require.Equal(t, app, resp.Body.Bytes())
+		require.Equal(t, digestOf(app), resp.Header().Get("Docker-Content-Digest"))
+
+		resp = get(t, server, http.MethodHead, "/v2/library/alpine/blobs/"+digestOf(app), nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		require.Equal(t, fmt.Sprint(len(app)), resp.Header().Get("Content-Length"))
+		require.Empty(t, resp.Body.Bytes())
+
+		resp = get(t, server, http.MethodGet, "/v2/library/alpine/blobs/"+digestOf(app), http.Header{"Range": {"bytes=100-199"}})
+		require.Equal(t, http.StatusPartialContent, resp.Code)
+		require.Equal(t, app[100:200], resp.Body.Bytes())
+		require.Equal(t, fmt.Sprintf("bytes 100-199/%d", len(app)), resp.Header().Get("Content-Range"))
+	})
+
+	t.Run("other registries", func(t *testing.T) {
+		resp := get(t, server, http.MethodGet, "/v2/quay.io/team/other/manifests/1", nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		resp := get(t, server, http.MethodGet, "/v2/library/alpine/manifests/2", nil)
+		require.Equal(t, http.StatusNotFound, resp.Code)
+		require.JSONEq(t, `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"'alpine:2' is not cached"}]}`, resp.Body.String())
+
+		resp = get(t, server, http.MethodGet, "/v2/library/ubuntu/manifests/latest", nil)
+		require.Equal(t, http.StatusNotFound, resp.Code)
+		require.JSONEq(t, `{"errors":[{"code":"NAME_UNKNOWN","message":"'ubuntu' is not cached"}]}`, resp.Body.String())
+
+		// blobs are served only by repositories which have them
+		resp = get(t, server, http.MethodGet, "/v2/library/alpine/blobs/"+digestOf([]byte("other")), nil)
+		require.Equal(t, http.StatusNotFound, resp.Code)
+		require.Contains(t, resp.Body.String(), "BLOB_UNKNOWN")
+	})
+
+	t.Run("read-only", func(t *testing.T) {
+		resp := get(t, server, http.MethodPut, "/v2/library/alpine/manifests/latest", nil)
+		require.Equal(t, http.StatusMethodNotAllowed, resp.Code)
+		require.Contains(t, resp.Body.String(), "UNSUPPORTED")
+	})
+}
+
+type countingImages struct {
+	*compact.ImgStorage
+	reads int
+}
+
+func (c *countingImages) Image(imageName string) (compact.Image, error) {
+	c.reads++
+
+	return c.ImgStorage.Image(imageName)
+}
+
+func TestServer_CachedImages(t *testing.T) {
+	images := &countingImages{ImgStorage: compact.NewImgStorage(setUpTempDir(t))}
+	image := saveImage(t, images.ImgStorage, "amd64", []byte("base layer"))
+	server := NewServer(metasStub{{ImageName: "alpine:3", ImageID: image.id}}, images)
+
+	for n := 0; n < 3; n++ {
+		resp := get(t, server, http.MethodGet, "/v2/library/alpine/manifests/3", nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		resp = get(t, server, http.MethodGet, "/v2/library/alpine/blobs/"+image.id, nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+	}
+	require.Equal(t, 1, images.reads, "the image is described once")
+
+	require.NoError(t, images.Remove(image.id))
+	resp := get(t, server, http.MethodGet, "/v2/library/alpine/manifests/3", nil)
+	require.Equal(t, http.StatusNotFound, resp.Code, "removing an image drops descriptions")
+}
@@ -0,0 +1,162 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// DockerHub is the registry which daemons mirror by registry-mirrors.
+const DockerHub = "https://registry-1.docker.io"
+
+// nolint: gochecknoglobals
+var authParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// upstreamError is an error status of the upstream registry.
+type upstreamError struct {
+	statusCode int
+	url        string
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("upstream responded %d to '%s'", e.statusCode, e.url)
+}
+
+func isUpstreamNotFound(err error) bool {
+	var upstreamErr *upstreamError
+
+	return errors.As(err, &upstreamErr) && upstreamErr.statusCode == http.StatusNotFound
+}
+
+// upstream pulls from a registry anonymously, bearer tokens are requested on demand.
+type upstream struct {
+	client *http.Client
+	base   *url.URL
+
+	mu sync.Mutex
+	// tokens are bearer tokens by repositories
+	tokens map[string]string
+}
+
+func newUpstream(rawURL string, client *http.Client) (*upstream, error) {
+	base, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing upstream url, %w", err)
+	}
+
+	return &upstream{client: client, base: base, tokens: map[string]string{}}, nil
+}
+
+// do requests /v2/<name>/<path> of the upstream, a response with an error status is returned as *upstreamError.
+func (u *upstream) do(ctx context.Context, method, name, path string, header http.Header) (*http.Response, error) {
+	reqURL := *u.base
+	reqURL.Path = strings.TrimSuffix(reqURL.Path, "/") + "/v2/" + name + "/" + path
+
+	resp, err := u.send(ctx, method, reqURL.String(), name, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		_ = resp.Body.Close()
+		if err = u.authorize(ctx, name, challenge); err != nil {
+			return nil, err
+		}
+		if resp, err = u.send(ctx, method, reqURL.String(), name, header); err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		_ = resp.Body.Close()
+
+		return nil, &upstreamError{statusCode: resp.StatusCode, url: reqURL.String()}
+	}
+
+	return resp, nil
+}
+
+func (u *upstream) send(ctx context.Context, method, rawURL, name string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	u.mu.Lock()
+	token := u.tokens[name]
+	u.mu.Unlock()
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return u.client.Do(req)
+}
+
+// authorize gets a pull token for the repository from the realm of the bearer challenge.
+func (u *upstream) authorize(ctx context.Context, name, challenge string) error {
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return fmt.Errorf("unsupported upstream authentication '%s'", challenge) // nolint: goerr113
+	}
+
+	params := map[string]string{}
+	for _, match := range authParam.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("no realm in the upstream challenge '%s'", challenge) // nolint: goerr113
+	}
+
+	query := realm.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	query.Set("scope", "repository:"+name+":pull")
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := u.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("getting an upstream token, %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &upstreamError{statusCode: resp.StatusCode, url: realm.String()}
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.Unmarshal(data, &token); err != nil {
+		return fmt.Errorf("decoding an upstream token, %w", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+
+	u.mu.Lock()
+	u.tokens[name] = token.Token
+	u.mu.Unlock()
+
+	return nil
+}
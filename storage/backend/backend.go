@@ -0,0 +1,147 @@
+// Package backend opens image and meta storages by URLs, the scheme of a URL picks the backend.
+// Packages add their own backends by calling RegisterImg or RegisterMeta from init.
+package backend
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/podtserkovskiy/garnerd/storage/image/compact"
+	"github.com/podtserkovskiy/garnerd/storage/separated"
+)
+
+// Params are settings of the daemon which backends may use.
+type Params struct {
+	// CompressionWorkers is a number of layers compressed at the same time.
+	CompressionWorkers int
+	// Codec compresses newly saved layers.
+	Codec compact.Codec
+	// SlowTier is a dir which the compact backend moves layers of cold images to, "" keeps all layers in its dir.
+	SlowTier string
+	// Keyring encrypts meta and layers of images in the compact backend, nil keeps them in plain text.
+	Keyring *compact.Keyring
+	// ReadOnly opens storages for restoring only, e.g. from a read-only mount, their changes fail.
+	ReadOnly bool
+}
+
+type ImgOpener func(storageURL *url.URL, params Params) (separated.ImgStorage, error)
+
+type MetaOpener func(storageURL *url.URL, params Params) (separated.MetaCRUD, error)
+
+var (
+	mu          sync.RWMutex
+	imgOpeners  = map[string]ImgOpener{}
+	metaOpeners = map[string]MetaOpener{}
+)
+
+// RegisterImg makes the image backend available by the scheme, it panics if the scheme is taken.
+func RegisterImg(scheme string, open ImgOpener) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := imgOpeners[scheme]; ok {
+		panic(fmt.Sprintf("image backend '%s' is registered twice", scheme))
+	}
+	imgOpeners[scheme] = open
+}
+
+// RegisterMeta makes the meta backend available by the scheme, it panics if the scheme is taken.
+func RegisterMeta(scheme string, open MetaOpener) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := metaOpeners[scheme]; ok {
+		panic(fmt.Sprintf("meta backend '%s' is registered twice", scheme))
+	}
+	metaOpeners[scheme] = open
+}
+
+func OpenImg(rawURL string, params Params) (separated.ImgStorage, error) {
+	storageURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing image storage url, %w", err)
+	}
+
+	mu.RLock()
+	open, ok := imgOpeners[storageURL.Scheme]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown image backend '%s', known are %v", storageURL.Scheme, ImgSchemes()) // nolint: goerr113
+	}
+
+	imgStorage, err := open(storageURL, params)
+	if err != nil {
+		return nil, fmt.Errorf("opening image storage '%s', %w", rawURL, err)
+	}
+
+	return imgStorage, nil
+}
+
+func OpenMeta(rawURL string, params Params) (separated.MetaCRUD, error) {
+	storageURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing meta storage url, %w", err)
+	}
+
+	mu.RLock()
+	open, ok := metaOpeners[storageURL.Scheme]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown meta backend '%s', known are %v", storageURL.Scheme, MetaSchemes()) // nolint: goerr113
+	}
+
+	metaStorage, err := open(storageURL, params)
+	if err != nil {
+		return nil, fmt.Errorf("opening meta storage '%s', %w", rawURL, err)
+	}
+
+	return metaStorage, nil
+}
+
+// ImgSchemes returns sorted schemes of registered image backends.
+func ImgSchemes() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	schemes := make([]string, 0, len(imgOpeners))
+	for scheme := range imgOpeners {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+
+	return schemes
+}
+
+// MetaSchemes returns sorted schemes of registered meta backends.
+func MetaSchemes() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	schemes := make([]string, 0, len(metaOpeners))
+	for scheme := range metaOpeners {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+
+	return schemes
+}
+
+// URL returns a URL of the dir backend for the dir.
+func URL(scheme, dir string) string {
+	return (&url.URL{Scheme: scheme, Path: dir}).String()
+}
+
+// Dir returns the dir of file://dir, file:///abs/dir or file:dir.
+func Dir(storageURL *url.URL) (string, error) {
+	dir := storageURL.Opaque
+	if dir == "" {
+		dir = storageURL.Host + storageURL.Path
+	}
+	if dir == "" {
+		return "", fmt.Errorf("'%s' has no dir", storageURL) // nolint: goerr113
+	}
+
+	return dir, nil
+}
@@ -0,0 +1,121 @@
+package backend
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/podtserkovskiy/garnerd/storage/image/compact"
+	fs1 "github.com/podtserkovskiy/garnerd/storage/image/fs"
+	mem1 "github.com/podtserkovskiy/garnerd/storage/image/mem"
+	fs2 "github.com/podtserkovskiy/garnerd/storage/meta/fs"
+	"github.com/podtserkovskiy/garnerd/storage/meta/journal"
+	"github.com/podtserkovskiy/garnerd/storage/meta/kv"
+	mem2 "github.com/podtserkovskiy/garnerd/storage/meta/mem"
+	"github.com/podtserkovskiy/garnerd/storage/separated"
+)
+
+func setUpTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("can't create tempdir", err)
+	}
+	t.Cleanup(cleanUpTempDir(t, dir))
+
+	return dir
+}
+
+func cleanUpTempDir(t *testing.T, dir string) func() {
+	return func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatal("can't remove tempdir", err)
+		}
+	}
+}
+
+func TestOpenImg(t *testing.T) {
+	dir := setUpTempDir(t)
+	params := Params{CompressionWorkers: 1, Codec: compact.DefaultCodec}
+
+	imgStorage, err := OpenImg(URL(SchemeFile, dir), params)
+	require.NoError(t, err)
+	require.IsType(t, &fs1.ImgStorage{}, imgStorage)
+
+	imgStorage, err = OpenImg(URL(SchemeCompact, dir), params)
+	require.NoError(t, err)
+	require.IsType(t, &compact.ImgStorage{}, imgStorage)
+
+	imgStorage, err = OpenImg("mem://", params)
+	require.NoError(t, err)
+	require.IsType(t, &mem1.ImgStorage{}, imgStorage)
+
+	_, err = OpenImg("gs://bucket", params)
+	require.EqualError(t, err, "unknown image backend 'gs', known are [compact file mem s3]")
+
+	_, err = OpenImg("compact://", params)
+	require.EqualError(t, err, "opening image storage 'compact://', 'compact:' has no dir")
+}
+
+func TestOpenMeta(t *testing.T) {
+	dir := setUpTempDir(t)
+
+	metaStorage, err := OpenMeta(URL(SchemeFile, dir), Params{})
+	require.NoError(t, err)
+	require.IsType(t, &fs2.MetaCRUD{}, metaStorage)
+
+	metaStorage, err = OpenMeta(URL(SchemeJournal, dir), Params{})
+	require.NoError(t, err)
+	require.IsType(t, &journal.MetaJournal{}, metaStorage)
+
+	metaStorage, err = OpenMeta(URL(SchemeKV, dir), Params{})
+	require.NoError(t, err)
+	require.IsType(t, &kv.MetaDB{}, metaStorage)
+
+	metaStorage, err = OpenMeta("mem://", Params{})
+	require.NoError(t, err)
+	require.IsType(t, &mem2.MetaCRUD{}, metaStorage)
+
+	_, err = OpenMeta("bolt:///tmp", Params{})
+	require.EqualError(t, err, "unknown meta backend 'bolt', known are [file journal kv mem s3]")
+}
+
+func TestRegister(t *testing.T) {
+	var opened *url.URL
+	RegisterImg("custom", func(storageURL *url.URL, params Params) (separated.ImgStorage, error) {
+		opened = storageURL
+
+		return mem1.NewImgStorage(), nil
+	})
+	defer func() {
+		mu.Lock()
+		delete(imgOpeners, "custom")
+		mu.Unlock()
+	}()
+
+	_, err := OpenImg("custom://host/path?x=1", Params{})
+	require.NoError(t, err)
+	require.Equal(t, "host", opened.Host)
+	require.Equal(t, "1", opened.Query().Get("x"))
+
+	require.PanicsWithValue(t, "image backend 'custom' is registered twice", func() {
+		RegisterImg("custom", nil)
+	})
+}
+
+func TestDir(t *testing.T) {
+	for rawURL, expected := range map[string]string{
+		"file:///var/cache/garnerd": "/var/cache/garnerd",
+		"file://cache/garnerd":      "cache/garnerd",
+		"file:cache":                "cache",
+		URL(SchemeFile, "/a b/c"):   "/a b/c",
+	} {
+		storageURL, err := url.Parse(rawURL)
+		require.NoError(t, err)
+		dir, err := Dir(storageURL)
+		require.NoError(t, err)
+		require.Equal(t, expected, dir, rawURL)
+	}
+}
@@ -0,0 +1,98 @@
+package backend
+
+import (
+	"net/url"
+	"os"
+
+	"github.com/podtserkovskiy/garnerd/storage/image/compact"
+	fs1 "github.com/podtserkovskiy/garnerd/storage/image/fs"
+	mem1 "github.com/podtserkovskiy/garnerd/storage/image/mem"
+	fs2 "github.com/podtserkovskiy/garnerd/storage/meta/fs"
+	"github.com/podtserkovskiy/garnerd/storage/meta/journal"
+	"github.com/podtserkovskiy/garnerd/storage/meta/kv"
+	mem2 "github.com/podtserkovskiy/garnerd/storage/meta/mem"
+	"github.com/podtserkovskiy/garnerd/storage/s3"
+	"github.com/podtserkovskiy/garnerd/storage/separated"
+)
+
+const (
+	SchemeFile    = "file"
+	SchemeCompact = "compact"
+	SchemeJournal = "journal"
+	SchemeKV      = "kv"
+	SchemeMem     = "mem"
+	SchemeS3      = "s3"
+)
+
+func init() {
+	RegisterImg(SchemeFile, func(storageURL *url.URL, params Params) (separated.ImgStorage, error) {
+		dir, err := Dir(storageURL)
+		if err != nil {
+			return nil, err
+		}
+
+		return fs1.NewImgStorage(dir), nil
+	})
+	RegisterImg(SchemeCompact, func(storageURL *url.URL, params Params) (separated.ImgStorage, error) {
+		dir, err := Dir(storageURL)
+		if err != nil {
+			return nil, err
+		}
+
+		return compact.NewImgStorage(
+			dir,
+			compact.WithCompressionWorkers(params.CompressionWorkers),
+			compact.WithCodec(params.Codec),
+			compact.WithSlowTier(params.SlowTier),
+			compact.WithEncryption(params.Keyring),
+			compact.WithReadOnly(params.ReadOnly),
+		), nil
+	})
+	RegisterImg(SchemeMem, func(*url.URL, Params) (separated.ImgStorage, error) {
+		return mem1.NewImgStorage(), nil
+	})
+	RegisterImg(SchemeS3, func(storageURL *url.URL, params Params) (separated.ImgStorage, error) {
+		cfg, err := s3.ConfigFromURL(storageURL.String(), os.Getenv)
+		if err != nil {
+			return nil, err
+		}
+
+		return s3.NewImgStorage(cfg)
+	})
+
+	RegisterMeta(SchemeFile, func(storageURL *url.URL, params Params) (separated.MetaCRUD, error) {
+		dir, err := Dir(storageURL)
+		if err != nil {
+			return nil, err
+		}
+
+		return fs2.NewMetaCRUD(fs2.NewMetaFile(dir)), nil
+	})
+	RegisterMeta(SchemeJournal, func(storageURL *url.URL, params Params) (separated.MetaCRUD, error) {
+		dir, err := Dir(storageURL)
+		if err != nil {
+			return nil, err
+		}
+
+		return journal.NewMetaJournal(dir, journal.WithReadOnly(params.ReadOnly)), nil
+	})
+	RegisterMeta(SchemeKV, func(storageURL *url.URL, params Params) (separated.MetaCRUD, error) {
+		dir, err := Dir(storageURL)
+		if err != nil {
+			return nil, err
+		}
+
+		return kv.NewMetaDB(dir, kv.WithReadOnly(params.ReadOnly))
+	})
+	RegisterMeta(SchemeMem, func(*url.URL, Params) (separated.MetaCRUD, error) {
+		return mem2.NewMetaCRUD(), nil
+	})
+	RegisterMeta(SchemeS3, func(storageURL *url.URL, params Params) (separated.MetaCRUD, error) {
+		cfg, err := s3.ConfigFromURL(storageURL.String(), os.Getenv)
+		if err != nil {
+			return nil, err
+		}
+
+		return s3.NewMetaCRUD(cfg)
+	})
+}
@@ -0,0 +1,189 @@
+package compact
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+)
+
+// Image is the config and the layers of a stored image, layers are in the order of its rootfs.
+type Image struct {
+	Config []byte
+	Layers []Layer
+}
+
+type Layer struct {
+	ID string
+	// Size is the size of the uncompressed layer.tar.
+	Size int64
+}
+
+// Image returns the config and the layers of the image, it returns storage.ErrNotFound if the image is not stored.
+func (i *ImgStorage) Image(imageName string) (Image, error) {
+	dirName := imageNameToDirName(imageName)
+	defer i.images.Lock(dirName)()
+
+	imgMetaDir := filepath.Join(i.dir, "meta", dirName)
+	manifest, err := i.readManifest(filepath.Join(imgMetaDir, "manifest.json"))
+	if os.IsNotExist(err) {
+		return Image{}, storage.ErrNotFound
+	}
+	if err != nil {
+		return Image{}, err
+	}
+	if len(manifest) == 0 {
+		return Image{}, fmt.Errorf("manifest of '%s' is empty", imageName) // nolint: goerr113
+	}
+
+	config, err := i.readFile(filepath.Join(imgMetaDir, filepath.Clean("/"+manifest[0].Config)))
+	if err != nil {
+		return Image{}, fmt.Errorf("reading the config of '%s', %w", imageName, err)
+	}
+
+	image := Image{Config: config}
+	for _, layerFile := range manifest[0].Layers {
+		meta, err := loadLayerMeta(filepath.Join(i.layerDir(layerOf(layerFile)), "layer.tar"))
+		if err != nil {
+			return Image{}, err
+		}
+		image.Layers = append(image.Layers, Layer{ID: layerOf(layerFile), Size: meta.OriginalSize})
+	}
+
+	return image, nil
+}
+
+// LayerReader reads an uncompressed layer.tar. Seeking forward skips the current stream ahead,
+// but seeking backward decompresses the layer again from its start, so ranges are cheap only in ascending order.
+type LayerReader struct {
+	path string
+	size int64
+	pos  int64
+
+	open   func(path string) (io.ReadCloser, error)
+	file   io.Closer
+	dec    io.ReadCloser
+	decPos int64
+
+	pins *pinSet
+}
+
+// OpenLayer opens layer.tar of the layer, the layer is not garbage collected until the reader is closed.
+func (i *ImgStorage) OpenLayer(layerID string) (*LayerReader, error) {
+	layerID = filepath.Base(layerID)
+	pins := i.refs.newPinSet()
+	pins.pin(layerID)
+
+	path := filepath.Join(i.layerDir(layerID), "layer.tar")
+	meta, err := loadLayerMeta(path)
+	if os.IsNotExist(err) {
+		pins.release()
+
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		pins.release()
+
+		return nil, err
+	}
+
+	// the layer is opened under its shared lock, so it's never caught while being replaced
+	open := func(path string) (io.ReadCloser, error) {
+		defer i.layers.RLock(layerID)()
+
+		return i.openFile(path)
+	}
+
+	return &LayerReader{path: path, size: meta.OriginalSize, open: open, pins: pins}, nil
+}
+
+func (r *LayerReader) Size() int64 {
+	return r.size
+}
+
+func (r *LayerReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.dec == nil || r.decPos != r.pos {
+		if err := r.reopen(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.dec.Read(p)
+	r.pos += int64(n)
+	r.decPos = r.pos
+
+	return n, err
+}
+
+// reopen decompresses the layer from the start up to the current position.
+func (r *LayerReader) reopen() error {
+	if r.dec != nil && r.decPos < r.pos {
+		// seeking forward continues the current stream
+		if _, err := io.CopyN(ioutil.Discard, r.dec, r.pos-r.decPos); err != nil {
+			return err
+		}
+		r.decPos = r.pos
+
+		return nil
+	}
+
+	r.closeStream()
+	file, err := r.open(r.path)
+	if err != nil {
+		return err
+	}
+	dec, err := NewDecompressor(file)
+	if err != nil {
+		_ = file.Close()
+
+		return err
+	}
+	r.file, r.dec, r.decPos = file, dec, 0
+
+	if _, err = io.CopyN(ioutil.Discard, r.dec, r.pos); err != nil {
+		return err
+	}
+	r.decPos = r.pos
+
+	return nil
+}
+
+var errNegativePosition = errors.New("negative position")
+
+func (r *LayerReader) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	switch whence {
+	case io.SeekCurrent:
+		pos += r.pos
+	case io.SeekEnd:
+		pos += r.size
+	}
+	if pos < 0 {
+		return 0, errNegativePosition
+	}
+	r.pos = pos
+
+	return pos, nil
+}
+
+func (r *LayerReader) closeStream() {
+	if r.dec != nil {
+		_ = r.dec.Close()
+		_ = r.file.Close()
+		r.dec, r.file = nil, nil
+	}
+}
+
+func (r *LayerReader) Close() error {
+	r.closeStream()
+	r.pins.release()
+
+	return nil
+}
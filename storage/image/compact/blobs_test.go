@@ -0,0 +1,71 @@
+package compact
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+)
+
+func TestImgStorage_Image(t *testing.T) {
+	imgStorage := NewImgStorage(setUpTempDir(t))
+	dump, files := makeImageDump(t, 2, 1000)
+	require.NoError(t, imgStorage.Save("img:1", bytes.NewReader(dump)))
+
+	image, err := imgStorage.Image("img:1")
+	require.NoError(t, err)
+	require.Equal(t, Image{
+		Config: files["config.json"],
+		Layers: []Layer{
+			{ID: "0000000000000000000000000000000000000000000000000000000000000001", Size: 1000},
+			{ID: "0000000000000000000000000000000000000000000000000000000000000002", Size: 1000},
+		},
+	}, image)
+
+	_, err = imgStorage.Image("img:2")
+	require.Equal(t, storage.ErrNotFound, err)
+}
+
+func TestImgStorage_OpenLayer(t *testing.T) {
+	for _, codec := range []Codec{{Name: CodecNone}, {Name: CodecGzip, Level: 1}, DefaultCodec} {
+		codec := codec
+		t.Run(codec.String(), func(t *testing.T) {
+			imgStorage := NewImgStorage(setUpTempDir(t), WithCodec(codec))
+			dump, files := makeImageDump(t, 1, 100<<10)
+			require.NoError(t, imgStorage.Save("img:1", bytes.NewReader(dump)))
+			layerID := "0000000000000000000000000000000000000000000000000000000000000001"
+			content := files[layerID+"/layer.tar"]
+
+			layer, err := imgStorage.OpenLayer(layerID)
+			require.NoError(t, err)
+			defer layer.Close()
+			require.Equal(t, int64(len(content)), layer.Size())
+
+			data, err := ioutil.ReadAll(layer)
+			require.NoError(t, err)
+			require.Equal(t, content, data)
+
+			for _, offset := range []int64{50 << 10, 10, 90 << 10} {
+				_, err = layer.Seek(offset, io.SeekStart)
+				require.NoError(t, err)
+				part := make([]byte, 100)
+				_, err = io.ReadFull(layer, part)
+				require.NoError(t, err)
+				require.Equal(t, content[offset:offset+100], part, offset)
+			}
+
+			end, err := layer.Seek(0, io.SeekEnd)
+			require.NoError(t, err)
+			require.Equal(t, int64(len(content)), end)
+		})
+	}
+
+	t.Run("not found", func(t *testing.T) {
+		_, err := NewImgStorage(setUpTempDir(t)).OpenLayer("abc")
+		require.Equal(t, storage.ErrNotFound, err)
+	})
+}
@@ -0,0 +1,285 @@
+package compact
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+)
+
+// Bundles keep images as they are stored:
+//
+//	images/<escaped image name>/   meta files of the image
+//	layers/<id>/                    compressed layers with their sidecars, every layer once
+//
+// Layers follow the meta of the first image which uses them, so a bundle is imported in one pass.
+// Files are decrypted on export and encrypted with the key of the importing store, so bundles are portable.
+const (
+	bundleImagesDir = "images"
+	bundleLayersDir = "layers"
+)
+
+// ExportImage writes the image to the bundle without re-encoding its layers, layers in written are skipped
+// and written layers are added to it.
+func (i *ImgStorage) ExportImage(dst *tar.Writer, imageName string, written map[string]bool) error {
+	defer i.touch()
+	dirName := imageNameToDirName(imageName)
+	defer i.images.Lock(dirName)()
+
+	pins := i.refs.newPinSet()
+	defer pins.release()
+
+	imgMetaDir := filepath.Join(i.dir, "meta", dirName)
+	manifest, err := i.readManifest(filepath.Join(imgMetaDir, "manifest.json"))
+	if err != nil {
+		return fmt.Errorf("reading the manifest of '%s', %w", imageName, err)
+	}
+
+	if err = i.tarDir(dst, imgMetaDir, bundleImagesDir+"/"+url.PathEscape(imageName)); err != nil {
+		return err
+	}
+
+	for _, layer := range manifest.layers() {
+		if written[layer] {
+			continue
+		}
+		pins.pin(layer)
+		if err = i.exportLayer(dst, layer); err != nil {
+			return fmt.Errorf("exporting layer '%s', %w", layer, err)
+		}
+		written[layer] = true
+	}
+
+	return nil
+}
+
+// exportLayer writes files of the layer under its shared lock, so they aren't replaced meanwhile.
+func (i *ImgStorage) exportLayer(dst *tar.Writer, layer string) error {
+	defer i.layers.RLock(layer)()
+
+	return i.tarDir(dst, i.layerDir(layer), bundleLayersDir+"/"+layer)
+}
+
+// tarDir writes files of the dir as they are stored but decrypted, the dir itself is written first.
+func (i *ImgStorage) tarDir(dst *tar.Writer, dir, tarDir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	if err = dst.WriteHeader(&tar.Header{Name: tarDir + "/", Mode: 0755, Typeflag: tar.TypeDir}); err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !file.Mode().IsRegular() || isTempFile(file.Name()) {
+			continue
+		}
+		hdr, err := tar.FileInfoHeader(file, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = tarDir + "/" + file.Name()
+		hdr.Size = i.plainSize(file)
+		if err = dst.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if err = i.copyFileTo(dst, filepath.Join(dir, file.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (i *ImgStorage) copyFileTo(dst io.Writer, path string) error {
+	file, err := i.openFile(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(dst, file)
+
+	return err
+}
+
+// ImportImages stores images of the rest of the bundle written by ExportImage, layers are stored as they are compressed
+// and layers which are stored already are skipped. Only images accepted by accept are imported,
+// every image is staged and committed like a save.
+func (i *ImgStorage) ImportImages(src *tar.Reader, accept func(imageName string) (bool, error)) error {
+	if i.readOnly {
+		return storage.ErrReadOnly
+	}
+	defer i.cleanUp()
+	defer i.touch()
+
+	// layers follow the first image which uses them, so they are spooled even for skipped images
+	spool, err := i.newStage("bundle")
+	if err != nil {
+		return err
+	}
+	defer spool.remove()
+
+	pins := i.refs.newPinSet()
+	defer pins.release()
+
+	var current *bundleImport
+	defer func() {
+		current.abort()
+	}()
+
+	for {
+		header, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		parts := strings.SplitN(filepath.ToSlash(filepath.Clean(header.Name)), "/", 3)
+		if len(parts) < 2 {
+			return fmt.Errorf("unexpected bundle entry '%s'", header.Name) // nolint: goerr113
+		}
+
+		switch parts[0] {
+		case bundleImagesDir:
+			imageName, err := url.PathUnescape(parts[1])
+			if err != nil {
+				return fmt.Errorf("bundle entry '%s', %w", header.Name, err)
+			}
+			if current == nil || current.imageName != imageName {
+				if err = current.commit(); err != nil {
+					return err
+				}
+				if current, err = i.startImport(imageName, spool, pins, accept); err != nil {
+					return err
+				}
+			}
+			if len(parts) == 3 && !header.FileInfo().IsDir() {
+				err = current.addMeta(parts[2], header, src)
+			}
+		case bundleLayersDir:
+			if len(parts) == 3 && !header.FileInfo().IsDir() {
+				err = i.spoolLayerFile(spool, pins, parts[1], parts[2], header, src)
+			}
+		default:
+			err = fmt.Errorf("unexpected bundle entry '%s'", header.Name) // nolint: goerr113
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err = current.commit()
+	// layers spooled for nothing are collected
+	if releaseErr := i.index.release(pins.layers); err == nil {
+		err = releaseErr
+	}
+
+	return err
+}
+
+// spoolLayerFile writes a file of the layer to the spool, files of stored layers are skipped.
+func (i *ImgStorage) spoolLayerFile(spool stagingDir, pins *pinSet, layer, name string, header *tar.Header, src io.Reader) error {
+	layer = filepath.Base(layer)
+	pins.pin(layer)
+
+	if _, err := loadLayerMeta(filepath.Join(i.layerDir(layer), "layer.tar")); err == nil {
+		return nil
+	}
+
+	dstFile := filepath.Join(spool.layersDir(), layer, filepath.Clean("/"+name))
+	if err := os.MkdirAll(filepath.Dir(dstFile), os.ModePerm); err != nil {
+		return err
+	}
+
+	return i.writeFile(dstFile, header.FileInfo().Mode(), src, io.Copy)
+}
+
+// bundleImport stages one image of a bundle, a skipped image has no stage.
+type bundleImport struct {
+	store     *ImgStorage
+	imageName string
+	dirName   string
+	stage     stagingDir
+	spool     stagingDir
+	pins      *pinSet
+	unlock    func()
+}
+
+func (i *ImgStorage) startImport(
+	imageName string, spool stagingDir, pins *pinSet, accept func(imageName string) (bool, error),
+) (*bundleImport, error) {
+	imp := &bundleImport{store: i, imageName: imageName, dirName: imageNameToDirName(imageName), spool: spool, pins: pins}
+	ok, err := accept(imageName)
+	if err != nil || !ok {
+		return imp, err
+	}
+
+	imp.unlock = i.images.Lock(imp.dirName)
+	if imp.stage, err = i.newStage(imp.dirName); err != nil {
+		imp.unlock()
+
+		return nil, err
+	}
+
+	return imp, os.MkdirAll(imp.stage.metaDir(), os.ModePerm)
+}
+
+func (b *bundleImport) addMeta(name string, header *tar.Header, src io.Reader) error {
+	if b.stage == "" {
+		return nil
+	}
+
+	return b.store.writeFile(filepath.Join(b.stage.metaDir(), filepath.Clean("/"+name)), header.FileInfo().Mode(), src, io.Copy)
+}
+
+// commit moves spooled layers of the image to its stage and moves the image into the store,
+// every layer of the image has to be spooled or stored.
+func (b *bundleImport) commit() error {
+	if b == nil || b.stage == "" {
+		return nil
+	}
+	defer b.abort()
+
+	manifest, err := b.store.readManifest(filepath.Join(b.stage.metaDir(), "manifest.json"))
+	if err != nil {
+		return fmt.Errorf("reading the manifest of '%s', %w", b.imageName, err)
+	}
+	if err = os.MkdirAll(b.stage.layersDir(), os.ModePerm); err != nil {
+		return err
+	}
+	for _, layer := range manifest.layers() {
+		b.pins.pin(layer)
+		if _, err = loadLayerMeta(filepath.Join(b.store.layerDir(layer), "layer.tar")); err == nil {
+			continue
+		}
+
+		spooled := filepath.Join(b.spool.layersDir(), layer)
+		if _, err = loadLayerMeta(filepath.Join(spooled, "layer.tar")); err != nil {
+			return fmt.Errorf("layer '%s' of '%s' is missing in the bundle", layer, b.imageName) // nolint: goerr113
+		}
+		if err = os.Rename(spooled, filepath.Join(b.stage.layersDir(), layer)); err != nil {
+			return err
+		}
+	}
+
+	return b.store.commitStage(b.stage, journalRecord{Image: b.dirName}, nil)
+}
+
+// abort drops the stage and unlocks the image, it is a no-op after commit.
+func (b *bundleImport) abort() {
+	if b == nil || b.stage == "" {
+		return
+	}
+	b.stage.remove()
+	b.unlock()
+	b.stage = ""
+}
@@ -0,0 +1,103 @@
+package compact
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func exportImages(t *testing.T, storage *ImgStorage, written map[string]bool, imageNames ...string) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, imageName := range imageNames {
+		require.NoError(t, storage.ExportImage(tw, imageName, written))
+	}
+	require.NoError(t, tw.Close())
+
+	return buf.Bytes()
+}
+
+func acceptOnly(imageNames ...string) func(string) (bool, error) {
+	return func(imageName string) (bool, error) {
+		for _, name := range imageNames {
+			if name == imageName {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	}
+}
+
+func TestImgStorage_ExportImport(t *testing.T) {
+	src := NewImgStorage(setUpTempDir(t), WithCodec(Codec{Name: CodecGzip, Level: 6}))
+	dumpA, filesA := makeImageDump(t, 2, 16<<10)
+	dumpB, filesB := makeImageDump(t, 3, 16<<10)
+	require.NoError(t, src.Save("a", bytes.NewReader(dumpA)))
+	require.NoError(t, src.Save("b", bytes.NewReader(dumpB)))
+	bundle := exportImages(t, src, map[string]bool{}, "a", "b")
+
+	t.Run("shared layers are written once", func(t *testing.T) {
+		layerFiles := 0
+		tr := tar.NewReader(bytes.NewReader(bundle))
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			if filepath.Base(header.Name) == "layer.tar" {
+				layerFiles++
+			}
+		}
+		require.Equal(t, 3, layerFiles)
+	})
+
+	t.Run("layers keep their codec", func(t *testing.T) {
+		dir := setUpTempDir(t)
+		dst := NewImgStorage(dir)
+		require.NoError(t, dst.ImportImages(tar.NewReader(bytes.NewReader(bundle)), acceptOnly("a", "b")))
+
+		requireLoads(t, dst, "a", filesA)
+		requireLoads(t, dst, "b", filesB)
+		meta, err := loadLayerMeta(filepath.Join(dir, "layers", fmt.Sprintf("%064x", 3), "layer.tar"))
+		require.NoError(t, err)
+		require.Equal(t, Codec{Name: CodecGzip, Level: 6}, meta.Codec)
+	})
+
+	t.Run("only accepted images are imported", func(t *testing.T) {
+		dst := NewImgStorage(setUpTempDir(t))
+		require.NoError(t, dst.ImportImages(tar.NewReader(bytes.NewReader(bundle)), acceptOnly("b")))
+
+		exists, err := dst.IsExist("a")
+		require.NoError(t, err)
+		require.False(t, exists)
+		requireLoads(t, dst, "b", filesB)
+	})
+
+	t.Run("stored layers are reused", func(t *testing.T) {
+		dst := NewImgStorage(setUpTempDir(t))
+		require.NoError(t, dst.Save("a", bytes.NewReader(dumpA)))
+		onlyB := exportImages(t, src, map[string]bool{fmt.Sprintf("%064x", 1): true, fmt.Sprintf("%064x", 2): true}, "b")
+
+		require.NoError(t, dst.ImportImages(tar.NewReader(bytes.NewReader(onlyB)), acceptOnly("b")))
+		requireLoads(t, dst, "a", filesA)
+		requireLoads(t, dst, "b", filesB)
+	})
+
+	t.Run("image with missing layers is not imported", func(t *testing.T) {
+		dst := NewImgStorage(setUpTempDir(t))
+		onlyB := exportImages(t, src, map[string]bool{fmt.Sprintf("%064x", 3): true}, "b")
+
+		err := dst.ImportImages(tar.NewReader(bytes.NewReader(onlyB)), acceptOnly("b"))
+		require.EqualError(t, err, fmt.Sprintf("layer '%064x' of 'b' is missing in the bundle", 3))
+		exists, err := dst.IsExist("b")
+		require.NoError(t, err)
+		require.False(t, exists)
+	})
+}
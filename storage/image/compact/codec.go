@@ -0,0 +1,233 @@
+package compact
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	"github.com/docker/docker/pkg/ioutils"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CodecNone = "none"
+	CodecGzip = "gzip"
+	CodecZstd = "zstd"
+
+	// zstdLongWindow is the window of `zstd --long`.
+	zstdLongWindow = 1 << 27
+)
+
+// ZstdLevels are zstd levels closest to the speeds of the encoder, it has fewer speeds than zstd has levels:
+// 1 is the fastest, 3 is the default, 7 compresses better at 2-3x of the default CPU usage.
+var ZstdLevels = []int{1, 3, 7} // nolint: gochecknoglobals
+
+// Codec describes how a layer.tar is compressed on disk.
+type Codec struct {
+	Name  string
+	Level int
+	// LongWindow enables zstd long-distance matching window.
+	LongWindow bool `json:",omitempty"`
+}
+
+// DefaultCodec is the fastest zstd, it was the only codec before codecs became configurable.
+var DefaultCodec = Codec{Name: CodecZstd, Level: 1} // nolint: gochecknoglobals
+
+// Validate checks the codec name and the level range.
+func (c Codec) Validate() error {
+	switch c.Name {
+	case CodecNone:
+		return nil
+	case CodecGzip:
+		if c.Level < gzip.BestSpeed || c.Level > gzip.BestCompression {
+			return fmt.Errorf("gzip level must be in [%d, %d], got %d", gzip.BestSpeed, gzip.BestCompression, c.Level) // nolint: goerr113
+		}
+	case CodecZstd:
+		for _, level := range ZstdLevels {
+			if c.Level == level {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("zstd level must be one of %v, got %d", ZstdLevels, c.Level) // nolint: goerr113
+	default:
+		return fmt.Errorf("unknown codec '%s'", c.Name) // nolint: goerr113
+	}
+
+	return nil
+}
+
+// Stronger reports whether c is expected to compress better than other.
+func (c Codec) Stronger(other Codec) bool {
+	if c.Name == CodecNone {
+		return false
+	}
+	if c.Name != other.Name {
+		return other.Name == CodecNone || c.Name == CodecZstd
+	}
+
+	if c.Name == CodecZstd {
+		// levels of older versions were up to 19, they are compared by the speed they were compressed at
+		cur, prev := zstd.EncoderLevelFromZstd(c.Level), zstd.EncoderLevelFromZstd(other.Level)
+		if cur != prev {
+			return cur > prev
+		}
+
+		return c.LongWindow && !other.LongWindow
+	}
+
+	return c.Level > other.Level
+}
+
+func (c Codec) String() string {
+	s := c.Name
+	if c.Name != CodecNone {
+		s += ":" + strconv.Itoa(c.Level)
+	}
+	if c.LongWindow {
+		s += ":long"
+	}
+
+	return s
+}
+
+func (c Codec) compressAndCopy(dst io.Writer, src io.Reader) (int64, error) {
+	var enc io.WriteCloser
+	var err error
+	switch c.Name {
+	case CodecNone:
+		return io.Copy(dst, src)
+	case CodecGzip:
+		enc, err = gzip.NewWriterLevel(dst, c.Level)
+	case CodecZstd:
+		opts := []zstd.EOption{zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.Level))}
+		if c.LongWindow {
+			opts = append(opts, zstd.WithWindowSize(zstdLongWindow))
+		}
+		enc, err = zstd.NewWriter(dst, opts...)
+	default:
+		err = c.Validate()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	written, err := io.Copy(enc, src)
+	if err != nil {
+		_ = enc.Close()
+
+		return written, err
+	}
+
+	return written, enc.Close()
+}
+
+// nolint: gochecknoglobals
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// detectCodec recognises a codec by magic bytes, so a layer.tar replaced by recompression
+// is decoded correctly even if a crash has left its meta from the previous codec.
+func detectCodec(src *bufio.Reader) string {
+	magic, _ := src.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, zstdMagic):
+		return CodecZstd
+	case bytes.HasPrefix(magic, gzipMagic):
+		return CodecGzip
+	}
+
+	return CodecNone
+}
+
+// NewDecompressor decodes a layer compressed by any codec, the codec is recognised by magic bytes.
+func NewDecompressor(src io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(src)
+	switch detectCodec(buffered) {
+	case CodecGzip:
+		return gzip.NewReader(buffered)
+	case CodecZstd:
+		dec, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+
+		return dec.IOReadCloser(), nil
+	}
+
+	return ioutil.NopCloser(buffered), nil
+}
+
+func decompressAndCopy(dst io.Writer, src io.Reader) (int64, error) {
+	dec, err := NewDecompressor(src)
+	if err != nil {
+		return 0, err
+	}
+	defer dec.Close()
+
+	return io.Copy(dst, dec)
+}
+
+// layerMeta is stored next to every layer.tar as layer.tar.meta.
+type layerMeta struct {
+	Codec        Codec
+	OriginalSize int64
+}
+
+const (
+	layerMetaSuffix = ".meta"
+	// legacySizeSuffix is a sidecar written before layerMeta, such layers are always fast zstd.
+	legacySizeSuffix = "originalSize"
+)
+
+func isLayerSidecar(name string) bool {
+	return name == "layer.tar"+layerMetaSuffix || name == "layer.tar"+legacySizeSuffix
+}
+
+func saveLayerMeta(layerPath string, meta layerMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	return ioutils.AtomicWriteFile(layerPath+layerMetaSuffix, data, 0600)
+}
+
+func loadLayerMeta(layerPath string) (layerMeta, error) {
+	data, err := ioutil.ReadFile(layerPath + layerMetaSuffix)
+	if os.IsNotExist(err) {
+		return loadLegacyLayerMeta(layerPath)
+	}
+	if err != nil {
+		return layerMeta{}, err
+	}
+
+	var meta layerMeta
+	if err = json.Unmarshal(data, &meta); err != nil {
+		return layerMeta{}, fmt.Errorf("decoding '%s', %w", layerPath+layerMetaSuffix, err)
+	}
+
+	return meta, nil
+}
+
+func loadLegacyLayerMeta(layerPath string) (layerMeta, error) {
+	b, err := ioutil.ReadFile(layerPath + legacySizeSuffix)
+	if err != nil {
+		return layerMeta{}, err
+	}
+
+	size, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return layerMeta{}, err
+	}
+
+	return layerMeta{Codec: DefaultCodec, OriginalSize: size}, nil
+}
@@ -0,0 +1,41 @@
+package compact
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodec_Validate(t *testing.T) {
+	require.NoError(t, Codec{Name: CodecNone}.Validate())
+	require.NoError(t, Codec{Name: CodecGzip, Level: 9}.Validate())
+	require.NoError(t, Codec{Name: CodecZstd, Level: 7, LongWindow: true}.Validate())
+	require.EqualError(t, Codec{Name: CodecZstd, Level: 19}.Validate(), "zstd level must be one of [1 3 7], got 19")
+	require.EqualError(t, Codec{Name: CodecZstd, Level: 5}.Validate(), "zstd level must be one of [1 3 7], got 5")
+	require.EqualError(t, Codec{Name: CodecGzip, Level: 10}.Validate(), "gzip level must be in [1, 9], got 10")
+	require.EqualError(t, Codec{Name: CodecGzip, Level: -1}.Validate(), "gzip level must be in [1, 9], got -1")
+	require.EqualError(t, Codec{Name: "lz4"}.Validate(), "unknown codec 'lz4'")
+}
+
+func TestCodec_Stronger(t *testing.T) {
+	cases := []struct {
+		name        string
+		codec, prev Codec
+		exp         bool
+	}{
+		{"none is never stronger", Codec{Name: CodecNone}, Codec{Name: CodecGzip, Level: 1}, false},
+		{"anything is stronger than none", Codec{Name: CodecGzip, Level: 1}, Codec{Name: CodecNone}, true},
+		{"zstd is stronger than gzip", Codec{Name: CodecZstd, Level: 1}, Codec{Name: CodecGzip, Level: 9}, true},
+		{"gzip is weaker than zstd", Codec{Name: CodecGzip, Level: 9}, Codec{Name: CodecZstd, Level: 1}, false},
+		{"higher zstd level", Codec{Name: CodecZstd, Level: 7}, Codec{Name: CodecZstd, Level: 3}, true},
+		{"same zstd speed", Codec{Name: CodecZstd, Level: 19}, Codec{Name: CodecZstd, Level: 7}, false},
+		{"long window", Codec{Name: CodecZstd, Level: 7, LongWindow: true}, Codec{Name: CodecZstd, Level: 7}, true},
+		{"higher gzip level", Codec{Name: CodecGzip, Level: 9}, Codec{Name: CodecGzip, Level: 1}, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.exp, tc.codec.Stronger(tc.prev))
+		})
+	}
+}
@@ -0,0 +1,598 @@
+package compact
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+)
+
+// Encrypted files are a header and a sequence of AES-256-GCM sealed chunks:
+//
+//	magic | key id | salt    8 + 8 + 16 bytes, the file key is HMAC-SHA256(key, salt)
+//	chunk ...               up to encChunkSize bytes of plain text and a tag, the nonce is the chunk number
+//
+// Every chunk but the last one is full, the last one is sealed with the final flag, so a truncated file
+// can't be mistaken for a complete one. Sizes of plain texts can be told by sizes of files.
+// Layers are addressed by their layer ids, which are digests of their content, so encryption doesn't break dedup.
+const (
+	// KeySize is the size of AES-256 keys.
+	KeySize = 32
+
+	encMagic      = "GARNENC1"
+	encKeyIDSize  = 8
+	encSaltSize   = 16
+	encHeaderSize = len(encMagic) + encKeyIDSize + encSaltSize
+	encChunkSize  = 64 << 10
+	encTagSize    = 16
+)
+
+var (
+	// ErrNotEncrypted is returned for plain files of a store with a keyring.
+	ErrNotEncrypted = errors.New("the file is not encrypted, run 'garnerd rekey' to encrypt the cache")
+	errTruncated    = errors.New("the encrypted file is truncated")
+	errDirLocked    = errors.New("the dir is used by another garnerd")
+)
+
+// WithEncryption encrypts meta and layers of images and payloads of staged saves with the keyring,
+// nil keeps them in plain text. Sidecars of layers and the layer index stay in plain text, they have nothing
+// but sizes and ids. Names of image dirs are derived from image names, garnerd names images by ImageIDs,
+// and metas kept by meta storages aren't encrypted either.
+func WithEncryption(keys *Keyring) Option {
+	return func(i *ImgStorage) {
+		i.keys = keys
+	}
+}
+
+// Keyring encrypts files with its first key, every key of it decrypts files.
+// Older keys are kept in the keyring until files encrypted with them are rekeyed.
+type Keyring struct {
+	keys []encKey
+}
+
+type encKey struct {
+	id  []byte
+	key []byte
+}
+
+// NewKeyring makes a keyring of KeySize-byte keys, the first key encrypts.
+func NewKeyring(keys ...[]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("the keyring has no keys") // nolint: goerr113
+	}
+
+	k := &Keyring{}
+	for _, key := range keys {
+		if len(key) != KeySize {
+			return nil, fmt.Errorf("the key has %d bytes, %d are expected", len(key), KeySize) // nolint: goerr113
+		}
+		mac := hmac.New(sha256.New, key)
+		_, _ = mac.Write([]byte("garnerd key id"))
+		k.keys = append(k.keys, encKey{id: mac.Sum(nil)[:encKeyIDSize], key: key})
+	}
+
+	return k, nil
+}
+
+// ParseKey decodes a key written as 64 hex digits, base64 or KeySize raw bytes, surrounding spaces are ignored.
+func ParseKey(data []byte) ([]byte, error) {
+	text := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	if len(data) == KeySize {
+		return data, nil
+	}
+
+	return nil, fmt.Errorf("a key has to be %d bytes in hex, base64 or raw", KeySize) // nolint: goerr113
+}
+
+// ID returns the id of the key which encrypts, it is written to headers of encrypted files.
+func (k *Keyring) ID() string {
+	return hex.EncodeToString(k.keys[0].id)
+}
+
+// join returns a keyring which decrypts files of both keyrings, either may be nil.
+func (k *Keyring) join(other *Keyring) *Keyring {
+	switch {
+	case k == nil:
+		return other
+	case other == nil:
+		return k
+	}
+
+	return &Keyring{keys: append(append([]encKey{}, k.keys...), other.keys...)}
+}
+
+func (k *Keyring) find(id []byte) (encKey, bool) {
+	for _, key := range k.keys {
+		if bytes.Equal(key.id, id) {
+			return key, true
+		}
+	}
+
+	return encKey{}, false
+}
+
+func fileAEAD(key, salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(aead cipher.AEAD, n uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], n)
+
+	return nonce
+}
+
+func chunkAAD(header []byte, final bool) []byte {
+	aad := append([]byte{}, header...)
+	if final {
+		return append(aad, 1)
+	}
+
+	return append(aad, 0)
+}
+
+// encWriter seals chunks as they are filled, Close seals the last one and doesn't close dst.
+type encWriter struct {
+	dst    io.Writer
+	aead   cipher.AEAD
+	header []byte
+	buf    []byte
+	n      uint64
+}
+
+// Encrypt returns a writer which encrypts to dst by the first key, it must be closed to seal the last chunk.
+func (k *Keyring) Encrypt(dst io.Writer) (io.WriteCloser, error) {
+	key := k.keys[0]
+	header := make([]byte, 0, encHeaderSize)
+	header = append(append(header, encMagic...), key.id...)
+	salt := make([]byte, encSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	header = append(header, salt...)
+
+	aead, err := fileAEAD(key.key, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = dst.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &encWriter{dst: dst, aead: aead, header: header, buf: make([]byte, 0, encChunkSize)}, nil
+}
+
+func (w *encWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.buf[len(w.buf):encChunkSize], p)
+		w.buf, p, written = w.buf[:len(w.buf)+n], p[n:], written+n
+		if len(w.buf) == encChunkSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+func (w *encWriter) seal(final bool) error {
+	sealed := w.aead.Seal(nil, chunkNonce(w.aead, w.n), w.buf, chunkAAD(w.header, final))
+	w.buf, w.n = w.buf[:0], w.n+1
+	_, err := w.dst.Write(sealed)
+
+	return err
+}
+
+func (w *encWriter) Close() error {
+	return w.seal(true)
+}
+
+// encReader opens chunks one by one, it fails on a tampered or truncated file.
+type encReader struct {
+	src    io.Reader
+	aead   cipher.AEAD
+	header []byte
+	chunk  []byte
+	plain  []byte
+	n      uint64
+	done   bool
+}
+
+// Decrypt returns a reader of the plain text of src, it returns ErrNotEncrypted for a file without the header.
+func (k *Keyring) Decrypt(src io.Reader) (io.Reader, error) {
+	header, err := readEncHeader(src)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := k.find(header[len(encMagic) : len(encMagic)+encKeyIDSize])
+	if !ok {
+		return nil, fmt.Errorf("the file is encrypted with unknown key %x", header[len(encMagic):len(encMagic)+encKeyIDSize]) // nolint: goerr113
+	}
+	aead, err := fileAEAD(key.key, header[len(encMagic)+encKeyIDSize:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &encReader{src: src, aead: aead, header: header, chunk: make([]byte, encChunkSize+encTagSize)}, nil
+}
+
+func readEncHeader(src io.Reader) ([]byte, error) {
+	header := make([]byte, encHeaderSize)
+	n, err := io.ReadFull(src, header)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	if n < len(encMagic) || string(header[:len(encMagic)]) != encMagic {
+		return nil, ErrNotEncrypted
+	}
+	if err != nil {
+		return nil, errTruncated
+	}
+
+	return header, nil
+}
+
+func (r *encReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+
+	return n, nil
+}
+
+// open reads the next chunk, only the last chunk is shorter than a full one.
+func (r *encReader) open() error {
+	n, err := io.ReadFull(r.src, r.chunk)
+	final := false
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		final = true
+	case errors.Is(err, io.EOF):
+		return errTruncated
+	case err != nil:
+		return err
+	}
+	if n < encTagSize {
+		return errTruncated
+	}
+
+	plain, err := r.aead.Open(r.chunk[:0], chunkNonce(r.aead, r.n), r.chunk[:n], chunkAAD(r.header, final))
+	if err != nil {
+		return fmt.Errorf("decrypting chunk %d, %w", r.n, err)
+	}
+	r.plain, r.n, r.done = plain, r.n+1, final
+
+	return nil
+}
+
+// encryptedKeyID returns the id of the key which the file is encrypted with, or ErrNotEncrypted.
+func encryptedKeyID(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return readKeyID(file)
+}
+
+func readKeyID(src io.Reader) (string, error) {
+	header, err := readEncHeader(src)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(header[len(encMagic) : len(encMagic)+encKeyIDSize]), nil
+}
+
+// encPlainSize returns the size of the plain text of an encrypted file of the size.
+func encPlainSize(size int64) int64 {
+	body := size - int64(encHeaderSize)
+	fullChunk := int64(encChunkSize + encTagSize)
+
+	return body/fullChunk*encChunkSize + body%fullChunk - encTagSize
+}
+
+// isEncrypted reports whether the file of an image or a layer is encrypted by the storage.
+func (i *ImgStorage) isEncrypted(path string) bool {
+	return i.keys != nil && !isLayerSidecar(filepath.Base(path))
+}
+
+// writeFile is copyToFile which encrypts the file when the storage has a keyring.
+func (i *ImgStorage) writeFile(path string, mode os.FileMode, src io.Reader, copyFunc func(io.Writer, io.Reader) (int64, error)) error {
+	return copyToFile(path, mode, src, i.encryptingCopy(path, copyFunc))
+}
+
+// encryptingCopy wraps copyFunc to encrypt the file of the path when the storage has a keyring.
+func (i *ImgStorage) encryptingCopy(
+	path string, copyFunc func(io.Writer, io.Reader) (int64, error),
+) func(io.Writer, io.Reader) (int64, error) {
+	if !i.isEncrypted(path) {
+		return copyFunc
+	}
+
+	return func(dst io.Writer, src io.Reader) (int64, error) {
+		enc, err := i.keys.Encrypt(dst)
+		if err != nil {
+			return 0, err
+		}
+		n, err := copyFunc(enc, src)
+		if err != nil {
+			return n, err
+		}
+
+		return n, enc.Close()
+	}
+}
+
+type decryptedFile struct {
+	io.Reader
+	io.Closer
+}
+
+// openFile opens the plain text of a file of an image or a layer.
+func (i *ImgStorage) openFile(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil || !i.isEncrypted(path) {
+		return file, err
+	}
+
+	plain, err := i.keys.Decrypt(file)
+	if err != nil {
+		_ = file.Close()
+
+		return nil, fmt.Errorf("reading '%s', %w", path, err)
+	}
+
+	return decryptedFile{Reader: plain, Closer: file}, nil
+}
+
+func (i *ImgStorage) readFile(path string) ([]byte, error) {
+	file, err := i.openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ioutil.ReadAll(file)
+}
+
+// sealPayload encrypts the payload of a journal record when the storage has a keyring,
+// payloads are metas of images, which have their names.
+func (i *ImgStorage) sealPayload(payload []byte) ([]byte, error) {
+	if i.keys == nil || payload == nil {
+		return payload, nil
+	}
+
+	return sealWith(i.keys, payload)
+}
+
+func sealWith(keys *Keyring, plain []byte) ([]byte, error) {
+	var sealed bytes.Buffer
+	enc, err := keys.Encrypt(&sealed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = enc.Write(plain); err != nil {
+		return nil, err
+	}
+	if err = enc.Close(); err != nil {
+		return nil, err
+	}
+
+	return sealed.Bytes(), nil
+}
+
+// openPayload returns the plain text of a payload of a journal record, payloads written before
+// the storage got a keyring are in plain text.
+func (i *ImgStorage) openPayload(payload []byte) ([]byte, error) {
+	return openWith(i.keys, payload)
+}
+
+func openWith(keys *Keyring, payload []byte) ([]byte, error) {
+	id, err := readKeyID(bytes.NewReader(payload))
+	switch {
+	case errors.Is(err, ErrNotEncrypted):
+		return payload, nil
+	case err != nil:
+		return nil, err
+	case keys == nil:
+		return nil, fmt.Errorf("the payload is encrypted with key %s, but no keys are given", id) // nolint: goerr113
+	}
+
+	plain, err := keys.Decrypt(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(plain)
+}
+
+// plainSize returns the size of the plain text of a stored file.
+func (i *ImgStorage) plainSize(file os.FileInfo) int64 {
+	if !i.isEncrypted(file.Name()) {
+		return file.Size()
+	}
+
+	return encPlainSize(file.Size())
+}
+
+// Rekey encrypts every file of images and layers and payloads of staged saves with the first key of the storage, files are decrypted
+// by keys of old or of the storage, plain files are encrypted too. A storage without a keyring decrypts files.
+// Files already encrypted with the current key are skipped, so an interrupted rekey is finished by the next one.
+// A file is replaced only once it has been decrypted and encrypted in full, a failed file is kept as it was.
+// The dir is locked exclusively meanwhile, so it fails if garnerd holds the dir by LockDir.
+// It returns how many files have been rewritten.
+func (i *ImgStorage) Rekey(old *Keyring) (int, error) {
+	if i.readOnly {
+		return 0, storage.ErrReadOnly
+	}
+	unlock, err := i.lockDir(true)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	roots := append([]string{filepath.Join(i.dir, "meta"), filepath.Join(i.dir, "staging")}, i.layerRoots()...)
+	decrypting := i.keys.join(old)
+
+	rekeyed := 0
+	for _, root := range roots {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() || isLayerSidecar(info.Name()) || isTempFile(info.Name()) {
+				return nil
+			}
+
+			rekey := i.rekeyFile
+			if info.Name() == "journal.json" {
+				rekey = i.rekeyJournal
+			}
+			ok, err := rekey(path, info.Mode(), decrypting)
+			if err != nil {
+				return fmt.Errorf("rekeying '%s', %w", path, err)
+			}
+			if ok {
+				rekeyed++
+			}
+
+			return nil
+		})
+		if err != nil {
+			return rekeyed, err
+		}
+	}
+	log.Infof("%d files have been rekeyed", rekeyed)
+
+	return rekeyed, nil
+}
+
+// LockDir takes a shared lock of the dir, which garnerd holds while it uses the dir, so Rekey can't run meanwhile.
+// Processes sharing the dir hold the lock together, a read-only storage doesn't lock the dir.
+func (i *ImgStorage) LockDir() (func(), error) {
+	if i.readOnly {
+		return func() {}, nil
+	}
+
+	return i.lockDir(false)
+}
+
+func (i *ImgStorage) lockDir(exclusive bool) (func(), error) {
+	if err := os.MkdirAll(i.dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	unlock, err := lockFile(filepath.Join(i.dir, "garnerd.lock"), exclusive)
+	if err != nil {
+		return nil, fmt.Errorf("locking '%s', %w", i.dir, err)
+	}
+
+	return unlock, nil
+}
+
+// rekeyFile rewrites the file unless it is encrypted as the storage encrypts files.
+func (i *ImgStorage) rekeyFile(path string, mode os.FileMode, decrypting *Keyring) (bool, error) {
+	id, err := encryptedKeyID(path)
+	switch {
+	case errors.Is(err, ErrNotEncrypted):
+		if i.keys == nil {
+			return false, nil
+		}
+	case err != nil:
+		return false, err
+	case i.keys != nil && id == i.keys.ID():
+		return false, nil
+	case decrypting == nil:
+		return false, fmt.Errorf("the file is encrypted with key %s, but no keys are given", id) // nolint: goerr113
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	var plain io.Reader = file
+	if id != "" {
+		if plain, err = decrypting.Decrypt(file); err != nil {
+			return false, err
+		}
+	}
+
+	return true, i.writeFile(path, mode, plain, io.Copy)
+}
+
+// rekeyJournal rewrites the payload of a journal record unless it is encrypted as the storage encrypts payloads,
+// the record itself stays in plain text, Recover reads it without keys.
+func (i *ImgStorage) rekeyJournal(path string, mode os.FileMode, decrypting *Keyring) (bool, error) {
+	stage := stagingDir(filepath.Dir(path))
+	record, err := stage.readJournal()
+	if err != nil || record.Payload == nil {
+		return false, err
+	}
+
+	id, err := readKeyID(bytes.NewReader(record.Payload))
+	switch {
+	case errors.Is(err, ErrNotEncrypted):
+		if i.keys == nil {
+			return false, nil
+		}
+	case err != nil:
+		return false, err
+	case i.keys != nil && id == i.keys.ID():
+		return false, nil
+	}
+
+	plain, err := openWith(decrypting, record.Payload)
+	if err != nil {
+		return false, err
+	}
+	if record.Payload, err = i.sealPayload(plain); err != nil {
+		return false, err
+	}
+
+	return true, stage.writeJournal(record, mode)
+}
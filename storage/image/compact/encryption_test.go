@@ -0,0 +1,274 @@
+package compact
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newKeyring(t *testing.T, seed byte) *Keyring {
+	keys, err := NewKeyring(bytes.Repeat([]byte{seed}, KeySize))
+	require.NoError(t, err)
+
+	return keys
+}
+
+func encrypt(t *testing.T, keys *Keyring, plain []byte) []byte {
+	buf := &bytes.Buffer{}
+	enc, err := keys.Encrypt(buf)
+	require.NoError(t, err)
+	_, err = enc.Write(plain)
+	require.NoError(t, err)
+	require.NoError(t, enc.Close())
+
+	return buf.Bytes()
+}
+
+func decrypt(keys *Keyring, data []byte) ([]byte, error) {
+	plain, err := keys.Decrypt(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(plain)
+}
+
+// requireNoPlainText fails if any stored file of images contains the content.
+func requireNoPlainText(t *testing.T, dir string, content []byte) {
+	require.NoError(t, filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		require.NoError(t, err)
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		require.False(t, bytes.Contains(data, content), path)
+
+		return nil
+	}))
+}
+
+func TestKeyring(t *testing.T) {
+	keys := newKeyring(t, 1)
+
+	t.Run("round trip", func(t *testing.T) {
+		for _, size := range []int{0, 1, encChunkSize - 1, encChunkSize, encChunkSize + 1, 3 * encChunkSize} {
+			plain := layerContent(int64(size), size)
+			data := encrypt(t, keys, plain)
+			require.Equal(t, int64(size), encPlainSize(int64(len(data))), size)
+
+			decrypted, err := decrypt(keys, data)
+			require.NoError(t, err, size)
+			require.Equal(t, plain, decrypted, size)
+		}
+	})
+
+	t.Run("tampered and truncated files are rejected", func(t *testing.T) {
+		data := encrypt(t, keys, layerContent(1, 2*encChunkSize+10))
+
+		tampered := append([]byte{}, data...)
+		tampered[encHeaderSize+encChunkSize+1] ^= 1
+		_, err := decrypt(keys, tampered)
+		require.Error(t, err)
+
+		_, err = decrypt(keys, data[:encHeaderSize+encChunkSize+encTagSize])
+		require.Error(t, err, "a full chunk isn't the last one")
+		_, err = decrypt(keys, data[:len(data)-1])
+		require.Error(t, err)
+	})
+
+	t.Run("keys", func(t *testing.T) {
+		data := encrypt(t, keys, []byte("secret"))
+
+		_, err := decrypt(newKeyring(t, 2), data)
+		require.EqualError(t, err, "the file is encrypted with unknown key "+keys.ID())
+		plain, err := decrypt(newKeyring(t, 2).join(keys), data)
+		require.NoError(t, err)
+		require.Equal(t, "secret", string(plain))
+
+		_, err = decrypt(keys, []byte("plain text"))
+		require.True(t, errors.Is(err, ErrNotEncrypted), err)
+	})
+
+	t.Run("key formats", func(t *testing.T) {
+		raw := bytes.Repeat([]byte{0xab}, KeySize)
+		for _, text := range []string{fmt.Sprintf("%x\n", raw), "q6urq6urq6urq6urq6urq6urq6urq6urq6urq6urq6s=", string(raw)} {
+			key, err := ParseKey([]byte(text))
+			require.NoError(t, err, text)
+			require.Equal(t, raw, key)
+		}
+		_, err := ParseKey([]byte("short"))
+		require.Error(t, err)
+	})
+}
+
+func TestImgStorage_Encryption(t *testing.T) {
+	keys := newKeyring(t, 1)
+	plainCodec := WithCodec(Codec{Name: CodecNone})
+
+	t.Run("images are stored encrypted", func(t *testing.T) {
+		dir := setUpTempDir(t)
+		storage := NewImgStorage(dir, plainCodec, WithEncryption(keys))
+		dump, files := makeImageDump(t, 2, 100<<10)
+		require.NoError(t, storage.Save("a", bytes.NewReader(dump)))
+		require.NoError(t, storage.Save("a", bytes.NewReader(dump)), "stored layers are recognised")
+
+		requireLoads(t, storage, "a", files)
+		requireNoPlainText(t, dir, files[fmt.Sprintf("%064x", 1)+"/layer.tar"][:1024])
+		requireNoPlainText(t, dir, files["manifest.json"])
+
+		image, err := storage.Image("a")
+		require.NoError(t, err)
+		require.Equal(t, files["config.json"], image.Config)
+		layer, err := storage.OpenLayer(image.Layers[1].ID)
+		require.NoError(t, err)
+		content, err := ioutil.ReadAll(layer)
+		require.NoError(t, err)
+		require.NoError(t, layer.Close())
+		require.Equal(t, files[fmt.Sprintf("%064x", 2)+"/layer.tar"], content)
+
+		_, err = NewImgStorage(dir, WithEncryption(newKeyring(t, 2))).Load("a")
+		require.Error(t, err)
+	})
+
+	t.Run("bundles are decrypted", func(t *testing.T) {
+		storage := NewImgStorage(setUpTempDir(t), WithEncryption(keys))
+		dump, files := makeImageDump(t, 2, 16<<10)
+		require.NoError(t, storage.Save("a", bytes.NewReader(dump)))
+		bundle := exportImages(t, storage, map[string]bool{}, "a")
+
+		dir := setUpTempDir(t)
+		dst := NewImgStorage(dir, WithEncryption(newKeyring(t, 2)))
+		require.NoError(t, dst.ImportImages(tar.NewReader(bytes.NewReader(bundle)), acceptOnly("a")))
+		requireLoads(t, dst, "a", files)
+		requireNoPlainText(t, dir, files["manifest.json"])
+	})
+
+	t.Run("rekey", func(t *testing.T) {
+		dir := setUpTempDir(t)
+		dump, files := makeImageDump(t, 2, 16<<10)
+		require.NoError(t, NewImgStorage(dir, plainCodec).Save("a", bytes.NewReader(dump)))
+
+		encrypted := NewImgStorage(dir, plainCodec, WithEncryption(keys))
+		_, err := encrypted.Load("a")
+		require.True(t, errors.Is(err, ErrNotEncrypted), err)
+		rekeyed, err := encrypted.Rekey(nil)
+		require.NoError(t, err)
+		require.Equal(t, 2+3*2, rekeyed, "meta files and files of layers")
+		requireLoads(t, encrypted, "a", files)
+		requireNoPlainText(t, dir, files["manifest.json"])
+
+		newKeys := newKeyring(t, 2)
+		rotated := NewImgStorage(dir, WithEncryption(newKeys))
+		_, err = rotated.Rekey(newKeyring(t, 3))
+		require.Error(t, err, "the old key is wrong")
+		_, err = rotated.Rekey(keys)
+		require.NoError(t, err)
+		rekeyed, err = rotated.Rekey(keys)
+		require.NoError(t, err)
+		require.Zero(t, rekeyed, "files encrypted with the current key are skipped")
+		requireLoads(t, rotated, "a", files)
+
+		decrypted := NewImgStorage(dir)
+		_, err = decrypted.Rekey(newKeys)
+		require.NoError(t, err)
+		requireLoads(t, decrypted, "a", files)
+	})
+
+	t.Run("a failed rekey keeps files", func(t *testing.T) {
+		dir := setUpTempDir(t)
+		dump, files := makeImageDump(t, 2, 16<<10)
+		require.NoError(t, NewImgStorage(dir, plainCodec, WithEncryption(keys)).Save("a", bytes.NewReader(dump)))
+		readAll := func() map[string][]byte {
+			contents := map[string][]byte{}
+			require.NoError(t, filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+				require.NoError(t, err)
+				require.False(t, isTempFile(info.Name()), path)
+				if info.Mode().IsRegular() && info.Name() != "garnerd.lock" {
+					contents[path], err = ioutil.ReadFile(path)
+				}
+
+				return err
+			}))
+
+			return contents
+		}
+
+		rotated := NewImgStorage(dir, plainCodec, WithEncryption(newKeyring(t, 2)))
+		before := readAll()
+		_, err := rotated.Rekey(newKeyring(t, 3))
+		require.Error(t, err, "the old key is wrong")
+		require.Equal(t, before, readAll())
+
+		layerPath := filepath.Join(dir, "layers", fmt.Sprintf("%064x", 2), "layer.tar")
+		tampered := append([]byte{}, before[layerPath]...)
+		tampered[len(tampered)/2] ^= 1
+		require.NoError(t, ioutil.WriteFile(layerPath, tampered, 0600))
+		_, err = rotated.Rekey(keys)
+		require.Error(t, err)
+		require.Equal(t, tampered, readAll()[layerPath], "the tampered layer is kept as it was")
+
+		require.NoError(t, ioutil.WriteFile(layerPath, before[layerPath], 0600))
+		_, err = rotated.Rekey(keys)
+		require.NoError(t, err)
+		requireLoads(t, rotated, "a", files)
+	})
+
+	t.Run("payloads of staged saves are encrypted", func(t *testing.T) {
+		dir := setUpTempDir(t)
+		dump, files := makeImageDump(t, 2, 16<<10)
+		payload := []byte(`{"ImageName":"registry.example.com/secret:1"}`)
+		err := NewImgStorage(dir, WithEncryption(keys)).SaveTx("a", bytes.NewReader(dump), payload, func([]byte) error {
+			return errors.New("meta storage is down")
+		})
+		require.EqualError(t, err, "meta storage is down")
+		requireNoPlainText(t, dir, payload)
+
+		recovered := func(storage *ImgStorage) [][]byte {
+			committed := [][]byte{}
+			require.NoError(t, storage.Recover(func(payload []byte) error {
+				committed = append(committed, payload)
+
+				return nil
+			}))
+
+			return committed
+		}
+		require.Error(t, NewImgStorage(dir).Recover(func([]byte) error { return nil }), "no keys are given")
+
+		newKeys := newKeyring(t, 2)
+		_, err = NewImgStorage(dir, WithEncryption(newKeys)).Rekey(keys)
+		require.NoError(t, err)
+		requireNoPlainText(t, dir, payload)
+		_, err = NewImgStorage(dir).Rekey(newKeys)
+		require.NoError(t, err)
+
+		decrypted := NewImgStorage(dir)
+		require.Equal(t, [][]byte{payload}, recovered(decrypted))
+		requireLoads(t, decrypted, "a", files)
+	})
+
+	t.Run("rekey refuses a dir in use", func(t *testing.T) {
+		dir := setUpTempDir(t)
+		running := NewImgStorage(dir)
+		unlock, err := running.LockDir()
+		require.NoError(t, err)
+		other, err := NewImgStorage(dir).LockDir()
+		require.NoError(t, err, "garnerd processes share the dir")
+		other()
+
+		_, err = NewImgStorage(dir, WithEncryption(keys)).Rekey(nil)
+		require.True(t, errors.Is(err, errDirLocked), err)
+
+		unlock()
+		_, err = NewImgStorage(dir, WithEncryption(keys)).Rekey(nil)
+		require.NoError(t, err)
+	})
+}
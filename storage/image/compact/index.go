@@ -0,0 +1,322 @@
+package compact
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/pkg/ioutils"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxIndexDeltas is the length of the journal which is folded into the index file.
+const maxIndexDeltas = 1000
+
+// layerIndex counts references from images to layers and persists them in one file,
+// so garbage collection looks only at orphans, the layers whose references have dropped to zero.
+// Changes are appended to a journal next to the file, which is folded into the file on load
+// and every maxIndexDeltas changes. A missing file is rebuilt by scanning the store.
+type layerIndex struct {
+	mu          sync.Mutex
+	path        string
+	journalPath string
+	scan        func() (images map[string][]string, layers []string, err error)
+	loaded      bool
+	// deltas is the length of the journal
+	deltas int
+
+	images  map[string][]string
+	orphans map[string]bool
+	refs    map[string]int
+}
+
+type layerIndexFile struct {
+	// Images maps an image dir to its layers.
+	Images  map[string][]string
+	Orphans []string
+}
+
+// layerIndexDelta is a change in the journal, applying it again gives the same index.
+type layerIndexDelta struct {
+	// Image gets Layers or is removed.
+	Image   string   `json:",omitempty"`
+	Layers  []string `json:",omitempty"`
+	Removed bool     `json:",omitempty"`
+	// Released become orphans unless they are referenced, Collected orphans have been removed.
+	Released  []string `json:",omitempty"`
+	Collected []string `json:",omitempty"`
+}
+
+func newLayerIndex(path string, scan func() (map[string][]string, []string, error)) *layerIndex {
+	journalPath := strings.TrimSuffix(path, filepath.Ext(path)) + ".journal"
+
+	return &layerIndex{path: path, journalPath: journalPath, scan: scan}
+}
+
+// setImage replaces image's layers, layers which are not referenced anymore become orphans.
+func (x *layerIndex) setImage(image string, layers []string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.ensureLoaded(); err != nil {
+		return err
+	}
+
+	return x.commit(layerIndexDelta{Image: image, Layers: layers})
+}
+
+func (x *layerIndex) removeImage(image string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.ensureLoaded(); err != nil {
+		return err
+	}
+
+	if _, ok := x.images[image]; !ok {
+		return nil
+	}
+
+	return x.commit(layerIndexDelta{Image: image, Removed: true})
+}
+
+// release marks unreferenced layers as orphans, e.g. layers left by a failed save.
+func (x *layerIndex) release(layers []string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.ensureLoaded(); err != nil {
+		return err
+	}
+
+	released := []string{}
+	for _, layer := range layers {
+		if x.refs[layer] == 0 && !x.orphans[layer] {
+			released = append(released, layer)
+		}
+	}
+	if len(released) == 0 {
+		return nil
+	}
+
+	return x.commit(layerIndexDelta{Released: released})
+}
+
+func (x *layerIndex) getOrphans() ([]string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.ensureLoaded(); err != nil {
+		return nil, err
+	}
+
+	return sortedKeys(x.orphans), nil
+}
+
+// collected forgets removed orphans.
+func (x *layerIndex) collected(layers []string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if len(layers) == 0 {
+		return nil
+	}
+
+	return x.commit(layerIndexDelta{Collected: layers})
+}
+
+// rebuild drops the persisted index and scans the store again.
+func (x *layerIndex) rebuild() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	return x.rebuildLocked()
+}
+
+func (x *layerIndex) ensureLoaded() error {
+	if x.loaded {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(x.path)
+	if os.IsNotExist(err) {
+		return x.rebuildLocked()
+	}
+	if err != nil {
+		return fmt.Errorf("reading layer index, %w", err)
+	}
+
+	var file layerIndexFile
+	if err = json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("decoding layer index '%s', %w", x.path, err)
+	}
+
+	x.fill(file.Images, file.Orphans)
+	journaled, err := x.replay()
+	if err != nil {
+		return err
+	}
+	if journaled {
+		// a read-only dir keeps its journal
+		if err = x.persist(); err != nil {
+			log.Warnf("folding the layer index journal, %s", err)
+		}
+	}
+
+	return nil
+}
+
+// replay applies the journal if there is one, a torn change of an interrupted append ends it.
+func (x *layerIndex) replay() (bool, error) {
+	journal, err := os.Open(x.journalPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("reading layer index journal, %w", err)
+	}
+	defer journal.Close()
+
+	decoder := json.NewDecoder(journal)
+	for {
+		var delta layerIndexDelta
+		err = decoder.Decode(&delta)
+		if errors.Is(err, io.EOF) {
+			return true, nil
+		}
+		if err != nil {
+			log.Warnf("layer index journal '%s' ends with a torn change, %s", x.journalPath, err)
+
+			return true, nil
+		}
+		x.apply(delta)
+		x.deltas++
+	}
+}
+
+func (x *layerIndex) rebuildLocked() error {
+	images, layers, err := x.scan()
+	if err != nil {
+		return fmt.Errorf("scanning the store, %w", err)
+	}
+
+	x.fill(images, nil)
+	for _, layer := range layers {
+		if x.refs[layer] == 0 {
+			x.orphans[layer] = true
+		}
+	}
+
+	return x.persist()
+}
+
+func (x *layerIndex) fill(images map[string][]string, orphans []string) {
+	x.images = map[string][]string{}
+	x.refs = map[string]int{}
+	x.orphans = map[string]bool{}
+	for image, layers := range images {
+		x.images[image] = layers
+		x.reference(layers)
+	}
+	for _, layer := range orphans {
+		if x.refs[layer] == 0 {
+			x.orphans[layer] = true
+		}
+	}
+	x.loaded = true
+}
+
+func (x *layerIndex) apply(delta layerIndexDelta) {
+	if delta.Image != "" {
+		old := x.images[delta.Image]
+		if delta.Removed {
+			delete(x.images, delta.Image)
+		} else {
+			x.images[delta.Image] = delta.Layers
+			x.reference(delta.Layers)
+		}
+		x.dereference(old)
+	}
+	for _, layer := range delta.Released {
+		if x.refs[layer] == 0 {
+			x.orphans[layer] = true
+		}
+	}
+	for _, layer := range delta.Collected {
+		delete(x.orphans, layer)
+	}
+}
+
+// commit applies the change and appends it to the journal, a long journal is folded into the index file.
+func (x *layerIndex) commit(delta layerIndexDelta) error {
+	x.apply(delta)
+	if x.deltas >= maxIndexDeltas {
+		return x.persist()
+	}
+
+	data, err := json.Marshal(delta)
+	if err != nil {
+		return err
+	}
+	journal, err := os.OpenFile(x.journalPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("opening layer index journal, %w", err)
+	}
+	defer journal.Close()
+
+	if _, err = journal.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("writing layer index journal, %w", err)
+	}
+	if err = journal.Sync(); err != nil {
+		return fmt.Errorf("syncing layer index journal, %w", err)
+	}
+	x.deltas++
+
+	return nil
+}
+
+func (x *layerIndex) reference(layers []string) {
+	for _, layer := range layers {
+		x.refs[layer]++
+		delete(x.orphans, layer)
+	}
+}
+
+func (x *layerIndex) dereference(layers []string) {
+	for _, layer := range layers {
+		x.refs[layer]--
+		if x.refs[layer] <= 0 {
+			delete(x.refs, layer)
+			x.orphans[layer] = true
+		}
+	}
+}
+
+func (x *layerIndex) persist() error {
+	data, err := json.Marshal(layerIndexFile{Images: x.images, Orphans: sortedKeys(x.orphans)})
+	if err != nil {
+		return err
+	}
+
+	if err = ioutils.AtomicWriteFile(x.path, data, 0600); err != nil {
+		return fmt.Errorf("writing layer index, %w", err)
+	}
+	if err = os.Remove(x.journalPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing layer index journal, %w", err)
+	}
+	x.deltas = 0
+
+	return nil
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
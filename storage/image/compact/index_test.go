@@ -0,0 +1,132 @@
+package compact
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func noScan() (map[string][]string, []string, error) {
+	return nil, nil, nil
+}
+
+func TestLayerIndex(t *testing.T) {
+	t.Run("shared layers become orphans after the last image", func(t *testing.T) {
+		index := newLayerIndex(filepath.Join(setUpTempDir(t), "index.json"), noScan)
+		require.NoError(t, index.setImage("a", []string{"l1", "l2"}))
+		require.NoError(t, index.setImage("b", []string{"l2", "l3"}))
+
+		require.NoError(t, index.removeImage("a"))
+		orphans, err := index.getOrphans()
+		require.NoError(t, err)
+		require.Equal(t, []string{"l1"}, orphans)
+
+		require.NoError(t, index.setImage("b", []string{"l4"}))
+		orphans, err = index.getOrphans()
+		require.NoError(t, err)
+		require.Equal(t, []string{"l1", "l2", "l3"}, orphans)
+	})
+
+	t.Run("released layers referenced by images are not orphans", func(t *testing.T) {
+		index := newLayerIndex(filepath.Join(setUpTempDir(t), "index.json"), noScan)
+		require.NoError(t, index.setImage("a", []string{"l1"}))
+		require.NoError(t, index.release([]string{"l1", "l2"}))
+
+		orphans, err := index.getOrphans()
+		require.NoError(t, err)
+		require.Equal(t, []string{"l2"}, orphans)
+	})
+
+	t.Run("is persisted", func(t *testing.T) {
+		path := filepath.Join(setUpTempDir(t), "index.json")
+		index := newLayerIndex(path, noScan)
+		require.NoError(t, index.setImage("a", []string{"l1"}))
+		require.NoError(t, index.setImage("b", []string{"l2"}))
+		require.NoError(t, index.removeImage("b"))
+
+		reloaded := newLayerIndex(path, func() (map[string][]string, []string, error) {
+			panic("must not scan an existing index")
+		})
+		orphans, err := reloaded.getOrphans()
+		require.NoError(t, err)
+		require.Equal(t, []string{"l2"}, orphans)
+		require.NoError(t, reloaded.removeImage("a"))
+		orphans, err = reloaded.getOrphans()
+		require.NoError(t, err)
+		require.Equal(t, []string{"l1", "l2"}, orphans)
+	})
+
+	t.Run("changes are journaled and folded on load", func(t *testing.T) {
+		dir := setUpTempDir(t)
+		path, journal := filepath.Join(dir, "index.json"), filepath.Join(dir, "index.journal")
+		index := newLayerIndex(path, noScan)
+		_, err := index.getOrphans()
+		require.NoError(t, err)
+		snapshot, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+
+		require.NoError(t, index.setImage("a", []string{"l1", "l2"}))
+		require.NoError(t, index.setImage("b", []string{"l2"}))
+		require.NoError(t, index.removeImage("a"))
+		require.NoError(t, index.release([]string{"l3"}))
+		require.NoError(t, index.collected([]string{"l3"}))
+		unchanged, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, snapshot, unchanged)
+
+		// an append interrupted by a crash
+		file, err := os.OpenFile(journal, os.O_APPEND|os.O_WRONLY, 0600)
+		require.NoError(t, err)
+		_, err = file.WriteString(`{"Image":"c","Lay`)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+
+		reloaded := newLayerIndex(path, noScan)
+		orphans, err := reloaded.getOrphans()
+		require.NoError(t, err)
+		require.Equal(t, []string{"l1"}, orphans)
+		require.NoFileExists(t, journal)
+		data, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		require.JSONEq(t, `{"Images":{"b":["l2"]},"Orphans":["l1"]}`, string(data))
+	})
+
+	t.Run("a long journal is folded", func(t *testing.T) {
+		dir := setUpTempDir(t)
+		index := newLayerIndex(filepath.Join(dir, "index.json"), noScan)
+		for n := 0; n <= maxIndexDeltas; n++ {
+			require.NoError(t, index.setImage("a", []string{fmt.Sprint(n)}))
+		}
+		require.NoFileExists(t, filepath.Join(dir, "index.journal"))
+	})
+}
+
+func TestImgStorage_RebuildIndex(t *testing.T) {
+	dir := setUpTempDir(t)
+	storage := NewImgStorage(dir)
+	dump, files := makeImageDump(t, 2, 16<<10)
+	require.NoError(t, storage.Save("img:1", bytes.NewReader(dump)))
+
+	strayLayer := filepath.Join(dir, "layers", "stray")
+	require.NoError(t, os.MkdirAll(strayLayer, os.ModePerm))
+	require.NoError(t, os.Remove(filepath.Join(dir, "layers-index.json")))
+
+	storage = NewImgStorage(dir)
+	require.NoError(t, storage.RebuildIndex())
+
+	_, err := os.Stat(strayLayer)
+	require.True(t, os.IsNotExist(err))
+	requireLoads(t, storage, "img:1", files)
+
+	// the journal of the removed stray layer is folded on load
+	_, err = NewImgStorage(dir).index.getOrphans()
+	require.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "layers-index.json"))
+	require.NoError(t, err)
+	require.JSONEq(t, fmt.Sprintf(`{"Images":{"%s":["%064x","%064x"]},"Orphans":[]}`, imageNameToDirName("img:1"), 1, 2), string(data))
+}
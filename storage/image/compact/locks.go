@@ -0,0 +1,171 @@
+package compact
+
+import (
+	"sync"
+)
+
+// KeyedMutex is a set of read-write mutexes created on demand and dropped when nobody holds or waits for them.
+type KeyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*refMutex
+}
+
+type refMutex struct {
+	sync.RWMutex
+	refs int
+}
+
+func NewKeyedMutex() *KeyedMutex {
+	return &KeyedMutex{locks: map[string]*refMutex{}}
+}
+
+// Lock locks the key and returns its unlock function.
+func (k *KeyedMutex) Lock(key string) func() {
+	lock := k.acquire(key)
+	lock.Lock()
+
+	return func() {
+		lock.Unlock()
+		k.release(key, lock)
+	}
+}
+
+// RLock locks the key for reading and returns its unlock function.
+func (k *KeyedMutex) RLock(key string) func() {
+	lock := k.acquire(key)
+	lock.RLock()
+
+	return func() {
+		lock.RUnlock()
+		k.release(key, lock)
+	}
+}
+
+// TryLock locks the key only if nobody holds or waits for it.
+func (k *KeyedMutex) TryLock(key string) (func(), bool) {
+	k.mu.Lock()
+	if _, ok := k.locks[key]; ok {
+		k.mu.Unlock()
+
+		return nil, false
+	}
+	lock := &refMutex{refs: 1}
+	k.locks[key] = lock
+	k.mu.Unlock()
+
+	lock.Lock()
+
+	return func() {
+		lock.Unlock()
+		k.release(key, lock)
+	}, true
+}
+
+func (k *KeyedMutex) acquire(key string) *refMutex {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	lock, ok := k.locks[key]
+	if !ok {
+		lock = &refMutex{}
+		k.locks[key] = lock
+	}
+	lock.refs++
+
+	return lock
+}
+
+func (k *KeyedMutex) release(key string, lock *refMutex) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	lock.refs--
+	if lock.refs == 0 {
+		delete(k.locks, key)
+	}
+}
+
+// layerRefs counts in-flight saves and loads using a layer,
+// cleanUp never removes a layer which is pinned or has been pinned since cleanUp started.
+type layerRefs struct {
+	mu      sync.Mutex
+	pins    map[string]int
+	touched map[string]bool
+}
+
+func newLayerRefs() *layerRefs {
+	return &layerRefs{pins: map[string]int{}, touched: map[string]bool{}}
+}
+
+func (r *layerRefs) pin(layer string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pins[layer]++
+	r.touched[layer] = true
+}
+
+func (r *layerRefs) unpin(layer string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pins[layer]--
+	if r.pins[layer] <= 0 {
+		delete(r.pins, layer)
+	}
+}
+
+// startGC forgets layers touched before the current garbage collection.
+func (r *layerRefs) startGC() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.touched = map[string]bool{}
+}
+
+// removeIfUnused calls remove unless the layer is in use, no new pins happen during remove.
+func (r *layerRefs) removeIfUnused(layer string, remove func() error) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.pins[layer] > 0 || r.touched[layer] {
+		return false, nil
+	}
+
+	return true, remove()
+}
+
+// removeIfUnpinned calls remove unless the layer is pinned right now, no new pins happen during remove.
+// Unlike removeIfUnused it is for layers which stay on another tier, so past pins don't matter.
+func (r *layerRefs) removeIfUnpinned(layer string, remove func() error) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.pins[layer] > 0 {
+		return false, nil
+	}
+
+	return true, remove()
+}
+
+// pinSet remembers layers pinned by one operation.
+type pinSet struct {
+	refs   *layerRefs
+	layers []string
+}
+
+func (r *layerRefs) newPinSet() *pinSet {
+	return &pinSet{refs: r}
+}
+
+func (p *pinSet) pin(layer string) {
+	p.refs.pin(layer)
+	p.layers = append(p.layers, layer)
+}
+
+func (p *pinSet) release() {
+	for _, layer := range p.layers {
+		p.refs.unpin(layer)
+	}
+	p.layers = nil
+}
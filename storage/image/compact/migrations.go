@@ -0,0 +1,181 @@
+package compact
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/podtserkovskiy/garnerd/storage/schema"
+)
+
+// SchemaComponent is a name of the compact layout in schema.json.
+const SchemaComponent = "compact"
+
+// Migrations upgrade the layout of the cache dir, Migrations()[n] upgrades it from version n to n+1.
+// imageNames lists all cached images, it is used to rename their dirs.
+func (i *ImgStorage) Migrations(imageNames func() ([]string, error)) []schema.Migration {
+	return []schema.Migration{
+		{Description: "layer.tar.meta sidecars and the layer index", Up: i.migrateLayerMeta},
+		{Description: "collision-free image dir names", Up: func() error { return i.migrateDirNames(imageNames) }},
+	}
+}
+
+// migrateLayerMeta replaces legacy originalSize sidecars with layer.tar.meta and builds the layer index.
+func (i *ImgStorage) migrateLayerMeta() error {
+	layerDirs, err := ioutil.ReadDir(filepath.Join(i.dir, "layers"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, layerDir := range layerDirs {
+		layerPath := filepath.Join(i.dir, "layers", layerDir.Name(), "layer.tar")
+		if _, err = os.Stat(layerPath + legacySizeSuffix); os.IsNotExist(err) {
+			continue
+		}
+
+		meta, err := loadLayerMeta(layerPath)
+		if err != nil {
+			return fmt.Errorf("reading meta of layer '%s', %w", layerDir.Name(), err)
+		}
+		if err = saveLayerMeta(layerPath, meta); err != nil {
+			return fmt.Errorf("writing meta of layer '%s', %w", layerDir.Name(), err)
+		}
+		if err = os.Remove(layerPath + legacySizeSuffix); err != nil {
+			return err
+		}
+	}
+
+	return i.index.rebuild()
+}
+
+// migrateDirNames renames image dirs and staged saves to names with a hash suffix.
+// If several images have shared a dir, the one named in RepoTags of its manifest gets it,
+// a dir which can't be attributed is left to CleanUp.
+func (i *ImgStorage) migrateDirNames(imageNames func() ([]string, error)) error {
+	names, err := imageNames()
+	if err != nil {
+		return err
+	}
+
+	byLegacyDir := map[string][]string{}
+	for _, name := range names {
+		legacyDir := legacyImageNameToDirName(name)
+		byLegacyDir[legacyDir] = append(byLegacyDir[legacyDir], name)
+	}
+
+	for legacyDir, candidates := range byLegacyDir {
+		legacyPath := filepath.Join(i.dir, "meta", legacyDir)
+		if _, err = os.Stat(legacyPath); os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		name, ok := i.ownerOf(candidates, filepath.Join(legacyPath, "manifest.json"))
+		if !ok {
+			log.Warnf("image dir '%s' may belong to any of %v, it is left to clean up", legacyDir, candidates)
+
+			continue
+		}
+		if err = os.Rename(legacyPath, filepath.Join(i.dir, "meta", imageNameToDirName(name))); err != nil {
+			return fmt.Errorf("renaming image dir '%s', %w", legacyDir, err)
+		}
+	}
+
+	if err = i.migrateStagedDirNames(byLegacyDir); err != nil {
+		return err
+	}
+
+	return i.index.rebuild()
+}
+
+// migrateStagedDirNames points journal records of committed saves to the new dir names.
+func (i *ImgStorage) migrateStagedDirNames(byLegacyDir map[string][]string) error {
+	entries, err := ioutil.ReadDir(filepath.Join(i.dir, "staging"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		stage := stagingDir(filepath.Join(i.dir, "staging", entry.Name()))
+		record, err := stage.readJournal()
+		if os.IsNotExist(err) {
+			// an uncommitted save is dropped by Recover anyway
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		manifestPath := filepath.Join(stage.metaDir(), "manifest.json")
+		candidates := byLegacyDir[record.Image]
+		if len(candidates) == 0 {
+			// the image has not been cached before the save
+			candidates = i.legacyTagsOf(record.Image, manifestPath)
+		}
+		name, ok := i.ownerOf(candidates, manifestPath)
+		if !ok {
+			log.Warnf("staged save '%s' may belong to any of %v, it is dropped", entry.Name(), candidates)
+			stage.remove()
+
+			continue
+		}
+
+		record.Image = imageNameToDirName(name)
+		if err = stage.writeJournal(record, 0600); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ownerOf picks the image stored with the manifest among candidates sharing a legacy dir.
+func (i *ImgStorage) ownerOf(candidates []string, manifestPath string) (string, bool) {
+	if len(candidates) == 1 {
+		return candidates[0], true
+	}
+
+	manifest, err := i.readManifest(manifestPath)
+	if err != nil {
+		return "", false
+	}
+
+	for _, candidate := range candidates {
+		for _, imageEntry := range manifest {
+			for _, tag := range imageEntry.RepoTags {
+				if tag == candidate {
+					return candidate, true
+				}
+			}
+		}
+	}
+
+	return "", false
+}
+
+// legacyTagsOf returns tags of the manifest which have been stored in the legacy dir.
+func (i *ImgStorage) legacyTagsOf(legacyDir, manifestPath string) []string {
+	manifest, err := i.readManifest(manifestPath)
+	if err != nil {
+		return nil
+	}
+
+	tags := []string{}
+	for _, imageEntry := range manifest {
+		for _, tag := range imageEntry.RepoTags {
+			if legacyImageNameToDirName(tag) == legacyDir {
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	return tags
+}
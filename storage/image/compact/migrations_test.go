@@ -0,0 +1,92 @@
+package compact
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/podtserkovskiy/garnerd/storage/schema"
+)
+
+func TestImgStorage_Migrations(t *testing.T) {
+	dir := setUpTempDir(t)
+	storage := NewImgStorage(dir)
+	dump, files := makeImageDump(t, 2, 16<<10)
+	require.NoError(t, storage.Save("img:1", bytes.NewReader(dump)))
+
+	// the layout before versioning has originalSize sidecars and no layer index
+	layerPath := filepath.Join(dir, "layers", fmt.Sprintf("%064x", 1), "layer.tar")
+	require.NoError(t, os.Remove(layerPath+layerMetaSuffix))
+	require.NoError(t, ioutil.WriteFile(layerPath+legacySizeSuffix, []byte("16384"), 0600))
+	require.NoError(t, os.Remove(filepath.Join(dir, "layers-index.json")))
+
+	storage = NewImgStorage(dir)
+	require.NoError(t, schema.Migrate(dir, SchemaComponent, storage.Migrations(func() ([]string, error) { return []string{"img:1"}, nil })))
+
+	meta, err := loadLayerMeta(layerPath)
+	require.NoError(t, err)
+	require.Equal(t, layerMeta{Codec: DefaultCodec, OriginalSize: 16 << 10}, meta)
+	_, err = os.Stat(layerPath + legacySizeSuffix)
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "layers-index.json"))
+	require.NoError(t, err)
+	requireLoads(t, storage, "img:1", files)
+
+	t.Run("newer layout is refused", func(t *testing.T) {
+		err := schema.Migrate(dir, SchemaComponent, storage.Migrations(nil)[:0])
+		require.True(t, errors.Is(err, schema.ErrDowngrade))
+	})
+}
+
+func TestImageNameToDirName(t *testing.T) {
+	for _, names := range [][2]string{{"foo/bar:1", "foo_bar:1"}, {"a.b/c:1", "a/b.c:1"}} {
+		require.Equal(t, legacyImageNameToDirName(names[0]), legacyImageNameToDirName(names[1]))
+		require.NotEqual(t, imageNameToDirName(names[0]), imageNameToDirName(names[1]))
+	}
+}
+
+func TestImgStorage_migrateDirNames(t *testing.T) {
+	names := func() ([]string, error) { return []string{"img:1", "img.1", "other:2"}, nil }
+
+	t.Run("shared dir goes to the image from RepoTags", func(t *testing.T) {
+		dir := setUpTempDir(t)
+		storage := NewImgStorage(dir)
+		dump, files := makeImageDump(t, 2, 16<<10)
+		otherDump, otherFiles := makeImageDump(t, 1, 16<<10)
+		require.NoError(t, storage.Save("img:1", bytes.NewReader(dump)))
+		require.NoError(t, storage.Save("other:2", bytes.NewReader(otherDump)))
+		for _, name := range []string{"img:1", "other:2"} {
+			require.NoError(t, os.Rename(
+				filepath.Join(dir, "meta", imageNameToDirName(name)),
+				filepath.Join(dir, "meta", legacyImageNameToDirName(name)),
+			))
+		}
+
+		require.NoError(t, storage.migrateDirNames(names))
+
+		requireLoads(t, storage, "img:1", files)
+		requireLoads(t, storage, "other:2", otherFiles)
+		exists, err := storage.IsExist("img.1")
+		require.NoError(t, err)
+		require.False(t, exists)
+	})
+
+	t.Run("committed save of a new image", func(t *testing.T) {
+		dir := setUpTempDir(t)
+		storage := NewImgStorage(dir)
+		dump, files := makeImageDump(t, 2, 16<<10)
+		stage := stageImage(t, storage, legacyImageNameToDirName("img:1"), dump)
+		writeJournal(t, stage, journalRecord{Image: legacyImageNameToDirName("img:1"), Payload: []byte("meta")})
+
+		require.NoError(t, storage.migrateDirNames(func() ([]string, error) { return nil, nil }))
+		require.NoError(t, storage.Recover(func([]byte) error { return nil }))
+
+		requireLoads(t, storage, "img:1", files)
+	})
+}
@@ -0,0 +1,149 @@
+package compact
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+)
+
+// RecompressIdle upgrades stored layers to the codec while nobody saves or loads images for `idle`.
+// It blocks until ctx is done.
+func (i *ImgStorage) RecompressIdle(ctx context.Context, codec Codec, idle time.Duration) {
+	ticker := time.NewTicker(idle)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := i.recompressWhileIdle(ctx, codec, idle); err != nil {
+			log.Warn("recompressing layers, ", err)
+		}
+	}
+}
+
+func (i *ImgStorage) recompressWhileIdle(ctx context.Context, codec Codec, idle time.Duration) error {
+	if i.readOnly {
+		return storage.ErrReadOnly
+	}
+	for _, root := range i.layerRoots() {
+		layers, err := ioutil.ReadDir(root)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, layer := range layers {
+			if ctx.Err() != nil || !i.isIdle(idle) {
+				return nil
+			}
+
+			if err := i.recompressLayer(filepath.Join(root, layer.Name(), "layer.tar"), codec); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (i *ImgStorage) recompressLayer(layerPath string, codec Codec) error {
+	layer := layerOf(layerPath)
+	pins := i.refs.newPinSet()
+	pins.pin(layer)
+	defer pins.release()
+
+	meta, src, stat, err := i.openToRecompress(layerPath)
+	if os.IsNotExist(err) {
+		// the layer has been removed or it is being written
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if !codec.Stronger(meta.Codec) {
+		return nil
+	}
+
+	decompressed, pw := io.Pipe()
+	defer decompressed.Close()
+	go func() {
+		_, err := decompressAndCopy(pw, src)
+		_ = pw.CloseWithError(err)
+	}()
+
+	// the layer is locked only to be replaced, so restores don't wait for the compression
+	replaced := false
+	err = replaceFile(layerPath, stat.Mode(), decompressed, i.encryptingCopy(layerPath, codec.compressAndCopy),
+		func(tmp, path string) error {
+			defer i.layers.Lock(layer)()
+
+			current, err := os.Stat(path)
+			if err != nil || !os.SameFile(stat, current) {
+				// the layer has been replaced by a save meanwhile
+				return nil // nolint: nilerr
+			}
+
+			// the sidecar is updated first, so a crash leaves at worst a layer
+			// which looks recompressed already and still decompresses, as codecs are detected by the data
+			if err = saveLayerMeta(layerPath, layerMeta{Codec: codec, OriginalSize: meta.OriginalSize}); err != nil {
+				return err
+			}
+			if err = os.Rename(tmp, path); err != nil {
+				_ = saveLayerMeta(layerPath, meta)
+
+				return err
+			}
+			replaced = true
+
+			return nil
+		})
+	if err != nil || !replaced {
+		return err
+	}
+
+	log.Infof("layer '%s' has been recompressed %s -> %s", layer, meta.Codec, codec)
+
+	return nil
+}
+
+// openToRecompress opens the layer under its shared lock, so the sidecar matches the opened file.
+func (i *ImgStorage) openToRecompress(layerPath string) (layerMeta, io.ReadCloser, os.FileInfo, error) {
+	defer i.layers.RLock(layerOf(layerPath))()
+
+	meta, err := loadLayerMeta(layerPath)
+	if err != nil {
+		return layerMeta{}, nil, nil, err
+	}
+	stat, err := os.Stat(layerPath)
+	if err != nil {
+		return layerMeta{}, nil, nil, err
+	}
+	src, err := i.openFile(layerPath)
+	if err != nil {
+		return layerMeta{}, nil, nil, err
+	}
+
+	return meta, src, stat, nil
+}
+
+func (i *ImgStorage) isIdle(idle time.Duration) bool {
+	lastUsed := time.Unix(0, atomic.LoadInt64(&i.lastUsed))
+
+	return time.Since(lastUsed) >= idle
+}
@@ -2,6 +2,7 @@ package compact
 
 import (
 	"archive/tar"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,43 +10,184 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
-	"strconv"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/docker/docker/pkg/ioutils"
-	"github.com/klauspost/compress/zstd"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/podtserkovskiy/garnerd/storage"
 )
 
 type manifestJSON []struct {
-	Layers []string
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// layers returns unique layer ids of the manifest.
+func (m manifestJSON) layers() []string {
+	seen := map[string]bool{}
+	layers := []string{}
+	for _, imageEntry := range m {
+		for _, layerFile := range imageEntry.Layers {
+			layer := filepath.Dir(layerFile)
+			if !seen[layer] {
+				seen[layer] = true
+				layers = append(layers, layer)
+			}
+		}
+	}
+
+	return layers
 }
 
 type fileData struct {
 	srcPath, tarPath string
+	// layer is the layer of the file, "" for files of the image meta.
+	layer string
 }
 
 // compact.ImgStorage stores every layer in a single instance.
 // it saves ~25% of disk space unlike fs.ImgStorage.
 // then it additionally saves ~61% of disk space by zstd-compression.
+// Images are locked one by one, so unrelated images can be saved and loaded at the same time.
 type ImgStorage struct {
-	dir string
-	mu  sync.Mutex
+	// lastUsed is UnixNano of the last Save or Load, it is accessed atomically.
+	lastUsed int64
+	// changes counts saved and removed images, it is accessed atomically.
+	changes uint64
+	dir     string
+	// slowDir is the slow tier of layers, "" if the storage has a single tier.
+	slowDir string
+	workers int
+	codec   Codec
+	// keys encrypt meta and layers of images, nil if they are stored in plain text.
+	keys *Keyring
+	// readOnly refuses changes, so the dir may be a read-only mount shared by many hosts.
+	readOnly bool
+
+	images *KeyedMutex
+	// layers is locked while files of a layer are replaced, readers lock it shared while they list and open the files.
+	layers *KeyedMutex
+	refs   *layerRefs
+	index  *layerIndex
+
+	gcMu      sync.Mutex
+	gcRunning bool
+	gcPending bool
+}
+
+type Option func(*ImgStorage)
+
+// WithCompressionWorkers sets how many layers are compressed at the same time.
+// One worker compresses layers straight from the tar stream without spooling.
+func WithCompressionWorkers(n int) Option {
+	return func(i *ImgStorage) {
+		if n > 0 {
+			i.workers = n
+		}
+	}
+}
+
+// WithCodec sets a codec for newly saved layers, already stored layers keep their codecs.
+func WithCodec(codec Codec) Option {
+	return func(i *ImgStorage) {
+		i.codec = codec
+	}
 }
 
-func NewImgStorage(dir string) *ImgStorage {
-	return &ImgStorage{dir: dir}
+// WithReadOnly only reads the dir, changes return storage.ErrReadOnly and layers aren't moved between tiers.
+func WithReadOnly(readOnly bool) Option {
+	return func(i *ImgStorage) {
+		i.readOnly = readOnly
+	}
+}
+
+func NewImgStorage(dir string, opts ...Option) *ImgStorage {
+	i := &ImgStorage{
+		dir:     dir,
+		workers: runtime.NumCPU(),
+		codec:   DefaultCodec,
+		images:  NewKeyedMutex(),
+		layers:  NewKeyedMutex(),
+		refs:    newLayerRefs(),
+	}
+	i.index = newLayerIndex(filepath.Join(dir, "layers-index.json"), i.scan)
+	for _, opt := range opts {
+		opt(i)
+	}
+
+	return i
 }
 
 // Save decodes tar and stores layers and meta.
-func (i *ImgStorage) Save(imageName string, imageDump io.Reader) error { // nolint: funlen,gocognit
-	i.mu.Lock()
-	defer i.mu.Unlock()
+// Layers are spooled from the tar stream and compressed by a pool of workers.
+func (i *ImgStorage) Save(imageName string, imageDump io.Reader) error {
+	return i.SaveTx(imageName, imageDump, nil, nil)
+}
+
+// SaveTx saves the image atomically together with the payload.
+// Everything is staged first, then a journal record with the payload commits the save,
+// and commit is called after the image is in place. If garnerd crashes or commit fails after the journal
+// has been written, the journal is kept and Recover finishes the save and calls commit again.
+func (i *ImgStorage) SaveTx(
+	imageName string, imageDump io.Reader, payload []byte, commit func(payload []byte) error,
+) (err error) {
+	if i.readOnly {
+		return storage.ErrReadOnly
+	}
 	defer i.cleanUp()
+	defer i.touch()
+	dirName := imageNameToDirName(imageName)
+	defer i.images.Lock(dirName)()
 
-	imgMetaDir := filepath.Join(i.dir, "meta", imageNameToDirName(imageName))
-	err := os.MkdirAll(imgMetaDir, os.ModePerm)
+	pins := i.refs.newPinSet()
+	defer pins.release()
+
+	stage, err := i.newStage(dirName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil && stage.isCommitted() {
+			log.Warnf("save of '%s' is committed, it will be finished on the next start, %s", imageName, err)
+
+			return
+		}
+		stage.remove()
+	}()
+
+	pool := newWorkerPool(i.workers)
+	err = i.save(stage, imageDump, pool, pins)
+	if waitErr := pool.Wait(); err == nil {
+		err = waitErr
+	}
+	if err == nil {
+		err = i.commitStage(stage, journalRecord{Image: dirName, Payload: payload}, commit)
+	}
+	// layers of a failed save are collected if nobody else references them
+	if releaseErr := i.index.release(pins.layers); err == nil {
+		err = releaseErr
+	}
+
+	return err
+}
+
+func (i *ImgStorage) indexImage(dirName string) error {
+	manifest, err := i.readManifest(filepath.Join(i.dir, "meta", dirName, "manifest.json"))
+	if err != nil {
+		return err
+	}
+
+	return i.index.setImage(dirName, manifest.layers())
+}
+
+// save writes image's meta and new layers into the stage.
+func (i *ImgStorage) save(stage stagingDir, imageDump io.Reader, pool *workerPool, pins *pinSet) error { // nolint: funlen,gocognit
+	err := os.MkdirAll(stage.metaDir(), os.ModePerm)
 	if err != nil {
 		return err
 	}
@@ -64,80 +206,100 @@ func (i *ImgStorage) Save(imageName string, imageDump io.Reader) error { // noli
 		// suppose any dir are layer-dir
 		if header.FileInfo().IsDir() {
 			lastDir = header.Name
-			dstDir := filepath.Join(i.dir, "layers", lastDir)
-			err = os.MkdirAll(dstDir, header.FileInfo().Mode())
-			if err != nil {
-				return err
-			}
+			pins.pin(filepath.Clean(lastDir))
 
 			continue
 		}
 
 		// check if it is layer's file
 		if strings.HasPrefix(header.Name, lastDir) { // nolint: nestif
-			dstFile := filepath.Join(i.dir, "layers", header.Name)
-			dstFileStat, err := os.Stat(dstFile)
-			switch {
-			case os.IsNotExist(err):
-				// create file
-			case err != nil:
-				return err
-			case dstFileStat.Size() == header.FileInfo().Size():
-				// file with the same name and size already exists
+			if i.isStoredLayerFile(filepath.Join(i.layerDir(layerOf(header.Name)), filepath.Base(header.Name)), header) {
 				continue
 			}
 
-			file, err := ioutils.NewAtomicFileWriter(dstFile, header.FileInfo().Mode())
-			if err != nil {
+			dstFile := filepath.Join(stage.layersDir(), header.Name)
+			if err = os.MkdirAll(filepath.Dir(dstFile), os.ModePerm); err != nil {
 				return err
 			}
 
-			copyFunc := io.Copy
 			if filepath.Base(header.Name) == "layer.tar" {
-				copyFunc = compressAndCopy
-				err = saveOriginalSize(dstFile, header.Size)
-				if err != nil {
-					return err
-				}
+				err = i.compressLayer(pool, dstFile, header.FileInfo().Mode(), header.Size, archive)
+			} else {
+				err = i.writeFile(dstFile, header.FileInfo().Mode(), archive, io.Copy)
 			}
-
-			_, cpErr := copyFunc(file, archive)
-			if closeErr := file.Close(); closeErr != nil {
+			if err != nil {
 				return err
 			}
-			if cpErr != nil {
-				return cpErr
-			}
 
 			continue
 		}
 
 		// everything else is metadata
 		// recreate metadata
-		file, err := ioutils.NewAtomicFileWriter(filepath.Join(imgMetaDir, header.Name), header.FileInfo().Mode())
-		if err != nil {
+		if err = i.writeFile(filepath.Join(stage.metaDir(), header.Name), header.FileInfo().Mode(), archive, io.Copy); err != nil {
 			return err
 		}
+	}
 
-		if _, err = io.Copy(file, archive); err != nil { // nolint: gosec
-			return err
-		}
-		if err := file.Close(); err != nil {
+	return nil
+}
+
+// compressLayer compresses the current tar entry into dstFile and records the codec next to it.
+// With more than one worker the entry is spooled to a temp file, so the tar stream
+// can move on to the next layer while this one is being compressed.
+func (i *ImgStorage) compressLayer(pool *workerPool, dstFile string, mode os.FileMode, size int64, layer io.Reader) error {
+	codec := i.codec
+	compress := func(src io.Reader) error {
+		if err := i.writeFile(dstFile, mode, src, codec.compressAndCopy); err != nil {
 			return err
 		}
+
+		return saveLayerMeta(dstFile, layerMeta{Codec: codec, OriginalSize: size})
 	}
 
+	if i.workers <= 1 {
+		return compress(layer)
+	}
+
+	spool, err := newKamikazeFile()
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(spool, layer); err != nil {
+		_ = spool.Close()
+
+		return err
+	}
+
+	if _, err = spool.Seek(0, io.SeekStart); err != nil {
+		_ = spool.Close()
+
+		return err
+	}
+
+	pool.Go(func() error {
+		defer spool.Close()
+
+		return compress(spool)
+	})
+
 	return nil
 }
 
 // Load creates temp tar io.ReadCloser.
 func (i *ImgStorage) Load(imageName string) (io.ReadCloser, error) { // nolint: funlen
-	i.mu.Lock()
-	defer i.mu.Unlock()
-	imgMetaDir := filepath.Join(i.dir, "meta", imageNameToDirName(imageName))
+	defer i.touch()
+	dirName := imageNameToDirName(imageName)
+	defer i.images.Lock(dirName)()
+
+	pins := i.refs.newPinSet()
+	defer pins.release()
+	imgMetaDir := filepath.Join(i.dir, "meta", dirName)
 	if _, err := os.Stat(imgMetaDir); os.IsNotExist(err) {
 		return nil, fmt.Errorf("image '%v', does not exist", imageName) // nolint: goerr113
 	}
+	i.markUsed(dirName)
 
 	files, err := ioutil.ReadDir(imgMetaDir)
 	if err != nil {
@@ -152,21 +314,21 @@ func (i *ImgStorage) Load(imageName string) (io.ReadCloser, error) { // nolint:
 		})
 	}
 
-	manifestFile, err := os.Open(filepath.Join(imgMetaDir, "manifest.json"))
+	manifest, err := i.readManifest(filepath.Join(imgMetaDir, "manifest.json"))
 	if err != nil {
 		return nil, err
 	}
-
-	var manifest manifestJSON
-	if err = json.NewDecoder(manifestFile).Decode(&manifest); err != nil {
-		return nil, err
-	}
+	// the image is being restored, so it's hot again
+	i.promote(manifest.layers())
 
 	for _, imageEntry := range manifest {
 		for _, layerFile := range imageEntry.Layers {
 			layerDirName := filepath.Dir(layerFile)
-			layerDirPath := filepath.Join(i.dir, "layers", layerDirName)
+			pins.pin(layerDirName)
+			layerDirPath := i.layerDir(layerDirName)
+			unlock := i.layers.RLock(layerDirName)
 			files, err := ioutil.ReadDir(layerDirPath)
+			unlock()
 			if err != nil {
 				return nil, err
 			}
@@ -174,12 +336,18 @@ func (i *ImgStorage) Load(imageName string) (io.ReadCloser, error) { // nolint:
 			toCopy = append(toCopy, fileData{
 				srcPath: layerDirPath,
 				tarPath: filepath.Base(layerDirName) + string(filepath.Separator),
+				layer:   layerDirName,
 			})
 
 			for _, file := range files {
+				if isLayerSidecar(file.Name()) || isTempFile(file.Name()) {
+					continue
+				}
+
 				toCopy = append(toCopy, fileData{
 					srcPath: filepath.Join(layerDirPath, file.Name()),
 					tarPath: filepath.Join(layerDirName, file.Name()),
+					layer:   layerDirName,
 				})
 			}
 		}
@@ -190,8 +358,10 @@ func (i *ImgStorage) Load(imageName string) (io.ReadCloser, error) { // nolint:
 		return nil, err
 	}
 
-	err = tarFiles(outFile, toCopy)
+	err = i.tarFiles(outFile, toCopy)
 	if err != nil {
+		_ = outFile.Close()
+
 		return nil, err
 	}
 
@@ -203,22 +373,26 @@ func (i *ImgStorage) Load(imageName string) (io.ReadCloser, error) { // nolint:
 }
 
 func (i *ImgStorage) Remove(imageName string) error {
-	i.mu.Lock()
-	defer i.mu.Unlock()
+	if i.readOnly {
+		return storage.ErrReadOnly
+	}
 	defer i.cleanUp()
+	dirName := imageNameToDirName(imageName)
+	defer i.images.Lock(dirName)()
 
-	imgMetaDir := filepath.Join(i.dir, "meta", imageNameToDirName(imageName))
+	imgMetaDir := filepath.Join(i.dir, "meta", dirName)
 	err := os.RemoveAll(imgMetaDir)
+	atomic.AddUint64(&i.changes, 1)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return i.index.removeImage(dirName)
 }
 
 func (i *ImgStorage) IsExist(imageName string) (bool, error) {
-	i.mu.Lock()
-	defer i.mu.Unlock()
+	defer i.images.Lock(imageNameToDirName(imageName))()
+
 	imgMetaDir := filepath.Join(i.dir, "meta", imageNameToDirName(imageName))
 	if _, err := os.Stat(imgMetaDir); os.IsNotExist(err) {
 		return false, nil
@@ -229,9 +403,36 @@ func (i *ImgStorage) IsExist(imageName string) (bool, error) {
 	return true, nil
 }
 
+// DiskSize returns how much space the image takes, layers shared with other images are counted in full.
+func (i *ImgStorage) DiskSize(imageName string) (int64, error) {
+	defer i.images.Lock(imageNameToDirName(imageName))()
+
+	imgMetaDir := filepath.Join(i.dir, "meta", imageNameToDirName(imageName))
+	size, err := dirSize(imgMetaDir)
+	if err != nil {
+		return 0, err
+	}
+
+	manifest, err := i.readManifest(filepath.Join(imgMetaDir, "manifest.json"))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, layer := range manifest.layers() {
+		layerSize, err := dirSize(i.layerDir(layer))
+		if err != nil {
+			return 0, err
+		}
+		size += layerSize
+	}
+
+	return size, nil
+}
+
 func (i *ImgStorage) RemoveNotIn(imageNames []string) error {
-	i.mu.Lock()
-	defer i.mu.Unlock()
+	if i.readOnly {
+		return storage.ErrReadOnly
+	}
 	defer i.cleanUp()
 
 	allowedSet := map[string]bool{}
@@ -252,13 +453,28 @@ func (i *ImgStorage) RemoveNotIn(imageNames []string) error {
 		}
 
 		if !allowedSet[filepath.Base(path)] {
-			return os.RemoveAll(path)
+			unlock := i.images.Lock(filepath.Base(path))
+			defer unlock()
+
+			err := os.RemoveAll(path)
+			atomic.AddUint64(&i.changes, 1)
+			if err != nil {
+				return err
+			}
+			if err := i.index.removeImage(filepath.Base(path)); err != nil {
+				return err
+			}
 		}
 
 		return filepath.SkipDir
 	})
 }
 
+// Changes returns a counter of saved and removed images, readers may cache images until it changes.
+func (i *ImgStorage) Changes() uint64 {
+	return atomic.LoadUint64(&i.changes)
+}
+
 func (i *ImgStorage) Ping() error {
 	stat, err := os.Stat(i.dir)
 	if err != nil {
@@ -267,14 +483,98 @@ func (i *ImgStorage) Ping() error {
 	if !stat.IsDir() {
 		return fmt.Errorf("path '%s' is a file, directory is expected", i.dir) //nolint: goerr113
 	}
+	if i.slowDir != "" {
+		if _, err = os.Stat(i.slowDir); err != nil {
+			return fmt.Errorf("ping the slow tier, %w", err)
+		}
+	}
 
 	return nil
 }
 
 // cleanUp removes unused layers
 // cleanUp should be called after any change in meta or layers.
+// Concurrent calls are merged into one more run of the already running cleanUp.
 func (i *ImgStorage) cleanUp() {
-	allowedLayers := map[string]bool{}
+	i.gcMu.Lock()
+	if i.gcRunning {
+		i.gcPending = true
+		i.gcMu.Unlock()
+
+		return
+	}
+	i.gcRunning = true
+	i.gcMu.Unlock()
+
+	for {
+		i.collectGarbage()
+
+		i.gcMu.Lock()
+		if !i.gcPending {
+			i.gcRunning = false
+			i.gcMu.Unlock()
+
+			return
+		}
+		i.gcPending = false
+		i.gcMu.Unlock()
+	}
+}
+
+// collectGarbage removes orphaned layers which are not used by in-flight saves and loads.
+func (i *ImgStorage) collectGarbage() {
+	i.refs.startGC()
+
+	orphans, err := i.index.getOrphans()
+	if err != nil {
+		log.Warn("images cleanUp, ", err)
+
+		return
+	}
+
+	removed := make([]string, 0, len(orphans))
+	for _, layer := range orphans {
+		ok, err := i.refs.removeIfUnused(layer, func() error {
+			for _, root := range i.layerRoots() {
+				if err := os.RemoveAll(filepath.Join(root, layer)); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			log.Warn("images cleanUp, ", err)
+
+			continue
+		}
+		if ok {
+			removed = append(removed, layer)
+		}
+	}
+
+	if err = i.index.collected(removed); err != nil {
+		log.Warn("images cleanUp, ", err)
+	}
+}
+
+// RebuildIndex scans all manifests and layers and replaces the layer index,
+// it repairs the index after manual changes in the cache dir.
+func (i *ImgStorage) RebuildIndex() error {
+	if i.readOnly {
+		return storage.ErrReadOnly
+	}
+	if err := i.index.rebuild(); err != nil {
+		return err
+	}
+	i.cleanUp()
+
+	return nil
+}
+
+// scan reads layers of every image and lists all stored layers.
+func (i *ImgStorage) scan() (map[string][]string, []string, error) {
+	images := map[string][]string{}
 	err := filepath.Walk(filepath.Join(i.dir, "meta"), func(path string, info os.FileInfo, err error) error {
 		if os.IsNotExist(err) {
 			return nil
@@ -286,101 +586,126 @@ func (i *ImgStorage) cleanUp() {
 			return nil
 		}
 
-		manifestFile, err := os.Open(path)
+		manifest, err := i.readManifest(path)
 		if err != nil {
 			return err
 		}
-
-		var manifest manifestJSON
-		if err = json.NewDecoder(manifestFile).Decode(&manifest); err != nil {
-			return err
-		}
-
-		for _, imageEntry := range manifest {
-			for _, layerFile := range imageEntry.Layers {
-				allowedLayers[filepath.Dir(layerFile)] = true
-			}
-		}
+		images[filepath.Base(filepath.Dir(path))] = manifest.layers()
 
 		return nil
 	})
 	if err != nil {
-		log.Warn("images cleanUp", err)
+		return nil, nil, err
 	}
 
-	err = filepath.Walk(filepath.Join(i.dir, "layers"), func(path string, info os.FileInfo, err error) error {
-		if os.IsNotExist(err) {
-			return nil
+	layers := []string{}
+	for _, root := range i.layerRoots() {
+		layerDirs, err := ioutil.ReadDir(root)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, nil, err
 		}
-		if err != nil {
-			return err
+		for _, layerDir := range layerDirs {
+			layers = append(layers, layerDir.Name())
 		}
+	}
 
-		if filepath.Base(path) == "layers" {
-			return nil
-		}
+	return images, layers, nil
+}
 
-		if !allowedLayers[filepath.Base(path)] {
-			return os.RemoveAll(path)
-		}
+func dirSize(path string) (int64, error) {
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return 0, err
+	}
 
-		return filepath.SkipDir
-	})
+	size := int64(0)
+	for _, file := range files {
+		size += file.Size()
+	}
+
+	return size, nil
+}
+
+// touch marks the storage as used right now.
+func (i *ImgStorage) touch() {
+	atomic.StoreInt64(&i.lastUsed, time.Now().UnixNano())
+}
+
+func (i *ImgStorage) readManifest(path string) (manifestJSON, error) {
+	manifestFile, err := i.openFile(path)
 	if err != nil {
-		log.Warn("images cleanUp", err)
+		return nil, err
 	}
+	defer manifestFile.Close()
+
+	var manifest manifestJSON
+	if err = json.NewDecoder(manifestFile).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("decoding '%s', %w", path, err)
+	}
+
+	return manifest, nil
+}
+
+// isSameLayer reports whether layer.tar with the same original size is already stored.
+func isSameLayer(layerPath string, size int64) bool {
+	meta, err := loadLayerMeta(layerPath)
+
+	return err == nil && meta.OriginalSize == size
 }
 
+// isStoredLayerFile reports whether the layer's file from the tar is already stored.
+func (i *ImgStorage) isStoredLayerFile(path string, header *tar.Header) bool {
+	if filepath.Base(path) == "layer.tar" {
+		return isSameLayer(path, header.Size)
+	}
+
+	stat, err := os.Stat(path)
+
+	return err == nil && i.plainSize(stat) == header.Size
+}
+
+// layerOf returns the layer id of a file stored in the layer's dir.
+func layerOf(layerFile string) string {
+	return filepath.Base(filepath.Dir(layerFile))
+}
+
+// imageNameToDirName keeps the name readable and makes it unique with a hash suffix.
 func imageNameToDirName(str string) string {
+	sum := sha256.Sum256([]byte(str))
+
+	return fmt.Sprintf("%s-%x", legacyImageNameToDirName(str), sum[:8])
+}
+
+// legacyImageNameToDirName is the mapping before the hash suffix, different names may share a dir.
+func legacyImageNameToDirName(str string) string {
 	return regexp.MustCompile(`\W+`).ReplaceAllString(str, "_")
 }
 
-func tarFiles(tmpTar io.Writer, toCopy []fileData) error {
+func (i *ImgStorage) tarFiles(tmpTar io.Writer, toCopy []fileData) error {
 	tw := tar.NewWriter(tmpTar)
 	defer tw.Close()
 
 	for _, data := range toCopy {
-		fi, err := os.Stat(data.srcPath)
-		if err != nil {
-			return err
-		}
-
-		hdr, err := tar.FileInfoHeader(fi, fi.Name())
+		hdr, srcFile, copyFunc, err := i.openTarFile(data)
 		if err != nil {
 			return err
 		}
-
-		copyFunc := io.Copy
-		if fi.Name() == "layer.tar" {
-			copyFunc = decompressAndCopy
-			size, err := loadOriginalSize(data.srcPath)
-			if err != nil {
+		if srcFile == nil {
+			// a dir
+			if err = tw.WriteHeader(hdr); err != nil {
 				return err
 			}
-			hdr.Size = size
-		}
-
-		hdr.Name = data.tarPath
-		if err := tw.WriteHeader(hdr); err != nil {
-			return err
-		}
 
-		if fi.Mode().IsDir() {
 			continue
 		}
 
-		// add file to tar
-		srcFile, err := os.Open(data.srcPath)
-		if err != nil {
-			return err
+		if err = tw.WriteHeader(hdr); err == nil {
+			_, err = copyFunc(tw, srcFile)
 		}
-
-		if _, err = copyFunc(tw, srcFile); err != nil {
-			_ = srcFile.Close()
-
-			return err
+		if closeErr := srcFile.Close(); err == nil {
+			err = closeErr
 		}
-		if err = srcFile.Close(); err != nil {
+		if err != nil {
 			return err
 		}
 	}
@@ -388,50 +713,88 @@ func tarFiles(tmpTar io.Writer, toCopy []fileData) error {
 	return nil
 }
 
-func compressAndCopy(dst io.Writer, src io.Reader) (int64, error) {
-	enc, err := zstd.NewWriter(dst, zstd.WithEncoderLevel(zstd.SpeedFastest))
-	if err != nil {
-		return 0, err
+// openTarFile returns the tar header of the file and opens it unless it's a dir.
+// Files of a layer are opened under the shared lock of the layer, so the header matches the opened file.
+func (i *ImgStorage) openTarFile(
+	data fileData,
+) (*tar.Header, io.ReadCloser, func(io.Writer, io.Reader) (int64, error), error) {
+	if data.layer != "" {
+		defer i.layers.RLock(data.layer)()
 	}
-	written, err := io.Copy(enc, src)
-	if err != nil {
-		_ = enc.Close()
 
-		return written, err
+	fi, err := os.Stat(data.srcPath)
+	if err != nil {
+		return nil, nil, nil, err
 	}
 
-	return written, enc.Close()
-}
-
-func decompressAndCopy(dst io.Writer, src io.Reader) (int64, error) {
-	dec, err := zstd.NewReader(src)
+	hdr, err := tar.FileInfoHeader(fi, fi.Name())
 	if err != nil {
-		return 0, err
+		return nil, nil, nil, err
+	}
+	hdr.Name = data.tarPath
+	if fi.Mode().IsDir() {
+		return hdr, nil, nil, nil
+	}
+	if fi.Mode().IsRegular() {
+		hdr.Size = i.plainSize(fi)
+	}
+
+	copyFunc := io.Copy
+	if fi.Name() == "layer.tar" {
+		meta, err := loadLayerMeta(data.srcPath)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		copyFunc = decompressAndCopy
+		hdr.Size = meta.OriginalSize
 	}
-	defer dec.Close()
 
-	written, err := io.Copy(dst, dec)
+	srcFile, err := i.openFile(data.srcPath)
 	if err != nil {
-		return written, err
+		return nil, nil, nil, err
 	}
 
-	return written, nil
+	return hdr, srcFile, copyFunc, nil
 }
 
-func saveOriginalSize(filePath string, size int64) error {
-	return ioutil.WriteFile(filePath+"originalSize", []byte(strconv.FormatInt(size, 10)), 0600)
+// tempFilePrefix starts names of files being written by replaceFile.
+const tempFilePrefix = ".tmp-"
+
+// isTempFile reports whether the file is being written or has been left by a crash while it was written.
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, tempFilePrefix)
+}
+
+// copyToFile replaces the file only when the whole src has been copied, see replaceFile.
+func copyToFile(path string, mode os.FileMode, src io.Reader, copyFunc func(io.Writer, io.Reader) (int64, error)) error {
+	return replaceFile(path, mode, src, copyFunc, os.Rename)
 }
 
-func loadOriginalSize(filePath string) (int64, error) {
-	b, err := ioutil.ReadFile(filePath + "originalSize")
+// replaceFile copies src to a temp file next to path and calls rename to move it over path once the copy has succeeded,
+// so a failed read of src never leaves a partial file at path. The temp file is removed unless it has been renamed.
+func replaceFile(
+	path string, mode os.FileMode, src io.Reader, copyFunc func(io.Writer, io.Reader) (int64, error),
+	rename func(tmp, path string) error,
+) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), tempFilePrefix+filepath.Base(path))
 	if err != nil {
-		return 0, err
+		return err
 	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
 
-	size, err := strconv.ParseInt(string(b), 10, 64)
-	if err != nil {
-		return 0, err
+	if _, err = copyFunc(tmp, src); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), mode); err != nil {
+		return err
 	}
 
-	return size, nil
+	return rename(tmp.Name(), path)
 }
@@ -0,0 +1,369 @@
+package compact
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+)
+
+func setUpTempDir(t testing.TB) string {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("can't create tempdir", err)
+	}
+	t.Cleanup(cleanUpTempDir(t, dir))
+
+	return dir
+}
+
+func cleanUpTempDir(t testing.TB, dir string) func() {
+	return func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Log("can't Remove tempdir", err)
+		}
+	}
+}
+
+// layerContent returns compressible pseudo-random data, similar to real layers.
+func layerContent(seed int64, size int) []byte {
+	const alphabet = "abcdefghijklmnopqrstuvwxyz0123456789 \n"
+	rnd := rand.New(rand.NewSource(seed)) // nolint: gosec
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = alphabet[rnd.Intn(len(alphabet))]
+	}
+
+	return data
+}
+
+// makeImageDump builds a tar in the `docker save` format and returns it with its files.
+func makeImageDump(t testing.TB, layers, layerSize int) ([]byte, map[string][]byte) {
+	files := map[string][]byte{}
+	dirs := []string{}
+	layerPaths := []string{}
+	for l := 0; l < layers; l++ {
+		dir := fmt.Sprintf("%064x", l+1)
+		dirs = append(dirs, dir+"/")
+		files[dir+"/VERSION"] = []byte("1.0")
+		files[dir+"/json"] = []byte(fmt.Sprintf(`{"id":"%s"}`, dir))
+		files[dir+"/layer.tar"] = layerContent(int64(l), layerSize)
+		layerPaths = append(layerPaths, dir+"/layer.tar")
+	}
+
+	manifest, err := json.Marshal([]map[string]interface{}{{
+		"Config":   "config.json",
+		"RepoTags": []string{"img:1"},
+		"Layers":   layerPaths,
+	}})
+	require.NoError(t, err)
+	files["manifest.json"] = manifest
+	files["config.json"] = []byte(`{}`)
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, dir := range dirs {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: dir, Mode: 0755, Typeflag: tar.TypeDir}))
+		for _, name := range []string{"VERSION", "json", "layer.tar"} {
+			path := dir + name
+			writeTarFile(t, tw, path, files[path])
+		}
+	}
+	writeTarFile(t, tw, "manifest.json", files["manifest.json"])
+	writeTarFile(t, tw, "config.json", files["config.json"])
+	require.NoError(t, tw.Close())
+
+	return buf.Bytes(), files
+}
+
+func writeTarFile(t testing.TB, tw *tar.Writer, name string, content []byte) {
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}))
+	_, err := tw.Write(content)
+	require.NoError(t, err)
+}
+
+func readTarFiles(t testing.TB, r io.Reader) map[string][]byte {
+	files := map[string][]byte{}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if header.FileInfo().IsDir() {
+			continue
+		}
+
+		content, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		files[header.Name] = content
+	}
+
+	return files
+}
+
+func TestImgStorage_SaveLoad(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		workers := workers
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			storage := NewImgStorage(setUpTempDir(t), WithCompressionWorkers(workers))
+			dump, files := makeImageDump(t, 5, 64<<10)
+
+			require.NoError(t, storage.Save("img:1", bytes.NewReader(dump)))
+			requireLoads(t, storage, "img:1", files)
+		})
+	}
+}
+
+func requireLoads(t *testing.T, storage *ImgStorage, imageName string, files map[string][]byte) {
+	loaded, err := storage.Load(imageName)
+	require.NoError(t, err)
+	defer loaded.Close()
+
+	loadedFiles := readTarFiles(t, loaded)
+	for name, content := range files {
+		require.Equal(t, content, loadedFiles[name], name)
+	}
+}
+
+func TestImgStorage_Codecs(t *testing.T) {
+	codecs := []Codec{
+		{Name: CodecNone},
+		{Name: CodecGzip, Level: 6},
+		{Name: CodecZstd, Level: 1},
+		{Name: CodecZstd, Level: 7, LongWindow: true},
+	}
+
+	t.Run("save and load", func(t *testing.T) {
+		for _, codec := range codecs {
+			codec := codec
+			t.Run(codec.String(), func(t *testing.T) {
+				storage := NewImgStorage(setUpTempDir(t), WithCodec(codec))
+				dump, files := makeImageDump(t, 2, 16<<10)
+
+				require.NoError(t, storage.Save("img:1", bytes.NewReader(dump)))
+				requireLoads(t, storage, "img:1", files)
+			})
+		}
+	})
+
+	t.Run("mixed codecs in one store", func(t *testing.T) {
+		dir := setUpTempDir(t)
+		dump, files := makeImageDump(t, 2, 16<<10)
+		require.NoError(t, NewImgStorage(dir, WithCodec(codecs[1])).Save("img:1", bytes.NewReader(dump)))
+
+		dump2, files2 := makeImageDump(t, 4, 16<<10)
+		storage := NewImgStorage(dir, WithCodec(codecs[2]))
+		require.NoError(t, storage.Save("img:2", bytes.NewReader(dump2)))
+
+		requireLoads(t, storage, "img:1", files)
+		requireLoads(t, storage, "img:2", files2)
+	})
+
+	t.Run("legacy originalSize sidecar", func(t *testing.T) {
+		dir := setUpTempDir(t)
+		storage := NewImgStorage(dir)
+		dump, files := makeImageDump(t, 1, 16<<10)
+		require.NoError(t, storage.Save("img:1", bytes.NewReader(dump)))
+
+		layerPath := filepath.Join(dir, "layers", fmt.Sprintf("%064x", 1), "layer.tar")
+		require.NoError(t, os.Remove(layerPath+layerMetaSuffix))
+		require.NoError(t, ioutil.WriteFile(layerPath+legacySizeSuffix, []byte("16384"), 0600))
+
+		requireLoads(t, storage, "img:1", files)
+	})
+}
+
+func TestImgStorage_recompressWhileIdle(t *testing.T) {
+	dir := setUpTempDir(t)
+	storage := NewImgStorage(dir, WithCodec(Codec{Name: CodecGzip, Level: 1}))
+	dump, files := makeImageDump(t, 2, 16<<10)
+	require.NoError(t, storage.Save("img:1", bytes.NewReader(dump)))
+
+	target := Codec{Name: CodecZstd, Level: 7}
+	t.Run("busy storage is not recompressed", func(t *testing.T) {
+		require.NoError(t, storage.recompressWhileIdle(context.Background(), target, time.Hour))
+
+		meta, err := loadLayerMeta(filepath.Join(dir, "layers", fmt.Sprintf("%064x", 1), "layer.tar"))
+		require.NoError(t, err)
+		require.Equal(t, CodecGzip, meta.Codec.Name)
+	})
+
+	t.Run("idle storage is recompressed", func(t *testing.T) {
+		require.NoError(t, storage.recompressWhileIdle(context.Background(), target, 0))
+
+		for l := 1; l <= 2; l++ {
+			meta, err := loadLayerMeta(filepath.Join(dir, "layers", fmt.Sprintf("%064x", l), "layer.tar"))
+			require.NoError(t, err)
+			require.Equal(t, target, meta.Codec)
+		}
+		requireLoads(t, storage, "img:1", files)
+	})
+
+	t.Run("a layer which fails to decompress is kept", func(t *testing.T) {
+		layerPath := filepath.Join(dir, "layers", fmt.Sprintf("%064x", 1), "layer.tar")
+		data, err := ioutil.ReadFile(layerPath)
+		require.NoError(t, err)
+		corrupt := append(data[:len(data)/2:len(data)/2], bytes.Repeat([]byte{0xff}, 64)...)
+		require.NoError(t, ioutil.WriteFile(layerPath, corrupt, 0600))
+
+		require.NoError(t, saveLayerMeta(layerPath, layerMeta{Codec: Codec{Name: CodecGzip, Level: 1}}))
+		require.Error(t, storage.recompressLayer(layerPath, target))
+
+		stored, err := ioutil.ReadFile(layerPath)
+		require.NoError(t, err)
+		require.Equal(t, corrupt, stored)
+		meta, err := loadLayerMeta(layerPath)
+		require.NoError(t, err)
+		require.Equal(t, CodecGzip, meta.Codec.Name)
+		entries, err := ioutil.ReadDir(filepath.Dir(layerPath))
+		require.NoError(t, err)
+		for _, entry := range entries {
+			require.False(t, strings.HasPrefix(entry.Name(), ".tmp-"), "temp files are removed")
+		}
+	})
+}
+
+func TestImgStorage_Concurrency(t *testing.T) {
+	t.Run("unrelated images are saved and loaded at the same time", func(t *testing.T) {
+		storage := NewImgStorage(setUpTempDir(t), WithCompressionWorkers(2))
+		dump, files := makeImageDump(t, 3, 16<<10)
+
+		wg := sync.WaitGroup{}
+		for n := 0; n < 8; n++ {
+			imageName := fmt.Sprintf("img:%d", n)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				require.NoError(t, storage.Save(imageName, bytes.NewReader(dump)))
+				requireLoads(t, storage, imageName, files)
+				if imageName != "img:0" {
+					require.NoError(t, storage.Remove(imageName))
+				}
+			}()
+		}
+		wg.Wait()
+
+		requireLoads(t, storage, "img:0", files)
+	})
+
+	t.Run("cleanUp keeps pinned layers", func(t *testing.T) {
+		dir := setUpTempDir(t)
+		storage := NewImgStorage(dir)
+		layerDir := filepath.Join(dir, "layers", "in-flight")
+		require.NoError(t, os.MkdirAll(layerDir, os.ModePerm))
+
+		pins := storage.refs.newPinSet()
+		pins.pin("in-flight")
+		storage.cleanUp()
+		require.DirExists(t, layerDir)
+
+		pins.release()
+		storage.cleanUp()
+		_, err := os.Stat(layerDir)
+		require.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("layers are restored while they are recompressed", func(t *testing.T) {
+		dir := setUpTempDir(t)
+		storage := NewImgStorage(dir, WithCodec(Codec{Name: CodecGzip, Level: 1}))
+		dump, files := makeImageDump(t, 3, 64<<10)
+		require.NoError(t, storage.Save("img:1", bytes.NewReader(dump)))
+		layer := fmt.Sprintf("%064x", 2)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for _, level := range []int{2, 4, 6, 8, 9} {
+				require.NoError(t, storage.recompressLayer(
+					filepath.Join(dir, "layers", layer, "layer.tar"), Codec{Name: CodecGzip, Level: level}))
+			}
+		}()
+
+		for restoring := true; restoring; {
+			select {
+			case <-done:
+				restoring = false
+			default:
+			}
+			requireLoads(t, storage, "img:1", files)
+
+			reader, err := storage.OpenLayer(layer)
+			require.NoError(t, err)
+			content, err := ioutil.ReadAll(reader)
+			require.NoError(t, err)
+			require.NoError(t, reader.Close())
+			require.Equal(t, files[layer+"/layer.tar"], content)
+		}
+	})
+
+}
+
+func BenchmarkImgStorage_Save(b *testing.B) {
+	dump, _ := makeImageDump(b, 8, 4<<20)
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		workers := workers
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(int64(len(dump)))
+			for n := 0; n < b.N; n++ {
+				b.StopTimer()
+				storage := NewImgStorage(setUpTempDir(b), WithCompressionWorkers(workers))
+				b.StartTimer()
+
+				if err := storage.Save("img:1", bytes.NewReader(dump)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// dirFiles lists files of the dir with their sizes and modification times.
+func dirFiles(t *testing.T, dir string) map[string]string {
+	files := map[string]string{}
+	require.NoError(t, filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		require.NoError(t, err)
+		files[path] = fmt.Sprintf("%d %s", info.Size(), info.ModTime())
+
+		return nil
+	}))
+
+	return files
+}
+
+func TestImgStorage_ReadOnly(t *testing.T) {
+	dir := setUpTempDir(t)
+	dump, files := makeImageDump(t, 2, 16<<10)
+	require.NoError(t, NewImgStorage(dir).Save("a", bytes.NewReader(dump)))
+	before := dirFiles(t, dir)
+
+	images := NewImgStorage(dir, WithReadOnly(true))
+	requireLoads(t, images, "a", files)
+	requireReadOnly := func(err error) {
+		require.True(t, errors.Is(err, storage.ErrReadOnly), err)
+	}
+	requireReadOnly(images.Save("b", bytes.NewReader(dump)))
+	requireReadOnly(images.Remove("a"))
+	requireReadOnly(images.RemoveNotIn(nil))
+	requireReadOnly(images.RebuildIndex())
+	requireLoads(t, images, "a", files)
+
+	require.Equal(t, before, dirFiles(t, dir))
+}
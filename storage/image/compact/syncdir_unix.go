@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package compact
+
+import (
+	"fmt"
+	"os"
+)
+
+// syncDir makes renames and removals in the dir durable.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	if err = dir.Sync(); err != nil {
+		return fmt.Errorf("syncing '%s', %w", path, err)
+	}
+
+	return nil
+}
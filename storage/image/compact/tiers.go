@@ -0,0 +1,261 @@
+package compact
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+)
+
+// With a slow tier layers are kept on one of two dirs: new and restored layers are stored in the dir of the storage,
+// layers used only by cold images are moved to the slow tier. Every layer is stored once on either tier,
+// so images share layers across tiers. Meta of all images stays in the dir of the storage.
+//
+// An image is used when it is saved or loaded, the modification time of its meta dir is the time of the last use.
+// Layers are moved only while nobody has them pinned and a move copies a layer into a temp dir of the target tier first,
+// so a crash leaves at most a duplicate which the next demotion removes.
+
+// tieringDir keeps layers being copied to a tier.
+const tieringDir = "tiering"
+
+// WithSlowTier keeps layers of cold images in dir, e.g. on a bigger and slower disk, "" disables tiers.
+func WithSlowTier(dir string) Option {
+	return func(i *ImgStorage) {
+		i.slowDir = dir
+	}
+}
+
+// layerRoots returns dirs of layers of every tier, the fast one first.
+func (i *ImgStorage) layerRoots() []string {
+	roots := []string{filepath.Join(i.dir, "layers")}
+	if i.slowDir != "" {
+		roots = append(roots, filepath.Join(i.slowDir, "layers"))
+	}
+
+	return roots
+}
+
+// layerDir returns the dir of the layer on the tier which has it, a missing layer belongs to the fast tier.
+// The layer has to be pinned, so it isn't moved meanwhile.
+func (i *ImgStorage) layerDir(layer string) string {
+	fast := filepath.Join(i.dir, "layers", layer)
+	if i.slowDir == "" {
+		return fast
+	}
+
+	if _, err := os.Stat(fast); err == nil {
+		return fast
+	}
+	slow := filepath.Join(i.slowDir, "layers", layer)
+	if _, err := os.Stat(slow); err == nil {
+		return slow
+	}
+
+	return fast
+}
+
+// isSlow reports whether the layer dir is on the slow tier.
+func (i *ImgStorage) isSlow(layerDir string) bool {
+	return i.slowDir != "" && filepath.Dir(layerDir) == filepath.Join(i.slowDir, "layers")
+}
+
+// markUsed records a use of the image for demotion.
+func (i *ImgStorage) markUsed(dirName string) {
+	if i.slowDir == "" || i.readOnly {
+		return
+	}
+
+	now := time.Now()
+	if err := os.Chtimes(filepath.Join(i.dir, "meta", dirName), now, now); err != nil {
+		log.Warnf("marking '%s' as used, %s", dirName, err)
+	}
+}
+
+// promote moves layers of the image from the slow tier, layers which can't be moved are left there.
+func (i *ImgStorage) promote(layers []string) {
+	if i.slowDir == "" || i.readOnly {
+		return
+	}
+
+	for _, layer := range layers {
+		slow := filepath.Join(i.slowDir, "layers", layer)
+		if _, err := os.Stat(slow); err != nil {
+			continue
+		}
+
+		if err := i.moveLayer(layer, slow, i.dir); err != nil {
+			log.Warnf("promoting layer '%s', %s", layer, err)
+		}
+	}
+}
+
+// DemoteCold moves layers used only by images which haven't been used for `cold` to the slow tier.
+// It blocks until ctx is done.
+func (i *ImgStorage) DemoteCold(ctx context.Context, cold time.Duration) {
+	ticker := time.NewTicker(cold)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := i.demoteCold(ctx, cold); err != nil {
+			log.Warn("demoting layers, ", err)
+		}
+	}
+}
+
+func (i *ImgStorage) demoteCold(ctx context.Context, cold time.Duration) error {
+	if i.slowDir == "" {
+		return nil
+	}
+	if i.readOnly {
+		return storage.ErrReadOnly
+	}
+
+	hot, err := i.hotLayers(cold)
+	if err != nil {
+		return err
+	}
+
+	fastLayers, err := ioutil.ReadDir(filepath.Join(i.dir, "layers"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, layer := range fastLayers {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		fast := filepath.Join(i.dir, "layers", layer.Name())
+		slow := filepath.Join(i.slowDir, "layers", layer.Name())
+		switch {
+		case hot[layer.Name()]:
+			// a promotion has left the slow copy, because the layer was being read
+			_, err = i.refs.removeIfUnpinned(layer.Name(), func() error { return os.RemoveAll(slow) })
+		case time.Since(layer.ModTime()) >= cold:
+			err = i.moveLayer(layer.Name(), fast, i.slowDir)
+		}
+		if err != nil {
+			return fmt.Errorf("demoting layer '%s', %w", layer.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// hotLayers returns layers of images used within `cold`.
+func (i *ImgStorage) hotLayers(cold time.Duration) (map[string]bool, error) {
+	imageDirs, err := ioutil.ReadDir(filepath.Join(i.dir, "meta"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	hot := map[string]bool{}
+	for _, imageDir := range imageDirs {
+		if time.Since(imageDir.ModTime()) >= cold {
+			continue
+		}
+
+		manifest, err := i.readManifest(filepath.Join(i.dir, "meta", imageDir.Name(), "manifest.json"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, layer := range manifest.layers() {
+			hot[layer] = true
+		}
+	}
+
+	return hot, nil
+}
+
+// moveLayer copies the layer to the tier of root and removes it from src unless it's pinned.
+func (i *ImgStorage) moveLayer(layer, src, root string) error {
+	defer i.layers.Lock(layer)()
+
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		// has been collected or moved by a concurrent load
+		return nil
+	}
+
+	// a complete copy on the target tier is left by an interrupted move, it may be being read
+	dst := filepath.Join(root, "layers", layer)
+	if _, err := os.Stat(dst); os.IsNotExist(err) {
+		if err = copyLayer(src, dst, filepath.Join(root, tieringDir)); err != nil {
+			return err
+		}
+	}
+
+	moved, err := i.refs.removeIfUnpinned(layer, func() error { return os.RemoveAll(src) })
+	if err != nil || !moved {
+		return err
+	}
+	log.Debugf("layer '%s' has been moved to %s", layer, root)
+
+	return nil
+}
+
+// copyLayer copies files of the layer to a temp dir of tmpRoot and then renames it to dst.
+func copyLayer(src, dst, tmpRoot string) error {
+	if err := os.MkdirAll(tmpRoot, os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(tmpRoot, filepath.Base(dst)+".")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if !file.Mode().IsRegular() || isTempFile(file.Name()) {
+			continue
+		}
+		if err = copyFile(filepath.Join(src, file.Name()), filepath.Join(tmp, file.Name()), file.Mode()); err != nil {
+			return err
+		}
+	}
+
+	if err = os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, dst); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(dst))
+}
+
+// removeTiering drops copies interrupted by a crash.
+func (i *ImgStorage) removeTiering() error {
+	for _, root := range []string{i.dir, i.slowDir} {
+		if root == "" {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(root, tieringDir)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
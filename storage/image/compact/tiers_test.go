@@ -0,0 +1,121 @@
+package compact
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// coolDown makes the image and all layers look unused for an hour.
+func coolDown(t *testing.T, storage *ImgStorage, imageName string) {
+	past := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(storage.dir, "meta", imageNameToDirName(imageName)), past, past))
+	for _, root := range storage.layerRoots() {
+		layers, err := filepath.Glob(filepath.Join(root, "*"))
+		require.NoError(t, err)
+		for _, layer := range layers {
+			require.NoError(t, os.Chtimes(layer, past, past))
+		}
+	}
+}
+
+func requireTier(t *testing.T, root string, layers ...int) {
+	for _, layer := range layers {
+		require.DirExists(t, filepath.Join(root, "layers", fmt.Sprintf("%064x", layer)))
+	}
+}
+
+func requireNotOnTier(t *testing.T, root string, layers ...int) {
+	for _, layer := range layers {
+		require.NoDirExists(t, filepath.Join(root, "layers", fmt.Sprintf("%064x", layer)))
+	}
+}
+
+func TestImgStorage_Tiers(t *testing.T) {
+	ctx := context.Background()
+	newStorage := func(t *testing.T) (*ImgStorage, string, string) {
+		fast, slow := setUpTempDir(t), setUpTempDir(t)
+
+		return NewImgStorage(fast, WithSlowTier(slow)), fast, slow
+	}
+
+	t.Run("layers of cold images are demoted and promoted on load", func(t *testing.T) {
+		storage, fast, slow := newStorage(t)
+		dumpA, filesA := makeImageDump(t, 3, 16<<10)
+		dumpB, filesB := makeImageDump(t, 1, 16<<10)
+		require.NoError(t, storage.Save("a", bytes.NewReader(dumpA)))
+		require.NoError(t, storage.Save("b", bytes.NewReader(dumpB)))
+		coolDown(t, storage, "a")
+		// b is hot, so is its layer shared with a
+		now := time.Now()
+		require.NoError(t, os.Chtimes(filepath.Join(fast, "meta", imageNameToDirName("b")), now, now))
+
+		require.NoError(t, storage.demoteCold(ctx, time.Minute))
+		requireTier(t, fast, 1)
+		requireTier(t, slow, 2, 3)
+		requireNotOnTier(t, fast, 2, 3)
+		requireNotOnTier(t, slow, 1)
+
+		requireLoads(t, storage, "b", filesB)
+		requireLoads(t, storage, "a", filesA)
+		requireTier(t, fast, 1, 2, 3)
+		requireNotOnTier(t, slow, 1, 2, 3)
+	})
+
+	t.Run("layers on the slow tier are not stored again", func(t *testing.T) {
+		storage, fast, slow := newStorage(t)
+		dumpA, _ := makeImageDump(t, 2, 16<<10)
+		dumpB, filesB := makeImageDump(t, 3, 16<<10)
+		require.NoError(t, storage.Save("a", bytes.NewReader(dumpA)))
+		coolDown(t, storage, "a")
+		require.NoError(t, storage.demoteCold(ctx, time.Minute))
+
+		require.NoError(t, storage.Save("b", bytes.NewReader(dumpB)))
+		requireTier(t, slow, 1, 2)
+		requireNotOnTier(t, fast, 1, 2)
+		requireTier(t, fast, 3)
+
+		size, err := storage.DiskSize("b")
+		require.NoError(t, err)
+		require.Greater(t, size, int64(0))
+		requireLoads(t, storage, "b", filesB)
+	})
+
+	t.Run("removed images are collected on both tiers", func(t *testing.T) {
+		storage, fast, slow := newStorage(t)
+		dump, _ := makeImageDump(t, 2, 16<<10)
+		require.NoError(t, storage.Save("a", bytes.NewReader(dump)))
+		coolDown(t, storage, "a")
+		require.NoError(t, storage.demoteCold(ctx, time.Minute))
+		requireTier(t, slow, 1, 2)
+
+		require.NoError(t, storage.Remove("a"))
+		requireNotOnTier(t, slow, 1, 2)
+		requireNotOnTier(t, fast, 1, 2)
+	})
+
+	t.Run("pinned layers stay in place", func(t *testing.T) {
+		storage, fast, slow := newStorage(t)
+		dump, files := makeImageDump(t, 1, 16<<10)
+		require.NoError(t, storage.Save("a", bytes.NewReader(dump)))
+		coolDown(t, storage, "a")
+
+		reader, err := storage.OpenLayer(fmt.Sprintf("%064x", 1))
+		require.NoError(t, err)
+		require.NoError(t, storage.demoteCold(ctx, time.Minute))
+		requireTier(t, fast, 1)
+		require.NoError(t, reader.Close())
+
+		// the copy left on the slow tier completes the next demotion
+		require.NoError(t, storage.demoteCold(ctx, time.Minute))
+		requireNotOnTier(t, fast, 1)
+		requireTier(t, slow, 1)
+		requireLoads(t, storage, "a", files)
+	})
+}
@@ -0,0 +1,361 @@
+package compact
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/docker/pkg/ioutils"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+)
+
+// stagingDir keeps everything of one save until it is committed:
+//
+//	meta/           image's meta files
+//	layers/<id>/    layers which are not stored yet
+//	journal.json    commit record, the save is committed when it exists
+//	trash/          replaced meta and layers, removed with the stage
+type stagingDir string
+
+// journalRecord is the commit record of a save.
+type journalRecord struct {
+	Image     string
+	CreatedAt time.Time
+	Payload   []byte `json:",omitempty"`
+}
+
+func (i *ImgStorage) newStage(dirName string) (stagingDir, error) {
+	root := filepath.Join(i.dir, "staging")
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		return "", err
+	}
+
+	dir, err := ioutil.TempDir(root, dirName+".")
+	if err != nil {
+		return "", err
+	}
+
+	return stagingDir(dir), nil
+}
+
+func (s stagingDir) metaDir() string {
+	return filepath.Join(string(s), "meta")
+}
+
+func (s stagingDir) layersDir() string {
+	return filepath.Join(string(s), "layers")
+}
+
+func (s stagingDir) journalPath() string {
+	return filepath.Join(string(s), "journal.json")
+}
+
+func (s stagingDir) trash(name string) string {
+	return filepath.Join(string(s), "trash", name)
+}
+
+func (s stagingDir) remove() {
+	if err := os.RemoveAll(string(s)); err != nil {
+		log.Warnf("removing staging dir '%s', %s", s, err)
+	}
+}
+
+// isCommitted reports whether the journal record of the save has been written.
+func (s stagingDir) isCommitted() bool {
+	_, err := os.Stat(s.journalPath())
+
+	return err == nil
+}
+
+func (s stagingDir) readJournal() (journalRecord, error) {
+	data, err := ioutil.ReadFile(s.journalPath())
+	if err != nil {
+		return journalRecord{}, err
+	}
+
+	var record journalRecord
+	if err = json.Unmarshal(data, &record); err != nil {
+		return journalRecord{}, fmt.Errorf("decoding '%s', %w", s.journalPath(), err)
+	}
+
+	return record, nil
+}
+
+func (s stagingDir) writeJournal(record journalRecord, mode os.FileMode) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return ioutils.AtomicWriteFile(s.journalPath(), data, mode)
+}
+
+// commitStage writes the journal record and then moves the stage into the store.
+// The payload is written sealed by the keyring of the storage, commit gets it in plain text.
+func (i *ImgStorage) commitStage(stage stagingDir, record journalRecord, commit func([]byte) error) error {
+	record.CreatedAt = time.Now()
+	sealed := record
+	var err error
+	if sealed.Payload, err = i.sealPayload(record.Payload); err != nil {
+		return err
+	}
+
+	if err = stage.writeJournal(sealed, 0600); err != nil {
+		return fmt.Errorf("writing journal, %w", err)
+	}
+	if err = syncDir(string(stage)); err != nil {
+		return err
+	}
+
+	return i.applyStage(stage, record, commit)
+}
+
+// applyStage moves committed layers and meta into the store, it is idempotent.
+func (i *ImgStorage) applyStage(stage stagingDir, record journalRecord, commit func([]byte) error) error {
+	stagedLayers, err := ioutil.ReadDir(stage.layersDir())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, layer := range stagedLayers {
+		if err = i.applyLayer(stage, layer.Name()); err != nil {
+			return fmt.Errorf("applying layer '%s', %w", layer.Name(), err)
+		}
+	}
+
+	if err = i.applyMeta(stage, record.Image); err != nil {
+		return fmt.Errorf("applying meta of '%s', %w", record.Image, err)
+	}
+
+	for _, dir := range []string{filepath.Join(i.dir, "layers"), filepath.Join(i.dir, "meta")} {
+		if err = syncDir(dir); err != nil {
+			return err
+		}
+	}
+
+	if err = i.indexImage(record.Image); err != nil {
+		return err
+	}
+
+	if commit != nil && record.Payload != nil {
+		return commit(record.Payload)
+	}
+
+	return nil
+}
+
+func (i *ImgStorage) applyLayer(stage stagingDir, layer string) error {
+	defer i.layers.Lock(layer)()
+
+	staged := filepath.Join(stage.layersDir(), layer)
+	fast := filepath.Join(i.dir, "layers", layer)
+	if err := os.MkdirAll(filepath.Dir(fast), os.ModePerm); err != nil {
+		return err
+	}
+
+	live := i.layerDir(layer)
+	_, err := os.Stat(live)
+	if os.IsNotExist(err) {
+		return os.Rename(staged, live)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the layer has been stored by a concurrent save or it is incomplete after an older version
+	complete, err := isLayerComplete(live, staged)
+	if err != nil || complete {
+		return err
+	}
+
+	if err = linkMissingFiles(live, staged); err != nil {
+		return err
+	}
+
+	if i.isSlow(live) {
+		// the stage is on the fast tier, so the complete layer replaces the slow copy there
+		if err = os.Rename(staged, fast); err != nil {
+			return err
+		}
+
+		return os.RemoveAll(live)
+	}
+
+	trash := stage.trash(filepath.Join("layers", layer))
+	if err = os.MkdirAll(filepath.Dir(trash), os.ModePerm); err != nil {
+		return err
+	}
+	if err = os.Rename(live, trash); err != nil {
+		return err
+	}
+
+	return os.Rename(staged, live)
+}
+
+func (i *ImgStorage) applyMeta(stage stagingDir, dirName string) error {
+	live := filepath.Join(i.dir, "meta", dirName)
+	if _, err := os.Stat(stage.metaDir()); os.IsNotExist(err) {
+		// has been applied before a crash
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(live), os.ModePerm); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(live); err == nil {
+		if err = os.MkdirAll(stage.trash(""), os.ModePerm); err != nil {
+			return err
+		}
+		if err = os.Rename(live, stage.trash("meta")); err != nil {
+			return err
+		}
+	}
+
+	defer atomic.AddUint64(&i.changes, 1)
+
+	return os.Rename(stage.metaDir(), live)
+}
+
+// Recover finishes saves committed before a crash and drops uncommitted ones.
+// It has to be called before any Save, commit receives payloads of finished saves.
+func (i *ImgStorage) Recover(commit func(payload []byte) error) error {
+	if i.readOnly {
+		return storage.ErrReadOnly
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(i.dir, "staging"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	type committed struct {
+		stage  stagingDir
+		record journalRecord
+	}
+	if err = i.removeTiering(); err != nil {
+		return err
+	}
+
+	toApply := []committed{}
+	for _, entry := range entries {
+		stage := stagingDir(filepath.Join(i.dir, "staging", entry.Name()))
+		record, err := stage.readJournal()
+		if os.IsNotExist(err) {
+			log.Infof("dropping uncommitted save '%s'", entry.Name())
+			stage.remove()
+
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if record.Payload, err = i.openPayload(record.Payload); err != nil {
+			return fmt.Errorf("reading journal of '%s', %w", entry.Name(), err)
+		}
+
+		toApply = append(toApply, committed{stage: stage, record: record})
+	}
+
+	// the newest save of an image wins
+	sort.Slice(toApply, func(a, b int) bool {
+		return toApply[a].record.CreatedAt.Before(toApply[b].record.CreatedAt)
+	})
+
+	for _, c := range toApply {
+		log.Infof("finishing committed save of '%s'", c.record.Image)
+		unlock := i.images.Lock(c.record.Image)
+		err := i.applyStage(c.stage, c.record, commit)
+		unlock()
+		if err != nil {
+			return fmt.Errorf("recovering '%s', %w", c.stage, err)
+		}
+		c.stage.remove()
+	}
+	i.cleanUp()
+
+	return nil
+}
+
+// isLayerComplete reports whether every staged file is already in the live layer.
+func isLayerComplete(live, staged string) (bool, error) {
+	files, err := ioutil.ReadDir(staged)
+	if err != nil {
+		return false, err
+	}
+
+	for _, file := range files {
+		if isLayerSidecar(file.Name()) {
+			continue
+		}
+
+		livePath := filepath.Join(live, file.Name())
+		if file.Name() == "layer.tar" {
+			meta, err := loadLayerMeta(filepath.Join(staged, file.Name()))
+			if err != nil {
+				return false, err
+			}
+			if !isSameLayer(livePath, meta.OriginalSize) {
+				return false, nil
+			}
+
+			continue
+		}
+
+		stat, err := os.Stat(livePath)
+		if err != nil || stat.Size() != file.Size() {
+			return false, nil // nolint: nilerr
+		}
+	}
+
+	return true, nil
+}
+
+// linkMissingFiles puts files of the live layer which are not staged into the stage.
+func linkMissingFiles(live, staged string) error {
+	files, err := ioutil.ReadDir(live)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if isTempFile(file.Name()) {
+			continue
+		}
+		dst := filepath.Join(staged, file.Name())
+		if _, err := os.Stat(dst); err == nil {
+			continue
+		}
+
+		src := filepath.Join(live, file.Name())
+		if err := os.Link(src, dst); err == nil {
+			continue
+		}
+
+		if err := copyFile(src, dst, file.Mode()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	return copyToFile(dst, mode, srcFile, io.Copy)
+}
@@ -0,0 +1,119 @@
+package compact
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// stageImage stages the image as SaveTx does right before a crash.
+func stageImage(t *testing.T, storage *ImgStorage, dirName string, dump []byte) stagingDir {
+	stage, err := storage.newStage(dirName)
+	require.NoError(t, err)
+
+	pool := newWorkerPool(1)
+	require.NoError(t, storage.save(stage, bytes.NewReader(dump), pool, storage.refs.newPinSet()))
+	require.NoError(t, pool.Wait())
+
+	return stage
+}
+
+func writeJournal(t *testing.T, stage stagingDir, record journalRecord) {
+	data, err := json.Marshal(record)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(stage.journalPath(), data, 0600))
+}
+
+func TestImgStorage_Recover(t *testing.T) {
+	t.Run("uncommitted save is dropped and the previous version is kept", func(t *testing.T) {
+		dir := setUpTempDir(t)
+		storage := NewImgStorage(dir)
+		dump, files := makeImageDump(t, 2, 16<<10)
+		require.NoError(t, storage.Save("img:1", bytes.NewReader(dump)))
+
+		newDump, _ := makeImageDump(t, 3, 16<<10)
+		stageImage(t, storage, imageNameToDirName("img:1"), newDump)
+
+		storage = NewImgStorage(dir)
+		require.NoError(t, storage.Recover(func([]byte) error {
+			t.Fatal("nothing should be committed")
+
+			return nil
+		}))
+
+		requireLoads(t, storage, "img:1", files)
+		entries, err := ioutil.ReadDir(filepath.Join(dir, "staging"))
+		require.NoError(t, err)
+		require.Empty(t, entries)
+		require.NoDirExists(t, filepath.Join(dir, "layers", "0000000000000000000000000000000000000000000000000000000000000003"))
+	})
+
+	t.Run("committed save is finished", func(t *testing.T) {
+		dir := setUpTempDir(t)
+		storage := NewImgStorage(dir)
+		dump, _ := makeImageDump(t, 2, 16<<10)
+		require.NoError(t, storage.Save("img:1", bytes.NewReader(dump)))
+
+		newDump, newFiles := makeImageDump(t, 3, 16<<10)
+		stage := stageImage(t, storage, imageNameToDirName("img:1"), newDump)
+		writeJournal(t, stage, journalRecord{Image: imageNameToDirName("img:1"), Payload: []byte("meta")})
+
+		storage = NewImgStorage(dir)
+		committed := [][]byte{}
+		require.NoError(t, storage.Recover(func(payload []byte) error {
+			committed = append(committed, payload)
+
+			return nil
+		}))
+
+		require.Equal(t, [][]byte{[]byte("meta")}, committed)
+		requireLoads(t, storage, "img:1", newFiles)
+		entries, err := ioutil.ReadDir(filepath.Join(dir, "staging"))
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	})
+
+	t.Run("SaveTx commits the payload", func(t *testing.T) {
+		storage := NewImgStorage(setUpTempDir(t))
+		dump, files := makeImageDump(t, 2, 16<<10)
+
+		committed := []byte(nil)
+		err := storage.SaveTx("img:1", bytes.NewReader(dump), []byte("meta"), func(payload []byte) error {
+			committed = payload
+
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, []byte("meta"), committed)
+		requireLoads(t, storage, "img:1", files)
+	})
+
+	t.Run("a failed commit is replayed by Recover", func(t *testing.T) {
+		dir := setUpTempDir(t)
+		storage := NewImgStorage(dir)
+		dump, files := makeImageDump(t, 2, 16<<10)
+
+		err := storage.SaveTx("img:1", bytes.NewReader(dump), []byte("meta"), func([]byte) error {
+			return errors.New("meta storage is down")
+		})
+		require.EqualError(t, err, "meta storage is down")
+
+		storage = NewImgStorage(dir)
+		committed := [][]byte{}
+		require.NoError(t, storage.Recover(func(payload []byte) error {
+			committed = append(committed, payload)
+
+			return nil
+		}))
+		require.Equal(t, [][]byte{[]byte("meta")}, committed)
+		requireLoads(t, storage, "img:1", files)
+		entries, err := ioutil.ReadDir(filepath.Join(dir, "staging"))
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	})
+}
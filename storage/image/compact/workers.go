@@ -0,0 +1,52 @@
+package compact
+
+import (
+	"sync"
+)
+
+// workerPool runs at most `size` jobs at the same time and remembers the first error.
+type workerPool struct {
+	sem chan struct{}
+	wg  sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+func newWorkerPool(size int) *workerPool {
+	if size < 1 {
+		size = 1
+	}
+
+	return &workerPool{sem: make(chan struct{}, size)}
+}
+
+// Go blocks until a worker is free, then runs job in background.
+func (p *workerPool) Go(job func() error) {
+	p.sem <- struct{}{}
+	p.wg.Add(1)
+	go func() {
+		defer func() {
+			<-p.sem
+			p.wg.Done()
+		}()
+
+		if err := job(); err != nil {
+			p.mu.Lock()
+			if p.err == nil {
+				p.err = err
+			}
+			p.mu.Unlock()
+		}
+	}()
+}
+
+// Wait waits for all jobs and returns the first error.
+func (p *workerPool) Wait() error {
+	p.wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.err
+}
@@ -72,6 +72,16 @@ func (i *ImgStorage) IsExist(imageName string) (bool, error) {
 	return false, fmt.Errorf("checking existence '%s', %w", imageName, err)
 }
 
+// DiskSize returns the size of the image's file.
+func (i *ImgStorage) DiskSize(imageName string) (int64, error) {
+	stat, err := os.Stat(i.imagePath(imageName))
+	if err != nil {
+		return 0, fmt.Errorf("measuring '%s', %w", imageName, err)
+	}
+
+	return stat.Size(), nil
+}
+
 func (i *ImgStorage) RemoveNotIn(imageNames []string) error {
 	allowedSet := map[string]bool{}
 	for _, name := range imageNames {
@@ -106,7 +116,16 @@ func (i *ImgStorage) imagePath(imageName string) string {
 	return filepath.Join(i.dir, imageNameToFileName(imageName))
 }
 
+// imageNameToFileName keeps the name readable and makes it unique with a hash suffix.
 func imageNameToFileName(str string) string {
+	sum := sha256.Sum256([]byte(str))
+
+	return fmt.Sprintf("%s_%x.cache", imageSlug.ReplaceAllString(str, "_"), sum[:8])
+}
+
+// legacyImageNameToFileName is the mapping before the hash suffix,
+// it takes the first bytes of the name instead of its hash, so different names may share a file.
+func legacyImageNameToFileName(str string) string {
 	sb := strings.Builder{}
 	sb.WriteString(imageSlug.ReplaceAllString(str, "_"))
 	sb.WriteString("_")
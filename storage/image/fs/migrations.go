@@ -0,0 +1,120 @@
+package fs
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/podtserkovskiy/garnerd/storage/schema"
+)
+
+// SchemaComponent is a name of the fs layout in schema.json.
+const SchemaComponent = "fs"
+
+// Migrations upgrade the layout of the cache dir, Migrations()[n] upgrades it from version n to n+1.
+// imageNames lists all cached images, it is used to rename their files.
+func (i *ImgStorage) Migrations(imageNames func() ([]string, error)) []schema.Migration {
+	return []schema.Migration{
+		{Description: "collision-free image file names", Up: func() error { return i.migrateFileNames(imageNames) }},
+	}
+}
+
+// migrateFileNames renames image files to names with a hash suffix.
+// If several images have shared a file, the one named in RepoTags of its manifest gets it,
+// a file which can't be attributed is left to CleanUp.
+func (i *ImgStorage) migrateFileNames(imageNames func() ([]string, error)) error {
+	names, err := imageNames()
+	if err != nil {
+		return err
+	}
+
+	byLegacyFile := map[string][]string{}
+	for _, name := range names {
+		legacyFile := legacyImageNameToFileName(name)
+		byLegacyFile[legacyFile] = append(byLegacyFile[legacyFile], name)
+	}
+
+	for legacyFile, candidates := range byLegacyFile {
+		legacyPath := filepath.Join(i.dir, legacyFile)
+		if _, err = os.Stat(legacyPath); os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		name, ok := ownerOf(candidates, legacyPath)
+		if !ok {
+			log.Warnf("image file '%s' may belong to any of %v, it is left to clean up", legacyFile, candidates)
+
+			continue
+		}
+		if err = os.Rename(legacyPath, i.imagePath(name)); err != nil {
+			return fmt.Errorf("renaming image file '%s', %w", legacyFile, err)
+		}
+	}
+
+	return nil
+}
+
+// ownerOf picks the image stored in the dump among candidates sharing a legacy file.
+func ownerOf(candidates []string, dumpPath string) (string, bool) {
+	if len(candidates) == 1 {
+		return candidates[0], true
+	}
+
+	tags, err := repoTags(dumpPath)
+	if err != nil {
+		return "", false
+	}
+
+	for _, candidate := range candidates {
+		for _, tag := range tags {
+			if tag == candidate {
+				return candidate, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// repoTags reads RepoTags from manifest.json of the dump.
+func repoTags(dumpPath string) ([]string, error) {
+	dump, err := os.Open(dumpPath)
+	if err != nil {
+		return nil, err
+	}
+	defer dump.Close()
+
+	tarReader := tar.NewReader(dump)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("'%s' has no manifest.json", dumpPath) // nolint: goerr113
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Name != "manifest.json" {
+			continue
+		}
+
+		var manifest []struct{ RepoTags []string }
+		if err = json.NewDecoder(tarReader).Decode(&manifest); err != nil {
+			return nil, fmt.Errorf("decoding manifest.json of '%s', %w", dumpPath, err)
+		}
+
+		tags := []string{}
+		for _, imageEntry := range manifest {
+			tags = append(tags, imageEntry.RepoTags...)
+		}
+
+		return tags, nil
+	}
+}
@@ -0,0 +1,48 @@
+package fs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func makeDump(t *testing.T, repoTag string) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	manifest := []byte(`[{"Config":"config.json","RepoTags":["` + repoTag + `"],"Layers":[]}]`)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0644, Size: int64(len(manifest))}))
+	_, err := tw.Write(manifest)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+
+	return buf.Bytes()
+}
+
+func TestImageNameToFileName(t *testing.T) {
+	require.Equal(t, legacyImageNameToFileName("ab/c:1"), legacyImageNameToFileName("ab/c.1"))
+	require.NotEqual(t, imageNameToFileName("ab/c:1"), imageNameToFileName("ab/c.1"))
+}
+
+func TestImgStorage_migrateFileNames(t *testing.T) {
+	dir := setUpTempDir(t)
+	storage := NewImgStorage(dir)
+	shared, other := makeDump(t, "ab/c:1"), makeDump(t, "other:2")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, legacyImageNameToFileName("ab/c:1")), shared, 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, legacyImageNameToFileName("other:2")), other, 0600))
+
+	names := func() ([]string, error) { return []string{"ab/c.1", "ab/c:1", "other:2"}, nil }
+	require.NoError(t, storage.migrateFileNames(names))
+
+	for name, dump := range map[string][]byte{"ab/c:1": shared, "other:2": other} {
+		data, err := ioutil.ReadFile(storage.imagePath(name))
+		require.NoError(t, err)
+		require.Equal(t, dump, data)
+	}
+	exists, err := storage.IsExist("ab/c.1")
+	require.NoError(t, err)
+	require.False(t, exists)
+}
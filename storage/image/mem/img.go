@@ -0,0 +1,82 @@
+package mem
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+)
+
+// ImgStorage keeps images in memory, they are lost on restart.
+type ImgStorage struct {
+	mu     sync.RWMutex
+	images map[string][]byte
+}
+
+func NewImgStorage() *ImgStorage {
+	return &ImgStorage{images: map[string][]byte{}}
+}
+
+func (i *ImgStorage) Save(imageName string, imageDump io.Reader) error {
+	data, err := ioutil.ReadAll(imageDump)
+	if err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.images[imageName] = data
+
+	return nil
+}
+
+func (i *ImgStorage) Load(imageName string) (io.ReadCloser, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	data, ok := i.images[imageName]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (i *ImgStorage) Remove(imageName string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.images, imageName)
+
+	return nil
+}
+
+func (i *ImgStorage) IsExist(imageName string) (bool, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	_, ok := i.images[imageName]
+
+	return ok, nil
+}
+
+func (i *ImgStorage) RemoveNotIn(imageNames []string) error {
+	allowed := map[string]bool{}
+	for _, name := range imageNames {
+		allowed[name] = true
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for name := range i.images {
+		if !allowed[name] {
+			delete(i.images, name)
+		}
+	}
+
+	return nil
+}
+
+func (i *ImgStorage) Ping() error {
+	return nil
+}
@@ -0,0 +1,36 @@
+package mem
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+)
+
+func TestImgStorage(t *testing.T) {
+	imgStorage := NewImgStorage()
+	require.NoError(t, imgStorage.Save("sha256:a", strings.NewReader("aaa")))
+	require.NoError(t, imgStorage.Save("sha256:b", strings.NewReader("bbb")))
+
+	dump, err := imgStorage.Load("sha256:a")
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(dump)
+	require.NoError(t, err)
+	require.Equal(t, "aaa", string(data))
+
+	require.NoError(t, imgStorage.RemoveNotIn([]string{"sha256:b"}))
+	_, err = imgStorage.Load("sha256:a")
+	require.Equal(t, storage.ErrNotFound, err)
+
+	exist, err := imgStorage.IsExist("sha256:b")
+	require.NoError(t, err)
+	require.True(t, exist)
+
+	require.NoError(t, imgStorage.Remove("sha256:b"))
+	exist, err = imgStorage.IsExist("sha256:b")
+	require.NoError(t, err)
+	require.False(t, exist)
+}
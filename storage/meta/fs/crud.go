@@ -24,18 +24,18 @@ func (s *MetaCRUD) Set(entry storage.Meta) error {
 		return err
 	}
 
-	data[entry.ImageName] = entry
+	data[entry.Key()] = entry
 
 	return s.metaRW.write(data)
 }
 
-func (s *MetaCRUD) Get(imageName string) (storage.Meta, error) {
+func (s *MetaCRUD) Get(key string) (storage.Meta, error) {
 	data, err := s.metaRW.read()
 	if err != nil {
 		return storage.Meta{}, err
 	}
 
-	entry, ok := data[imageName]
+	entry, ok := data[key]
 	if !ok {
 		return storage.Meta{}, storage.ErrNotFound
 	}
@@ -57,13 +57,13 @@ func (s *MetaCRUD) GetAll() ([]storage.Meta, error) {
 	return list, nil
 }
 
-func (s *MetaCRUD) Remove(imageName string) error {
+func (s *MetaCRUD) Remove(key string) error {
 	data, err := s.metaRW.read()
 	if err != nil {
 		return err
 	}
 
-	delete(data, imageName)
+	delete(data, key)
 
 	return s.metaRW.write(data)
 }
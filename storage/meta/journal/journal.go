@@ -0,0 +1,430 @@
+package journal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+)
+
+const (
+	opSet    = "set"
+	opRemove = "remove"
+
+	// frameHeaderSize is a length and a crc32 of the record.
+	frameHeaderSize = 8
+	maxRecordSize   = 1 << 20
+
+	defaultCompactAfter = 1000
+)
+
+var errTornRecord = errors.New("torn record")
+
+type record struct {
+	Op string
+	// Key is Meta.Key(), the field is named after the image name it has been before platforms
+	Key  string       `json:"ImageName"`
+	Meta storage.Meta `json:",omitempty"`
+}
+
+// MetaJournal is a MetaCRUD which appends every change to meta.journal instead of rewriting
+// the whole file. Every record is framed with its length and crc32 and fsync-ed, a torn tail
+// left by a crash is cut off on replay, a corrupted record before the tail fails the replay. The journal is compacted to a snapshot when it has
+// too many stale records. All operations take a file lock, so several processes can share it.
+type MetaJournal struct {
+	mu           sync.Mutex
+	dir          string
+	compactAfter int
+	readOnly     bool
+
+	file    *os.File
+	offset  int64
+	records int
+	data    map[string]storage.Meta
+}
+
+type Option func(*MetaJournal)
+
+// WithCompactAfter sets how many records trigger compaction, if most of them are stale.
+func WithCompactAfter(records int) Option {
+	return func(j *MetaJournal) {
+		if records > 0 {
+			j.compactAfter = records
+		}
+	}
+}
+
+// WithReadOnly only replays the journal, e.g. from a read-only mount, it isn't locked, created or repaired
+// and changes return storage.ErrReadOnly.
+func WithReadOnly(readOnly bool) Option {
+	return func(j *MetaJournal) {
+		j.readOnly = readOnly
+	}
+}
+
+func NewMetaJournal(dir string, opts ...Option) *MetaJournal {
+	j := &MetaJournal{dir: dir, compactAfter: defaultCompactAfter}
+	for _, opt := range opts {
+		opt(j)
+	}
+
+	return j
+}
+
+func (j *MetaJournal) Set(entry storage.Meta) error {
+	return j.update(record{Op: opSet, Key: entry.Key(), Meta: entry})
+}
+
+func (j *MetaJournal) Remove(key string) error {
+	return j.update(record{Op: opRemove, Key: key})
+}
+
+func (j *MetaJournal) Get(key string) (storage.Meta, error) {
+	var entry storage.Meta
+	var ok bool
+	err := j.locked(func() error {
+		entry, ok = j.data[key]
+
+		return nil
+	})
+	if err != nil {
+		return storage.Meta{}, err
+	}
+	if !ok {
+		return storage.Meta{}, storage.ErrNotFound
+	}
+
+	return entry, nil
+}
+
+func (j *MetaJournal) GetAll() ([]storage.Meta, error) {
+	var list []storage.Meta
+	err := j.locked(func() error {
+		list = make([]storage.Meta, 0, len(j.data))
+		for _, entry := range j.data {
+			list = append(list, entry)
+		}
+
+		return nil
+	})
+
+	return list, err
+}
+
+func (j *MetaJournal) Ping() error {
+	stat, err := os.Stat(j.dir)
+	if err != nil {
+		return fmt.Errorf("ping '%s', %w", j.dir, err)
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("path '%s' is a file, directory is expected", j.dir) //nolint: goerr113
+	}
+
+	return nil
+}
+
+// Close releases the journal file.
+func (j *MetaJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.closeFile()
+}
+
+func (j *MetaJournal) update(rec record) error {
+	if j.readOnly {
+		return storage.ErrReadOnly
+	}
+
+	return j.locked(func() error {
+		if err := j.append(rec); err != nil {
+			return err
+		}
+		j.apply(rec)
+
+		if j.records >= j.compactAfter && j.records > 2*len(j.data) {
+			return j.compact()
+		}
+
+		return nil
+	})
+}
+
+// locked catches up with the journal under the process and the file locks.
+func (j *MetaJournal) locked(f func() error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if !j.readOnly {
+		unlock, err := lockFile(j.path() + ".lock")
+		if err != nil {
+			return fmt.Errorf("locking meta journal, %w", err)
+		}
+		defer unlock()
+	}
+
+	if err := j.catchUp(); err != nil {
+		return err
+	}
+
+	return f()
+}
+
+func (j *MetaJournal) path() string {
+	return filepath.Join(j.dir, "meta.journal")
+}
+
+// catchUp replays records appended by other processes, it reopens the journal after compaction.
+func (j *MetaJournal) catchUp() error {
+	stat, err := os.Stat(j.path())
+	if os.IsNotExist(err) && j.readOnly {
+		_ = j.closeFile()
+		j.data = map[string]storage.Meta{}
+
+		return nil
+	}
+	if os.IsNotExist(err) {
+		_ = j.closeFile()
+
+		return j.create()
+	}
+	if err != nil {
+		return err
+	}
+
+	if j.file != nil {
+		openStat, err := j.file.Stat()
+		if err != nil {
+			return err
+		}
+		if os.SameFile(stat, openStat) {
+			return j.replay()
+		}
+		_ = j.closeFile()
+	}
+
+	flag := os.O_RDWR | os.O_APPEND
+	if j.readOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(j.path(), flag, 0600)
+	if err != nil {
+		return fmt.Errorf("opening meta journal, %w", err)
+	}
+	j.file, j.offset, j.records, j.data = file, 0, 0, map[string]storage.Meta{}
+
+	return j.replay()
+}
+
+// create starts a new journal, the legacy meta.json is imported if it exists.
+func (j *MetaJournal) create() error {
+	j.data = map[string]storage.Meta{}
+	legacy, err := ioutil.ReadFile(filepath.Join(j.dir, "meta.json"))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	case len(bytes.TrimSpace(legacy)) > 0:
+		if err = json.Unmarshal(legacy, &j.data); err != nil {
+			return fmt.Errorf("importing meta.json, %w", err)
+		}
+		log.Infof("%d entries have been imported from meta.json", len(j.data))
+	}
+
+	return j.compact()
+}
+
+func (j *MetaJournal) replay() error {
+	stat, err := j.file.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err = j.file.Seek(j.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(j.file)
+	for {
+		rec, size, err := readRecord(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if errors.Is(err, errTornRecord) && j.offset+size < stat.Size() {
+			// only the last record may be torn by a crash, cutting off this one would lose the records after it
+			return fmt.Errorf("meta journal is corrupted at %d of %d bytes, %w", j.offset, stat.Size(), err)
+		}
+		if errors.Is(err, errTornRecord) && j.readOnly {
+			log.Warnf("meta journal has a torn record at %d, it is ignored, %s", j.offset, err)
+
+			return nil
+		}
+		if errors.Is(err, errTornRecord) {
+			log.Warnf("meta journal has a torn record at %d, it is cut off, %s", j.offset, err)
+
+			return j.file.Truncate(j.offset)
+		}
+		if err != nil {
+			return err
+		}
+
+		j.apply(rec)
+		j.offset += size
+	}
+}
+
+func (j *MetaJournal) apply(rec record) {
+	switch rec.Op {
+	case opSet:
+		j.data[rec.Key] = rec.Meta
+	case opRemove:
+		delete(j.data, rec.Key)
+	}
+	j.records++
+}
+
+func (j *MetaJournal) append(rec record) error {
+	frame, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+
+	if _, err = j.file.Write(frame); err != nil {
+		// drop a partially written frame, so the next record is not appended after garbage
+		_ = j.file.Truncate(j.offset)
+
+		return fmt.Errorf("appending to meta journal, %w", err)
+	}
+	if err = j.file.Sync(); err != nil {
+		return fmt.Errorf("syncing meta journal, %w", err)
+	}
+	j.offset += int64(len(frame))
+
+	return nil
+}
+
+// compact writes the current state as a new journal and replaces the old one.
+func (j *MetaJournal) compact() error {
+	tmp, err := ioutil.TempFile(j.dir, ".meta.journal")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	size := int64(0)
+	for key, entry := range j.data {
+		frame, err := encodeRecord(record{Op: opSet, Key: key, Meta: entry})
+		if err != nil {
+			_ = tmp.Close()
+
+			return err
+		}
+		if _, err = writer.Write(frame); err != nil {
+			_ = tmp.Close()
+
+			return err
+		}
+		size += int64(len(frame))
+	}
+
+	if err = writer.Flush(); err != nil {
+		_ = tmp.Close()
+
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), j.path()); err != nil {
+		return fmt.Errorf("replacing meta journal, %w", err)
+	}
+	if err = syncDir(j.dir); err != nil {
+		return err
+	}
+
+	_ = j.closeFile()
+	file, err := os.OpenFile(j.path(), os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	j.file, j.offset, j.records = file, size, len(j.data)
+
+	return nil
+}
+
+func (j *MetaJournal) closeFile() error {
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+
+	return err
+}
+
+func encodeRecord(rec record) ([]byte, error) {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	frame := make([]byte, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	copy(frame[frameHeaderSize:], payload)
+
+	return frame, nil
+}
+
+// readRecord returns io.EOF at the clean end and errTornRecord for an incomplete or corrupted frame.
+// The size is the size of the frame, for a torn frame it's as much as the frame claims to have,
+// or just the header if its length is broken.
+func readRecord(reader io.Reader) (record, int64, error) {
+	header := make([]byte, frameHeaderSize)
+	n, err := io.ReadFull(reader, header)
+	if err == io.EOF {
+		return record{}, 0, io.EOF
+	}
+	if err != nil {
+		return record{}, int64(n), fmt.Errorf("%w, header has %d bytes", errTornRecord, n)
+	}
+
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > maxRecordSize {
+		return record{}, frameHeaderSize, fmt.Errorf("%w, record size %d", errTornRecord, size)
+	}
+	frameSize := int64(frameHeaderSize) + int64(size)
+
+	payload := make([]byte, size)
+	if _, err = io.ReadFull(reader, payload); err != nil {
+		return record{}, frameSize, fmt.Errorf("%w, %s", errTornRecord, err)
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return record{}, frameSize, fmt.Errorf("%w, checksum mismatch", errTornRecord)
+	}
+
+	var rec record
+	if err = json.Unmarshal(payload, &rec); err != nil {
+		return record{}, frameSize, fmt.Errorf("%w, %s", errTornRecord, err)
+	}
+
+	return rec, frameSize, nil
+}
@@ -0,0 +1,183 @@
+package journal
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+)
+
+func setUpTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("can't create tempdir", err)
+	}
+	t.Cleanup(cleanUpTempDir(t, dir))
+
+	return dir
+}
+
+func cleanUpTempDir(t *testing.T, dir string) func() {
+	return func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Log("can't Remove tempdir", err)
+		}
+	}
+}
+
+func newJournal(t *testing.T, dir string, opts ...Option) *MetaJournal {
+	j := NewMetaJournal(dir, opts...)
+	t.Cleanup(func() { _ = j.Close() })
+
+	return j
+}
+
+func meta(name string) storage.Meta {
+	return storage.Meta{ImageName: name, ImageID: "id-" + name, UpdatedAt: time.Unix(23, 0).UTC()}
+}
+
+func journalSize(t *testing.T, dir string) int64 {
+	stat, err := os.Stat(filepath.Join(dir, "meta.journal"))
+	require.NoError(t, err)
+
+	return stat.Size()
+}
+
+func TestMetaJournal_CRUD(t *testing.T) {
+	dir := setUpTempDir(t)
+	j := newJournal(t, dir)
+
+	_, err := j.Get("a")
+	require.Equal(t, storage.ErrNotFound, err)
+
+	require.NoError(t, j.Set(meta("a")))
+	require.NoError(t, j.Set(meta("b")))
+	require.NoError(t, j.Remove("a"))
+
+	entry, err := j.Get("b")
+	require.NoError(t, err)
+	require.Equal(t, meta("b"), entry)
+
+	t.Run("is replayed by a new instance", func(t *testing.T) {
+		all, err := newJournal(t, dir).GetAll()
+		require.NoError(t, err)
+		require.Equal(t, []storage.Meta{meta("b")}, all)
+	})
+}
+
+func TestMetaJournal_TornWrite(t *testing.T) {
+	cases := []struct {
+		name string
+		tail func(frame []byte) []byte
+	}{
+		{"partial header", func(frame []byte) []byte { return frame[:5] }},
+		{"partial payload", func(frame []byte) []byte { return frame[:len(frame)-3] }},
+		{"checksum mismatch", func(frame []byte) []byte {
+			frame[len(frame)-2] ^= 0xff
+
+			return frame
+		}},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			dir := setUpTempDir(t)
+			j := newJournal(t, dir)
+			require.NoError(t, j.Set(meta("a")))
+			require.NoError(t, j.Close())
+			goodSize := journalSize(t, dir)
+
+			frame, err := encodeRecord(record{Op: opSet, Key: "b", Meta: meta("b")})
+			require.NoError(t, err)
+			file, err := os.OpenFile(filepath.Join(dir, "meta.journal"), os.O_WRONLY|os.O_APPEND, 0600)
+			require.NoError(t, err)
+			_, err = file.Write(tc.tail(frame))
+			require.NoError(t, err)
+			require.NoError(t, file.Close())
+
+			j = newJournal(t, dir)
+			all, err := j.GetAll()
+			require.NoError(t, err)
+			require.Equal(t, []storage.Meta{meta("a")}, all)
+			require.Equal(t, goodSize, journalSize(t, dir))
+
+			require.NoError(t, j.Set(meta("c")))
+			all, err = newJournal(t, dir).GetAll()
+			require.NoError(t, err)
+			require.ElementsMatch(t, []storage.Meta{meta("a"), meta("c")}, all)
+		})
+	}
+}
+
+func TestMetaJournal_CorruptedRecord(t *testing.T) {
+	dir := setUpTempDir(t)
+	j := newJournal(t, dir)
+	require.NoError(t, j.Set(meta("a")))
+	offset := journalSize(t, dir)
+	require.NoError(t, j.Set(meta("b")))
+	require.NoError(t, j.Set(meta("c")))
+	require.NoError(t, j.Close())
+	size := journalSize(t, dir)
+
+	file, err := os.OpenFile(filepath.Join(dir, "meta.journal"), os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = file.WriteAt([]byte{0xff}, offset+frameHeaderSize+2)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	_, err = newJournal(t, dir).GetAll()
+	require.Error(t, err, "records after a corrupted one aren't dropped silently")
+	require.True(t, errors.Is(err, errTornRecord), err)
+	require.Equal(t, size, journalSize(t, dir), "the journal isn't cut off")
+}
+
+func TestMetaJournal_Compaction(t *testing.T) {
+	dir := setUpTempDir(t)
+	j := newJournal(t, dir, WithCompactAfter(10))
+
+	for n := 0; n < 9; n++ {
+		require.NoError(t, j.Set(meta("a")))
+	}
+	sizeBefore := journalSize(t, dir)
+
+	require.NoError(t, j.Set(meta("a")))
+	require.Less(t, journalSize(t, dir), sizeBefore)
+
+	all, err := newJournal(t, dir).GetAll()
+	require.NoError(t, err)
+	require.Equal(t, []storage.Meta{meta("a")}, all)
+}
+
+func TestMetaJournal_SharedBetweenInstances(t *testing.T) {
+	dir := setUpTempDir(t)
+	first, second := newJournal(t, dir, WithCompactAfter(3)), newJournal(t, dir, WithCompactAfter(3))
+
+	require.NoError(t, first.Set(meta("a")))
+	require.NoError(t, second.Set(meta("b")))
+	// compaction by the first instance replaces the file under the second one
+	require.NoError(t, first.Set(meta("a")))
+	require.NoError(t, first.Set(meta("a")))
+	require.NoError(t, first.Set(meta("a")))
+	require.NoError(t, second.Remove("a"))
+
+	all, err := first.GetAll()
+	require.NoError(t, err)
+	require.Equal(t, []storage.Meta{meta("b")}, all)
+}
+
+func TestMetaJournal_ImportsMetaJSON(t *testing.T) {
+	dir := setUpTempDir(t)
+	content := `{"ubuntu:1.0": {"ImageID": "hash:1111", "ImageName":"ubuntu:1.0", "UpdatedAt":"1970-01-01T00:00:23Z"}}`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "meta.json"), []byte(content), 0600))
+
+	entry, err := newJournal(t, dir).Get("ubuntu:1.0")
+	require.NoError(t, err)
+	require.Equal(t, storage.Meta{ImageName: "ubuntu:1.0", ImageID: "hash:1111", UpdatedAt: time.Unix(23, 0).UTC()}, entry)
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package journal
+
+import (
+	"os"
+)
+
+// syncDir makes renames and removals in the dir durable.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
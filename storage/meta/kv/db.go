@@ -0,0 +1,366 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+)
+
+// nolint: gochecknoglobals
+var (
+	bucketMeta       = []byte("meta")
+	bucketByImageID  = []byte("by-image-id")
+	bucketByRegistry = []byte("by-registry")
+	bucketByUsed     = []byte("by-used")
+	bucketInfo       = []byte("info")
+
+	keyMetaJSONImported = []byte("meta-json-imported")
+	keyUsedIndexRebuilt = []byte("used-index-rebuilt")
+)
+
+const (
+	// separator splits an index value and an image name in index keys.
+	separator = 0
+	// usedSize is a size of the last-used time in by-used keys.
+	usedSize = 8
+)
+
+// MetaDB is a MetaCRUD on top of bbolt.
+// Besides image names it indexes entries by ImageID, registry and last-used time
+// (LastUsedAt, or UpdatedAt for entries that have never been used),
+// so it answers "which tags share this ImageID" and "the oldest N images" without GetAll.
+type MetaDB struct {
+	db       *bolt.DB
+	dir      string
+	readOnly bool
+}
+
+type Option func(*MetaDB)
+
+// WithReadOnly opens an existing meta.db for reading only, changes return storage.ErrReadOnly.
+func WithReadOnly(readOnly bool) Option {
+	return func(m *MetaDB) {
+		m.readOnly = readOnly
+	}
+}
+
+// NewMetaDB opens meta.db in the dir, meta.json from the same dir is imported once.
+func NewMetaDB(dir string, opts ...Option) (*MetaDB, error) {
+	m := &MetaDB{dir: dir}
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	db, err := bolt.Open(filepath.Join(dir, "meta.db"), 0600, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: m.readOnly})
+	if err != nil {
+		return nil, fmt.Errorf("opening meta.db, %w", err)
+	}
+
+	m.db = db
+	if err = m.init(); err != nil {
+		_ = db.Close()
+
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *MetaDB) init() error {
+	if m.readOnly {
+		return m.db.View(func(tx *bolt.Tx) error {
+			for _, name := range [][]byte{bucketMeta, bucketByImageID, bucketByRegistry, bucketByUsed, bucketInfo} {
+				if tx.Bucket(name) == nil {
+					return fmt.Errorf("meta.db has no bucket '%s', it has to be opened writable first", name) // nolint: goerr113
+				}
+			}
+
+			return nil
+		})
+	}
+
+	return m.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketMeta, bucketByImageID, bucketByRegistry, bucketByUsed, bucketInfo} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		if tx.Bucket(bucketInfo).Get(keyUsedIndexRebuilt) == nil {
+			if err := rebuildUsedIndex(tx); err != nil {
+				return err
+			}
+			if err := tx.Bucket(bucketInfo).Put(keyUsedIndexRebuilt, []byte(time.Now().Format(time.RFC3339))); err != nil {
+				return err
+			}
+		}
+
+		if tx.Bucket(bucketInfo).Get(keyMetaJSONImported) != nil {
+			return nil
+		}
+
+		if err := importMetaJSON(tx, filepath.Join(m.dir, "meta.json")); err != nil {
+			return err
+		}
+
+		return tx.Bucket(bucketInfo).Put(keyMetaJSONImported, []byte(time.Now().Format(time.RFC3339)))
+	})
+}
+
+// rebuildUsedIndex migrates by-used keys of older versions, they were built from UpdatedAt only.
+func rebuildUsedIndex(tx *bolt.Tx) error {
+	if err := tx.DeleteBucket(bucketByUsed); err != nil {
+		return err
+	}
+	used, err := tx.CreateBucket(bucketByUsed)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(bucketMeta).ForEach(func(key, value []byte) error {
+		var entry storage.Meta
+		if err := json.Unmarshal(value, &entry); err != nil {
+			return fmt.Errorf("decoding '%s', %w", key, err)
+		}
+
+		return used.Put(indexKeys(entry, string(key))[string(bucketByUsed)], nil)
+	})
+}
+
+// importMetaJSON migrates entries of fs.MetaFile, the file is left as is.
+func importMetaJSON(tx *bolt.Tx, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) || len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	entries := map[string]storage.Meta{}
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("importing meta.json, %w", err)
+	}
+
+	for _, entry := range entries {
+		if err = put(tx, entry); err != nil {
+			return err
+		}
+	}
+	log.Infof("%d entries have been imported from meta.json", len(entries))
+
+	return nil
+}
+
+func (m *MetaDB) Set(entry storage.Meta) error {
+	if m.readOnly {
+		return storage.ErrReadOnly
+	}
+
+	return m.db.Update(func(tx *bolt.Tx) error {
+		if err := remove(tx, entry.Key()); err != nil {
+			return err
+		}
+
+		return put(tx, entry)
+	})
+}
+
+func (m *MetaDB) Get(key string) (storage.Meta, error) {
+	var entry storage.Meta
+	err := m.db.View(func(tx *bolt.Tx) error {
+		var err error
+		entry, err = get(tx, key)
+
+		return err
+	})
+
+	return entry, err
+}
+
+func (m *MetaDB) Remove(key string) error {
+	if m.readOnly {
+		return storage.ErrReadOnly
+	}
+
+	return m.db.Update(func(tx *bolt.Tx) error {
+		return remove(tx, key)
+	})
+}
+
+func (m *MetaDB) GetAll() ([]storage.Meta, error) {
+	list := []storage.Meta{}
+	err := m.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMeta).ForEach(func(_, value []byte) error {
+			var entry storage.Meta
+			if err := json.Unmarshal(value, &entry); err != nil {
+				return err
+			}
+			list = append(list, entry)
+
+			return nil
+		})
+	})
+
+	return list, err
+}
+
+// ByImageID returns all tags of the image.
+func (m *MetaDB) ByImageID(imageID string) ([]storage.Meta, error) {
+	return m.byPrefix(bucketByImageID, []byte(imageID))
+}
+
+// ByRegistry returns images pulled from the registry, e.g. docker.io.
+func (m *MetaDB) ByRegistry(registry string) ([]storage.Meta, error) {
+	return m.byPrefix(bucketByRegistry, []byte(registry))
+}
+
+// Oldest returns up to n least recently used images, the oldest first.
+func (m *MetaDB) Oldest(n int) ([]storage.Meta, error) {
+	list := []storage.Meta{}
+	err := m.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(bucketByUsed).Cursor()
+		for key, _ := cursor.First(); key != nil && len(list) < n; key, _ = cursor.Next() {
+			entry, err := get(tx, string(key[usedSize+1:]))
+			if err != nil {
+				return err
+			}
+			list = append(list, entry)
+		}
+
+		return nil
+	})
+
+	return list, err
+}
+
+func (m *MetaDB) Ping() error {
+	stat, err := os.Stat(m.dir)
+	if err != nil {
+		return fmt.Errorf("ping '%s', %w", m.dir, err)
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("path '%s' is a file, directory is expected", m.dir) //nolint: goerr113
+	}
+
+	return nil
+}
+
+func (m *MetaDB) Close() error {
+	return m.db.Close()
+}
+
+func (m *MetaDB) byPrefix(bucket, value []byte) ([]storage.Meta, error) {
+	prefix := append(append([]byte{}, value...), separator)
+	list := []storage.Meta{}
+	err := m.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(bucket).Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			entry, err := get(tx, string(key[len(prefix):]))
+			if err != nil {
+				return err
+			}
+			list = append(list, entry)
+		}
+
+		return nil
+	})
+
+	return list, err
+}
+
+func get(tx *bolt.Tx, key string) (storage.Meta, error) {
+	value := tx.Bucket(bucketMeta).Get([]byte(key))
+	if value == nil {
+		return storage.Meta{}, storage.ErrNotFound
+	}
+
+	var entry storage.Meta
+	if err := json.Unmarshal(value, &entry); err != nil {
+		return storage.Meta{}, fmt.Errorf("decoding '%s', %w", key, err)
+	}
+
+	return entry, nil
+}
+
+func put(tx *bolt.Tx, entry storage.Meta) error {
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err = tx.Bucket(bucketMeta).Put([]byte(entry.Key()), value); err != nil {
+		return err
+	}
+
+	for bucket, key := range indexKeys(entry, entry.Key()) {
+		if err = tx.Bucket([]byte(bucket)).Put(key, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func remove(tx *bolt.Tx, key string) error {
+	entry, err := get(tx, key)
+	if err == storage.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// entries stored before platforms are keyed by the image name, so their index keys are built from the given key
+	for bucket, indexKey := range indexKeys(entry, key) {
+		if err = tx.Bucket([]byte(bucket)).Delete(indexKey); err != nil {
+			return err
+		}
+	}
+
+	return tx.Bucket(bucketMeta).Delete([]byte(key))
+}
+
+// indexKeys point to the entry stored under the key.
+func indexKeys(entry storage.Meta, key string) map[string][]byte {
+	lastUsed := entry.LastUsedAt
+	if lastUsed.IsZero() {
+		lastUsed = entry.UpdatedAt
+	}
+	used := make([]byte, usedSize)
+	// flipping the sign bit keeps the order of negative timestamps
+	binary.BigEndian.PutUint64(used, uint64(lastUsed.UnixNano())^(1<<63))
+
+	return map[string][]byte{
+		string(bucketByImageID):  indexKey([]byte(entry.ImageID), key),
+		string(bucketByRegistry): indexKey([]byte(registryOf(entry.ImageName)), key),
+		string(bucketByUsed):     indexKey(used, key),
+	}
+}
+
+func indexKey(value []byte, metaKey string) []byte {
+	key := make([]byte, 0, len(value)+1+len(metaKey))
+	key = append(key, value...)
+	key = append(key, separator)
+
+	return append(key, metaKey...)
+}
+
+func registryOf(imageName string) string {
+	named, err := reference.ParseNormalizedNamed(imageName)
+	if err != nil {
+		return ""
+	}
+
+	return reference.Domain(named)
+}
@@ -0,0 +1,165 @@
+package kv
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+)
+
+func setUpTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("can't create tempdir", err)
+	}
+	t.Cleanup(cleanUpTempDir(t, dir))
+
+	return dir
+}
+
+func cleanUpTempDir(t *testing.T, dir string) func() {
+	return func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Log("can't Remove tempdir", err)
+		}
+	}
+}
+
+func newMetaDB(t *testing.T, dir string) *MetaDB {
+	db, err := NewMetaDB(dir)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+
+	return db
+}
+
+func meta(name, imageID string, updatedAt int64) storage.Meta {
+	return storage.Meta{ImageName: name, ImageID: imageID, UpdatedAt: time.Unix(updatedAt, 0).UTC()}
+}
+
+func TestMetaDB_CRUD(t *testing.T) {
+	db := newMetaDB(t, setUpTempDir(t))
+
+	_, err := db.Get("a:1")
+	require.Equal(t, storage.ErrNotFound, err)
+
+	require.NoError(t, db.Set(meta("a:1", "id-a", 1)))
+	require.NoError(t, db.Set(meta("b:1", "id-b", 2)))
+	require.NoError(t, db.Remove("b:1"))
+	require.NoError(t, db.Remove("c:1"))
+
+	entry, err := db.Get("a:1")
+	require.NoError(t, err)
+	require.Equal(t, meta("a:1", "id-a", 1), entry)
+
+	all, err := db.GetAll()
+	require.NoError(t, err)
+	require.Equal(t, []storage.Meta{meta("a:1", "id-a", 1)}, all)
+}
+
+func TestMetaDB_Platforms(t *testing.T) {
+	db := newMetaDB(t, setUpTempDir(t))
+	arm, amd := meta("app:1", "id-arm", 1), meta("app:1", "id-amd", 2)
+	arm.OS, arm.Architecture = "linux", "arm64"
+	amd.OS, amd.Architecture = "linux", "amd64"
+	require.NoError(t, db.Set(arm))
+	require.NoError(t, db.Set(amd))
+
+	entry, err := db.Get("app:1 linux/arm64")
+	require.NoError(t, err)
+	require.Equal(t, arm, entry)
+
+	require.NoError(t, db.Remove("app:1 linux/amd64"))
+	list, err := db.ByImageID("id-amd")
+	require.NoError(t, err)
+	require.Empty(t, list)
+	all, err := db.GetAll()
+	require.NoError(t, err)
+	require.Equal(t, []storage.Meta{arm}, all)
+}
+
+func TestMetaDB_Indexes(t *testing.T) {
+	db := newMetaDB(t, setUpTempDir(t))
+	require.NoError(t, db.Set(meta("app:1.2", "id-app", 3)))
+	require.NoError(t, db.Set(meta("app:latest", "id-app", 1)))
+	require.NoError(t, db.Set(meta("quay.io/org/tool:1", "id-tool", 2)))
+	// an updated entry must leave no stale index keys
+	require.NoError(t, db.Set(meta("app:1.2", "id-app2", 4)))
+
+	t.Run("by ImageID", func(t *testing.T) {
+		list, err := db.ByImageID("id-app")
+		require.NoError(t, err)
+		require.Equal(t, []storage.Meta{meta("app:latest", "id-app", 1)}, list)
+	})
+
+	t.Run("by registry", func(t *testing.T) {
+		list, err := db.ByRegistry("quay.io")
+		require.NoError(t, err)
+		require.Equal(t, []storage.Meta{meta("quay.io/org/tool:1", "id-tool", 2)}, list)
+
+		list, err = db.ByRegistry("docker.io")
+		require.NoError(t, err)
+		require.Len(t, list, 2)
+	})
+
+	t.Run("oldest", func(t *testing.T) {
+		list, err := db.Oldest(2)
+		require.NoError(t, err)
+		require.Equal(t, []storage.Meta{meta("app:latest", "id-app", 1), meta("quay.io/org/tool:1", "id-tool", 2)}, list)
+	})
+}
+
+func TestMetaDB_OldestByLastUsedAt(t *testing.T) {
+	db := newMetaDB(t, setUpTempDir(t))
+	used := meta("app:1", "id-app", 1)
+	used.LastUsedAt = time.Unix(5, 0).UTC()
+	require.NoError(t, db.Set(used))
+	require.NoError(t, db.Set(meta("tool:1", "id-tool", 3)))
+
+	list, err := db.Oldest(2)
+	require.NoError(t, err)
+	require.Equal(t, []storage.Meta{meta("tool:1", "id-tool", 3), used}, list)
+
+	t.Run("rebuilds the index of older versions", func(t *testing.T) {
+		require.NoError(t, db.db.Update(func(tx *bolt.Tx) error {
+			stale := make([]byte, usedSize)
+			binary.BigEndian.PutUint64(stale, uint64(used.UpdatedAt.UnixNano())^(1<<63))
+			require.NoError(t, tx.Bucket(bucketByUsed).Delete(indexKeys(used, used.Key())[string(bucketByUsed)]))
+			require.NoError(t, tx.Bucket(bucketByUsed).Put(indexKey(stale, used.Key()), nil))
+
+			return tx.Bucket(bucketInfo).Delete(keyUsedIndexRebuilt)
+		}))
+		require.NoError(t, db.Close())
+
+		list, err := newMetaDB(t, db.dir).Oldest(2)
+		require.NoError(t, err)
+		require.Equal(t, []storage.Meta{meta("tool:1", "id-tool", 3), used}, list)
+	})
+}
+
+func TestMetaDB_ImportsMetaJSON(t *testing.T) {
+	dir := setUpTempDir(t)
+	content := `{"ubuntu:1.0": {"ImageID": "hash:1111", "ImageName":"ubuntu:1.0", "UpdatedAt":"1970-01-01T00:00:23Z"}}`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "meta.json"), []byte(content), 0600))
+
+	db := newMetaDB(t, dir)
+	list, err := db.ByImageID("hash:1111")
+	require.NoError(t, err)
+	require.Equal(t, []storage.Meta{meta("ubuntu:1.0", "hash:1111", 23)}, list)
+
+	t.Run("only once", func(t *testing.T) {
+		require.NoError(t, db.Remove("ubuntu:1.0"))
+		require.NoError(t, db.Close())
+
+		all, err := newMetaDB(t, dir).GetAll()
+		require.NoError(t, err)
+		require.Empty(t, all)
+	})
+}
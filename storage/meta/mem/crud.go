@@ -0,0 +1,61 @@
+package mem
+
+import (
+	"sync"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+)
+
+// MetaCRUD keeps metas in memory, they are lost on restart.
+type MetaCRUD struct {
+	mu    sync.RWMutex
+	metas map[string]storage.Meta
+}
+
+func NewMetaCRUD() *MetaCRUD {
+	return &MetaCRUD{metas: map[string]storage.Meta{}}
+}
+
+func (m *MetaCRUD) Set(entry storage.Meta) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.metas[entry.Key()] = entry
+
+	return nil
+}
+
+func (m *MetaCRUD) Get(key string) (storage.Meta, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	entry, ok := m.metas[key]
+	if !ok {
+		return storage.Meta{}, storage.ErrNotFound
+	}
+
+	return entry, nil
+}
+
+func (m *MetaCRUD) GetAll() ([]storage.Meta, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	list := make([]storage.Meta, 0, len(m.metas))
+	for _, entry := range m.metas {
+		list = append(list, entry)
+	}
+
+	return list, nil
+}
+
+func (m *MetaCRUD) Remove(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.metas, key)
+
+	return nil
+}
+
+func (m *MetaCRUD) Ping() error {
+	return nil
+}
@@ -0,0 +1,29 @@
+package mem
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+)
+
+func TestMetaCRUD(t *testing.T) {
+	metaCRUD := NewMetaCRUD()
+	amd64 := storage.Meta{ImageName: "alpine", ImageID: "sha256:a", OS: "linux", Architecture: "amd64"}
+	arm64 := storage.Meta{ImageName: "alpine", ImageID: "sha256:b", OS: "linux", Architecture: "arm64"}
+	require.NoError(t, metaCRUD.Set(amd64))
+	require.NoError(t, metaCRUD.Set(arm64))
+
+	got, err := metaCRUD.Get(arm64.Key())
+	require.NoError(t, err)
+	require.Equal(t, arm64, got)
+
+	require.NoError(t, metaCRUD.Remove(arm64.Key()))
+	_, err = metaCRUD.Get(arm64.Key())
+	require.Equal(t, storage.ErrNotFound, err)
+
+	all, err := metaCRUD.GetAll()
+	require.NoError(t, err)
+	require.Equal(t, []storage.Meta{amd64}, all)
+}
@@ -0,0 +1,139 @@
+// Package overlay restores images from a read-only cache shared by many hosts and keeps new images in a local one.
+package overlay
+
+import (
+	"errors"
+	"io"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+)
+
+// Storage is a storage.Storage which finds tags in the local storage first and then in the base one.
+// The base storage is never changed: new images and their usage go to the local storage,
+// tags of the base storage can't be removed and their usage isn't recorded.
+// Without a local storage nothing is saved and changes return storage.ErrReadOnly.
+type Storage struct {
+	base  storage.Storage
+	local storage.Storage
+}
+
+// NewStorage lays local over base, local may be nil.
+func NewStorage(base, local storage.Storage) *Storage {
+	return &Storage{base: base, local: local}
+}
+
+// Save stores the image in the local storage.
+func (s *Storage) Save(meta storage.Meta, imageDump io.Reader) error {
+	if s.local == nil {
+		return storage.ErrReadOnly
+	}
+
+	return s.local.Save(meta, imageDump)
+}
+
+// SaveTag adds a tag to an image of the local storage, images of the base storage are saved again by Save.
+func (s *Storage) SaveTag(meta storage.Meta) error {
+	if s.local == nil {
+		return storage.ErrReadOnly
+	}
+
+	return s.local.SaveTag(meta)
+}
+
+func (s *Storage) Load(key string) (io.ReadCloser, error) {
+	owner, err := s.find(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return owner.Load(key)
+}
+
+// Remove drops the tag from the local storage, tags of the base storage return storage.ErrReadOnly.
+func (s *Storage) Remove(key string) error {
+	owner, err := s.find(key)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return nil
+	case err != nil:
+		return err
+	case owner == s.base:
+		return storage.ErrReadOnly
+	}
+
+	return owner.Remove(key)
+}
+
+func (s *Storage) GetMeta(key string) (storage.Meta, error) {
+	if s.local != nil {
+		meta, err := s.local.GetMeta(key)
+		if !errors.Is(err, storage.ErrNotFound) {
+			return meta, err
+		}
+	}
+
+	return s.base.GetMeta(key)
+}
+
+// GetAllMeta returns metas of both storages, local tags hide the same tags of the base storage.
+func (s *Storage) GetAllMeta() ([]storage.Meta, error) {
+	metas, err := s.base.GetAllMeta()
+	if err != nil || s.local == nil {
+		return metas, err
+	}
+
+	localMetas, err := s.local.GetAllMeta()
+	if err != nil {
+		return nil, err
+	}
+
+	local := map[string]bool{}
+	for _, meta := range localMetas {
+		local[meta.Key()] = true
+	}
+	for _, meta := range metas {
+		if !local[meta.Key()] {
+			localMetas = append(localMetas, meta)
+		}
+	}
+
+	return localMetas, nil
+}
+
+// MarkUsed counts a hit of a local image, hits of base images aren't recorded.
+func (s *Storage) MarkUsed(key string) error {
+	return s.update(key, storage.Storage.MarkUsed)
+}
+
+// MarkRestored records a restore of a local image, restores of base images aren't recorded.
+func (s *Storage) MarkRestored(key string) error {
+	return s.update(key, storage.Storage.MarkRestored)
+}
+
+func (s *Storage) update(key string, update func(storage.Storage, string) error) error {
+	owner, err := s.find(key)
+	if err != nil || owner == s.base {
+		return err
+	}
+
+	return update(owner, key)
+}
+
+// find returns the storage which has the tag.
+func (s *Storage) find(key string) (storage.Storage, error) {
+	if s.local != nil {
+		_, err := s.local.GetMeta(key)
+		if err == nil {
+			return s.local, nil
+		}
+		if !errors.Is(err, storage.ErrNotFound) {
+			return nil, err
+		}
+	}
+
+	if _, err := s.base.GetMeta(key); err != nil {
+		return nil, err
+	}
+
+	return s.base, nil
+}
@@ -0,0 +1,110 @@
+package overlay
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+	imgmem "github.com/podtserkovskiy/garnerd/storage/image/mem"
+	"github.com/podtserkovskiy/garnerd/storage/meta/mem"
+	"github.com/podtserkovskiy/garnerd/storage/separated"
+)
+
+// makeDump is a tar with the image id.
+func makeDump(t *testing.T, imageID string) io.Reader {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "id", Mode: 0644, Size: int64(len(imageID))}))
+	_, err := tw.Write([]byte(imageID))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+
+	return buf
+}
+
+func newStorage(t *testing.T, metas ...storage.Meta) *separated.Storage {
+	store := separated.NewStorage(mem.NewMetaCRUD(), imgmem.NewImgStorage())
+	for _, meta := range metas {
+		require.NoError(t, store.Save(meta, makeDump(t, meta.ImageID)))
+	}
+
+	return store
+}
+
+// requireDump checks that the tag restores the image.
+func requireDump(t *testing.T, store storage.Storage, key, imageID string) {
+	loaded, err := store.Load(key)
+	require.NoError(t, err)
+	defer loaded.Close()
+
+	tr := tar.NewReader(loaded)
+	_, err = tr.Next()
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(tr)
+	require.NoError(t, err)
+	require.Equal(t, imageID, string(data))
+}
+
+func requireReadOnly(t *testing.T, err error) {
+	require.True(t, errors.Is(err, storage.ErrReadOnly), err)
+}
+
+func TestStorage(t *testing.T) {
+	alpine := storage.Meta{ImageName: "alpine:3", ImageID: "sha256:a"}
+	busybox := storage.Meta{ImageName: "busybox:1", ImageID: "sha256:b"}
+
+	t.Run("base only", func(t *testing.T) {
+		base := newStorage(t, alpine)
+		store := NewStorage(base, nil)
+
+		requireDump(t, store, "alpine:3", "sha256:a")
+		requireReadOnly(t, store.Save(busybox, makeDump(t, busybox.ImageID)))
+		requireReadOnly(t, store.SaveTag(busybox))
+		requireReadOnly(t, store.Remove("alpine:3"))
+		require.NoError(t, store.Remove("busybox:1"))
+
+		require.NoError(t, store.MarkUsed("alpine:3"))
+		require.NoError(t, store.MarkRestored("alpine:3"))
+		meta, err := base.GetMeta("alpine:3")
+		require.NoError(t, err)
+		require.Zero(t, meta.HitCount, "the base isn't changed")
+		require.True(t, meta.LastRestoredAt.IsZero())
+
+		require.True(t, errors.Is(store.MarkUsed("busybox:1"), storage.ErrNotFound))
+		_, err = store.Load("busybox:1")
+		require.True(t, errors.Is(err, storage.ErrNotFound), err)
+	})
+
+	t.Run("local over base", func(t *testing.T) {
+		base := newStorage(t, alpine, busybox)
+		local := newStorage(t)
+		store := NewStorage(base, local)
+
+		newBusybox := storage.Meta{ImageName: "busybox:1", ImageID: "sha256:c"}
+		require.NoError(t, store.Save(newBusybox, makeDump(t, newBusybox.ImageID)))
+		requireDump(t, store, "busybox:1", "sha256:c")
+		requireDump(t, store, "alpine:3", "sha256:a")
+
+		metas, err := store.GetAllMeta()
+		require.NoError(t, err)
+		require.Len(t, metas, 2)
+		meta, err := store.GetMeta("busybox:1")
+		require.NoError(t, err)
+		require.Equal(t, "sha256:c", meta.ImageID)
+
+		require.NoError(t, store.MarkUsed("busybox:1"))
+		meta, err = local.GetMeta("busybox:1")
+		require.NoError(t, err)
+		require.Equal(t, 1, meta.HitCount)
+
+		require.NoError(t, store.Remove("busybox:1"))
+		requireDump(t, store, "busybox:1", "sha256:b")
+		requireReadOnly(t, store.Remove("busybox:1"))
+	})
+}
@@ -0,0 +1,330 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ResponseError is an error response of the S3 API.
+type ResponseError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *ResponseError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3 responded %d", e.StatusCode)
+	}
+
+	return fmt.Sprintf("s3 responded %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+func isStatus(err error, statusCodes ...int) bool {
+	var respErr *ResponseError
+	if !errors.As(err, &respErr) {
+		return false
+	}
+	for _, statusCode := range statusCodes {
+		if respErr.StatusCode == statusCode {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isNotFound(err error) bool {
+	return isStatus(err, http.StatusNotFound)
+}
+
+// isConflict is true when a conditional put has lost a race.
+func isConflict(err error) bool {
+	return isStatus(err, http.StatusPreconditionFailed, http.StatusConflict)
+}
+
+type objectInfo struct {
+	Key          string
+	LastModified time.Time
+	Size         int64
+	ETag         string
+}
+
+// client speaks the subset of the S3 API which the storages need, buckets are addressed by path.
+type client struct {
+	httpClient *http.Client
+	endpoint   *url.URL
+	bucket     string
+	region     string
+	creds      Credentials
+	now        func() time.Time
+}
+
+func newClient(cfg Config) (*client, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parsing endpoint, %w", err)
+	}
+
+	httpClient := cfg.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &client{
+		httpClient: httpClient,
+		endpoint:   endpoint,
+		bucket:     cfg.Bucket,
+		region:     cfg.Region,
+		creds:      cfg.Credentials,
+		now:        time.Now,
+	}, nil
+}
+
+// do sends a signed request, a response with an error status is returned as *ResponseError.
+func (c *client) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	reqURL := *c.endpoint
+	reqURL.Path = strings.TrimSuffix(reqURL.Path, "/") + "/" + c.bucket
+	if key != "" {
+		reqURL.Path += "/" + key
+	}
+	reqURL.RawPath = encodePath(reqURL.Path)
+	reqURL.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, reqURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	sign(req, c.creds, c.region, hashHex(body), c.now())
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < http.StatusMultipleChoices {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	respErr := &ResponseError{StatusCode: resp.StatusCode}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	_ = xml.Unmarshal(data, respErr)
+
+	return nil, respErr
+}
+
+func (c *client) headBucket() error {
+	resp, err := c.do(http.MethodHead, "", nil, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// putObject returns the ETag of the new object.
+func (c *client) putObject(key string, header http.Header, body []byte) (string, error) {
+	resp, err := c.do(http.MethodPut, key, nil, header, body)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	return resp.Header.Get("ETag"), nil
+}
+
+// getObject returns the body and the ETag of the object.
+func (c *client) getObject(key string) (io.ReadCloser, string, error) {
+	resp, err := c.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return resp.Body, resp.Header.Get("ETag"), nil
+}
+
+func (c *client) headObject(key string) (objectInfo, error) {
+	resp, err := c.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return objectInfo{}, err
+	}
+	defer resp.Body.Close()
+
+	lastModified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	return objectInfo{
+		Key:          key,
+		LastModified: lastModified,
+		Size:         resp.ContentLength,
+		ETag:         resp.Header.Get("ETag"),
+	}, nil
+}
+
+func (c *client) deleteObject(key string) error {
+	resp, err := c.do(http.MethodDelete, key, nil, nil, nil)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// touchObject copies the object onto itself, so its LastModified is now.
+func (c *client) touchObject(key string) error {
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", "/"+c.bucket+"/"+uriEncode(key, false))
+	header.Set("X-Amz-Metadata-Directive", "REPLACE")
+	resp, err := c.do(http.MethodPut, key, nil, header, nil)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		LastModified time.Time
+		Size         int64
+		ETag         string
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// listObjects returns all objects which keys start with the prefix.
+func (c *client) listObjects(prefix string) ([]objectInfo, error) {
+	objects, _, err := c.list(prefix, "")
+
+	return objects, err
+}
+
+// listDir returns objects right in the prefix "dir" and prefixes of its subdirs.
+func (c *client) listDir(prefix string) ([]objectInfo, []string, error) {
+	return c.list(prefix, "/")
+}
+
+func (c *client) list(prefix, delimiter string) ([]objectInfo, []string, error) {
+	objects, dirs := []objectInfo{}, []string{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		var result listBucketResult
+		if err := c.doXML(http.MethodGet, "", query, nil, &result); err != nil {
+			return nil, nil, err
+		}
+		for _, content := range result.Contents {
+			objects = append(objects, objectInfo(content))
+		}
+		for _, common := range result.CommonPrefixes {
+			dirs = append(dirs, common.Prefix)
+		}
+		if !result.IsTruncated {
+			return objects, dirs, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (c *client) doXML(method, key string, query url.Values, body []byte, result interface{}) error {
+	resp, err := c.do(method, key, query, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err = xml.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("decoding s3 response, %w", err)
+	}
+
+	return nil
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+func (c *client) createMultipartUpload(key string) (string, error) {
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := c.doXML(http.MethodPost, key, url.Values{"uploads": {""}}, nil, &result); err != nil {
+		return "", err
+	}
+
+	return result.UploadID, nil
+}
+
+func (c *client) uploadPart(key, uploadID string, partNumber int, body []byte) (completedPart, error) {
+	query := url.Values{"uploadId": {uploadID}, "partNumber": {strconv.Itoa(partNumber)}}
+	resp, err := c.do(http.MethodPut, key, query, nil, body)
+	if err != nil {
+		return completedPart{}, err
+	}
+	defer resp.Body.Close()
+
+	return completedPart{PartNumber: partNumber, ETag: resp.Header.Get("ETag")}, nil
+}
+
+func (c *client) completeMultipartUpload(key, uploadID string, parts []completedPart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+
+	// S3 may report a failure in the body of a 200 response
+	var result struct {
+		XMLName xml.Name
+		ResponseError
+	}
+	if err = c.doXML(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body, &result); err != nil {
+		return err
+	}
+	if result.XMLName.Local == "Error" {
+		result.StatusCode = http.StatusOK
+
+		return &result.ResponseError
+	}
+
+	return nil
+}
+
+func (c *client) abortMultipartUpload(key, uploadID string) error {
+	resp, err := c.do(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
@@ -0,0 +1,65 @@
+package s3
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const defaultRegion = "us-east-1"
+
+// Config of an S3-compatible storage.
+type Config struct {
+	Bucket string
+	// Prefix separates caches sharing the bucket, layers are shared by all of them.
+	Prefix string
+	// Endpoint is e.g. https://s3.eu-west-1.amazonaws.com or http://minio:9000.
+	Endpoint    string
+	Region      string
+	Credentials Credentials
+	HTTPClient  *http.Client
+}
+
+// ConfigFromURL parses s3://bucket/prefix?endpoint=http://minio:9000&region=eu-west-1.
+// Credentials, a missing region and a missing endpoint are taken from the standard AWS variables of env.
+func ConfigFromURL(rawURL string, env func(string) string) (Config, error) {
+	storageURL, err := url.Parse(rawURL)
+	if err != nil {
+		return Config{}, err
+	}
+	if storageURL.Scheme != "s3" {
+		return Config{}, fmt.Errorf("'%s' is not an s3:// url", rawURL) // nolint: goerr113
+	}
+	if storageURL.Host == "" {
+		return Config{}, fmt.Errorf("'%s' has no bucket", rawURL) // nolint: goerr113
+	}
+
+	query := storageURL.Query()
+	cfg := Config{
+		Bucket:   storageURL.Host,
+		Prefix:   strings.Trim(storageURL.Path, "/"),
+		Region:   firstOf(query.Get("region"), env("AWS_REGION"), env("AWS_DEFAULT_REGION"), defaultRegion),
+		Endpoint: firstOf(query.Get("endpoint"), env("AWS_ENDPOINT_URL_S3"), env("AWS_ENDPOINT_URL")),
+		Credentials: Credentials{
+			AccessKeyID:     env("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: env("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    env("AWS_SESSION_TOKEN"),
+		},
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+
+	return cfg, nil
+}
+
+func firstOf(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,57 @@
+package s3
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigFromURL(t *testing.T) {
+	env := map[string]string{
+		"AWS_ACCESS_KEY_ID":     "AKID",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+		"AWS_SESSION_TOKEN":     "token",
+	}
+	getenv := func(name string) string { return env[name] }
+	creds := Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret", SessionToken: "token"}
+
+	t.Run("defaults", func(t *testing.T) {
+		cfg, err := ConfigFromURL("s3://cache/team/garnerd/", getenv)
+		require.NoError(t, err)
+		require.Equal(t, Config{
+			Bucket:      "cache",
+			Prefix:      "team/garnerd",
+			Endpoint:    "https://s3.us-east-1.amazonaws.com",
+			Region:      "us-east-1",
+			Credentials: creds,
+		}, cfg)
+	})
+
+	t.Run("env", func(t *testing.T) {
+		env["AWS_REGION"] = "eu-west-1"
+		env["AWS_ENDPOINT_URL"] = "http://minio:9000"
+		defer delete(env, "AWS_REGION")
+		defer delete(env, "AWS_ENDPOINT_URL")
+
+		cfg, err := ConfigFromURL("s3://cache", getenv)
+		require.NoError(t, err)
+		require.Equal(t, Config{Bucket: "cache", Endpoint: "http://minio:9000", Region: "eu-west-1", Credentials: creds}, cfg)
+	})
+
+	t.Run("query", func(t *testing.T) {
+		env["AWS_REGION"] = "eu-west-1"
+		defer delete(env, "AWS_REGION")
+
+		cfg, err := ConfigFromURL("s3://cache/team?endpoint=http://localhost:9000&region=local", getenv)
+		require.NoError(t, err)
+		require.Equal(t, Config{Bucket: "cache", Prefix: "team", Endpoint: "http://localhost:9000", Region: "local", Credentials: creds}, cfg)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		_, err := ConfigFromURL("gs://cache", getenv)
+		require.EqualError(t, err, "'gs://cache' is not an s3:// url")
+
+		_, err = ConfigFromURL("s3:///team", getenv)
+		require.EqualError(t, err, "'s3:///team' has no bucket")
+	})
+}
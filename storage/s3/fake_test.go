@@ -0,0 +1,402 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/md5" // nolint: gosec
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	fakeBucket = "cache"
+	fakeRegion = "eu-west-1"
+)
+
+var fakeCreds = Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}
+
+type fakeObject struct {
+	data     []byte
+	etag     string
+	modified time.Time
+}
+
+// fakeS3 is an in-memory S3 with one bucket, it checks signatures of all requests.
+type fakeS3 struct {
+	t        *testing.T
+	mu       sync.Mutex
+	objects  map[string]fakeObject
+	uploads  map[string]map[int][]byte
+	uploadID int
+	pageSize int
+	// requests are "METHOD key?query" of all requests, copies are logged as COPY
+	requests []string
+	// beforePut is called without the lock before a plain put is applied
+	beforePut func(key string)
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, Config) {
+	fake := &fakeS3{t: t, objects: map[string]fakeObject{}, uploads: map[string]map[int][]byte{}, pageSize: 1000}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	return fake, Config{Bucket: fakeBucket, Endpoint: server.URL, Region: fakeRegion, Credentials: fakeCreds}
+}
+
+func (f *fakeS3) keys(prefix string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	keys := []string{}
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func (f *fakeS3) countRequests(prefix string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := 0
+	for _, request := range f.requests {
+		if strings.HasPrefix(request, prefix) {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		f.t.Error(err)
+
+		return
+	}
+	if err = f.checkSignature(r, body); err != nil {
+		writeError(w, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key := path, ""
+	if n := strings.Index(path, "/"); n >= 0 {
+		bucket, key = path[:n], path[n+1:]
+	}
+	if bucket != fakeBucket {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", bucket)
+
+		return
+	}
+
+	method := r.Method
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		method = "COPY"
+	}
+	f.mu.Lock()
+	f.requests = append(f.requests, method+" "+key+"?"+r.URL.RawQuery)
+	f.mu.Unlock()
+
+	query := r.URL.Query()
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, query)
+	case r.Method == http.MethodPost && query["uploads"] != nil:
+		f.createUpload(w)
+	case r.Method == http.MethodPost && query.Get("uploadId") != "":
+		f.completeUpload(w, key, query.Get("uploadId"), body)
+	case r.Method == http.MethodPut && query.Get("uploadId") != "":
+		f.uploadPart(w, query, body)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		f.copy(w, key, r.Header.Get("X-Amz-Copy-Source"))
+	case r.Method == http.MethodPut:
+		f.put(w, r, key, body)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		f.get(w, key)
+	case r.Method == http.MethodDelete && query.Get("uploadId") != "":
+		f.mu.Lock()
+		delete(f.uploads, query.Get("uploadId"))
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		f.mu.Lock()
+		delete(f.objects, key)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented", r.Method)
+	}
+}
+
+// checkSignature signs the signed headers of the request again.
+func (f *fakeS3) checkSignature(r *http.Request, body []byte) error {
+	if got := r.Header.Get("X-Amz-Content-Sha256"); got != hashHex(body) {
+		return fmt.Errorf("payload hash is %s", got) // nolint: goerr113
+	}
+	signedAt, err := time.Parse(amzDateFormat, r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return err
+	}
+
+	auth := r.Header.Get("Authorization")
+	n := strings.Index(auth, "SignedHeaders=")
+	if n < 0 {
+		return fmt.Errorf("no signed headers in '%s'", auth) // nolint: goerr113
+	}
+	signedHeaders := strings.Split(strings.SplitN(auth[n+len("SignedHeaders="):], ",", 2)[0], ";")
+
+	req, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	if err != nil {
+		return err
+	}
+	for _, name := range signedHeaders {
+		if name != "host" {
+			req.Header[http.CanonicalHeaderKey(name)] = r.Header[http.CanonicalHeaderKey(name)]
+		}
+	}
+	sign(req, fakeCreds, fakeRegion, hashHex(body), signedAt)
+	if req.Header.Get("Authorization") != auth {
+		return fmt.Errorf("signature of '%s' doesn't match", r.URL) // nolint: goerr113
+	}
+
+	return nil
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, query map[string][]string) {
+	prefix, token := first(query["prefix"]), first(query["continuation-token"])
+	keys := f.keys(prefix)
+
+	// keys under the delimiter are rolled up into common prefixes, each prefix is listed once
+	if delimiter := first(query["delimiter"]); delimiter != "" {
+		entries := []string{}
+		for _, key := range keys {
+			if n := strings.Index(key[len(prefix):], delimiter); n >= 0 {
+				key = key[:len(prefix)+n+len(delimiter)]
+				if len(entries) > 0 && entries[len(entries)-1] == key {
+					continue
+				}
+			}
+			entries = append(entries, key)
+		}
+		keys = entries
+	}
+
+	start := 0
+	if token != "" {
+		start, _ = strconv.Atoi(token)
+	}
+	end := start + f.pageSize
+	if end > len(keys) {
+		end = len(keys)
+	}
+
+	var result listBucketResult
+	f.mu.Lock()
+	for _, key := range keys[start:end] {
+		object, ok := f.objects[key]
+		if !ok {
+			result.CommonPrefixes = append(result.CommonPrefixes, struct{ Prefix string }{key})
+
+			continue
+		}
+		result.Contents = append(result.Contents, struct {
+			Key          string
+			LastModified time.Time
+			Size         int64
+			ETag         string
+		}{key, object.modified, int64(len(object.data)), object.etag})
+	}
+	f.mu.Unlock()
+	if end < len(keys) {
+		result.IsTruncated, result.NextContinuationToken = true, strconv.Itoa(end)
+	}
+
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"ListBucketResult"`
+		listBucketResult
+	}{listBucketResult: result})
+}
+
+func (f *fakeS3) put(w http.ResponseWriter, r *http.Request, key string, body []byte) {
+	if f.beforePut != nil {
+		f.beforePut(key)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	existing, exists := f.objects[key]
+	if r.Header.Get("If-None-Match") == "*" && exists {
+		writeError(w, http.StatusPreconditionFailed, "PreconditionFailed", key)
+
+		return
+	}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if !exists {
+			writeError(w, http.StatusNotFound, "NoSuchKey", key)
+
+			return
+		}
+		if ifMatch != existing.etag {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed", key)
+
+			return
+		}
+	}
+
+	f.objects[key] = newFakeObject(body)
+	w.Header().Set("ETag", f.objects[key].etag)
+}
+
+func (f *fakeS3) get(w http.ResponseWriter, key string) {
+	f.mu.Lock()
+	object, ok := f.objects[key]
+	f.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey", key)
+
+		return
+	}
+
+	w.Header().Set("ETag", object.etag)
+	w.Header().Set("Last-Modified", object.modified.Format(http.TimeFormat))
+	w.Header().Set("Content-Length", strconv.Itoa(len(object.data)))
+	_, _ = w.Write(object.data)
+}
+
+func (f *fakeS3) copy(w http.ResponseWriter, key, source string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	object, ok := f.objects[strings.TrimPrefix(source, "/"+fakeBucket+"/")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey", source)
+
+		return
+	}
+	object.modified = time.Now()
+	f.objects[key] = object
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CopyObjectResult"`
+		ETag    string
+	}{ETag: object.etag})
+}
+
+func (f *fakeS3) createUpload(w http.ResponseWriter) {
+	f.mu.Lock()
+	f.uploadID++
+	uploadID := strconv.Itoa(f.uploadID)
+	f.uploads[uploadID] = map[int][]byte{}
+	f.mu.Unlock()
+
+	writeXML(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		UploadID string   `xml:"UploadId"`
+	}{UploadID: uploadID})
+}
+
+func (f *fakeS3) uploadPart(w http.ResponseWriter, query map[string][]string, body []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	parts, ok := f.uploads[first(query["uploadId"])]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", first(query["uploadId"]))
+
+		return
+	}
+	partNumber, _ := strconv.Atoi(first(query["partNumber"]))
+	parts[partNumber] = body
+	w.Header().Set("ETag", newFakeObject(body).etag)
+}
+
+func (f *fakeS3) completeUpload(w http.ResponseWriter, key, uploadID string, body []byte) {
+	var request struct {
+		Parts []completedPart `xml:"Part"`
+	}
+	if err := xml.Unmarshal(body, &request); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	parts, ok := f.uploads[uploadID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", uploadID)
+
+		return
+	}
+	data := []byte{}
+	for _, part := range request.Parts {
+		if newFakeObject(parts[part.PartNumber]).etag != part.ETag {
+			writeError(w, http.StatusBadRequest, "InvalidPart", strconv.Itoa(part.PartNumber))
+
+			return
+		}
+		data = append(data, parts[part.PartNumber]...)
+	}
+	delete(f.uploads, uploadID)
+	f.objects[key] = newFakeObject(data)
+
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Key     string
+	}{Key: key})
+}
+
+func newFakeObject(data []byte) fakeObject {
+	sum := md5.Sum(data) // nolint: gosec
+
+	return fakeObject{data: data, etag: `"` + hex.EncodeToString(sum[:]) + `"`, modified: time.Now()}
+}
+
+func writeXML(w http.ResponseWriter, value interface{}) {
+	data, err := xml.Marshal(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = w.Write(data)
+}
+
+func writeError(w http.ResponseWriter, statusCode int, code, message string) {
+	var buf bytes.Buffer
+	_ = xml.NewEncoder(&buf).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: message})
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(statusCode)
+	_, _ = w.Write(buf.Bytes())
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
@@ -0,0 +1,481 @@
+package s3
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+)
+
+const (
+	defaultPartSize = 16 << 20
+	// files up to inlineLimit are kept in the recipe, bigger ones are stored as layers
+	inlineLimit    = 64 << 10
+	defaultGCGrace = 24 * time.Hour
+	layersPrefix   = "layers/sha256/"
+	recipeSuffix   = ".json"
+)
+
+// recipe lists entries of a docker save tarball, contents of big files are layers stored by their sha256.
+type recipe struct {
+	Entries []recipeEntry
+}
+
+type recipeEntry struct {
+	Header *tar.Header
+	Data   []byte `json:",omitempty"`
+	// Layer is a hex sha256 of the content
+	Layer string `json:",omitempty"`
+}
+
+// ImgStorage keeps images in an S3 bucket. An image is a recipe in <prefix>/images/,
+// its layers are in layers/sha256/ of the bucket, so every cache sharing the bucket deduplicates them.
+type ImgStorage struct {
+	client   *client
+	prefix   string
+	partSize int
+	gcGrace  time.Duration
+
+	// gcMu guards recipes, layers of recipes are remembered by their ETags between collections
+	gcMu    sync.Mutex
+	recipes map[string]recipeLayers
+}
+
+type recipeLayers struct {
+	etag   string
+	layers []string
+}
+
+type Option func(*ImgStorage)
+
+// WithPartSize sets a size of multipart upload parts, smaller layers are uploaded at once.
+func WithPartSize(size int) Option {
+	return func(i *ImgStorage) {
+		if size > 0 {
+			i.partSize = size
+		}
+	}
+}
+
+// WithGCGrace keeps unused layers for the duration, so layers found by concurrent saves are not removed.
+func WithGCGrace(grace time.Duration) Option {
+	return func(i *ImgStorage) {
+		i.gcGrace = grace
+	}
+}
+
+func NewImgStorage(cfg Config, opts ...Option) (*ImgStorage, error) {
+	client, err := newClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	i := &ImgStorage{
+		client:   client,
+		prefix:   cfg.Prefix,
+		partSize: defaultPartSize,
+		gcGrace:  defaultGCGrace,
+		recipes:  map[string]recipeLayers{},
+	}
+	for _, opt := range opts {
+		opt(i)
+	}
+
+	return i, nil
+}
+
+func (i *ImgStorage) recipeKey(imageName string) string {
+	return path.Join(i.prefix, "images", imageName) + recipeSuffix
+}
+
+func (i *ImgStorage) Save(imageName string, imageDump io.Reader) error {
+	var imgRecipe recipe
+	tarReader := tar.NewReader(imageDump)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		entry := recipeEntry{Header: header}
+		switch {
+		case header.Typeflag == tar.TypeReg && header.Size > inlineLimit:
+			if entry.Layer, err = i.putLayer(tarReader); err != nil {
+				return fmt.Errorf("uploading '%s', %w", header.Name, err)
+			}
+		case header.Typeflag == tar.TypeReg:
+			if entry.Data, err = ioutil.ReadAll(tarReader); err != nil {
+				return err
+			}
+		}
+		imgRecipe.Entries = append(imgRecipe.Entries, entry)
+	}
+
+	data, err := json.Marshal(imgRecipe)
+	if err != nil {
+		return err
+	}
+	_, err = i.client.putObject(i.recipeKey(imageName), nil, data)
+
+	return err
+}
+
+// putLayer uploads the content unless the bucket already has it and returns its hex sha256.
+// The content is spooled to a temp file, because its key is known only at the end.
+func (i *ImgStorage) putLayer(content io.Reader) (string, error) {
+	spool, err := ioutil.TempFile("", "")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(spool, hash), content)
+	if err != nil {
+		return "", err
+	}
+	digest := hex.EncodeToString(hash.Sum(nil))
+	key := layersPrefix + digest
+
+	_, err = i.client.headObject(key)
+	if err == nil {
+		// a fresh LastModified protects the layer from garbage collection until the recipe is saved
+		return digest, i.client.touchObject(key)
+	}
+	if !isNotFound(err) {
+		return "", err
+	}
+
+	if _, err = spool.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if size <= int64(i.partSize) {
+		data, err := ioutil.ReadAll(spool)
+		if err != nil {
+			return "", err
+		}
+		_, err = i.client.putObject(key, nil, data)
+
+		return digest, err
+	}
+
+	return digest, i.putMultipart(key, spool)
+}
+
+func (i *ImgStorage) putMultipart(key string, content io.Reader) error {
+	uploadID, err := i.client.createMultipartUpload(key)
+	if err != nil {
+		return err
+	}
+
+	parts := []completedPart{}
+	buf := make([]byte, i.partSize)
+	for partNumber := 1; ; partNumber++ {
+		n, err := io.ReadFull(content, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			_ = i.client.abortMultipartUpload(key, uploadID)
+
+			return err
+		}
+
+		part, err := i.client.uploadPart(key, uploadID, partNumber, buf[:n])
+		if err != nil {
+			_ = i.client.abortMultipartUpload(key, uploadID)
+
+			return fmt.Errorf("uploading part %d, %w", partNumber, err)
+		}
+		parts = append(parts, part)
+	}
+
+	if err = i.client.completeMultipartUpload(key, uploadID, parts); err != nil {
+		_ = i.client.abortMultipartUpload(key, uploadID)
+
+		return err
+	}
+
+	return nil
+}
+
+func (i *ImgStorage) getRecipe(imageName string) (recipe, int64, error) {
+	body, _, err := i.client.getObject(i.recipeKey(imageName))
+	if isNotFound(err) {
+		return recipe{}, 0, storage.ErrNotFound
+	}
+	if err != nil {
+		return recipe{}, 0, err
+	}
+	defer body.Close()
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return recipe{}, 0, err
+	}
+
+	var imgRecipe recipe
+	if err = json.Unmarshal(data, &imgRecipe); err != nil {
+		return recipe{}, 0, fmt.Errorf("decoding the recipe of '%s', %w", imageName, err)
+	}
+
+	return imgRecipe, int64(len(data)), nil
+}
+
+// Load streams the tarball, layers are verified by their sha256 on the way.
+func (i *ImgStorage) Load(imageName string) (io.ReadCloser, error) {
+	imgRecipe, _, err := i.getRecipe(imageName)
+	if err != nil {
+		return nil, err
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		_ = pipeWriter.CloseWithError(i.writeTar(pipeWriter, imgRecipe))
+	}()
+
+	return pipeReader, nil
+}
+
+func (i *ImgStorage) writeTar(dst io.Writer, imgRecipe recipe) error {
+	tarWriter := tar.NewWriter(dst)
+	for _, entry := range imgRecipe.Entries {
+		if err := tarWriter.WriteHeader(entry.Header); err != nil {
+			return err
+		}
+
+		if entry.Layer == "" {
+			if _, err := tarWriter.Write(entry.Data); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := i.copyLayer(tarWriter, entry.Layer); err != nil {
+			return fmt.Errorf("downloading '%s', %w", entry.Header.Name, err)
+		}
+	}
+
+	return tarWriter.Close()
+}
+
+func (i *ImgStorage) copyLayer(dst io.Writer, digest string) error {
+	body, _, err := i.client.getObject(layersPrefix + digest)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(dst, hash), body); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != digest {
+		return fmt.Errorf("layer '%s' is corrupted, its sha256 is '%s'", digest, got) // nolint: goerr113
+	}
+
+	return nil
+}
+
+// Remove removes the recipe, layers are collected by RemoveNotIn.
+func (i *ImgStorage) Remove(imageName string) error {
+	return i.client.deleteObject(i.recipeKey(imageName))
+}
+
+func (i *ImgStorage) IsExist(imageName string) (bool, error) {
+	_, err := i.client.headObject(i.recipeKey(imageName))
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// DiskSize returns how much space the image takes, layers shared with other images are counted in full.
+func (i *ImgStorage) DiskSize(imageName string) (int64, error) {
+	imgRecipe, size, err := i.getRecipe(imageName)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, entry := range imgRecipe.Entries {
+		if entry.Layer != "" {
+			size += entry.Header.Size
+		}
+	}
+
+	return size, nil
+}
+
+// RemoveNotIn removes other images of the prefix and then layers which no image in the bucket uses.
+func (i *ImgStorage) RemoveNotIn(imageNames []string) error {
+	allowed := map[string]bool{}
+	for _, name := range imageNames {
+		allowed[i.recipeKey(name)] = true
+	}
+
+	recipes, err := i.client.listObjects(path.Join(i.prefix, "images") + "/")
+	if err != nil {
+		return err
+	}
+	for _, object := range recipes {
+		if allowed[object.Key] {
+			continue
+		}
+		if err = i.client.deleteObject(object.Key); err != nil {
+			return err
+		}
+	}
+
+	return i.collectLayers()
+}
+
+// collectLayers removes layers which are not used by recipes of any prefix and have not been touched for gcGrace.
+// Only recipes which are new or changed since the previous collection are downloaded.
+func (i *ImgStorage) collectLayers() error {
+	i.gcMu.Lock()
+	defer i.gcMu.Unlock()
+
+	recipes, err := i.listRecipes("")
+	if err != nil {
+		return err
+	}
+
+	used := map[string]bool{}
+	listed := map[string]bool{}
+	for _, object := range recipes {
+		listed[object.Key] = true
+		if err = i.markUsed(object, used); err != nil {
+			return err
+		}
+	}
+	for key := range i.recipes {
+		if !listed[key] {
+			delete(i.recipes, key)
+		}
+	}
+
+	layers, err := i.client.listObjects(layersPrefix)
+	if err != nil {
+		return err
+	}
+
+	deadline := i.client.now().Add(-i.gcGrace)
+	for _, layer := range layers {
+		digest := strings.TrimPrefix(layer.Key, layersPrefix)
+		if used[digest] || layer.LastModified.After(deadline) {
+			continue
+		}
+		if err = i.client.deleteObject(layer.Key); err != nil {
+			return err
+		}
+		log.Infof("Unused layer '%s' has been removed from the bucket", digest)
+	}
+
+	return nil
+}
+
+// listRecipes walks dirs of the bucket from the dir and returns recipes of every prefix, layers are not listed.
+func (i *ImgStorage) listRecipes(dir string) ([]objectInfo, error) {
+	objects, subdirs, err := i.client.listDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	recipes := []objectInfo{}
+	if path.Base(dir) == "images" {
+		for _, object := range objects {
+			if strings.HasSuffix(object.Key, recipeSuffix) {
+				recipes = append(recipes, object)
+			}
+		}
+	}
+	for _, subdir := range subdirs {
+		if subdir == layersPrefix {
+			continue
+		}
+		found, err := i.listRecipes(subdir)
+		if err != nil {
+			return nil, err
+		}
+		recipes = append(recipes, found...)
+	}
+
+	return recipes, nil
+}
+
+// markUsed marks layers of the recipe, it downloads the recipe only if its ETag is not remembered yet.
+// It has to be called under gcMu.
+func (i *ImgStorage) markUsed(object objectInfo, used map[string]bool) error {
+	known, ok := i.recipes[object.Key]
+	if !ok || known.etag != object.ETag {
+		layers, err := i.readRecipeLayers(object.Key)
+		if err != nil {
+			return err
+		}
+		known = recipeLayers{etag: object.ETag, layers: layers}
+		i.recipes[object.Key] = known
+	}
+
+	for _, layer := range known.layers {
+		used[layer] = true
+	}
+
+	return nil
+}
+
+func (i *ImgStorage) readRecipeLayers(recipeKey string) ([]string, error) {
+	body, _, err := i.client.getObject(recipeKey)
+	if isNotFound(err) {
+		// removed concurrently
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var imgRecipe recipe
+	if err = json.NewDecoder(body).Decode(&imgRecipe); err != nil {
+		// an unreadable recipe can't be loaded anyway
+		log.Warnf("decoding '%s', %s", recipeKey, err)
+
+		return nil, nil
+	}
+	layers := []string{}
+	for _, entry := range imgRecipe.Entries {
+		if entry.Layer != "" {
+			layers = append(layers, entry.Layer)
+		}
+	}
+
+	return layers, nil
+}
+
+func (i *ImgStorage) Ping() error {
+	if err := i.client.headBucket(); err != nil {
+		return fmt.Errorf("ping bucket '%s', %w", i.client.bucket, err)
+	}
+
+	return nil
+}
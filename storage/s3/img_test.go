@@ -0,0 +1,248 @@
+package s3
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+)
+
+type tarFile struct {
+	name string
+	data []byte
+}
+
+func makeDump(t *testing.T, files ...tarFile) []byte {
+	var buf bytes.Buffer
+	tarWriter := tar.NewWriter(&buf)
+	for _, file := range files {
+		header := &tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.data)), Typeflag: tar.TypeReg}
+		if file.data == nil {
+			header = &tar.Header{Name: file.name, Mode: 0755, Typeflag: tar.TypeDir}
+		}
+		require.NoError(t, tarWriter.WriteHeader(header))
+		_, err := tarWriter.Write(file.data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tarWriter.Close())
+
+	return buf.Bytes()
+}
+
+func readDump(t *testing.T, dump io.Reader) []tarFile {
+	files := []tarFile{}
+	tarReader := tar.NewReader(dump)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return files
+		}
+		require.NoError(t, err)
+
+		file := tarFile{name: header.Name}
+		if header.Typeflag == tar.TypeReg {
+			file.data, err = ioutil.ReadAll(tarReader)
+			require.NoError(t, err)
+		}
+		files = append(files, file)
+	}
+}
+
+func randomData(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data) // nolint: gosec
+
+	return data
+}
+
+func loadDump(t *testing.T, imgStorage *ImgStorage, imageName string) []tarFile {
+	dump, err := imgStorage.Load(imageName)
+	require.NoError(t, err)
+	defer dump.Close()
+
+	return readDump(t, dump)
+}
+
+func TestImgStorage_SaveLoad(t *testing.T) {
+	layer := randomData(200<<10, 1)
+	files := []tarFile{
+		{name: "manifest.json", data: []byte(`[{"Config":"abc.json"}]`)},
+		{name: "abc.json", data: []byte(`{}`)},
+		{name: "l1/"},
+		{name: "l1/layer.tar", data: layer},
+	}
+
+	t.Run("small layers are put at once", func(t *testing.T) {
+		fake, cfg := newFakeS3(t)
+		cfg.Prefix = "team"
+		imgStorage, err := NewImgStorage(cfg)
+		require.NoError(t, err)
+
+		require.NoError(t, imgStorage.Save("sha256:abc", bytes.NewReader(makeDump(t, files...))))
+		require.Equal(t, files, loadDump(t, imgStorage, "sha256:abc"))
+
+		require.Equal(t, []string{layersPrefix + hashHex(layer), "team/images/sha256:abc.json"}, fake.keys(""))
+		require.Zero(t, fake.countRequests("POST "))
+	})
+
+	t.Run("big layers are put in parts", func(t *testing.T) {
+		fake, cfg := newFakeS3(t)
+		imgStorage, err := NewImgStorage(cfg, WithPartSize(64<<10))
+		require.NoError(t, err)
+
+		require.NoError(t, imgStorage.Save("sha256:abc", bytes.NewReader(makeDump(t, files...))))
+		require.Equal(t, files, loadDump(t, imgStorage, "sha256:abc"))
+
+		require.Equal(t, 4, fake.countRequests("PUT "+layersPrefix+hashHex(layer)+"?partNumber="))
+		require.Equal(t, []string{"images/sha256:abc.json", layersPrefix + hashHex(layer)}, fake.keys(""))
+	})
+
+	t.Run("layers are shared by prefixes", func(t *testing.T) {
+		fake, cfg := newFakeS3(t)
+		cfg.Prefix = "a"
+		first, err := NewImgStorage(cfg)
+		require.NoError(t, err)
+		cfg.Prefix = "b"
+		second, err := NewImgStorage(cfg)
+		require.NoError(t, err)
+
+		require.NoError(t, first.Save("sha256:abc", bytes.NewReader(makeDump(t, files...))))
+		require.NoError(t, second.Save("sha256:abc", bytes.NewReader(makeDump(t, files...))))
+
+		require.Equal(t, 1, fake.countRequests("PUT "+layersPrefix+hashHex(layer)+"?"))
+		require.Equal(t, 1, fake.countRequests("COPY "+layersPrefix+hashHex(layer)+"?"))
+		require.Equal(t, []string{"a/images/sha256:abc.json", "b/images/sha256:abc.json", layersPrefix + hashHex(layer)}, fake.keys(""))
+		require.Equal(t, files, loadDump(t, second, "sha256:abc"))
+	})
+
+	t.Run("corrupted layer", func(t *testing.T) {
+		fake, cfg := newFakeS3(t)
+		imgStorage, err := NewImgStorage(cfg)
+		require.NoError(t, err)
+		require.NoError(t, imgStorage.Save("sha256:abc", bytes.NewReader(makeDump(t, files...))))
+
+		key := layersPrefix + hashHex(layer)
+		fake.objects[key] = newFakeObject(randomData(len(layer), 2))
+
+		dump, err := imgStorage.Load("sha256:abc")
+		require.NoError(t, err)
+		defer dump.Close()
+		_, err = ioutil.ReadAll(dump)
+		require.EqualError(t, err, "downloading 'l1/layer.tar', layer '"+hashHex(layer)+"' is corrupted, its sha256 is '"+hashHex(fake.objects[key].data)+"'")
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		_, cfg := newFakeS3(t)
+		imgStorage, err := NewImgStorage(cfg)
+		require.NoError(t, err)
+
+		_, err = imgStorage.Load("sha256:abc")
+		require.Equal(t, storage.ErrNotFound, err)
+	})
+}
+
+func TestImgStorage_IsExist(t *testing.T) {
+	_, cfg := newFakeS3(t)
+	imgStorage, err := NewImgStorage(cfg)
+	require.NoError(t, err)
+
+	exist, err := imgStorage.IsExist("sha256:abc")
+	require.NoError(t, err)
+	require.False(t, exist)
+
+	require.NoError(t, imgStorage.Save("sha256:abc", bytes.NewReader(makeDump(t, tarFile{name: "manifest.json", data: []byte("[]")}))))
+	exist, err = imgStorage.IsExist("sha256:abc")
+	require.NoError(t, err)
+	require.True(t, exist)
+
+	require.NoError(t, imgStorage.Remove("sha256:abc"))
+	exist, err = imgStorage.IsExist("sha256:abc")
+	require.NoError(t, err)
+	require.False(t, exist)
+}
+
+func TestImgStorage_RemoveNotIn(t *testing.T) {
+	kept, removed, shared := randomData(100<<10, 1), randomData(100<<10, 2), randomData(100<<10, 3)
+
+	setUp := func(t *testing.T, gcGrace time.Duration) (*fakeS3, *ImgStorage) {
+		fake, cfg := newFakeS3(t)
+		cfg.Prefix = "other"
+		other, err := NewImgStorage(cfg)
+		require.NoError(t, err)
+		cfg.Prefix = "mine"
+		imgStorage, err := NewImgStorage(cfg, WithGCGrace(gcGrace))
+		require.NoError(t, err)
+
+		require.NoError(t, imgStorage.Save("sha256:kept", bytes.NewReader(makeDump(t, tarFile{name: "l/layer.tar", data: kept}))))
+		require.NoError(t, imgStorage.Save("sha256:removed", bytes.NewReader(makeDump(t, tarFile{name: "l/layer.tar", data: removed}))))
+		require.NoError(t, imgStorage.Save("sha256:shared", bytes.NewReader(makeDump(t, tarFile{name: "l/layer.tar", data: shared}))))
+		require.NoError(t, other.Save("sha256:shared", bytes.NewReader(makeDump(t, tarFile{name: "l/layer.tar", data: shared}))))
+
+		return fake, imgStorage
+	}
+
+	t.Run("unused layers are removed", func(t *testing.T) {
+		fake, imgStorage := setUp(t, 0)
+		fake.pageSize = 2
+
+		require.NoError(t, imgStorage.RemoveNotIn([]string{"sha256:kept"}))
+		require.ElementsMatch(t, []string{layersPrefix + hashHex(kept), layersPrefix + hashHex(shared)}, fake.keys(layersPrefix))
+		require.Equal(t, []string{"mine/images/sha256:kept.json"}, fake.keys("mine/"))
+		require.Equal(t, []string{"other/images/sha256:shared.json"}, fake.keys("other/"))
+	})
+
+	t.Run("only recipe dirs are listed and known recipes aren't downloaded again", func(t *testing.T) {
+		fake, imgStorage := setUp(t, 0)
+		fake.pageSize = 2
+
+		require.NoError(t, imgStorage.RemoveNotIn([]string{"sha256:kept", "sha256:shared"}))
+		downloaded := fake.countRequests("GET mine/images/") + fake.countRequests("GET other/images/")
+		require.Equal(t, 3, downloaded)
+
+		require.NoError(t, imgStorage.RemoveNotIn([]string{"sha256:kept", "sha256:shared"}))
+		require.Equal(t, downloaded, fake.countRequests("GET mine/images/")+fake.countRequests("GET other/images/"))
+		require.NotContains(t, fake.requests, "GET ?list-type=2&prefix=")
+		require.Zero(t, fake.countRequests("GET ?delimiter=%2F&list-type=2&prefix="+url.QueryEscape(layersPrefix)))
+		require.Len(t, fake.keys(layersPrefix), 2)
+	})
+
+	t.Run("recent layers are kept", func(t *testing.T) {
+		fake, imgStorage := setUp(t, time.Hour)
+
+		require.NoError(t, imgStorage.RemoveNotIn(nil))
+		require.Len(t, fake.keys(layersPrefix), 3)
+		require.Empty(t, fake.keys("mine/"))
+	})
+}
+
+func TestImgStorage_DiskSize(t *testing.T) {
+	fake, cfg := newFakeS3(t)
+	imgStorage, err := NewImgStorage(cfg)
+	require.NoError(t, err)
+	layer := randomData(100<<10, 1)
+	require.NoError(t, imgStorage.Save("sha256:abc", bytes.NewReader(makeDump(t, tarFile{name: "l/layer.tar", data: layer}))))
+
+	size, err := imgStorage.DiskSize("sha256:abc")
+	require.NoError(t, err)
+	require.Equal(t, int64(len(fake.objects["images/sha256:abc.json"].data)+len(layer)), size)
+}
+
+func TestImgStorage_Ping(t *testing.T) {
+	_, cfg := newFakeS3(t)
+	imgStorage, err := NewImgStorage(cfg)
+	require.NoError(t, err)
+	require.NoError(t, imgStorage.Ping())
+
+	cfg.Bucket = "missing"
+	imgStorage, err = NewImgStorage(cfg)
+	require.NoError(t, err)
+	require.EqualError(t, imgStorage.Ping(), "ping bucket 'missing', s3 responded 404")
+}
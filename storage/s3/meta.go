@@ -0,0 +1,132 @@
+package s3
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+)
+
+const maxUpdateAttempts = 10
+
+// MetaCRUD keeps all metas in <prefix>/meta.json of the bucket. Every change is a conditional put
+// of the version it has been made to, so concurrent changes of several garnerd are not lost.
+type MetaCRUD struct {
+	client *client
+	key    string
+}
+
+func NewMetaCRUD(cfg Config) (*MetaCRUD, error) {
+	client, err := newClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MetaCRUD{client: client, key: path.Join(cfg.Prefix, "meta.json")}, nil
+}
+
+// read returns metas and the ETag of their version, the ETag is empty if there is no meta.json yet.
+func (m *MetaCRUD) read() (map[string]storage.Meta, string, error) {
+	body, etag, err := m.client.getObject(m.key)
+	if isNotFound(err) {
+		return map[string]storage.Meta{}, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer body.Close()
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	metas := map[string]storage.Meta{}
+	if err = json.Unmarshal(data, &metas); err != nil {
+		return nil, "", fmt.Errorf("decoding '%s', %w", m.key, err)
+	}
+
+	return metas, etag, nil
+}
+
+// update applies the change to the latest version, it is retried if another change wins the race.
+func (m *MetaCRUD) update(change func(metas map[string]storage.Meta)) error {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		metas, etag, err := m.read()
+		if err != nil {
+			return err
+		}
+		change(metas)
+
+		data, err := json.Marshal(metas)
+		if err != nil {
+			return err
+		}
+
+		header := http.Header{}
+		if etag == "" {
+			header.Set("If-None-Match", "*")
+		} else {
+			header.Set("If-Match", etag)
+		}
+		_, err = m.client.putObject(m.key, header, data)
+		if isConflict(err) || (etag != "" && isNotFound(err)) {
+			continue
+		}
+
+		return err
+	}
+
+	return fmt.Errorf("'%s' is changed concurrently, giving up after %d attempts", m.key, maxUpdateAttempts) // nolint: goerr113
+}
+
+func (m *MetaCRUD) Set(entry storage.Meta) error {
+	return m.update(func(metas map[string]storage.Meta) {
+		metas[entry.Key()] = entry
+	})
+}
+
+func (m *MetaCRUD) Get(key string) (storage.Meta, error) {
+	metas, _, err := m.read()
+	if err != nil {
+		return storage.Meta{}, err
+	}
+
+	entry, ok := metas[key]
+	if !ok {
+		return storage.Meta{}, storage.ErrNotFound
+	}
+
+	return entry, nil
+}
+
+func (m *MetaCRUD) GetAll() ([]storage.Meta, error) {
+	metas, _, err := m.read()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]storage.Meta, 0, len(metas))
+	for _, entry := range metas {
+		list = append(list, entry)
+	}
+
+	return list, nil
+}
+
+func (m *MetaCRUD) Remove(key string) error {
+	return m.update(func(metas map[string]storage.Meta) {
+		delete(metas, key)
+	})
+}
+
+func (m *MetaCRUD) Ping() error {
+	if err := m.client.headBucket(); err != nil {
+		return fmt.Errorf("ping bucket '%s', %w", m.client.bucket, err)
+	}
+
+	return nil
+}
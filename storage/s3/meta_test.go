@@ -0,0 +1,88 @@
+package s3
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+)
+
+func TestMetaCRUD(t *testing.T) {
+	fake, cfg := newFakeS3(t)
+	cfg.Prefix = "team"
+	metaCRUD, err := NewMetaCRUD(cfg)
+	require.NoError(t, err)
+	require.NoError(t, metaCRUD.Ping())
+
+	all, err := metaCRUD.GetAll()
+	require.NoError(t, err)
+	require.Empty(t, all)
+
+	_, err = metaCRUD.Get("alpine:3")
+	require.Equal(t, storage.ErrNotFound, err)
+
+	amd64 := storage.Meta{ImageName: "alpine:3", ImageID: "sha256:a", OS: "linux", Architecture: "amd64", UpdatedAt: time.Unix(1, 0).UTC()}
+	arm64 := storage.Meta{ImageName: "alpine:3", ImageID: "sha256:b", OS: "linux", Architecture: "arm64", UpdatedAt: time.Unix(2, 0).UTC()}
+	require.NoError(t, metaCRUD.Set(amd64))
+	require.NoError(t, metaCRUD.Set(arm64))
+	require.Equal(t, []string{"team/meta.json"}, fake.keys(""))
+
+	got, err := metaCRUD.Get(amd64.Key())
+	require.NoError(t, err)
+	require.Equal(t, amd64, got)
+
+	all, err = metaCRUD.GetAll()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []storage.Meta{amd64, arm64}, all)
+
+	require.NoError(t, metaCRUD.Remove(amd64.Key()))
+	all, err = metaCRUD.GetAll()
+	require.NoError(t, err)
+	require.Equal(t, []storage.Meta{arm64}, all)
+}
+
+func TestMetaCRUD_ConcurrentUpdate(t *testing.T) {
+	t.Run("lost race is retried", func(t *testing.T) {
+		fake, cfg := newFakeS3(t)
+		first, err := NewMetaCRUD(cfg)
+		require.NoError(t, err)
+		second, err := NewMetaCRUD(cfg)
+		require.NoError(t, err)
+
+		other := storage.Meta{ImageName: "busybox", ImageID: "sha256:b"}
+		fake.beforePut = func(string) {
+			// another garnerd saves its meta in between the read and the put of the first one
+			fake.beforePut = nil
+			require.NoError(t, second.Set(other))
+		}
+
+		mine := storage.Meta{ImageName: "alpine", ImageID: "sha256:a"}
+		require.NoError(t, first.Set(mine))
+		// the lost put of the first, the put of the second and the retry of the first
+		require.Equal(t, 3, fake.countRequests("PUT meta.json?"))
+
+		all, err := first.GetAll()
+		require.NoError(t, err)
+		require.ElementsMatch(t, []storage.Meta{mine, other}, all)
+	})
+
+	t.Run("giving up", func(t *testing.T) {
+		fake, cfg := newFakeS3(t)
+		metaCRUD, err := NewMetaCRUD(cfg)
+		require.NoError(t, err)
+
+		changes := 0
+		fake.beforePut = func(key string) {
+			changes++
+			fake.mu.Lock()
+			fake.objects[key] = newFakeObject([]byte(fmt.Sprintf(`{"change%d":{}}`, changes)))
+			fake.mu.Unlock()
+		}
+
+		err = metaCRUD.Set(storage.Meta{ImageName: "alpine"})
+		require.EqualError(t, err, "'meta.json' is changed concurrently, giving up after 10 attempts")
+	})
+}
@@ -0,0 +1,125 @@
+// Package schema versions the on-disk layout of the cache dir.
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/pkg/ioutils"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrDowngrade = errors.New("downgrade is not supported")
+	ErrOutdated  = errors.New("the dir has to be migrated")
+)
+
+// Migration upgrades a component by one version.
+type Migration struct {
+	Description string
+	Up          func() error
+}
+
+// versions are stored in schema.json as component -> version.
+type versions map[string]int
+
+// Migrate runs migrations of the component which have not been applied to the dir yet,
+// migrations[n] upgrades the component from version n to n+1.
+// A dir written by a newer garnerd is refused with ErrDowngrade.
+func Migrate(dir, component string, migrations []Migration) error {
+	stored, err := readVersions(dir)
+	if err != nil {
+		return err
+	}
+
+	current := stored[component]
+	if current > len(migrations) {
+		return fmt.Errorf(
+			"%w, '%s' in '%s' has schema version %d, this garnerd supports up to %d",
+			ErrDowngrade, component, dir, current, len(migrations),
+		)
+	}
+
+	for version := current; version < len(migrations); version++ {
+		migration := migrations[version]
+		log.Infof("Migrating %s to schema version %d: %s", component, version+1, migration.Description)
+		if err = migration.Up(); err != nil {
+			return fmt.Errorf("migrating %s to version %d, %w", component, version+1, err)
+		}
+
+		stored[component] = version + 1
+		if err = writeVersions(dir, stored); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Check refuses a dir with the component not migrated to the latest version, the dir is not changed.
+// It is for dirs which can't be written, e.g. read-only mounts.
+func Check(dir, component string, migrations []Migration) error {
+	current, err := Version(dir, component)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case current > len(migrations):
+		return fmt.Errorf(
+			"%w, '%s' in '%s' has schema version %d, this garnerd supports up to %d",
+			ErrDowngrade, component, dir, current, len(migrations),
+		)
+	case current < len(migrations):
+		return fmt.Errorf(
+			"%w, '%s' in '%s' has schema version %d, this garnerd needs %d",
+			ErrOutdated, component, dir, current, len(migrations),
+		)
+	}
+
+	return nil
+}
+
+// Version returns the stored version of the component, 0 means it has never been migrated.
+func Version(dir, component string) (int, error) {
+	stored, err := readVersions(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	return stored[component], nil
+}
+
+func readVersions(dir string) (versions, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "schema.json"))
+	if os.IsNotExist(err) {
+		return versions{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading schema.json, %w", err)
+	}
+
+	stored := versions{}
+	if err = json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("decoding schema.json, %w", err)
+	}
+
+	return stored, nil
+}
+
+func writeVersions(dir string, stored versions) error {
+	data, err := json.MarshalIndent(stored, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	if err = ioutils.AtomicWriteFile(filepath.Join(dir, "schema.json"), data, 0600); err != nil {
+		return fmt.Errorf("writing schema.json, %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+// nolint: goerr113
+package schema
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func setUpTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("can't create tempdir", err)
+	}
+	t.Cleanup(cleanUpTempDir(t, dir))
+
+	return dir
+}
+
+func cleanUpTempDir(t *testing.T, dir string) func() {
+	return func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Log("can't Remove tempdir", err)
+		}
+	}
+}
+
+func recorder(applied *[]string, name string, err error) Migration {
+	return Migration{Description: name, Up: func() error {
+		*applied = append(*applied, name)
+
+		return err
+	}}
+}
+
+func TestMigrate(t *testing.T) {
+	t.Run("runs only new migrations", func(t *testing.T) {
+		dir := setUpTempDir(t)
+		applied := []string{}
+		require.NoError(t, Migrate(dir, "meta", []Migration{recorder(&applied, "v1", nil)}))
+		require.NoError(t, Migrate(dir, "meta", []Migration{recorder(&applied, "v1", nil), recorder(&applied, "v2", nil)}))
+		require.Equal(t, []string{"v1", "v2"}, applied)
+
+		version, err := Version(dir, "meta")
+		require.NoError(t, err)
+		require.Equal(t, 2, version)
+	})
+
+	t.Run("components are versioned independently", func(t *testing.T) {
+		dir := setUpTempDir(t)
+		applied := []string{}
+		require.NoError(t, Migrate(dir, "meta", []Migration{recorder(&applied, "meta v1", nil)}))
+		require.NoError(t, Migrate(dir, "compact", []Migration{recorder(&applied, "compact v1", nil)}))
+		require.Equal(t, []string{"meta v1", "compact v1"}, applied)
+	})
+
+	t.Run("failed migration is retried", func(t *testing.T) {
+		dir := setUpTempDir(t)
+		applied := []string{}
+		err := Migrate(dir, "meta", []Migration{recorder(&applied, "v1", nil), recorder(&applied, "v2", errors.New("boom"))})
+		require.EqualError(t, err, "migrating meta to version 2, boom")
+
+		version, err := Version(dir, "meta")
+		require.NoError(t, err)
+		require.Equal(t, 1, version)
+	})
+
+	t.Run("downgrade is refused", func(t *testing.T) {
+		dir := setUpTempDir(t)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "schema.json"), []byte(`{"meta": 3}`), 0600))
+
+		err := Migrate(dir, "meta", []Migration{{Up: func() error { return nil }}})
+		require.True(t, errors.Is(err, ErrDowngrade))
+		require.Contains(t, err.Error(), "has schema version 3, this garnerd supports up to 1")
+	})
+}
+
+func TestCheck(t *testing.T) {
+	dir := setUpTempDir(t)
+	migrations := []Migration{{Up: func() error { return nil }}, {Up: func() error { return nil }}}
+
+	err := Check(dir, "meta", migrations)
+	require.True(t, errors.Is(err, ErrOutdated))
+	require.Contains(t, err.Error(), "has schema version 0, this garnerd needs 2")
+	require.NoFileExists(t, filepath.Join(dir, "schema.json"))
+
+	require.NoError(t, Migrate(dir, "meta", migrations))
+	require.NoError(t, Check(dir, "meta", migrations))
+	require.True(t, errors.Is(Check(dir, "meta", migrations[:1]), ErrDowngrade))
+}
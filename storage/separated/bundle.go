@@ -0,0 +1,241 @@
+package separated
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+)
+
+// BundleImgStorage exports images with their layers as they are stored and imports them back without re-encoding.
+type BundleImgStorage interface {
+	ExportImage(dst *tar.Writer, imgName string, written map[string]bool) error
+	ImportImages(src *tar.Reader, accept func(imgName string) (bool, error)) error
+}
+
+const (
+	bundleVersion  = 1
+	bundleMetaFile = "bundle.json"
+)
+
+// bundleMeta is the first entry of a bundle, images of the bundle follow it.
+type bundleMeta struct {
+	Version int
+	Metas   []storage.Meta
+}
+
+// ConflictRule decides whether a tag of the bundle replaces the same tag of another image in the store.
+type ConflictRule string
+
+const (
+	// KeepLocal keeps tags of the store.
+	KeepLocal ConflictRule = "keep"
+	// ReplaceLocal replaces tags of the store with tags of the bundle.
+	ReplaceLocal ConflictRule = "replace"
+	// KeepNewer keeps the tag of the image created later.
+	KeepNewer ConflictRule = "newer"
+)
+
+// Validate checks that the rule is known.
+func (r ConflictRule) Validate() error {
+	switch r {
+	case KeepLocal, ReplaceLocal, KeepNewer:
+		return nil
+	}
+
+	return fmt.Errorf("unknown conflict rule '%s', known are %s, %s and %s", r, KeepLocal, ReplaceLocal, KeepNewer) // nolint: goerr113
+}
+
+// ImportReport counts what an import has changed.
+type ImportReport struct {
+	// Images are imported images, StoredImages are images of the bundle which the store has already.
+	Images       int
+	StoredImages int
+	// Tags are added or replaced tags, Conflicts are tags of other images kept by the conflict rule.
+	Tags      int
+	Conflicts int
+}
+
+// Export writes a bundle of the tags, all tags are exported if imageNames is empty.
+// Every image is written once with its tags and every layer is written once as it is compressed in the store.
+func (s *Storage) Export(dst io.Writer, imageNames []string) error {
+	bundleStorage, ok := s.imgStorage.(BundleImgStorage)
+	if !ok {
+		return errors.New("the image storage can't export bundles") // nolint: goerr113
+	}
+
+	metas, err := s.metaStorage.GetAll()
+	if err != nil {
+		return err
+	}
+	if metas, err = selectMetas(metas, imageNames); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(bundleMeta{Version: bundleVersion, Metas: metas})
+	if err != nil {
+		return err
+	}
+	tarWriter := tar.NewWriter(dst)
+	if err = tarWriter.WriteHeader(&tar.Header{Name: bundleMetaFile, Mode: 0644, Size: int64(len(data))}); err != nil {
+		return err
+	}
+	if _, err = tarWriter.Write(data); err != nil {
+		return err
+	}
+
+	exported, written := map[string]bool{}, map[string]bool{}
+	for _, meta := range metas {
+		if exported[meta.ImageID] {
+			continue
+		}
+		exported[meta.ImageID] = true
+		if err = bundleStorage.ExportImage(tarWriter, meta.ImageID, written); err != nil {
+			return fmt.Errorf("exporting '%s', %w", meta.ImageName, err)
+		}
+	}
+
+	return tarWriter.Close()
+}
+
+// selectMetas returns metas of the tags, every platform of a tag is selected.
+func selectMetas(metas []storage.Meta, imageNames []string) ([]storage.Meta, error) {
+	if len(imageNames) == 0 {
+		return metas, nil
+	}
+
+	selected := []storage.Meta{}
+	for _, imageName := range imageNames {
+		found := false
+		for _, meta := range metas {
+			if meta.ImageName == imageName {
+				selected = append(selected, meta)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("'%s' is not cached", imageName) // nolint: goerr113
+		}
+	}
+
+	return selected, nil
+}
+
+// Import merges the bundle into the store. Images are matched by ImageID, so an image stored already is not imported again.
+// A tag of the bundle which the store has for another image is resolved by the rule,
+// an image which has lost its last tag is removed.
+func (s *Storage) Import(src io.Reader, rule ConflictRule) (ImportReport, error) {
+	bundleStorage, ok := s.imgStorage.(BundleImgStorage)
+	if !ok {
+		return ImportReport{}, errors.New("the image storage can't import bundles") // nolint: goerr113
+	}
+	if err := rule.Validate(); err != nil {
+		return ImportReport{}, err
+	}
+
+	tarReader := tar.NewReader(src)
+	bundle, err := readBundleMeta(tarReader)
+	if err != nil {
+		return ImportReport{}, err
+	}
+
+	report := ImportReport{}
+	tags := map[string][]storage.Meta{}
+	replaced := map[string]bool{}
+	for _, meta := range bundle.Metas {
+		local, err := s.metaStorage.Get(meta.Key())
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+		case err != nil:
+			return report, err
+		case local.ImageID == meta.ImageID:
+			continue
+		case rule == KeepLocal, rule == KeepNewer && !meta.Created.After(local.Created):
+			report.Conflicts++
+
+			continue
+		default:
+			replaced[local.ImageID] = true
+		}
+		tags[meta.ImageID] = append(tags[meta.ImageID], meta)
+	}
+
+	err = bundleStorage.ImportImages(tarReader, func(imageID string) (bool, error) {
+		if len(tags[imageID]) == 0 {
+			return false, nil
+		}
+		stored, err := s.imgStorage.IsExist(imageID)
+		if err != nil {
+			return false, err
+		}
+		if stored {
+			report.StoredImages++
+
+			return false, nil
+		}
+		report.Images++
+
+		return true, nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("importing images, %w", err)
+	}
+
+	for _, metas := range tags {
+		for _, meta := range metas {
+			if err = s.SaveTag(meta); err != nil {
+				return report, fmt.Errorf("importing '%s', %w", meta.ImageName, err)
+			}
+			report.Tags++
+		}
+	}
+
+	for imageID := range replaced {
+		if err = s.removeIfUntagged(imageID); err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+func readBundleMeta(src *tar.Reader) (bundleMeta, error) {
+	header, err := src.Next()
+	if err != nil {
+		return bundleMeta{}, fmt.Errorf("reading the bundle, %w", err)
+	}
+	if header.Name != bundleMetaFile {
+		return bundleMeta{}, fmt.Errorf("the bundle starts with '%s' instead of '%s'", header.Name, bundleMetaFile) // nolint: goerr113
+	}
+
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		return bundleMeta{}, err
+	}
+	var bundle bundleMeta
+	if err = json.Unmarshal(data, &bundle); err != nil {
+		return bundleMeta{}, fmt.Errorf("decoding '%s', %w", bundleMetaFile, err)
+	}
+	if bundle.Version != bundleVersion {
+		return bundleMeta{}, fmt.Errorf("unsupported bundle version %d", bundle.Version) // nolint: goerr113
+	}
+
+	return bundle, nil
+}
+
+// removeIfUntagged removes the image if none of its tags is left.
+func (s *Storage) removeIfUntagged(imageID string) error {
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+
+	tags, err := s.tagsOf(imageID)
+	if err != nil || len(tags) > 0 {
+		return err
+	}
+
+	return s.imgStorage.Remove(imageID)
+}
@@ -0,0 +1,128 @@
+package separated
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+	"github.com/podtserkovskiy/garnerd/storage/image/compact"
+	"github.com/podtserkovskiy/garnerd/storage/meta/mem"
+)
+
+func newCompactStorage(t *testing.T) *Storage {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	return NewStorage(mem.NewMetaCRUD(), compact.NewImgStorage(dir))
+}
+
+// imageDump returns a dump of one layer, images with the same id have the same layer.
+func imageDump(t *testing.T, imageID string) []byte {
+	layer := fmt.Sprintf("%064x", imageID)
+
+	return makeDump(t, map[string]string{
+		layer + "/":          "",
+		layer + "/layer.tar": "layer of " + imageID,
+		"manifest.json":      fmt.Sprintf(`[{"Config":"config.json","Layers":["%s/layer.tar"]}]`, layer),
+		"config.json":        imageID,
+	})
+}
+
+func saveImage(t *testing.T, stor *Storage, meta storage.Meta) {
+	require.NoError(t, stor.Save(meta, bytes.NewReader(imageDump(t, meta.ImageID))))
+}
+
+func requireTag(t *testing.T, stor *Storage, imageName, imageID string) {
+	meta, err := stor.GetMeta(imageName)
+	require.NoError(t, err)
+	require.Equal(t, imageID, meta.ImageID)
+
+	dump, err := stor.Load(imageName)
+	require.NoError(t, err)
+	defer dump.Close()
+	require.Equal(t, imageID, readDump(t, dump)["config.json"])
+}
+
+func TestStorage_ExportImport(t *testing.T) {
+	older, newer := time.Now().Add(-time.Hour), time.Now()
+	src := newCompactStorage(t)
+	saveImage(t, src, storage.Meta{ImageName: "a:1", ImageID: "id-a", Created: newer})
+	saveImage(t, src, storage.Meta{ImageName: "a:latest", ImageID: "id-a", Created: newer})
+	saveImage(t, src, storage.Meta{ImageName: "b:1", ImageID: "id-b", Created: older})
+	bundle := &bytes.Buffer{}
+	require.NoError(t, src.Export(bundle, nil))
+
+	t.Run("into an empty store", func(t *testing.T) {
+		dst := newCompactStorage(t)
+		report, err := dst.Import(bytes.NewReader(bundle.Bytes()), KeepLocal)
+		require.NoError(t, err)
+		require.Equal(t, ImportReport{Images: 2, Tags: 3}, report)
+
+		requireTag(t, dst, "a:1", "id-a")
+		requireTag(t, dst, "a:latest", "id-a")
+		requireTag(t, dst, "b:1", "id-b")
+	})
+
+	t.Run("selected tags", func(t *testing.T) {
+		selected := &bytes.Buffer{}
+		require.NoError(t, src.Export(selected, []string{"b:1"}))
+
+		dst := newCompactStorage(t)
+		report, err := dst.Import(selected, KeepLocal)
+		require.NoError(t, err)
+		require.Equal(t, ImportReport{Images: 1, Tags: 1}, report)
+		requireTag(t, dst, "b:1", "id-b")
+
+		require.EqualError(t, src.Export(&bytes.Buffer{}, []string{"c:1"}), "'c:1' is not cached")
+	})
+
+	t.Run("stored image is matched by ImageID", func(t *testing.T) {
+		dst := newCompactStorage(t)
+		saveImage(t, dst, storage.Meta{ImageName: "other:1", ImageID: "id-a"})
+
+		report, err := dst.Import(bytes.NewReader(bundle.Bytes()), KeepLocal)
+		require.NoError(t, err)
+		require.Equal(t, ImportReport{Images: 1, StoredImages: 1, Tags: 3}, report)
+		requireTag(t, dst, "other:1", "id-a")
+		requireTag(t, dst, "a:1", "id-a")
+	})
+
+	conflicts := []struct {
+		rule      ConflictRule
+		created   time.Time
+		wantImage string
+		wantOld   bool
+	}{
+		{rule: KeepLocal, created: older, wantImage: "id-c", wantOld: true},
+		{rule: ReplaceLocal, created: newer.Add(time.Hour), wantImage: "id-b"},
+		{rule: KeepNewer, created: newer, wantImage: "id-c", wantOld: true},
+		{rule: KeepNewer, created: older.Add(-time.Hour), wantImage: "id-b"},
+	}
+	for _, c := range conflicts {
+		c := c
+		t.Run(fmt.Sprintf("%s tag, local created %s", c.rule, c.created.Format(time.Kitchen)), func(t *testing.T) {
+			dst := newCompactStorage(t)
+			saveImage(t, dst, storage.Meta{ImageName: "b:1", ImageID: "id-c", Created: c.created})
+
+			_, err := dst.Import(bytes.NewReader(bundle.Bytes()), c.rule)
+			require.NoError(t, err)
+			requireTag(t, dst, "b:1", c.wantImage)
+
+			exists, err := dst.imgStorage.IsExist("id-c")
+			require.NoError(t, err)
+			require.Equal(t, c.wantOld, exists, "untagged image is removed")
+		})
+	}
+
+	t.Run("unknown rule", func(t *testing.T) {
+		_, err := newCompactStorage(t).Import(bytes.NewReader(bundle.Bytes()), "merge")
+		require.EqualError(t, err, "unknown conflict rule 'merge', known are keep, replace and newer")
+	})
+}
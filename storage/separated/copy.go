@@ -0,0 +1,138 @@
+package separated
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+)
+
+// CopyImagesTo copies every image with a meta to dst and verifies that dst loads the same files.
+// Image storages repack dumps in their own way, so only names and contents of files are compared.
+func (s *Storage) CopyImagesTo(dst ImgStorage) error {
+	metas, err := s.metaStorage.GetAll()
+	if err != nil {
+		return err
+	}
+
+	// tags of an image share its dump
+	tagsByID := map[string][]string{}
+	imageIDs := []string{}
+	for _, meta := range metas {
+		if _, ok := tagsByID[meta.ImageID]; !ok {
+			imageIDs = append(imageIDs, meta.ImageID)
+		}
+		tagsByID[meta.ImageID] = append(tagsByID[meta.ImageID], meta.Key())
+	}
+
+	dstStorage := NewStorage(s.metaStorage, dst)
+	for n, imageID := range imageIDs {
+		if err = s.copyImage(dst, imageID); err != nil {
+			return fmt.Errorf("copying '%s', %w", imageID, err)
+		}
+
+		if size, ok := dstStorage.compressedSize(imageID); ok {
+			for _, key := range tagsByID[imageID] {
+				err = s.updateMeta(key, func(meta *storage.Meta) { meta.CompressedSize = size })
+				if err != nil {
+					return err
+				}
+			}
+		}
+		log.Infof("Image %v has been copied (%d/%d)", tagsByID[imageID], n+1, len(imageIDs))
+	}
+
+	return nil
+}
+
+func (s *Storage) copyImage(dst ImgStorage, imageID string) error {
+	src, err := s.imgStorage.Load(imageID)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// the dump is read once, its digests are computed while dst saves it
+	pipeReader, pipeWriter := io.Pipe()
+	digestsCh := make(chan map[string][sha256.Size]byte, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		digests, err := tarDigests(pipeReader)
+		// drain the rest, so dst is not blocked when the dump has a tail after the tar
+		_, _ = io.Copy(ioutil.Discard, pipeReader)
+		digestsCh <- digests
+		errCh <- err
+	}()
+
+	err = dst.Save(imageID, io.TeeReader(src, pipeWriter))
+	_ = pipeWriter.CloseWithError(err)
+	want, digestErr := <-digestsCh, <-errCh
+	if err != nil {
+		return fmt.Errorf("saving, %w", err)
+	}
+	if digestErr != nil {
+		return fmt.Errorf("reading the source dump, %w", digestErr)
+	}
+
+	loaded, err := dst.Load(imageID)
+	if err != nil {
+		return fmt.Errorf("loading the copy, %w", err)
+	}
+	defer loaded.Close()
+
+	got, err := tarDigests(loaded)
+	if err != nil {
+		return fmt.Errorf("reading the copy, %w", err)
+	}
+
+	return compareDigests(want, got)
+}
+
+// tarDigests returns sha256 of every regular file in the tar.
+func tarDigests(r io.Reader) (map[string][sha256.Size]byte, error) {
+	digests := map[string][sha256.Size]byte{}
+	tarReader := tar.NewReader(r)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return digests, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		hash := sha256.New()
+		if _, err = io.Copy(hash, tarReader); err != nil {
+			return nil, err
+		}
+		var sum [sha256.Size]byte
+		copy(sum[:], hash.Sum(nil))
+		digests[header.Name] = sum
+	}
+}
+
+func compareDigests(want, got map[string][sha256.Size]byte) error {
+	for name, sum := range want {
+		gotSum, ok := got[name]
+		if !ok {
+			return fmt.Errorf("verifying the copy, '%s' is missing", name) // nolint: goerr113
+		}
+		if !bytes.Equal(sum[:], gotSum[:]) {
+			return fmt.Errorf("verifying the copy, '%s' differs", name) // nolint: goerr113
+		}
+	}
+	if len(got) != len(want) {
+		return fmt.Errorf("verifying the copy, it has %d files instead of %d", len(got), len(want)) // nolint: goerr113
+	}
+
+	return nil
+}
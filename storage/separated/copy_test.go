@@ -0,0 +1,147 @@
+// nolint: goerr113
+package separated
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+)
+
+// memImgStorage keeps dumps in memory, transform changes a dump on Load.
+type memImgStorage struct {
+	imgStorageMock
+	dumps     map[string][]byte
+	transform func([]byte) []byte
+}
+
+func newMemImgStorage() *memImgStorage {
+	return &memImgStorage{dumps: map[string][]byte{}, transform: func(dump []byte) []byte { return dump }}
+}
+
+func (m *memImgStorage) Save(imgName string, imageDump io.Reader) error {
+	dump, err := ioutil.ReadAll(imageDump)
+	m.dumps[imgName] = dump
+
+	return err
+}
+
+func (m *memImgStorage) Load(imgName string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(m.transform(m.dumps[imgName]))), nil
+}
+
+func (m *memImgStorage) IsExist(imgName string) (bool, error) {
+	_, ok := m.dumps[imgName]
+
+	return ok, nil
+}
+
+func (m *memImgStorage) Remove(imgName string) error {
+	delete(m.dumps, imgName)
+
+	return nil
+}
+
+// makeDump writes names ending with / as directories.
+func makeDump(t *testing.T, files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		content := files[name]
+		if strings.HasSuffix(name, "/") {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0700, Typeflag: tar.TypeDir}))
+
+			continue
+		}
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	return buf.Bytes()
+}
+
+// readDump returns contents of regular files of the dump.
+func readDump(t *testing.T, dump io.Reader) map[string]string {
+	files := map[string]string{}
+	tr := tar.NewReader(dump)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		require.NoError(t, err)
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		content, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		files[header.Name] = string(content)
+	}
+}
+
+func TestStorage_CopyImagesTo(t *testing.T) {
+	files := map[string]string{"manifest.json": "[]", "layer/layer.tar": "layer"}
+	newStorage := func() *Storage {
+		metaCRUD := &metaCRUDMock{}
+		metaCRUD.On("GetAll").Return([]storage.Meta{{ImageName: "aa:1", ImageID: "aa"}, {ImageName: "aa:latest", ImageID: "aa"}}, nil)
+		src := newMemImgStorage()
+		src.dumps["aa"] = makeDump(t, files)
+
+		return &Storage{metaStorage: metaCRUD, imgStorage: src}
+	}
+
+	t.Run("repacked copy is valid", func(t *testing.T) {
+		dst := newMemImgStorage()
+		dst.transform = func([]byte) []byte {
+			// repacked dumps have entries of directories
+			return makeDump(t, map[string]string{"layer/": "", "layer/layer.tar": "layer", "manifest.json": "[]"})
+		}
+
+		require.NoError(t, newStorage().CopyImagesTo(dst))
+		require.Equal(t, makeDump(t, files), dst.dumps["aa"])
+		require.Len(t, dst.dumps, 1)
+	})
+
+	t.Run("changed file", func(t *testing.T) {
+		dst := newMemImgStorage()
+		dst.transform = func([]byte) []byte {
+			return makeDump(t, map[string]string{"manifest.json": "[]", "layer/layer.tar": "broken"})
+		}
+
+		err := newStorage().CopyImagesTo(dst)
+		require.EqualError(t, err, "copying 'aa', verifying the copy, 'layer/layer.tar' differs")
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		dst := newMemImgStorage()
+		dst.transform = func([]byte) []byte { return makeDump(t, map[string]string{"manifest.json": "[]"}) }
+
+		err := newStorage().CopyImagesTo(dst)
+		require.EqualError(t, err, "copying 'aa', verifying the copy, 'layer/layer.tar' is missing")
+	})
+
+	t.Run("extra file", func(t *testing.T) {
+		dst := newMemImgStorage()
+		dst.transform = func([]byte) []byte {
+			return makeDump(t, map[string]string{"manifest.json": "[]", "layer/layer.tar": "layer", "extra": "x"})
+		}
+
+		err := newStorage().CopyImagesTo(dst)
+		require.EqualError(t, err, "copying 'aa', verifying the copy, it has 3 files instead of 2")
+	})
+}
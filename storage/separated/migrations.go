@@ -0,0 +1,178 @@
+package separated
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+	"github.com/podtserkovskiy/garnerd/storage/schema"
+)
+
+// MetaSchemaComponent is a name of the storage.Meta schema in schema.json,
+// it is shared by all meta backends because migrations work through MetaCRUD.
+const MetaSchemaComponent = "meta"
+
+// ImageSchemaComponent is a name of the image keys schema in schema.json, it is shared by all image backends.
+const ImageSchemaComponent = "images"
+
+// MetaMigrations upgrade storage.Meta entries, MetaMigrations()[n] upgrades them from version n to n+1.
+func MetaMigrations(metaStorage MetaCRUD) []schema.Migration {
+	return []schema.Migration{
+		// entries written before versioning already have the first schema
+		{Description: "ImageName, ImageID and UpdatedAt", Up: metaStorage.Ping},
+		{Description: "image details and usage stats", Up: func() error { return backfillUsage(metaStorage) }},
+		{Description: "metas keyed by image name and platform", Up: func() error { return keyByPlatform(metaStorage) }},
+	}
+}
+
+// backfillUsage treats the last save of an image cached before usage stats as its first caching and last use.
+func backfillUsage(metaStorage MetaCRUD) error {
+	metas, err := metaStorage.GetAll()
+	if err != nil {
+		return err
+	}
+
+	for _, meta := range metas {
+		if !meta.FirstCachedAt.IsZero() {
+			continue
+		}
+		meta.FirstCachedAt, meta.LastUsedAt = meta.UpdatedAt, meta.UpdatedAt
+		if err = metaStorage.Set(meta); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// keyByPlatform moves metas with a known platform from the image name to Meta.Key().
+func keyByPlatform(metaStorage MetaCRUD) error {
+	metas, err := metaStorage.GetAll()
+	if err != nil {
+		return err
+	}
+
+	for _, meta := range metas {
+		if meta.Key() == meta.ImageName {
+			continue
+		}
+		if err = metaStorage.Set(meta); err != nil {
+			return err
+		}
+		if err = metaStorage.Remove(meta.ImageName); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// normalizeNames moves metas to their normalized image names, the newest save of a tag wins.
+// An interrupted run is finished by the next one.
+func normalizeNames(metaStorage MetaCRUD) error {
+	metas, err := metaStorage.GetAll()
+	if err != nil {
+		return err
+	}
+
+	for _, meta := range metas {
+		normalized := normalizeMeta(meta)
+		if normalized.Key() == meta.Key() {
+			continue
+		}
+
+		existing, err := metaStorage.Get(normalized.Key())
+		switch {
+		case errors.Is(err, storage.ErrNotFound) || err == nil && !existing.UpdatedAt.After(meta.UpdatedAt):
+			if err = metaStorage.Set(normalized); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		}
+		if err = metaStorage.Remove(meta.Key()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Migrations upgrade keys of images in the image storage, Migrations()[n] upgrades them from version n to n+1.
+// Names of metas are normalized only after images have been moved to their ImageIDs,
+// because image backends find images of older versions by the names they have been saved with.
+func (s *Storage) Migrations() []schema.Migration {
+	return []schema.Migration{
+		{Description: "an image per ImageID shared by its tags", Up: s.keyByImageID},
+		{Description: "normalized image references", Up: func() error { return normalizeNames(s.metaStorage) }},
+	}
+}
+
+// keyByImageID moves images stored per tag to their ImageID, copies of other tags are dropped.
+// An interrupted run is finished by the next one, images already stored by ImageID are not copied again.
+func (s *Storage) keyByImageID() error {
+	// saves committed before the upgrade are stored by tag too
+	if txStorage, ok := s.imgStorage.(TxImgStorage); ok {
+		if err := txStorage.Recover(s.commitMeta); err != nil {
+			return fmt.Errorf("recovering interrupted saves, %w", err)
+		}
+	}
+
+	metas, err := s.metaStorage.GetAll()
+	if err != nil {
+		return err
+	}
+
+	tagsByID := map[string][]string{}
+	for _, meta := range metas {
+		tagsByID[meta.ImageID] = append(tagsByID[meta.ImageID], meta.ImageName)
+	}
+
+	for imageID, tags := range tagsByID {
+		if err = s.moveToImageID(imageID, tags); err != nil {
+			return fmt.Errorf("moving '%s' to its image id, %w", imageID, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Storage) moveToImageID(imageID string, tags []string) error {
+	stored, err := s.imgStorage.IsExist(imageID)
+	if err != nil {
+		return err
+	}
+
+	legacy := []string{}
+	for _, tag := range tags {
+		exists, err := s.imgStorage.IsExist(tag)
+		if err != nil {
+			return err
+		}
+		if exists && tag != imageID {
+			legacy = append(legacy, tag)
+		}
+	}
+
+	if !stored && len(legacy) > 0 {
+		dump, err := s.imgStorage.Load(legacy[0])
+		if err != nil {
+			return err
+		}
+		err = s.imgStorage.Save(imageID, dump)
+		_ = dump.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, tag := range legacy {
+		if err = s.imgStorage.Remove(tag); err != nil {
+			log.Warnf("removing '%s' stored by tag, %s", tag, err)
+		}
+	}
+
+	return nil
+}
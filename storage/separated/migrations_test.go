@@ -0,0 +1,129 @@
+package separated
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+	"github.com/podtserkovskiy/garnerd/storage/meta/mem"
+	"github.com/podtserkovskiy/garnerd/storage/schema"
+)
+
+func TestBackfillUsage(t *testing.T) {
+	updated := time.Unix(23, 0)
+	metaCRUD := &metaCRUDMock{}
+	metaCRUD.On("GetAll").Return([]storage.Meta{
+		{ImageName: "old", UpdatedAt: updated},
+		{ImageName: "new", UpdatedAt: updated, FirstCachedAt: time.Unix(1, 0)},
+	}, nil)
+	metaCRUD.On("Set", mock.MatchedBy(func(meta storage.Meta) bool {
+		return meta.ImageName == "old" && meta.FirstCachedAt.Equal(updated) && meta.LastUsedAt.Equal(updated)
+	})).Return(nil).Once()
+
+	require.NoError(t, backfillUsage(metaCRUD))
+	metaCRUD.AssertExpectations(t)
+}
+
+func TestKeyByPlatform(t *testing.T) {
+	arm := storage.Meta{ImageName: "a:1", ImageID: "id-a", OS: "linux", Architecture: "arm64"}
+	metaCRUD := &metaCRUDMock{}
+	metaCRUD.On("GetAll").Return([]storage.Meta{arm, {ImageName: "old:1", ImageID: "id-old"}}, nil)
+	metaCRUD.On("Set", arm).Return(nil).Once()
+	metaCRUD.On("Remove", "a:1").Return(nil).Once()
+
+	require.NoError(t, keyByPlatform(metaCRUD))
+	metaCRUD.AssertExpectations(t)
+}
+
+func TestStorage_keyByImageID(t *testing.T) {
+	metaCRUD := &metaCRUDMock{}
+	metaCRUD.On("GetAll").Return([]storage.Meta{
+		{ImageName: "a:1", ImageID: "id-a"},
+		{ImageName: "a:latest", ImageID: "id-a"},
+		{ImageName: "b:1", ImageID: "id-b"},
+		// moved by an interrupted run
+		{ImageName: "c:1", ImageID: "id-c"},
+	}, nil)
+	imgStorage := newMemImgStorage()
+	imgStorage.dumps["a:1"] = []byte("a")
+	imgStorage.dumps["a:latest"] = []byte("a")
+	imgStorage.dumps["b:1"] = []byte("b")
+	imgStorage.dumps["c:1"] = []byte("c")
+	imgStorage.dumps["id-c"] = []byte("c")
+
+	stor := &Storage{metaStorage: metaCRUD, imgStorage: imgStorage}
+	require.NoError(t, stor.keyByImageID())
+	require.Equal(t, map[string][]byte{"id-a": []byte("a"), "id-b": []byte("b"), "id-c": []byte("c")}, imgStorage.dumps)
+}
+
+func TestNormalizeNames(t *testing.T) {
+	metaCRUD := mem.NewMetaCRUD()
+	for _, meta := range []storage.Meta{
+		{ImageName: "ubuntu", ImageID: "id-old", UpdatedAt: time.Unix(1, 0)},
+		{ImageName: "ubuntu:latest", ImageID: "id-new", UpdatedAt: time.Unix(2, 0)},
+		{ImageName: "docker.io/library/alpine:3", ImageID: "id-a", OS: "linux", Architecture: "amd64"},
+		{ImageName: "b:1", ImageID: "id-b"},
+	} {
+		require.NoError(t, metaCRUD.Set(meta))
+	}
+
+	require.NoError(t, normalizeNames(metaCRUD))
+	metas, err := metaCRUD.GetAll()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []storage.Meta{
+		{ImageName: "ubuntu:latest", ImageID: "id-new", UpdatedAt: time.Unix(2, 0)},
+		{ImageName: "alpine:3", ImageID: "id-a", OS: "linux", Architecture: "amd64"},
+		{ImageName: "b:1", ImageID: "id-b"},
+	}, metas)
+}
+
+// crashingImgStorage fails saves of the image as if garnerd has crashed.
+type crashingImgStorage struct {
+	*memImgStorage
+	crashOn string
+}
+
+func (c *crashingImgStorage) Save(imgName string, imageDump io.Reader) error {
+	if imgName == c.crashOn {
+		return errors.New("crash") // nolint: goerr113
+	}
+
+	return c.memImgStorage.Save(imgName, imageDump)
+}
+
+func TestStorage_InterruptedMigrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	metaCRUD := mem.NewMetaCRUD()
+	require.NoError(t, metaCRUD.Set(storage.Meta{ImageName: "ubuntu", ImageID: "id-u"}))
+	require.NoError(t, metaCRUD.Set(storage.Meta{ImageName: "docker.io/library/b:1", ImageID: "id-b"}))
+	// images of older versions are stored by the names they have been saved with
+	imgStorage := &crashingImgStorage{memImgStorage: newMemImgStorage(), crashOn: "id-u"}
+	imgStorage.dumps["ubuntu"] = []byte("u")
+	imgStorage.dumps["docker.io/library/b:1"] = []byte("b")
+
+	migrate := func() error {
+		if err := schema.Migrate(dir, MetaSchemaComponent, MetaMigrations(metaCRUD)); err != nil {
+			return err
+		}
+
+		return schema.Migrate(dir, ImageSchemaComponent, NewStorage(metaCRUD, imgStorage).Migrations())
+	}
+	require.Error(t, migrate())
+
+	imgStorage.crashOn = ""
+	require.NoError(t, migrate())
+	require.Equal(t, map[string][]byte{"id-u": []byte("u"), "id-b": []byte("b")}, imgStorage.dumps)
+	metas, err := metaCRUD.GetAll()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []storage.Meta{{ImageName: "ubuntu:latest", ImageID: "id-u"}, {ImageName: "b:1", ImageID: "id-b"}}, metas)
+}
@@ -0,0 +1,26 @@
+package separated
+
+import (
+	"strings"
+
+	"github.com/podtserkovskiy/garnerd/docker"
+	"github.com/podtserkovskiy/garnerd/storage"
+)
+
+// normalizeKey normalizes the image name of Meta.Key(), the platform is kept.
+func normalizeKey(key string) string {
+	name, platform := key, ""
+	if n := strings.IndexByte(key, ' '); n >= 0 {
+		name, platform = key[:n], key[n:]
+	}
+
+	return docker.NormalizeNameOrKeep(name) + platform
+}
+
+// normalizeMeta turns the image name into the cache key form, so every caller shares one entry per image,
+// e.g. ubuntu and docker.io/library/ubuntu:latest.
+func normalizeMeta(meta storage.Meta) storage.Meta {
+	meta.ImageName = docker.NormalizeNameOrKeep(meta.ImageName)
+
+	return meta
+}
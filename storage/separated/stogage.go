@@ -2,17 +2,23 @@ package separated
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"sync"
 	"time"
 
+	log "github.com/sirupsen/logrus"
+
 	"github.com/podtserkovskiy/garnerd/storage"
 )
 
+// MetaCRUD stores metas by Meta.Key().
 type MetaCRUD interface {
 	Set(entry storage.Meta) error
-	Get(imageName string) (storage.Meta, error)
-	Remove(imageName string) error
+	Get(key string) (storage.Meta, error)
+	Remove(key string) error
 	GetAll() ([]storage.Meta, error)
 	Ping() error
 }
@@ -26,47 +32,324 @@ type ImgStorage interface {
 	Ping() error
 }
 
+// TxImgStorage saves an image and a payload atomically,
+// commit is called with the payload once the image is in place and again on Recover after a crash.
+type TxImgStorage interface {
+	SaveTx(imgName string, imageDump io.Reader, payload []byte, commit func(payload []byte) error) error
+	Recover(commit func(payload []byte) error) error
+}
+
+// SizedImgStorage tells how much space an image takes in the storage.
+type SizedImgStorage interface {
+	DiskSize(imgName string) (int64, error)
+}
+
 type Storage struct {
 	metaStorage MetaCRUD
 	imgStorage  ImgStorage
+	// metaMu serializes read-modify-write updates of metas
+	metaMu sync.Mutex
 }
 
+// NewStorage stores metas of images in metaStorage and images in imgStorage,
+// image names of metas and keys are normalized like references from the daemon.
 func NewStorage(metaStorage MetaCRUD, imgStorage ImgStorage) *Storage {
 	return &Storage{metaStorage: metaStorage, imgStorage: imgStorage}
 }
 
-func (s *Storage) Save(imageName, imageID string, imageDump io.Reader) error {
-	if err := s.imgStorage.Save(imageName, imageDump); err != nil {
+// errRemovedMeanwhile is returned by a save whose image has been removed with the last other tag meanwhile.
+var errRemovedMeanwhile = errors.New("the image has been removed by a concurrent remove of its last tag")
+
+// Save stores the image once per ImageID and then the meta of its tag, usage stats of the already cached tag are kept.
+// If the image storage supports transactions, the meta is committed together with the image.
+// The image the tag has been moved from is removed if no other tag refers to it.
+func (s *Storage) Save(meta storage.Meta, imageDump io.Reader) error {
+	meta, prevImageID, err := s.withUsage(normalizeMeta(meta))
+	if err != nil {
 		return err
 	}
 
-	err := s.metaStorage.Set(storage.Meta{
-		ImageName: imageName,
-		ImageID:   imageID,
-		UpdatedAt: time.Now(),
+	if txStorage, ok := s.imgStorage.(TxImgStorage); ok {
+		payload, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+
+		// the tag may have been moved meanwhile, the image it has right before the commit is the one orphaned
+		commit := func(payload []byte) error {
+			if prev, err := s.metaStorage.Get(meta.Key()); err == nil {
+				prevImageID = prev.ImageID
+			}
+
+			return s.commitMeta(payload)
+		}
+		if err = txStorage.SaveTx(meta.ImageID, imageDump, payload, commit); err != nil {
+			return err
+		}
+
+		s.metaMu.Lock()
+		defer s.metaMu.Unlock()
+
+		// Remove decides on the image under metaMu, a tag committed after its decision is dropped here
+		if err = s.requireStored(meta); err != nil {
+			return err
+		}
+		if err = s.removeOrphan(prevImageID, meta.ImageID); err != nil {
+			return err
+		}
+
+		// the size is known only when the image is in place, so it is not a part of the transaction
+		size, ok := s.compressedSize(meta.ImageID)
+		if !ok {
+			return nil
+		}
+		committed, err := s.metaStorage.Get(meta.Key())
+		if err != nil {
+			return err
+		}
+		committed.CompressedSize = size
+
+		return s.setMeta(committed)
+	}
+
+	if err := s.imgStorage.Save(meta.ImageID, imageDump); err != nil {
+		return err
+	}
+	meta.CompressedSize, _ = s.compressedSize(meta.ImageID)
+
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+
+	if err = s.requireStored(meta); err != nil {
+		return err
+	}
+	// the tag may have been moved meanwhile, the current image of the tag is the one orphaned
+	if _, prevImageID, err = s.withUsage(meta); err != nil {
+		return err
+	}
+	if err = s.setMeta(meta); err != nil {
+		return err
+	}
+
+	return s.removeOrphan(prevImageID, meta.ImageID)
+}
+
+// requireStored returns errRemovedMeanwhile and drops the meta if the image of the tag is not stored anymore.
+// It has to be called under metaMu.
+func (s *Storage) requireStored(meta storage.Meta) error {
+	exists, err := s.imgStorage.IsExist(meta.ImageID)
+	if err != nil || exists {
+		return err
+	}
+
+	committed, err := s.metaStorage.Get(meta.Key())
+	if err == nil && committed.ImageID == meta.ImageID {
+		if err = s.metaStorage.Remove(meta.Key()); err != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("saving '%s', %w", meta.ImageName, errRemovedMeanwhile)
+}
+
+// SaveTag adds a tag to the already stored image, it returns storage.ErrNotFound if the image is not stored.
+// The check and the meta are done under metaMu, so a concurrent Remove can't drop the image in between.
+func (s *Storage) SaveTag(meta storage.Meta) error {
+	meta = normalizeMeta(meta)
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+
+	exists, err := s.imgStorage.IsExist(meta.ImageID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return storage.ErrNotFound
+	}
+
+	meta, prevImageID, err := s.withUsage(meta)
+	if err != nil {
+		return err
+	}
+	meta.CompressedSize, _ = s.compressedSize(meta.ImageID)
+	if err = s.setMeta(meta); err != nil {
+		return err
+	}
+
+	return s.removeOrphan(prevImageID, meta.ImageID)
+}
+
+// withUsage sets save times and keeps usage stats of the tag, it also returns the ImageID the tag has had.
+func (s *Storage) withUsage(meta storage.Meta) (storage.Meta, string, error) {
+	now := time.Now()
+	meta.UpdatedAt, meta.FirstCachedAt = now, now
+	prev, err := s.metaStorage.Get(meta.Key())
+	switch {
+	case err == nil:
+		meta.FirstCachedAt = prev.FirstCachedAt
+		meta.LastUsedAt, meta.LastRestoredAt, meta.HitCount = prev.LastUsedAt, prev.LastRestoredAt, prev.HitCount
+	case !errors.Is(err, storage.ErrNotFound):
+		return storage.Meta{}, "", fmt.Errorf("getting metadata, %w", err)
+	}
+
+	return meta, prev.ImageID, nil
+}
+
+// removeOrphan removes the image a tag has been moved from unless other tags refer to it, like Remove does.
+// It has to be called under metaMu after the meta of the moved tag is stored.
+func (s *Storage) removeOrphan(prevImageID, imageID string) error {
+	if prevImageID == "" || prevImageID == imageID {
+		return nil
+	}
+
+	tags, err := s.tagsOf(prevImageID)
+	if err != nil || len(tags) > 0 {
+		return err
+	}
+
+	return s.imgStorage.Remove(prevImageID)
+}
+
+// MarkUsed counts a hit of the image.
+func (s *Storage) MarkUsed(key string) error {
+	return s.updateMeta(key, func(meta *storage.Meta) {
+		meta.HitCount++
+		meta.LastUsedAt = time.Now()
 	})
+}
+
+// MarkRestored records that the image has been loaded back into the daemon.
+func (s *Storage) MarkRestored(key string) error {
+	return s.updateMeta(key, func(meta *storage.Meta) {
+		meta.LastRestoredAt = time.Now()
+	})
+}
+
+func (s *Storage) updateMeta(key string, update func(meta *storage.Meta)) error {
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+
+	meta, err := s.metaStorage.Get(normalizeKey(key))
+	if err != nil {
+		return err
+	}
+	update(&meta)
+
+	return s.setMeta(meta)
+}
+
+// compressedSize returns the size of the image in the storage, if the image storage can tell it.
+func (s *Storage) compressedSize(imageName string) (int64, bool) {
+	sized, ok := s.imgStorage.(SizedImgStorage)
+	if !ok {
+		return 0, false
+	}
+
+	size, err := sized.DiskSize(imageName)
 	if err != nil {
+		log.Warnf("measuring '%s', %s", imageName, err)
+
+		return 0, false
+	}
+
+	return size, true
+}
+
+func (s *Storage) commitMeta(payload []byte) error {
+	var meta storage.Meta
+	if err := json.Unmarshal(payload, &meta); err != nil {
+		return fmt.Errorf("decoding metadata, %w", err)
+	}
+
+	return s.setMeta(meta)
+}
+
+func (s *Storage) setMeta(meta storage.Meta) error {
+	if err := s.metaStorage.Set(meta); err != nil {
 		return fmt.Errorf("saving metadata, %w", err)
 	}
 
 	return nil
 }
 
-func (s *Storage) Load(imageName string) (io.ReadCloser, error) {
-	return s.imgStorage.Load(imageName)
+// Load returns the image of the tag, the dump restores every cached tag of the image.
+func (s *Storage) Load(key string) (io.ReadCloser, error) {
+	meta, err := s.metaStorage.Get(normalizeKey(key))
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := s.tagsOf(meta.ImageID)
+	if err != nil {
+		return nil, err
+	}
+
+	dump, err := s.imgStorage.Load(meta.ImageID)
+	if err != nil {
+		return nil, err
+	}
+
+	return withRepoTags(dump, repoTags(tags)), nil
 }
 
-func (s *Storage) Remove(imageName string) error {
-	err := s.metaStorage.Remove(imageName)
+// Remove drops the tag, the image is removed with its last tag.
+// Tags are checked and the image is removed under metaMu, saves check their images under it afterwards.
+func (s *Storage) Remove(key string) error {
+	key = normalizeKey(key)
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+
+	meta, err := s.metaStorage.Get(key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
-	return s.imgStorage.Remove(imageName)
+	if err = s.metaStorage.Remove(key); err != nil {
+		return err
+	}
+
+	tags, err := s.tagsOf(meta.ImageID)
+	if err != nil {
+		return err
+	}
+	if len(tags) > 0 {
+		return nil
+	}
+
+	return s.imgStorage.Remove(meta.ImageID)
+}
+
+// MetaByImageID is a MetaCRUD which finds tags of an image without GetAll.
+type MetaByImageID interface {
+	ByImageID(imageID string) ([]storage.Meta, error)
+}
+
+// tagsOf returns metas of all tags of the image.
+func (s *Storage) tagsOf(imageID string) ([]storage.Meta, error) {
+	if index, ok := s.metaStorage.(MetaByImageID); ok {
+		return index.ByImageID(imageID)
+	}
+
+	metas, err := s.metaStorage.GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	tags := []storage.Meta{}
+	for _, meta := range metas {
+		if meta.ImageID == imageID {
+			tags = append(tags, meta)
+		}
+	}
+
+	return tags, nil
 }
 
-func (s *Storage) GetMeta(imageName string) (storage.Meta, error) {
-	return s.metaStorage.Get(imageName)
+func (s *Storage) GetMeta(key string) (storage.Meta, error) {
+	return s.metaStorage.Get(normalizeKey(key))
 }
 
 func (s *Storage) GetAllMeta() ([]storage.Meta, error) {
@@ -94,25 +377,31 @@ func (s *Storage) Wait(ctx context.Context) error {
 	}
 }
 
-// CleanUp removes not paired images and metas.
+// CleanUp finishes interrupted saves and removes images without tags and tags without images.
 func (s *Storage) CleanUp(ctx context.Context) error {
+	if txStorage, ok := s.imgStorage.(TxImgStorage); ok {
+		if err := txStorage.Recover(s.commitMeta); err != nil {
+			return fmt.Errorf("recovering interrupted saves, %w", err)
+		}
+	}
+
 	metas, err := s.metaStorage.GetAll()
 	if err != nil {
 		return err
 	}
 
-	imageNames := make([]string, 0, len(metas))
+	imageIDs := make([]string, 0, len(metas))
 	for _, meta := range metas {
-		imageNames = append(imageNames, meta.ImageName)
+		imageIDs = append(imageIDs, meta.ImageID)
 	}
 
-	err = s.imgStorage.RemoveNotIn(imageNames)
+	err = s.imgStorage.RemoveNotIn(imageIDs)
 	if err != nil {
 		return err
 	}
 
 	for _, meta := range metas {
-		isExist, err := s.imgStorage.IsExist(meta.ImageName)
+		isExist, err := s.imgStorage.IsExist(meta.ImageID)
 		if err != nil {
 			return err
 		}
@@ -121,10 +410,9 @@ func (s *Storage) CleanUp(ctx context.Context) error {
 			continue
 		}
 
-		if err := s.metaStorage.Remove(meta.ImageName); err != nil {
+		if err := s.metaStorage.Remove(meta.Key()); err != nil {
 			return err
 		}
 	}
-
 	return nil
 }
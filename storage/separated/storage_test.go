@@ -6,12 +6,16 @@ import (
 	"context"
 	"errors"
 	"io"
+	"io/ioutil"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 
 	"github.com/podtserkovskiy/garnerd/storage"
+	imgmem "github.com/podtserkovskiy/garnerd/storage/image/mem"
+	"github.com/podtserkovskiy/garnerd/storage/meta/mem"
 )
 
 type metaCRUDMock struct {
@@ -49,6 +53,14 @@ func (m *metaCRUDMock) Ping() error {
 	return args.Error(0)
 }
 
+// newMetaCRUDMock has no metas.
+func newMetaCRUDMock() *metaCRUDMock {
+	metaCRUD := &metaCRUDMock{}
+	metaCRUD.On("Get", mock.Anything).Return(storage.Meta{}, storage.ErrNotFound)
+
+	return metaCRUD
+}
+
 type imgStorageMock struct {
 	mock.Mock
 }
@@ -90,6 +102,31 @@ func (m *imgStorageMock) Ping() error {
 	return args.Error(0)
 }
 
+type txImgStorageMock struct {
+	imgStorageMock
+}
+
+func (m *txImgStorageMock) SaveTx(imgName string, imageDump io.Reader, payload []byte, commit func([]byte) error) error {
+	args := m.Called(imgName, imageDump, payload)
+	if err := args.Error(0); err != nil {
+		return err
+	}
+
+	return commit(payload)
+}
+
+func (m *txImgStorageMock) Recover(commit func([]byte) error) error {
+	args := m.Called()
+	payload, _ := args.Get(0).([]byte)
+	if payload != nil {
+		if err := commit(payload); err != nil {
+			return err
+		}
+	}
+
+	return args.Error(1)
+}
+
 func TestStorage_CleanUp(t *testing.T) {
 	t.Run("MetaCRUD.GetAll returns error", func(t *testing.T) {
 		metaCRUD := &metaCRUDMock{}
@@ -103,8 +140,8 @@ func TestStorage_CleanUp(t *testing.T) {
 	t.Run("ImgStorage.RemoveNotIn receives correct images list ", func(t *testing.T) {
 		metaCRUD := &metaCRUDMock{}
 		imgStorage := &imgStorageMock{}
-		metaCRUD.On("GetAll").Return([]storage.Meta{{ImageName: "a"}, {ImageName: "b"}}, nil)
-		imgStorage.On("RemoveNotIn", []string{"a", "b"}).Return(errors.New("some err"))
+		metaCRUD.On("GetAll").Return([]storage.Meta{{ImageName: "a", ImageID: "id-a"}, {ImageName: "b", ImageID: "id-b"}}, nil)
+		imgStorage.On("RemoveNotIn", []string{"id-a", "id-b"}).Return(errors.New("some err"))
 
 		stor := &Storage{metaStorage: metaCRUD, imgStorage: imgStorage}
 		_ = stor.CleanUp(context.Background())
@@ -149,9 +186,9 @@ func TestStorage_CleanUp(t *testing.T) {
 	t.Run("image has been deleted", func(t *testing.T) {
 		metaCRUD := &metaCRUDMock{}
 		imgStorage := &imgStorageMock{}
-		metaCRUD.On("GetAll").Return([]storage.Meta{{ImageName: "a"}}, nil)
+		metaCRUD.On("GetAll").Return([]storage.Meta{{ImageName: "a", ImageID: "id-a"}}, nil)
 		imgStorage.On("RemoveNotIn", mock.Anything).Return(nil)
-		imgStorage.On("IsExist", mock.Anything).Return(false, nil)
+		imgStorage.On("IsExist", "id-a").Return(false, nil)
 		metaCRUD.On("Remove", "a").Return(nil)
 
 		stor := &Storage{metaStorage: metaCRUD, imgStorage: imgStorage}
@@ -159,6 +196,30 @@ func TestStorage_CleanUp(t *testing.T) {
 		require.NoError(t, err)
 	})
 
+	t.Run("TxImgStorage.Recover returns an error", func(t *testing.T) {
+		imgStorage := &txImgStorageMock{}
+		imgStorage.On("Recover").Return(nil, errors.New("some err"))
+
+		stor := &Storage{metaStorage: &metaCRUDMock{}, imgStorage: imgStorage}
+		err := stor.CleanUp(context.Background())
+		require.EqualError(t, err, "recovering interrupted saves, some err")
+	})
+
+	t.Run("TxImgStorage.Recover commits meta of interrupted saves", func(t *testing.T) {
+		metaCRUD := &metaCRUDMock{}
+		imgStorage := &txImgStorageMock{}
+		imgStorage.On("Recover").Return([]byte(`{"ImageName":"a","ImageID":"id-a"}`), nil)
+		metaCRUD.On("Set", storage.Meta{ImageName: "a", ImageID: "id-a"}).Return(nil)
+		metaCRUD.On("GetAll").Return([]storage.Meta{{ImageName: "a", ImageID: "id-a"}}, nil)
+		imgStorage.On("RemoveNotIn", []string{"id-a"}).Return(nil)
+		imgStorage.On("IsExist", "id-a").Return(true, nil)
+
+		stor := &Storage{metaStorage: metaCRUD, imgStorage: imgStorage}
+		err := stor.CleanUp(context.Background())
+		require.NoError(t, err)
+		metaCRUD.AssertExpectations(t)
+	})
+
 	t.Run("image has not been deleted", func(t *testing.T) {
 		metaCRUD := &metaCRUDMock{}
 		imgStorage := &imgStorageMock{}
@@ -225,20 +286,47 @@ func TestStorage_GetAllMeta(t *testing.T) {
 }
 
 func TestStorage_Load(t *testing.T) {
+	t.Run("meta returns an error", func(t *testing.T) {
+		stor := &Storage{metaStorage: newMetaCRUDMock(), imgStorage: &imgStorageMock{}}
+		_, err := stor.Load("a:1")
+		require.Equal(t, storage.ErrNotFound, err)
+	})
+
 	t.Run("storage returns an error", func(t *testing.T) {
+		metaCRUD := &metaCRUDMock{}
+		metaCRUD.On("Get", "a:1").Return(storage.Meta{ImageName: "a:1", ImageID: "id-a"}, nil)
+		metaCRUD.On("GetAll").Return([]storage.Meta{{ImageName: "a:1", ImageID: "id-a"}}, nil)
 		imgStorage := &imgStorageMock{}
-		imgStorage.On("Load", mock.Anything).Return(nil, errors.New("some err"))
-		stor := &Storage{metaStorage: nil, imgStorage: imgStorage}
-		_, err := stor.Load("")
-		require.Error(t, err)
+		imgStorage.On("Load", "id-a").Return(nil, errors.New("some err"))
+		stor := &Storage{metaStorage: metaCRUD, imgStorage: imgStorage}
+		_, err := stor.Load("a:1")
+		require.EqualError(t, err, "some err")
 	})
 
-	t.Run("success", func(t *testing.T) {
+	t.Run("dump restores every tag of the image", func(t *testing.T) {
+		metaCRUD := &metaCRUDMock{}
+		metaCRUD.On("Get", "a:1").Return(storage.Meta{ImageName: "a:1", ImageID: "id-a"}, nil)
+		metaCRUD.On("GetAll").Return([]storage.Meta{
+			{ImageName: "a:latest", ImageID: "id-a"},
+			{ImageName: "a:1", ImageID: "id-a"},
+			{ImageName: "a@sha256:0000000000000000000000000000000000000000000000000000000000000001", ImageID: "id-a"},
+			{ImageName: "b:1", ImageID: "id-b"},
+		}, nil)
 		imgStorage := &imgStorageMock{}
-		imgStorage.On("Load", mock.Anything).Return(nil, nil)
-		stor := &Storage{metaStorage: nil, imgStorage: imgStorage}
-		_, err := stor.Load("")
+		dump := makeDump(t, map[string]string{
+			"config.json":   "{}",
+			"manifest.json": `[{"Config":"config.json","RepoTags":["a:1"],"Layers":[]}]`,
+		})
+		imgStorage.On("Load", "id-a").Return(ioutil.NopCloser(bytes.NewReader(dump)), nil)
+
+		stor := &Storage{metaStorage: metaCRUD, imgStorage: imgStorage}
+		rc, err := stor.Load("a:1")
 		require.NoError(t, err)
+		defer rc.Close()
+
+		files := readDump(t, rc)
+		require.Equal(t, "{}", files["config.json"])
+		require.JSONEq(t, `[{"Config":"config.json","RepoTags":["a:1","a:latest"],"Layers":[]}]`, files["manifest.json"])
 	})
 }
 
@@ -261,69 +349,298 @@ func TestStorage_GetMeta(t *testing.T) {
 }
 
 func TestStorage_Remove(t *testing.T) {
+	t.Run("unknown image", func(t *testing.T) {
+		stor := &Storage{metaStorage: newMetaCRUDMock(), imgStorage: &imgStorageMock{}}
+		require.NoError(t, stor.Remove("a:1"))
+	})
+
 	t.Run("meta returns an error", func(t *testing.T) {
 		metaCRUD := &metaCRUDMock{}
+		metaCRUD.On("Get", "a:1").Return(storage.Meta{ImageName: "a:1", ImageID: "id-a"}, nil)
 		metaCRUD.On("Remove", mock.Anything).Return(errors.New("meta err"))
 		imgStorage := &imgStorageMock{}
 		stor := &Storage{metaStorage: metaCRUD, imgStorage: imgStorage}
-		err := stor.Remove("")
+		err := stor.Remove("a:1")
 		require.EqualError(t, err, "meta err")
 	})
 
 	t.Run("img returns an error", func(t *testing.T) {
 		metaCRUD := &metaCRUDMock{}
+		metaCRUD.On("Get", "a:1").Return(storage.Meta{ImageName: "a:1", ImageID: "id-a"}, nil)
 		metaCRUD.On("Remove", mock.Anything).Return(nil)
+		metaCRUD.On("GetAll").Return(nil, nil)
 		imgStorage := &imgStorageMock{}
 		imgStorage.On("Remove", mock.Anything).Return(errors.New("img err"))
 		stor := &Storage{metaStorage: metaCRUD, imgStorage: imgStorage}
-		err := stor.Remove("")
+		err := stor.Remove("a:1")
 		require.EqualError(t, err, "img err")
 	})
 
-	t.Run("success", func(t *testing.T) {
+	t.Run("the last tag removes the image", func(t *testing.T) {
 		metaCRUD := &metaCRUDMock{}
-		metaCRUD.On("Remove", mock.Anything).Return(nil)
+		metaCRUD.On("Get", "a:1").Return(storage.Meta{ImageName: "a:1", ImageID: "id-a"}, nil)
+		metaCRUD.On("Remove", "a:1").Return(nil).Once()
+		metaCRUD.On("GetAll").Return([]storage.Meta{{ImageName: "b:1", ImageID: "id-b"}}, nil)
 		imgStorage := &imgStorageMock{}
-		imgStorage.On("Remove", mock.Anything).Return(nil)
+		imgStorage.On("Remove", "id-a").Return(nil).Once()
 		stor := &Storage{metaStorage: metaCRUD, imgStorage: imgStorage}
-		err := stor.Remove("")
-		require.NoError(t, err)
+		require.NoError(t, stor.Remove("a:1"))
+		metaCRUD.AssertExpectations(t)
+		imgStorage.AssertExpectations(t)
+	})
+
+	t.Run("the image is kept while it has other tags", func(t *testing.T) {
+		metaCRUD := &metaCRUDMock{}
+		metaCRUD.On("Get", "a:1").Return(storage.Meta{ImageName: "a:1", ImageID: "id-a"}, nil)
+		metaCRUD.On("Remove", "a:1").Return(nil).Once()
+		metaCRUD.On("GetAll").Return([]storage.Meta{{ImageName: "a:latest", ImageID: "id-a"}}, nil)
+		imgStorage := &imgStorageMock{}
+		stor := &Storage{metaStorage: metaCRUD, imgStorage: imgStorage}
+		require.NoError(t, stor.Remove("a:1"))
+		metaCRUD.AssertExpectations(t)
+		imgStorage.AssertNotCalled(t, "Remove", mock.Anything)
+	})
+}
+
+func TestStorage_SaveTag(t *testing.T) {
+	t.Run("image is not stored", func(t *testing.T) {
+		imgStorage := &imgStorageMock{}
+		imgStorage.On("IsExist", "id-a").Return(false, nil)
+		stor := &Storage{metaStorage: newMetaCRUDMock(), imgStorage: imgStorage}
+		err := stor.SaveTag(storage.Meta{ImageName: "a:latest", ImageID: "id-a"})
+		require.Equal(t, storage.ErrNotFound, err)
+	})
+
+	t.Run("img returns an error", func(t *testing.T) {
+		imgStorage := &imgStorageMock{}
+		imgStorage.On("IsExist", "id-a").Return(false, errors.New("img err"))
+		stor := &Storage{metaStorage: newMetaCRUDMock(), imgStorage: imgStorage}
+		err := stor.SaveTag(storage.Meta{ImageName: "a:latest", ImageID: "id-a"})
+		require.EqualError(t, err, "img err")
+	})
+
+	t.Run("tag is added to the stored image", func(t *testing.T) {
+		metaCRUD := newMetaCRUDMock()
+		metaCRUD.On("Set", mock.MatchedBy(func(meta storage.Meta) bool {
+			return meta.ImageName == "a:latest" && meta.ImageID == "id-a" && meta.CompressedSize == 7 && !meta.FirstCachedAt.IsZero()
+		})).Return(nil).Once()
+		imgStorage := &sizedImgStorageMock{}
+		imgStorage.On("IsExist", "id-a").Return(true, nil)
+		imgStorage.On("DiskSize", "id-a").Return(int64(7), nil)
+
+		stor := &Storage{metaStorage: metaCRUD, imgStorage: imgStorage}
+		require.NoError(t, stor.SaveTag(storage.Meta{ImageName: "a:latest", ImageID: "id-a"}))
+		metaCRUD.AssertExpectations(t)
+		imgStorage.AssertNotCalled(t, "Save", mock.Anything, mock.Anything)
 	})
 }
 
 func TestStorage_Save(t *testing.T) {
 	t.Run("img returns an error", func(t *testing.T) {
-		metaCRUD := &metaCRUDMock{}
+		metaCRUD := newMetaCRUDMock()
 		imgStorage := &imgStorageMock{}
 		reader := bytes.NewBufferString("cc")
-		imgStorage.On("Save", "aa", reader).Return(errors.New("img err"))
+		imgStorage.On("Save", "bb", reader).Return(errors.New("img err"))
 
 		stor := &Storage{metaStorage: metaCRUD, imgStorage: imgStorage}
-		err := stor.Save("aa", "bb", reader)
+		err := stor.Save(storage.Meta{ImageName: "aa:1", ImageID: "bb"}, reader)
 		require.EqualError(t, err, "img err")
 	})
 
 	t.Run("meta returns an error", func(t *testing.T) {
-		metaCRUD := &metaCRUDMock{}
+		metaCRUD := newMetaCRUDMock()
 		imgStorage := &imgStorageMock{}
 		reader := bytes.NewBufferString("cc")
-		imgStorage.On("Save", "aa", reader).Return(nil)
+		imgStorage.On("Save", "bb", reader).Return(nil)
+		imgStorage.On("IsExist", "bb").Return(true, nil)
 		metaCRUD.On("Set", mock.Anything).Return(errors.New("meta err"))
 
 		stor := &Storage{metaStorage: metaCRUD, imgStorage: imgStorage}
-		err := stor.Save("aa", "bb", reader)
+		err := stor.Save(storage.Meta{ImageName: "aa:1", ImageID: "bb"}, reader)
 		require.EqualError(t, err, "saving metadata, meta err")
 	})
 
 	t.Run("success", func(t *testing.T) {
-		metaCRUD := &metaCRUDMock{}
+		metaCRUD := newMetaCRUDMock()
 		imgStorage := &imgStorageMock{}
 		reader := bytes.NewBufferString("cc")
-		imgStorage.On("Save", "aa", reader).Return(nil)
+		imgStorage.On("Save", "bb", reader).Return(nil)
+		imgStorage.On("IsExist", "bb").Return(true, nil)
 		metaCRUD.On("Set", mock.Anything).Return(nil)
 
 		stor := &Storage{metaStorage: metaCRUD, imgStorage: imgStorage}
-		err := stor.Save("aa", "bb", reader)
+		err := stor.Save(storage.Meta{ImageName: "aa:1", ImageID: "bb"}, reader)
 		require.NoError(t, err)
 	})
+
+	t.Run("image removed by a concurrent remove", func(t *testing.T) {
+		metaCRUD := newMetaCRUDMock()
+		imgStorage := &imgStorageMock{}
+		reader := bytes.NewBufferString("cc")
+		imgStorage.On("Save", "bb", reader).Return(nil)
+		imgStorage.On("IsExist", "bb").Return(false, nil)
+
+		stor := &Storage{metaStorage: metaCRUD, imgStorage: imgStorage}
+		err := stor.Save(storage.Meta{ImageName: "aa:1", ImageID: "bb"}, reader)
+		require.True(t, errors.Is(err, errRemovedMeanwhile), err)
+		metaCRUD.AssertNotCalled(t, "Set", mock.Anything)
+	})
+
+	t.Run("tx: committed meta of a removed image is dropped", func(t *testing.T) {
+		metaCRUD := &metaCRUDMock{}
+		metaCRUD.On("Get", "aa:1").Return(storage.Meta{}, storage.ErrNotFound).Twice()
+		metaCRUD.On("Set", mock.Anything).Return(nil).Once()
+		metaCRUD.On("Get", "aa:1").Return(storage.Meta{ImageName: "aa:1", ImageID: "bb"}, nil).Once()
+		metaCRUD.On("Remove", "aa:1").Return(nil).Once()
+		imgStorage := &txImgStorageMock{}
+		reader := bytes.NewBufferString("cc")
+		imgStorage.On("SaveTx", "bb", reader, mock.Anything).Return(nil)
+		imgStorage.On("IsExist", "bb").Return(false, nil)
+
+		stor := &Storage{metaStorage: metaCRUD, imgStorage: imgStorage}
+		err := stor.Save(storage.Meta{ImageName: "aa:1", ImageID: "bb"}, reader)
+		require.True(t, errors.Is(err, errRemovedMeanwhile), err)
+		metaCRUD.AssertExpectations(t)
+	})
+
+	t.Run("tx: img returns an error", func(t *testing.T) {
+		imgStorage := &txImgStorageMock{}
+		reader := bytes.NewBufferString("cc")
+		imgStorage.On("SaveTx", "bb", reader, mock.Anything).Return(errors.New("img err"))
+
+		stor := &Storage{metaStorage: newMetaCRUDMock(), imgStorage: imgStorage}
+		err := stor.Save(storage.Meta{ImageName: "aa:1", ImageID: "bb"}, reader)
+		require.EqualError(t, err, "img err")
+	})
+
+	t.Run("tx: meta is committed with the image", func(t *testing.T) {
+		metaCRUD := newMetaCRUDMock()
+		imgStorage := &txImgStorageMock{}
+		reader := bytes.NewBufferString("cc")
+		imgStorage.On("SaveTx", "bb", reader, mock.Anything).Return(nil)
+		metaCRUD.On("Set", mock.MatchedBy(func(meta storage.Meta) bool {
+			return meta.ImageName == "aa:1" && meta.ImageID == "bb"
+		})).Return(errors.New("meta err"))
+
+		stor := &Storage{metaStorage: metaCRUD, imgStorage: imgStorage}
+		err := stor.Save(storage.Meta{ImageName: "aa:1", ImageID: "bb"}, reader)
+		require.EqualError(t, err, "saving metadata, meta err")
+	})
+}
+
+type sizedImgStorageMock struct {
+	txImgStorageMock
+}
+
+func (m *sizedImgStorageMock) DiskSize(imgName string) (int64, error) {
+	args := m.Called(imgName)
+
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func TestStorage_SaveKeepsUsage(t *testing.T) {
+	firstCached := time.Unix(1, 0)
+	prev := storage.Meta{ImageName: "aa:1", ImageID: "old", FirstCachedAt: firstCached, HitCount: 3, LastUsedAt: time.Unix(2, 0)}
+	metaCRUD := &metaCRUDMock{}
+	metaCRUD.On("Get", "aa:1").Return(prev, nil).Twice()
+	metaCRUD.On("Set", mock.MatchedBy(func(meta storage.Meta) bool {
+		return meta.ImageID == "bb" && meta.FirstCachedAt.Equal(firstCached) && meta.HitCount == 3 && meta.CompressedSize == 0
+	})).Return(nil).Once()
+
+	imgStorage := &sizedImgStorageMock{}
+	reader := bytes.NewBufferString("cc")
+	imgStorage.On("SaveTx", "bb", reader, mock.Anything).Return(nil)
+	imgStorage.On("DiskSize", "bb").Return(int64(7), nil)
+	imgStorage.On("IsExist", "bb").Return(true, nil)
+
+	// the compressed size is set after the transaction
+	committed := storage.Meta{ImageName: "aa:1", ImageID: "bb", FirstCachedAt: firstCached, HitCount: 3}
+	metaCRUD.On("Get", "aa:1").Return(committed, nil).Once()
+	metaCRUD.On("Set", mock.MatchedBy(func(meta storage.Meta) bool {
+		return meta.ImageID == "bb" && meta.CompressedSize == 7
+	})).Return(nil).Once()
+	// the tag has been moved from the old image, which has no other tags
+	metaCRUD.On("GetAll").Return([]storage.Meta{committed}, nil).Once()
+	imgStorage.On("Remove", "old").Return(nil).Once()
+
+	stor := &Storage{metaStorage: metaCRUD, imgStorage: imgStorage}
+	require.NoError(t, stor.Save(storage.Meta{ImageName: "aa:1", ImageID: "bb"}, reader))
+	metaCRUD.AssertExpectations(t)
+	imgStorage.AssertExpectations(t)
+}
+
+func TestStorage_RetagThenEvict(t *testing.T) {
+	images := imgmem.NewImgStorage()
+	stor := NewStorage(mem.NewMetaCRUD(), images)
+	require.NoError(t, stor.Save(storage.Meta{ImageName: "app:latest", ImageID: "id-1"}, bytes.NewBufferString("one")))
+	require.NoError(t, stor.Save(storage.Meta{ImageName: "app:1", ImageID: "id-1"}, bytes.NewBufferString("one")))
+	require.NoError(t, stor.Save(storage.Meta{ImageName: "app:latest", ImageID: "id-2"}, bytes.NewBufferString("two")))
+
+	exists, err := images.IsExist("id-1")
+	require.NoError(t, err)
+	require.True(t, exists, "app:1 still refers to the old image")
+
+	// moving the last tag orphans the old image, so it is removed instead of being left unevictable
+	require.NoError(t, stor.SaveTag(storage.Meta{ImageName: "app:1", ImageID: "id-2"}))
+	exists, err = images.IsExist("id-1")
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	require.NoError(t, stor.Remove("app:latest"))
+	require.NoError(t, stor.Remove("app:1"))
+	exists, err = images.IsExist("id-2")
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+func TestStorage_MarkUsed(t *testing.T) {
+	t.Run("counts a hit", func(t *testing.T) {
+		metaCRUD := &metaCRUDMock{}
+		metaCRUD.On("Get", "aa:1").Return(storage.Meta{ImageName: "aa:1", HitCount: 1}, nil)
+		metaCRUD.On("Set", mock.MatchedBy(func(meta storage.Meta) bool {
+			return meta.HitCount == 2 && !meta.LastUsedAt.IsZero()
+		})).Return(nil).Once()
+
+		stor := &Storage{metaStorage: metaCRUD}
+		require.NoError(t, stor.MarkUsed("aa:1"))
+		metaCRUD.AssertExpectations(t)
+	})
+
+	t.Run("unknown image", func(t *testing.T) {
+		stor := &Storage{metaStorage: newMetaCRUDMock()}
+		require.Equal(t, storage.ErrNotFound, stor.MarkUsed("aa:1"))
+	})
+}
+
+func TestStorage_MarkRestored(t *testing.T) {
+	metaCRUD := &metaCRUDMock{}
+	metaCRUD.On("Get", "aa:1").Return(storage.Meta{ImageName: "aa:1", HitCount: 1}, nil)
+	metaCRUD.On("Set", mock.MatchedBy(func(meta storage.Meta) bool {
+		return meta.HitCount == 1 && !meta.LastRestoredAt.IsZero()
+	})).Return(nil).Once()
+
+	stor := &Storage{metaStorage: metaCRUD}
+	require.NoError(t, stor.MarkRestored("aa:1"))
+	metaCRUD.AssertExpectations(t)
+}
+
+func TestStorage_NormalizedNames(t *testing.T) {
+	stor := NewStorage(mem.NewMetaCRUD(), imgmem.NewImgStorage())
+	require.NoError(t, stor.Save(storage.Meta{ImageName: "docker.io/library/ubuntu", ImageID: "id-u"}, bytes.NewBufferString("dump")))
+	require.NoError(t, stor.SaveTag(storage.Meta{ImageName: "ubuntu:latest", ImageID: "id-u"}))
+
+	metas, err := stor.GetAllMeta()
+	require.NoError(t, err)
+	require.Len(t, metas, 1, "one entry per image reference")
+	require.Equal(t, "ubuntu:latest", metas[0].ImageName)
+
+	for _, key := range []string{"ubuntu", "ubuntu:latest", "docker.io/library/ubuntu:latest"} {
+		meta, err := stor.GetMeta(key)
+		require.NoError(t, err, key)
+		require.Equal(t, "id-u", meta.ImageID)
+	}
+	require.NoError(t, stor.MarkUsed("ubuntu"))
+	require.NoError(t, stor.Remove("docker.io/library/ubuntu"))
+	_, err = stor.GetMeta("ubuntu:latest")
+	require.True(t, errors.Is(err, storage.ErrNotFound), err)
 }
@@ -0,0 +1,101 @@
+package separated
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"sort"
+
+	"github.com/docker/distribution/reference"
+
+	"github.com/podtserkovskiy/garnerd/storage"
+)
+
+// repoTags returns tags which docker load can restore, digest references can't be tags.
+func repoTags(metas []storage.Meta) []string {
+	tags := []string{}
+	for _, meta := range metas {
+		named, err := reference.ParseNormalizedNamed(meta.ImageName)
+		if err != nil {
+			continue
+		}
+		if _, ok := named.(reference.NamedTagged); !ok {
+			continue
+		}
+		tags = append(tags, meta.ImageName)
+	}
+	sort.Strings(tags)
+
+	return tags
+}
+
+type pipeReadCloser struct {
+	*io.PipeReader
+	dump io.Closer
+}
+
+func (p pipeReadCloser) Close() error {
+	_ = p.PipeReader.Close()
+
+	return p.dump.Close()
+}
+
+// withRepoTags streams the dump with RepoTags of manifest.json replaced by the tags.
+func withRepoTags(dump io.ReadCloser, tags []string) io.ReadCloser {
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		_ = pipeWriter.CloseWithError(rewriteManifest(pipeWriter, dump, tags))
+	}()
+
+	return pipeReadCloser{PipeReader: pipeReader, dump: dump}
+}
+
+func rewriteManifest(dst io.Writer, src io.Reader, tags []string) error {
+	tarReader := tar.NewReader(src)
+	tarWriter := tar.NewWriter(dst)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return tarWriter.Close()
+		}
+		if err != nil {
+			return err
+		}
+
+		if header.Name != "manifest.json" {
+			if err = tarWriter.WriteHeader(header); err != nil {
+				return err
+			}
+			if _, err = io.Copy(tarWriter, tarReader); err != nil { // nolint: gosec
+				return err
+			}
+
+			continue
+		}
+
+		// other fields are kept as is
+		var manifest []map[string]json.RawMessage
+		if err = json.NewDecoder(tarReader).Decode(&manifest); err != nil {
+			return err
+		}
+		encodedTags, err := json.Marshal(tags)
+		if err != nil {
+			return err
+		}
+		for _, imageEntry := range manifest {
+			imageEntry["RepoTags"] = encodedTags
+		}
+		data, err := json.Marshal(manifest)
+		if err != nil {
+			return err
+		}
+
+		header.Size = int64(len(data))
+		if err = tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err = tarWriter.Write(data); err != nil {
+			return err
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"encoding/json"
 	"errors"
 	"io"
 	"time"
@@ -12,14 +13,86 @@ type Meta struct {
 	// docker image id
 	ImageID   string
 	UpdatedAt time.Time
+
+	// Size is an uncompressed size of the image, CompressedSize is its size in the storage.
+	Size           int64    `json:",omitempty"`
+	CompressedSize int64    `json:",omitempty"`
+	LayerDigests   []string `json:",omitempty"`
+	RepoDigests    []string `json:",omitempty"`
+	OS             string   `json:",omitempty"`
+	Architecture   string   `json:",omitempty"`
+	// Created is when the image has been built.
+	Created time.Time `json:",omitempty"`
+
+	FirstCachedAt  time.Time `json:",omitempty"`
+	LastUsedAt     time.Time `json:",omitempty"`
+	LastRestoredAt time.Time `json:",omitempty"`
+	// HitCount is how many times the image has been pulled or used by a container.
+	HitCount int `json:",omitempty"`
+}
+
+// MarshalJSON leaves out zero times, encoding/json's omitempty doesn't skip zero structs.
+func (m Meta) MarshalJSON() ([]byte, error) {
+	type plainMeta Meta
+
+	return json.Marshal(struct {
+		plainMeta
+		Created        *time.Time `json:",omitempty"`
+		FirstCachedAt  *time.Time `json:",omitempty"`
+		LastUsedAt     *time.Time `json:",omitempty"`
+		LastRestoredAt *time.Time `json:",omitempty"`
+	}{
+		plainMeta:      plainMeta(m),
+		Created:        nonZeroTime(m.Created),
+		FirstCachedAt:  nonZeroTime(m.FirstCachedAt),
+		LastUsedAt:     nonZeroTime(m.LastUsedAt),
+		LastRestoredAt: nonZeroTime(m.LastRestoredAt),
+	})
+}
+
+func nonZeroTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
+
+// Key identifies the meta of the image, variants of a tag for other platforms have their own metas.
+func (m Meta) Key() string {
+	return Key(m.ImageName, m.OS, m.Architecture)
 }
 
-var ErrNotFound = errors.New("not found")
+// Key identifies the meta of the image variant, e.g. "ubuntu:20.04 linux/arm64".
+// Images cached without a platform are identified by the image name only.
+func Key(imageName, os, architecture string) string {
+	if os == "" || architecture == "" {
+		return imageName
+	}
+
+	return imageName + " " + os + "/" + architecture
+}
+
+var (
+	ErrNotFound = errors.New("not found")
+	// ErrReadOnly is returned by changes of a storage opened read-only.
+	ErrReadOnly = errors.New("the storage is read-only")
+)
 
+// Storage finds metas and images by Meta.Key().
 type Storage interface {
-	Save(imageName, imageID string, imageDump io.Reader) error
-	Load(imageName string) (io.ReadCloser, error)
-	Remove(imageName string) error
-	GetMeta(imageName string) (Meta, error)
+	// Save stores the image once per ImageID, usage stats of the already cached tag are kept.
+	Save(meta Meta, imageDump io.Reader) error
+	// SaveTag adds a tag to the already stored image, it returns ErrNotFound if the image is not stored.
+	SaveTag(meta Meta) error
+	// Load returns a dump which restores every cached tag of the image.
+	Load(key string) (io.ReadCloser, error)
+	// Remove drops the tag, the image is removed with its last tag.
+	Remove(key string) error
+	GetMeta(key string) (Meta, error)
 	GetAllMeta() ([]Meta, error)
+	// MarkUsed counts a hit of the image.
+	MarkUsed(key string) error
+	// MarkRestored records that the image has been loaded back into the daemon.
+	MarkRestored(key string) error
 }
@@ -0,0 +1,24 @@
+package storage
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMeta_JSON(t *testing.T) {
+	updated := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	data, err := json.Marshal(Meta{ImageName: "a:1", ImageID: "id-a", UpdatedAt: updated})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"ImageName":"a:1","ImageID":"id-a","UpdatedAt":"2020-10-01T12:00:00Z"}`, string(data))
+
+	meta := Meta{ImageName: "a:1", UpdatedAt: updated, LastUsedAt: updated.Add(time.Hour), HitCount: 2}
+	data, err = json.Marshal(meta)
+	require.NoError(t, err)
+	var decoded Meta
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	require.Equal(t, meta, decoded)
+}